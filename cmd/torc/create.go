@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jmatss/torc/internal/torrent"
+)
+
+// A flag that can be specified multiple times.
+type multiFlag []string
+
+func (m *multiFlag) String() string {
+	return strings.Join(*m, ",")
+}
+
+func (m *multiFlag) Set(value string) error {
+	*m = append(*m, value)
+	return nil
+}
+
+// Creates a torrent file from the arguments of "torc create".
+// Returns the exit code of the program.
+func create(args []string) int {
+	flags := flag.NewFlagSet("create", flag.ContinueOnError)
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(flags.Output(), "usage: torc create [options] <file or directory>\n")
+		flags.PrintDefaults()
+	}
+
+	var trackers, webSeeds multiFlag
+	flags.Var(&trackers, "t", "tracker announce URL, can be specified multiple times "+
+		"(one tier each, separate the trackers of a tier with \",\")")
+	flags.Var(&webSeeds, "w", "web seed URL, can be specified multiple times")
+	output := flags.String("o", "", "the created torrent file (default <name>.torrent)")
+	comment := flags.String("c", "", "comment")
+	private := flags.Bool("p", false, "create a private torrent")
+	pieceLength := flags.Int64("l", 0, "piece length in bytes (default picked from the total size)")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	} else if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	path := flags.Arg(0)
+	if *output == "" {
+		*output = filepath.Base(filepath.Clean(path)) + ".torrent"
+	}
+
+	// Empty trackers (ex. "-t a,,b" or "-t ''") and tiers are skipped.
+	announceList := make([][]string, 0, len(trackers))
+	for _, tier := range trackers {
+		urls := make([]string, 0)
+		for _, url := range strings.Split(tier, ",") {
+			if url = strings.TrimSpace(url); url != "" {
+				urls = append(urls, url)
+			}
+		}
+		if len(urls) > 0 {
+			announceList = append(announceList, urls)
+		}
+	}
+
+	opts := torrent.CreateOptions{
+		AnnounceList: announceList,
+		WebSeeds:     webSeeds,
+		Comment:      *comment,
+		Private:      *private,
+		PieceLength:  *pieceLength,
+	}
+	if err := torrent.CreateFile(path, *output, opts); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "unable to create torrent: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("created %s\n", *output)
+	return 0
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jmatss/torc/internal/torrent"
+)
+
+func TestCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torc")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := filepath.Join(dir, "data")
+	if err := ioutil.WriteFile(data, []byte(strings.Repeat("data", 1000)), 0644); err != nil {
+		t.Fatalf("unable to create file: %v", err)
+	}
+	output := filepath.Join(dir, "out.torrent")
+
+	tests := []struct {
+		name    string
+		args    []string
+		code    int
+		tiers   [][]string // the trackers of the created torrent
+		private bool
+	}{
+		{"no arguments", []string{}, 2, nil, false},
+		{"too many arguments", []string{data, data}, 2, nil, false},
+		{"unknown flag", []string{"-x", data}, 2, nil, false},
+		{"missing file", []string{"-o", output, filepath.Join(dir, "missing")}, 1, nil, false},
+		{"incorrect piece length", []string{"-o", output, "-l", "1000", data}, 1, nil, false},
+		{"no trackers", []string{"-o", output, data}, 0, [][]string{}, false},
+		{
+			"tiers",
+			[]string{"-o", output, "-t", "http://a/announce", "-t", "udp://b:80", data},
+			0, [][]string{{"http://a/announce"}, {"udp://b:80"}}, false,
+		},
+		{
+			"trackers in a tier",
+			[]string{"-o", output, "-t", "http://a/announce,udp://b:80", data},
+			0, [][]string{{"http://a/announce", "udp://b:80"}}, false,
+		},
+		{
+			"empty trackers",
+			[]string{"-o", output, "-t", "http://a/announce,,udp://b:80,", "-t", "", "-t", ",", data},
+			0, [][]string{{"http://a/announce", "udp://b:80"}}, false,
+		},
+		{
+			"private",
+			[]string{"-o", output, "-p", "-t", "http://a/announce", data},
+			0, [][]string{{"http://a/announce"}}, true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(output)
+
+			if code := create(tt.args); code != tt.code {
+				t.Fatalf("expected exit code %d, got: %d", tt.code, code)
+			} else if code != 0 {
+				if _, err := os.Stat(output); err == nil {
+					t.Fatalf("expected no torrent file to be created")
+				}
+				return
+			}
+
+			tor, err := torrent.NewTorrent(output)
+			if err != nil {
+				t.Fatalf("unable to parse created torrent: %v", err)
+			}
+			// The trackers of a tier are shuffled when the torrent is parsed.
+			statuses := tor.TrackerStatuses()
+			expected := make(map[string]int)
+			for tier, urls := range tt.tiers {
+				for _, url := range urls {
+					expected[url] = tier
+				}
+			}
+			if len(statuses) != len(expected) {
+				t.Fatalf("expected trackers: %v, got: %v", tt.tiers, statuses)
+			}
+			for _, status := range statuses {
+				if tier, ok := expected[status.URL]; !ok || status.Tier != tier {
+					t.Errorf("unexpected tracker %s in tier %d, expected: %v",
+						status.URL, status.Tier, tt.tiers)
+				}
+			}
+			if tor.Private() != tt.private {
+				t.Errorf("private: expected %v, got: %v", tt.private, tor.Private())
+			}
+		})
+	}
+}
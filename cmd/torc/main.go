@@ -13,6 +13,10 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "create" {
+		os.Exit(create(os.Args[2:]))
+	}
+
 	controllerId := "controller"
 	comController := com.New()
 	go internal.Controller(comController, controllerId)
@@ -28,15 +32,38 @@ func main() {
 				for i, file := range received.Torrent.Files {
 					log.Printf("file %d: %s\n", i, strings.Join(file.Path, "/"))
 				}
+				received.Torrent.Tracker.Lock()
 				log.Printf("peers: %d\n", len(received.Torrent.Tracker.Peers))
-				for i, peer := range received.Torrent.Tracker.Peers {
-					log.Printf("peer %d: %s\n", i, peer.HostAndPort)
+				for _, peer := range received.Torrent.Tracker.Peers {
+					log.Printf("peer: %s\n", peer.HostAndPort)
+				}
+				received.Torrent.Tracker.Unlock()
+				for _, status := range received.Torrent.TrackerStatuses() {
+					if status.Err != nil {
+						log.Printf("tracker (tier %d): %s: %v\n", status.Tier, status.URL, status.Err)
+					} else {
+						log.Printf("tracker (tier %d): %s: seeders: %d, leechers: %d\n",
+							status.Tier, status.URL, status.Seeders, status.Leechers)
+					}
 				}
 				log.Printf("seeders: %d\n", received.Torrent.Tracker.Seeders)
 				log.Printf("leechers: %d\n", received.Torrent.Tracker.Leechers)
 				log.Printf("downloaded: %d\n", received.Torrent.Tracker.Downloaded)
 				log.Printf("uploaded: %d\n", received.Torrent.Tracker.Uploaded)
 				log.Printf("bitfield: %v\n\n", received.Torrent.Tracker.BitFieldHave)
+			case com.Metadata:
+				log.Printf("received metadata of \"%s\", files: %d\n",
+					received.Torrent.Name, len(received.Torrent.Files))
+			case com.Recheck:
+				checked, total, err := com.DecodeProgress(received.Data)
+				if err == nil {
+					log.Printf("recheck: %d%% (%d/%d pieces)\n", checked*100/total, checked, total)
+				}
+			case com.Scrape:
+				if result, err := com.DecodeScrape(received.Data); err == nil {
+					log.Printf("scrape of \"%s\": seeders: %d, leechers: %d, completed: %d\n",
+						received.Torrent.Name, result.Seeders, result.Leechers, result.Completed)
+				}
 			}
 		}
 	}()
@@ -58,12 +85,17 @@ func main() {
 		case "a", "add":
 			if len(cmd) != 2 {
 				_, _ = fmt.Fprintf(os.Stderr, "incorrect amount of arguments, expected: %d, got: %d: "+
-					"specify torrent filename to add\n", 2, len(cmd))
+					"specify torrent filename or magnet link to add\n", 2, len(cmd))
 				continue
 			}
 
 			filename := cmd[1]
-			tor, err := torrent.NewTorrent(filename)
+			var tor *torrent.Torrent
+			if strings.HasPrefix(filename, torrent.MagnetPrefix) {
+				tor, err = torrent.NewTorrentFromMagnet(filename)
+			} else {
+				tor, err = torrent.NewTorrent(filename)
+			}
 			if err != nil {
 				_, _ = fmt.Fprintf(os.Stderr, "unable to create torrent \"%s\": %v", filename, err)
 				continue
@@ -77,6 +109,8 @@ func main() {
 			}
 		case "ls":
 			comController.SendChildren(com.List, nil)
+		case "scrape":
+			comController.SendChildren(com.Scrape, nil)
 		case "log", "level":
 			if len(cmd) != 2 {
 				_, _ = fmt.Fprintf(os.Stderr, "incorrect amount of arguments, expected: %d, got: %d: "+
@@ -85,6 +119,50 @@ func main() {
 			}
 
 			comController.SendChildren(com.LogLevel, []byte(cmd[1]))
+		case "encryption":
+			if len(cmd) != 2 {
+				_, _ = fmt.Fprintf(os.Stderr, "incorrect amount of arguments, expected: %d, got: %d: "+
+					"specify encryption policy (disabled, prefer, require)\n", 2, len(cmd))
+				continue
+			}
+
+			comController.SendChildren(com.Encryption, []byte(cmd[1]))
+		case "transport":
+			if len(cmd) != 2 {
+				_, _ = fmt.Fprintf(os.Stderr, "incorrect amount of arguments, expected: %d, got: %d: "+
+					"specify transport policy (tcp, prefer-utp, utp)\n", 2, len(cmd))
+				continue
+			}
+
+			comController.SendChildren(com.Transport, []byte(cmd[1]))
+		case "limit":
+			if len(cmd) != 4 && len(cmd) != 5 {
+				_, _ = fmt.Fprintf(os.Stderr, "incorrect amount of arguments, expected: %d or %d, "+
+					"got: %d: specify direction (up, down), scope (global, peer, torrent <info hash>) "+
+					"and rate in bytes per second (ex. 500k, 2m, 0 for unlimited)\n", 4, 5, len(cmd))
+				continue
+			}
+
+			var id com.Id
+			switch cmd[1] {
+			case "up", "upload":
+				id = com.UploadLimit
+			case "down", "download":
+				id = com.DownloadLimit
+			default:
+				_, _ = fmt.Fprintf(os.Stderr, "incorrect direction \"%s\", expected: up or down\n", cmd[1])
+				continue
+			}
+
+			comController.SendChildren(id, []byte(strings.Join(cmd[2:], " ")))
+		case "lsd":
+			if len(cmd) != 3 {
+				_, _ = fmt.Fprintf(os.Stderr, "incorrect amount of arguments, expected: %d, got: %d: "+
+					"specify info hash and local discovery (on, off)\n", 3, len(cmd))
+				continue
+			}
+
+			comController.SendChildren(com.LocalDiscovery, []byte(strings.Join(cmd[1:], " ")))
 		default:
 			log.Println("incorrect command, try again")
 		}
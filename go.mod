@@ -1,5 +1,3 @@
 module github.com/jmatss/torc
 
 go 1.13
-
-require github.com/jackpal/bencode-go v0.0.0-20180813173944-227668e840fa
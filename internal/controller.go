@@ -1,32 +1,103 @@
 package internal
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"math/rand"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/jmatss/torc/internal/dht"
+	"github.com/jmatss/torc/internal/handler"
+	"github.com/jmatss/torc/internal/lsd"
+	"github.com/jmatss/torc/internal/peer"
 	"github.com/jmatss/torc/internal/torrent"
 	"github.com/jmatss/torc/internal/util/com"
 	"github.com/jmatss/torc/internal/util/cons"
 	"github.com/jmatss/torc/internal/util/logger"
+	"github.com/jmatss/torc/internal/util/ratelimit"
+	"github.com/jmatss/torc/internal/utp"
 )
 
-func Controller(comView com.Channel, childId string) {
-	cons.DownloadPath = fetchDownloadPathFromDisk()
+const (
+	SessionDirName   = "torc"
+	DHTStateFileName = "dht_state"
+)
+
+func Controller(comView *com.Channel, childId string) {
+	cons.SessionPath = defaultSessionPath()
+	// Torrents are downloaded to the current directory.
+	cons.DownloadPath = filepath.FromSlash("")
 	cons.PeerId = newPeerId()
 
 	comView.AddChild(childId)
 	defer comView.RemoveChild(childId)
 
+	// uTP connections to remote peers are made on a UDP socket listening on the
+	// same port as the TCP listener. Only TCP is used if it can't be created.
+	socket, err := utp.Listen(":" + strconv.Itoa(torrent.Port))
+	if err != nil {
+		comView.SendParentError(com.Failure, err)
+		socket = nil
+	} else {
+		defer socket.Close()
+		peer.UTPSocket = socket
+	}
+
+	// The DHT is shared between all torrents. The torrents are still
+	// downloaded using their trackers if the DHT can't be started.
+	// It shares the UDP socket with uTP if the socket exists.
+	var node *dht.DHT
+	dhtStatePath := filepath.Join(cons.SessionPath, DHTStateFileName)
+	if socket != nil {
+		node = dht.NewWithConn(socket.PacketConn(), dht.DefaultBootstrap, dhtStatePath)
+	} else {
+		node, err = dht.New(":"+strconv.Itoa(torrent.Port), dht.DefaultBootstrap, dhtStatePath)
+	}
+	if err != nil {
+		comView.SendParentError(com.Failure, err)
+		node = nil
+	} else {
+		defer node.Close()
+		go func() {
+			if err := node.Bootstrap(); err != nil {
+				logger.Log(logger.Low, "%v", err)
+			}
+		}()
+	}
+
+	// Local Service Discovery is shared between all torrents.
+	local, err := lsd.New(lsd.MulticastAddr4, torrent.Port)
+	if err != nil {
+		comView.SendParentError(com.Failure, err)
+		local = nil
+	} else {
+		defer local.Close()
+	}
+
 	// Spawn handlers. Every handler will be in charge of a specific torrent with
 	// the InfoHash of the torrent being used as the "childId" in the com.Channel.
+	// The torrents from the previous session are restored and restarted.
 	comTorrentHandler := com.New()
-	for _, tor := range fetchTorrentsFromDisk() {
-		go torrent.Handler(comTorrentHandler, tor)
+	torrents, err := fetchTorrentsFromDisk()
+	if err != nil {
+		comView.SendParentError(com.Failure, err)
+	}
+	for _, tor := range torrents {
+		go handler.Torrent(comTorrentHandler, tor, node, local)
 	}
 
+	// Spawn a listener that accepts connections from remote peers. The incoming
+	// peers are routed to the handler in charge of the torrent with the
+	// info hash that the remote peer specified in its handshake.
+	listenerId := "listener"
+	comListener := com.New()
+	go handler.Listener(comListener, listenerId, torrent.Port)
+
 	for {
 		select {
 		case received := <-comView.GetChildChannel(childId):
@@ -54,7 +125,7 @@ func Controller(comView com.Channel, childId string) {
 
 				// TODO: Might have to do a synchronized send and receive so that
 				//  the client can be notified if it succeeded/failed immediately.
-				go torrent.Handler(comTorrentHandler, received.Torrent)
+				go handler.Torrent(comTorrentHandler, received.Torrent, node, local)
 
 			case com.Remove, com.Start, com.Stop:
 				// TODO: Fix this, must send correct child id (InfoHash).
@@ -65,8 +136,11 @@ func Controller(comView com.Channel, childId string) {
 					)
 				}
 
-			case com.Quit, com.List:
+			case com.Quit, com.List, com.Scrape:
 				comTorrentHandler.SendChildren(received.Id, nil)
+				if received.Id == com.Quit {
+					comListener.SendChildren(received.Id, nil)
+				}
 
 			case com.LogLevel:
 				err := setLogLevel(string(received.Data))
@@ -74,6 +148,34 @@ func Controller(comView com.Channel, childId string) {
 					com.LogLevel,
 					err,
 				)
+
+			case com.Encryption:
+				err := setEncryption(string(received.Data))
+				comView.SendParentError(
+					com.Encryption,
+					err,
+				)
+
+			case com.Transport:
+				err := setTransport(string(received.Data))
+				comView.SendParentError(
+					com.Transport,
+					err,
+				)
+
+			case com.UploadLimit, com.DownloadLimit:
+				err := setLimit(comTorrentHandler, received.Id, string(received.Data))
+				comView.SendParentError(
+					received.Id,
+					err,
+				)
+
+			case com.LocalDiscovery:
+				err := setLocalDiscovery(comTorrentHandler, string(received.Data))
+				comView.SendParentError(
+					com.LocalDiscovery,
+					err,
+				)
 			}
 
 		case received := <-comTorrentHandler.Parent:
@@ -81,12 +183,36 @@ func Controller(comView com.Channel, childId string) {
 				Received message from one of the "handlers"/children.
 			*/
 			switch received.Id {
-			case com.Add, com.Remove, com.Start, com.Stop, com.List:
+			case com.Add, com.Remove, com.Start, com.Stop, com.List, com.Recheck, com.Metadata,
+				com.Scrape:
 				// The torrentHandler has executed the commands sent from the view.
 				// Just pass along to the view so it can see the results.
 				comView.SendParentCopy(received, childId)
 
 			}
+
+		case received := <-comListener.Parent:
+			/*
+				Received message from the "listener"/child.
+			*/
+			switch received.Id {
+			case com.Incoming:
+				// Route the remote peer to the handler in charge of the torrent
+				// with the specified info hash. Close the connection if this
+				// client doesn't have a torrent with that info hash.
+				handlerId := string(received.Data)
+				if ok := comTorrentHandler.SendChildCopy(received, handlerId); !ok {
+					logger.Log(logger.High, "incoming peer %s requested an unknown "+
+						"info hash %040x", received.Peer.HostAndPort, received.Data)
+					received.Peer.Connection.Close()
+				}
+
+			case com.TotalFailure:
+				comView.SendParentError(
+					com.Failure,
+					fmt.Errorf("unable to listen for incoming peers: %w", received.Error),
+				)
+			}
 		}
 	}
 }
@@ -109,14 +235,20 @@ func newPeerId() string {
 	return string(peerId)
 }
 
-// TODO: currently only returns empty
-func fetchTorrentsFromDisk() map[string]*torrent.Torrent {
-	return make(map[string]*torrent.Torrent, 0)
+// Returns the directory where the session (torrents and their state) is stored.
+// Uses the users config directory if it exists, otherwise the current directory.
+func defaultSessionPath() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return filepath.FromSlash(SessionDirName)
+	}
+	return filepath.Join(configDir, SessionDirName)
 }
 
-// TODO: currently only returns default
-func fetchDownloadPathFromDisk() string {
-	return filepath.FromSlash("")
+// Restores the torrents that were added during previous sessions.
+// The returned map uses the info hash of the torrents as keys.
+func fetchTorrentsFromDisk() (map[string]*torrent.Torrent, error) {
+	return torrent.LoadSession(cons.SessionPath)
 }
 
 func setLogLevel(level string) error {
@@ -129,3 +261,105 @@ func setLogLevel(level string) error {
 
 	return fmt.Errorf("unable to set log level to \"%s\"", level)
 }
+
+func setEncryption(policy string) error {
+	encryption, err := peer.ParseEncryptionPolicy(policy)
+	if err != nil {
+		return fmt.Errorf("unable to set encryption: %w", err)
+	}
+
+	peer.SetEncryption(encryption)
+	return nil
+}
+
+func setTransport(policy string) error {
+	transport, err := peer.ParseTransportPolicy(policy)
+	if err != nil {
+		return fmt.Errorf("unable to set transport: %w", err)
+	}
+
+	peer.SetTransport(transport)
+	return nil
+}
+
+// Sets the upload (com.UploadLimit) or download (com.DownloadLimit) rate limit.
+// Format of "limit": "<scope> [info hash] <rate>" where scope is "global",
+// "torrent" or "peer". The hex encoded info hash is only specified for the
+// torrent scope. See ratelimit.ParseRate for the format of the rate.
+func setLimit(comTorrentHandler *com.Channel, id com.Id, limit string) error {
+	args := strings.Fields(limit)
+	if len(args) < 2 {
+		return fmt.Errorf("unable to set limit: expected \"<scope> [info hash] <rate>\", "+
+			"got: \"%s\"", limit)
+	}
+
+	rate, err := ratelimit.ParseRate(args[len(args)-1])
+	if err != nil {
+		return fmt.Errorf("unable to set limit: %w", err)
+	}
+
+	scope := strings.ToLower(args[0])
+	switch {
+	case scope == com.LimitGlobal.String() && len(args) == 2:
+		if id == com.UploadLimit {
+			ratelimit.GlobalUpload.SetRate(rate)
+		} else {
+			ratelimit.GlobalDownload.SetRate(rate)
+		}
+
+	case scope == com.LimitTorrent.String() && len(args) == 3:
+		infoHash, err := hex.DecodeString(args[1])
+		if err != nil || len(infoHash) != sha1.Size {
+			return fmt.Errorf("unable to set limit: incorrect info hash \"%s\"", args[1])
+		}
+
+		data := com.EncodeLimit(com.LimitTorrent, rate)
+		if ok := comTorrentHandler.SendChild(id, data, nil, nil, string(infoHash)); !ok {
+			return fmt.Errorf("unable to set limit: no torrent with info hash %s", args[1])
+		}
+
+	case scope == com.LimitPeer.String() && len(args) == 2:
+		if id == com.UploadLimit {
+			peer.SetUploadRate(rate)
+		} else {
+			peer.SetDownloadRate(rate)
+		}
+		comTorrentHandler.SendChildren(id, com.EncodeLimit(com.LimitPeer, rate))
+
+	default:
+		return fmt.Errorf("unable to set limit: expected \"<scope> [info hash] <rate>\", "+
+			"got: \"%s\"", limit)
+	}
+
+	return nil
+}
+
+// Enables or disables local discovery of a torrent.
+// Format of "setting": "<info hash> <on|off>" where the info hash is hex encoded.
+func setLocalDiscovery(comTorrentHandler *com.Channel, setting string) error {
+	args := strings.Fields(setting)
+	if len(args) != 2 {
+		return fmt.Errorf("unable to set local discovery: expected \"<info hash> <on|off>\", "+
+			"got: \"%s\"", setting)
+	}
+
+	infoHash, err := hex.DecodeString(args[0])
+	if err != nil || len(infoHash) != sha1.Size {
+		return fmt.Errorf("unable to set local discovery: incorrect info hash \"%s\"", args[0])
+	}
+
+	var data []byte
+	switch strings.ToLower(args[1]) {
+	case "on":
+		data = []byte{1}
+	case "off":
+		data = []byte{0}
+	default:
+		return fmt.Errorf("unable to set local discovery: expected on or off, got: \"%s\"", args[1])
+	}
+
+	if ok := comTorrentHandler.SendChild(com.LocalDiscovery, data, nil, nil, string(infoHash)); !ok {
+		return fmt.Errorf("unable to set local discovery: no torrent with info hash %s", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,674 @@
+// Contains logic related to the mainline DHT, a Kademlia-based distributed hash
+// table used to find peers of torrents without trackers.
+// See http://www.bittorrent.org/beps/bep_0005.html
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jmatss/torc/internal/torrent"
+	"github.com/jmatss/torc/internal/util/logger"
+)
+
+const (
+	// The max amount of nodes in a bucket and the amount of nodes returned
+	// in find_node and get_peers responses.
+	K = 8
+	// The amount of queries that are sent in parallel during a lookup.
+	Alpha = 3
+
+	// How long to wait for the response to a query.
+	QueryTimeout = 5 * time.Second
+	// The amount of queries in a row that a node can fail to answer before it
+	// is replaced.
+	MaxFailures = 2
+	// Nodes that hasn't been heard from in this amount of time are pinged
+	// before they are trusted.
+	QuestionableTime = 15 * time.Minute
+
+	// How often the routing table is refreshed with a lookup of a random id.
+	RefreshInterval = 15 * time.Minute
+	// How often the secret used to create tokens changes. Tokens created with
+	// the previous secret are also accepted.
+	TokenSecretInterval = 5 * time.Minute
+	// How long an announced peer is stored by this node.
+	PeerTimeout = 30 * time.Minute
+	// The max amount of peers returned in a get_peers response.
+	MaxPeerValues = 50
+	// How often a torrent handler should announce to the DHT.
+	AnnounceInterval = 15 * time.Minute
+
+	udpMaxPacketSize = 2048
+)
+
+// Nodes used to join the DHT if the routing table is empty.
+var DefaultBootstrap = []string{
+	"router.bittorrent.com:6881",
+	"router.utorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+}
+
+type pendingQuery struct {
+	addr     *net.UDPAddr
+	response chan *message
+}
+
+type storedPeer struct {
+	compact  string
+	received time.Time
+}
+
+// A node in the DHT. All exported functions are safe to call from multiple go
+// processes.
+type DHT struct {
+	mut sync.Mutex
+
+	id        NodeId
+	conn      net.PacketConn
+	table     *table
+	bootstrap []string
+	statePath string
+
+	// Queries sent by this node that waits for a response, indexed by
+	// transaction id.
+	transactionId uint16
+	pending       map[string]pendingQuery
+
+	// The peers that has announced themselves to this node, indexed by
+	// info hash and then by the compact peer info.
+	peers map[NodeId]map[string]storedPeer
+
+	secret         []byte
+	previousSecret []byte
+
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+// Creates a DHT node listening on the UDP address "address" (ex. ":6881").
+// "bootstrap" contains the "host:port" of the nodes used to join the DHT.
+// If "statePath" isn't empty, the node id and routing table are loaded from
+// the file if it exists and stored to it when the node is closed.
+func New(address string, bootstrap []string, statePath string) (*DHT, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve DHT address %s: %w", address, err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on DHT address %s: %w", address, err)
+	}
+
+	return NewWithConn(conn, bootstrap, statePath), nil
+}
+
+// Creates a DHT node that sends and receives its messages on "conn", which is
+// closed when the node is closed. Used to share a UDP socket with other
+// protocols. See New for a description of "bootstrap" and "statePath".
+func NewWithConn(conn net.PacketConn, bootstrap []string, statePath string) *DHT {
+	d := &DHT{
+		id:        randomNodeId(),
+		conn:      conn,
+		bootstrap: bootstrap,
+		statePath: statePath,
+		pending:   make(map[string]pendingQuery),
+		peers:     make(map[NodeId]map[string]storedPeer),
+		secret:    newSecret(),
+		quit:      make(chan struct{}),
+	}
+
+	nodes := make([]*node, 0)
+	if statePath != "" {
+		if id, loaded, err := loadState(statePath); err == nil {
+			d.id, nodes = id, loaded
+		} else if !os.IsNotExist(err) {
+			logger.Log(logger.Low, "unable to load DHT state: %v", err)
+		}
+	}
+	d.table = newTable(d.id)
+	for _, n := range nodes {
+		d.table.insert(n)
+	}
+
+	go d.serve()
+	go d.maintain()
+
+	logger.Log(logger.Low, "DHT node listening on %s", conn.LocalAddr().String())
+
+	return d
+}
+
+// Returns the address that this node listens on.
+func (d *DHT) Addr() *net.UDPAddr {
+	return d.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Returns the amount of nodes in the routing table.
+func (d *DHT) Nodes() int {
+	return d.table.len()
+}
+
+// Stops the node and stores its state if a state path was given.
+func (d *DHT) Close() error {
+	var err error
+	d.closeOnce.Do(func() {
+		close(d.quit)
+		if d.statePath != "" {
+			if saveErr := d.saveState(d.statePath); saveErr != nil {
+				err = saveErr
+			}
+		}
+		if closeErr := d.conn.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	})
+	return err
+}
+
+// Joins the DHT by looking up the id of this node through the bootstrap nodes.
+// Fills the routing table with the nodes closest to this node.
+func (d *DHT) Bootstrap() error {
+	for _, address := range d.bootstrap {
+		addr, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			logger.Log(logger.High, "unable to resolve DHT bootstrap node %s: %v", address, err)
+			continue
+		}
+		// The response is inserted into the routing table when it is received.
+		if _, err := d.query(addr, "find_node", map[string]interface{}{
+			"target": string(d.id[:]),
+		}); err != nil {
+			logger.Log(logger.High, "unable to bootstrap from %s: %v", address, err)
+		}
+	}
+
+	if d.table.len() == 0 {
+		return fmt.Errorf("unable to bootstrap the DHT, no nodes answered")
+	}
+
+	d.lookup(d.id, false)
+	return nil
+}
+
+// Looks up the peers of the torrent with the given info hash.
+func (d *DHT) GetPeers(infoHash [sha1.Size]byte) []*net.TCPAddr {
+	peers, _ := d.lookup(infoHash, true)
+	return peers
+}
+
+// Looks up the peers of the torrent with the given info hash and announces
+// that this client is a peer of the torrent listening on "port" to the nodes
+// closest to the info hash.
+func (d *DHT) Announce(infoHash [sha1.Size]byte, port int) []*net.TCPAddr {
+	peers, closest := d.lookup(infoHash, true)
+
+	var wg sync.WaitGroup
+	for _, n := range closest {
+		if n.token == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(n lookupNode) {
+			defer wg.Done()
+			_, err := d.query(n.addr, "announce_peer", map[string]interface{}{
+				"info_hash":    string(infoHash[:]),
+				"port":         port,
+				"token":        n.token,
+				"implied_port": 0,
+			})
+			if err != nil {
+				logger.Log(logger.High, "unable to announce to DHT node %s: %v", n.addr, err)
+			}
+		}(n)
+	}
+	wg.Wait()
+
+	return peers
+}
+
+// A node found during a lookup together with the token that it returned.
+type lookupNode struct {
+	*node
+	token   string
+	queried bool
+}
+
+// Does an iterative lookup of the nodes closest to "target". If "getPeers" is
+// set, get_peers queries are sent instead of find_node and the peers found are
+// returned. The K closest nodes that answered are also returned.
+func (d *DHT) lookup(target NodeId, getPeers bool) ([]*net.TCPAddr, []lookupNode) {
+	method, key := "find_node", "target"
+	if getPeers {
+		method, key = "get_peers", "info_hash"
+	}
+
+	type result struct {
+		from  *lookupNode
+		nodes []*node
+		peers []*net.TCPAddr
+		token string
+		err   error
+	}
+
+	seen := make(map[string]bool)
+	candidates := make([]*lookupNode, 0)
+	add := func(n *node) {
+		if n.id == d.id || seen[n.addr.String()] {
+			return
+		}
+		seen[n.addr.String()] = true
+		candidates = append(candidates, &lookupNode{node: n})
+	}
+	for _, n := range d.table.closest(target, K) {
+		add(n)
+	}
+
+	peers := make([]*net.TCPAddr, 0)
+	seenPeers := make(map[string]bool)
+	answered := make([]lookupNode, 0)
+	results := make(chan result, Alpha)
+	inFlight := 0
+
+	for {
+		// Sort the candidates after distance and send queries to the closest
+		// nodes that hasn't been queried yet.
+		sortLookupNodes(candidates, target)
+		if len(candidates) > K*2 {
+			candidates = candidates[:K*2]
+		}
+		for i := 0; i < len(candidates) && i < K && inFlight < Alpha; i++ {
+			n := candidates[i]
+			if n.queried {
+				continue
+			}
+			n.queried = true
+			inFlight++
+
+			go func(n *lookupNode) {
+				response, err := d.query(n.addr, method, map[string]interface{}{
+					key: string(target[:]),
+				})
+				res := result{from: n, err: err}
+				if err == nil {
+					res.token, _ = response["token"].(string)
+					if nodes, ok := response["nodes"].(string); ok {
+						res.nodes, _ = parseCompactNodes(nodes)
+					}
+					values, _ := response["values"].([]interface{})
+					for _, value := range values {
+						if s, ok := value.(string); ok {
+							if addr, ok := parseCompactPeer(s); ok {
+								res.peers = append(res.peers, addr)
+							}
+						}
+					}
+				}
+				select {
+				case results <- res:
+				case <-d.quit:
+				}
+			}(n)
+		}
+
+		if inFlight == 0 {
+			break
+		}
+
+		select {
+		case res := <-results:
+			inFlight--
+			if res.err != nil {
+				d.table.failed(res.from.id)
+				continue
+			}
+
+			res.from.token = res.token
+			answered = append(answered, *res.from)
+			for _, n := range res.nodes {
+				add(n)
+			}
+			for _, addr := range res.peers {
+				if !seenPeers[addr.String()] {
+					seenPeers[addr.String()] = true
+					peers = append(peers, addr)
+				}
+			}
+		case <-d.quit:
+			return peers, nil
+		}
+	}
+
+	sorted := make([]*lookupNode, len(answered))
+	for i := range answered {
+		sorted[i] = &answered[i]
+	}
+	sortLookupNodes(sorted, target)
+	closest := make([]lookupNode, 0, K)
+	for i := 0; i < len(sorted) && i < K; i++ {
+		closest = append(closest, *sorted[i])
+	}
+
+	return peers, closest
+}
+
+// Sorts the nodes after their distance to "target", closest first.
+func sortLookupNodes(nodes []*lookupNode, target NodeId) {
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].id.closer(nodes[j].id, target)
+	})
+}
+
+// Receives and handles messages from remote nodes until the node is closed.
+func (d *DHT) serve() {
+	buffer := make([]byte, udpMaxPacketSize)
+	for {
+		length, from, err := d.conn.ReadFrom(buffer)
+		if err != nil {
+			select {
+			case <-d.quit:
+				return
+			default:
+			}
+			logger.Log(logger.High, "unable to read from DHT connection: %v", err)
+			continue
+		}
+
+		addr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		msg, err := parseMessage(buffer[:length])
+		if err != nil {
+			logger.Log(logger.High, "received incorrect KRPC message from %s: %v", addr, err)
+			continue
+		}
+
+		if msg.args != nil {
+			d.handleQuery(addr, msg)
+		} else {
+			d.handleResponse(addr, msg)
+		}
+	}
+}
+
+// Passes a response (or error) along to the query waiting for it.
+func (d *DHT) handleResponse(addr *net.UDPAddr, msg *message) {
+	d.mut.Lock()
+	pending, ok := d.pending[msg.transaction]
+	d.mut.Unlock()
+	if !ok || !pending.addr.IP.Equal(addr.IP) || pending.addr.Port != addr.Port {
+		return
+	}
+
+	if msg.err == nil {
+		if id, err := msg.senderId(); err == nil {
+			d.insert(&node{id: id, addr: addr})
+		}
+	}
+
+	select {
+	case pending.response <- msg:
+	default:
+	}
+}
+
+// Answers a query received from a remote node.
+func (d *DHT) handleQuery(addr *net.UDPAddr, msg *message) {
+	id, err := msg.senderId()
+	if err != nil {
+		_ = d.respondError(addr, msg.transaction, errorProtocol, "incorrect node id")
+		return
+	}
+	d.insert(&node{id: id, addr: addr})
+
+	var values map[string]interface{}
+	switch msg.method {
+	case "ping":
+		values = make(map[string]interface{})
+
+	case "find_node":
+		target, err := nodeIdFromString(stringArg(msg.args, "target"))
+		if err != nil {
+			_ = d.respondError(addr, msg.transaction, errorProtocol, "incorrect target")
+			return
+		}
+		values = map[string]interface{}{"nodes": d.compactClosest(target)}
+
+	case "get_peers":
+		infoHash, err := nodeIdFromString(stringArg(msg.args, "info_hash"))
+		if err != nil {
+			_ = d.respondError(addr, msg.transaction, errorProtocol, "incorrect info_hash")
+			return
+		}
+		values = map[string]interface{}{"token": d.token(addr.IP)}
+		if peers := d.storedPeers(infoHash); len(peers) > 0 {
+			values["values"] = peers
+		} else {
+			values["nodes"] = d.compactClosest(infoHash)
+		}
+
+	case "announce_peer":
+		infoHash, err := nodeIdFromString(stringArg(msg.args, "info_hash"))
+		if err != nil {
+			_ = d.respondError(addr, msg.transaction, errorProtocol, "incorrect info_hash")
+			return
+		} else if !d.validToken(stringArg(msg.args, "token"), addr.IP) {
+			_ = d.respondError(addr, msg.transaction, errorProtocol, "bad token")
+			return
+		}
+
+		port, _ := msg.args["port"].(int64)
+		if impliedPort, _ := msg.args["implied_port"].(int64); impliedPort != 0 {
+			port = int64(addr.Port)
+		}
+		compact, ok := compactPeer(addr.IP, int(port))
+		if !ok {
+			_ = d.respondError(addr, msg.transaction, errorProtocol, "incorrect port")
+			return
+		}
+		d.storePeer(infoHash, string(compact))
+		values = make(map[string]interface{})
+
+	default:
+		_ = d.respondError(addr, msg.transaction, errorMethodUnknown, "method unknown")
+		return
+	}
+
+	if err := d.respond(addr, msg.transaction, values); err != nil {
+		logger.Log(logger.High, "unable to respond to DHT node %s: %v", addr, err)
+	}
+}
+
+// Inserts the node into the routing table. If the bucket is full and contains
+// a questionable node, the questionable node is pinged and replaced if it
+// doesn't answer.
+func (d *DHT) insert(n *node) {
+	stale := d.table.insert(n)
+	if stale == nil {
+		return
+	}
+
+	go func() {
+		if _, err := d.query(stale.addr, "ping", make(map[string]interface{})); err != nil {
+			d.table.replace(stale, n)
+		}
+	}()
+}
+
+// Returns the K nodes closest to "target" in the compact node info format.
+func (d *DHT) compactClosest(target NodeId) string {
+	var buf bytes.Buffer
+	for _, n := range d.table.closest(target, K) {
+		if compact, ok := n.compact(); ok {
+			buf.Write(compact)
+		}
+	}
+	return buf.String()
+}
+
+func (d *DHT) storePeer(infoHash NodeId, compact string) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	if d.peers[infoHash] == nil {
+		d.peers[infoHash] = make(map[string]storedPeer)
+	}
+	d.peers[infoHash][compact] = storedPeer{compact: compact, received: time.Now()}
+}
+
+// Returns the compact peer info of at most MaxPeerValues peers that have
+// announced themselves for the torrent with the given info hash.
+func (d *DHT) storedPeers(infoHash NodeId) []string {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	peers := make([]string, 0)
+	for _, p := range d.peers[infoHash] {
+		if len(peers) >= MaxPeerValues {
+			break
+		}
+		peers = append(peers, p.compact)
+	}
+	return peers
+}
+
+// Returns the token that a node with the given IP needs to send in an
+// announce_peer query to this node.
+func (d *DHT) token(ip net.IP) string {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	return createToken(d.secret, ip)
+}
+
+func (d *DHT) validToken(token string, ip net.IP) bool {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	return token == createToken(d.secret, ip) ||
+		(d.previousSecret != nil && token == createToken(d.previousSecret, ip))
+}
+
+func createToken(secret []byte, ip net.IP) string {
+	hash := sha1.Sum(append(append([]byte{}, secret...), ip...))
+	return string(hash[:8])
+}
+
+func newSecret() []byte {
+	secret := make([]byte, 16)
+	_, _ = rand.Read(secret)
+	return secret
+}
+
+// Rotates the token secret, removes old peers, refreshes the routing table and
+// stores the state of the node until the node is closed.
+func (d *DHT) maintain() {
+	secretTicker := time.NewTicker(TokenSecretInterval)
+	defer secretTicker.Stop()
+	refreshTicker := time.NewTicker(RefreshInterval)
+	defer refreshTicker.Stop()
+
+	for {
+		select {
+		case <-secretTicker.C:
+			d.mut.Lock()
+			d.previousSecret, d.secret = d.secret, newSecret()
+			for infoHash, peers := range d.peers {
+				for compact, p := range peers {
+					if time.Since(p.received) > PeerTimeout {
+						delete(peers, compact)
+					}
+				}
+				if len(peers) == 0 {
+					delete(d.peers, infoHash)
+				}
+			}
+			d.mut.Unlock()
+
+		case <-refreshTicker.C:
+			if d.table.len() == 0 {
+				if err := d.Bootstrap(); err != nil {
+					logger.Log(logger.High, "%v", err)
+				}
+			} else {
+				d.lookup(randomNodeId(), false)
+			}
+
+			if d.statePath != "" {
+				if err := d.saveState(d.statePath); err != nil {
+					logger.Log(logger.Low, "%v", err)
+				}
+			}
+
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+// The state of this node that is stored between restarts.
+// Format: bencoded dictionary "d2:id20:<id>5:nodes<compact node info>e".
+type state struct {
+	Id    string `bencode:"id"`
+	Nodes string `bencode:"nodes"`
+}
+
+// Stores the id of this node and the nodes in the routing table to "path".
+func (d *DHT) saveState(path string) error {
+	var nodes bytes.Buffer
+	for _, n := range d.table.closest(d.id, len(NodeId{})*8*K) {
+		if compact, ok := n.compact(); ok {
+			nodes.Write(compact)
+		}
+	}
+
+	data, err := torrent.Marshal(state{
+		Id:    string(d.id[:]),
+		Nodes: nodes.String(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("unable to store DHT state to %s: %w", path, err)
+	}
+	return nil
+}
+
+// Loads the node id and nodes stored with "saveState".
+func loadState(path string) (NodeId, []*node, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return NodeId{}, nil, err
+	}
+
+	var stored state
+	if err := torrent.Unmarshal(data, &stored); err != nil {
+		return NodeId{}, nil, fmt.Errorf("unable to decode DHT state %s: %w", path, err)
+	}
+
+	id, err := nodeIdFromString(stored.Id)
+	if err != nil {
+		return NodeId{}, nil, err
+	}
+	nodes, err := parseCompactNodes(stored.Nodes)
+	if err != nil {
+		return NodeId{}, nil, err
+	}
+	return id, nodes, nil
+}
+
+func stringArg(dict map[string]interface{}, key string) string {
+	s, _ := dict[key].(string)
+	return s
+}
@@ -0,0 +1,217 @@
+package dht
+
+import (
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jmatss/torc/internal/torrent"
+)
+
+// Starts "amount" nodes on localhost. The first node is the bootstrap node of
+// all other nodes, every node has bootstrapped when this function returns.
+func startNodes(t *testing.T, amount int) []*DHT {
+	t.Helper()
+
+	first, err := New("127.0.0.1:0", nil, "")
+	if err != nil {
+		t.Fatalf("unable to start node: %v", err)
+	}
+	nodes := []*DHT{first}
+	bootstrap := []string{first.Addr().String()}
+
+	for i := 1; i < amount; i++ {
+		d, err := New("127.0.0.1:0", bootstrap, "")
+		if err != nil {
+			closeNodes(nodes)
+			t.Fatalf("unable to start node: %v", err)
+		}
+		nodes = append(nodes, d)
+
+		if err := d.Bootstrap(); err != nil {
+			closeNodes(nodes)
+			t.Fatalf("unable to bootstrap node %d: %v", i, err)
+		}
+	}
+	return nodes
+}
+
+func closeNodes(nodes []*DHT) {
+	for _, d := range nodes {
+		d.Close()
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	nodes := startNodes(t, 5)
+	defer closeNodes(nodes)
+
+	// The bootstrap node knows about every node that has bootstrapped from it.
+	if n := nodes[0].Nodes(); n != len(nodes)-1 {
+		t.Fatalf("expected the bootstrap node to know %d nodes, got: %d", len(nodes)-1, n)
+	}
+	for i, d := range nodes[1:] {
+		if d.Nodes() == 0 {
+			t.Fatalf("node %d has an empty routing table", i+1)
+		}
+	}
+}
+
+func TestAnnounceGetPeers(t *testing.T) {
+	nodes := startNodes(t, 5)
+	defer closeNodes(nodes)
+
+	tests := []struct {
+		name     string
+		infoHash [sha1.Size]byte
+		announce int // index of the announcing node, -1 if nobody announces
+		port     int
+		lookup   int // index of the node that looks up the peers
+	}{
+		{"announced by other node", sha1.Sum([]byte("torrent 1")), 1, 6881, 4},
+		{"announced by bootstrap node", sha1.Sum([]byte("torrent 2")), 0, 51413, 3},
+		{"announced and looked up by same node", sha1.Sum([]byte("torrent 3")), 2, 7000, 2},
+		{"not announced", sha1.Sum([]byte("torrent 4")), -1, 0, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.announce >= 0 {
+				nodes[tt.announce].Announce(tt.infoHash, tt.port)
+			}
+
+			peers := nodes[tt.lookup].GetPeers(tt.infoHash)
+			if tt.announce < 0 {
+				if len(peers) != 0 {
+					t.Fatalf("expected no peers, got: %v", peers)
+				}
+				return
+			}
+
+			if len(peers) != 1 {
+				t.Fatalf("expected 1 peer, got: %v", peers)
+			}
+			if !peers[0].IP.Equal(nodes[tt.announce].Addr().IP) || peers[0].Port != tt.port {
+				t.Fatalf("expected peer 127.0.0.1:%d, got: %s", tt.port, peers[0].String())
+			}
+		})
+	}
+}
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		method   string
+		args     bool
+		response bool
+		errMsg   string // the error of a received KRPC error message
+		ok       bool
+	}{
+		{"query", "d1:ad2:id20:aaaaaaaaaaaaaaaaaaaae1:q4:ping1:t2:aa1:y1:qe", "ping", true, false, "", true},
+		{"response", "d1:rd2:id20:aaaaaaaaaaaaaaaaaaaae1:t2:aa1:y1:re", "", false, true, "", true},
+		{"error", "d1:eli201e7:Generice1:t2:aa1:y1:ee", "", false, false, "201: Generic", true},
+		{"malformed error", "d1:eli201ee1:t2:aa1:y1:ee", "", false, false, "201: ", true},
+		{"query without method", "d1:ad2:id20:aaaaaaaaaaaaaaaaaaaae1:t2:aa1:y1:qe", "", false, false, "", false},
+		{"query without arguments", "d1:q4:ping1:t2:aa1:y1:qe", "", false, false, "", false},
+		{"response without values", "d1:t2:aa1:y1:re", "", false, false, "", false},
+		{"without transaction id", "d1:rd2:id20:aaaaaaaaaaaaaaaaaaaae1:y1:re", "", false, false, "", false},
+		{"transaction id not a string", "d1:rd2:id20:aaaaaaaaaaaaaaaaaaaae1:ti1e1:y1:re", "", false, false, "", false},
+		{"unknown type", "d1:t2:aa1:y1:xe", "", false, false, "", false},
+		{"not a dictionary", "l1:t2:aae", "", false, false, "", false},
+		{"malformed", "d1:t2:aa", "", false, false, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := parseMessage([]byte(tt.data))
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("expected an error, got: %+v", msg)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unable to parse message: %v", err)
+			}
+
+			if msg.transaction != "aa" {
+				t.Errorf("expected transaction id \"aa\", got: %q", msg.transaction)
+			}
+			if msg.method != tt.method {
+				t.Errorf("expected method %q, got: %q", tt.method, msg.method)
+			}
+			if (msg.args != nil) != tt.args || (msg.response != nil) != tt.response {
+				t.Errorf("expected args: %v, response: %v, got: %v, %v",
+					tt.args, tt.response, msg.args, msg.response)
+			}
+			if tt.errMsg == "" {
+				if msg.err != nil {
+					t.Errorf("expected no KRPC error, got: %v", msg.err)
+				}
+			} else if msg.err == nil || !strings.HasSuffix(msg.err.Error(), tt.errMsg) {
+				t.Errorf("expected a KRPC error ending with %q, got: %v", tt.errMsg, msg.err)
+			}
+		})
+	}
+}
+
+// Makes sure that a message sent by a node is parsed the same way by the
+// receiving node.
+func TestSendParseMessage(t *testing.T) {
+	msg := krpcMessage{
+		Transaction: "aa",
+		Type:        "e",
+		Err:         []interface{}{errorProtocol, "Protocol Error"},
+	}
+	data, err := torrent.Marshal(msg)
+	if err != nil {
+		t.Fatalf("unable to encode message: %v", err)
+	}
+	if string(data) != "d1:eli203e14:Protocol Errore1:t2:aa1:y1:ee" {
+		t.Fatalf("expected keys to be sorted and empty fields skipped, got: %s", data)
+	}
+
+	parsed, err := parseMessage(data)
+	if err != nil {
+		t.Fatalf("unable to parse message: %v", err)
+	} else if parsed.err == nil || parsed.err.Error() != "received KRPC error 203: Protocol Error" {
+		t.Fatalf("expected the KRPC error to be parsed, got: %v", parsed.err)
+	}
+}
+
+func TestState(t *testing.T) {
+	nodes := startNodes(t, 3)
+	defer closeNodes(nodes)
+
+	dir, err := ioutil.TempDir("", "torc")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dht")
+
+	if err := nodes[0].saveState(path); err != nil {
+		t.Fatalf("unable to save state: %v", err)
+	}
+	id, loaded, err := loadState(path)
+	if err != nil {
+		t.Fatalf("unable to load state: %v", err)
+	}
+	if id != nodes[0].id {
+		t.Errorf("expected id %x, got: %x", nodes[0].id, id)
+	}
+	if len(loaded) != nodes[0].Nodes() {
+		t.Errorf("expected %d nodes, got: %d", nodes[0].Nodes(), len(loaded))
+	}
+
+	// A state with an incorrect id isn't loaded.
+	if err := ioutil.WriteFile(path, []byte("d2:id3:abc5:nodes0:e"), 0644); err != nil {
+		t.Fatalf("unable to write state: %v", err)
+	}
+	if _, _, err := loadState(path); err == nil {
+		t.Fatalf("expected an error when loading a state with an incorrect id")
+	}
+}
@@ -0,0 +1,164 @@
+// Contains logic related to KRPC, the protocol used between DHT nodes.
+// Every message is a bencoded dictionary sent in a single UDP packet.
+package dht
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/jmatss/torc/internal/torrent"
+)
+
+// The KRPC error codes.
+const (
+	errorGeneric       = 201
+	errorServer        = 202
+	errorProtocol      = 203
+	errorMethodUnknown = 204
+)
+
+// A KRPC message. Exactly one of "args", "response" and "err" is set depending
+// on if the message is a query, a response or an error.
+type message struct {
+	transaction string
+	method      string
+	args        map[string]interface{}
+	response    map[string]interface{}
+	err         error
+}
+
+// The bencoded dictionary of a KRPC message as it is sent between nodes.
+type krpcMessage struct {
+	Transaction string                 `bencode:"t"`
+	Type        string                 `bencode:"y"`
+	Method      string                 `bencode:"q,omitempty"`
+	Args        map[string]interface{} `bencode:"a,omitempty"`
+	Response    map[string]interface{} `bencode:"r,omitempty"`
+	Err         []interface{}          `bencode:"e,omitempty"`
+}
+
+// Parses a KRPC message received from a remote node.
+func parseMessage(data []byte) (*message, error) {
+	var received krpcMessage
+	if err := torrent.Unmarshal(data, &received); err != nil {
+		return nil, fmt.Errorf("unable to decode KRPC message: %w", err)
+	}
+
+	msg := &message{transaction: received.Transaction}
+	if msg.transaction == "" {
+		return nil, fmt.Errorf("KRPC message without transaction id")
+	}
+
+	switch received.Type {
+	case "q":
+		if msg.method = received.Method; msg.method == "" {
+			return nil, fmt.Errorf("KRPC query without method")
+		}
+		if msg.args = received.Args; msg.args == nil {
+			return nil, fmt.Errorf("KRPC query without arguments")
+		}
+	case "r":
+		if msg.response = received.Response; msg.response == nil {
+			return nil, fmt.Errorf("KRPC response without return values")
+		}
+	case "e":
+		code, reason := int64(errorGeneric), ""
+		if len(received.Err) == 2 {
+			code, _ = received.Err[0].(int64)
+			reason, _ = received.Err[1].(string)
+		}
+		msg.err = fmt.Errorf("received KRPC error %d: %s", code, reason)
+	default:
+		return nil, fmt.Errorf("unknown KRPC message type \"%s\"", received.Type)
+	}
+
+	return msg, nil
+}
+
+// Returns the id of the node that sent the query or response.
+func (msg *message) senderId() (NodeId, error) {
+	values := msg.args
+	if values == nil {
+		values = msg.response
+	}
+	id, _ := values["id"].(string)
+	return nodeIdFromString(id)
+}
+
+// Sends a query to the remote node at "addr" and waits for the response.
+// The "id" argument is added to "args".
+func (d *DHT) query(addr *net.UDPAddr, method string, args map[string]interface{}) (map[string]interface{}, error) {
+	args["id"] = string(d.id[:])
+
+	d.mut.Lock()
+	d.transactionId++
+	transaction := make([]byte, 2)
+	binary.BigEndian.PutUint16(transaction, d.transactionId)
+	responseChannel := make(chan *message, 1)
+	d.pending[string(transaction)] = pendingQuery{addr: addr, response: responseChannel}
+	d.mut.Unlock()
+
+	defer func() {
+		d.mut.Lock()
+		delete(d.pending, string(transaction))
+		d.mut.Unlock()
+	}()
+
+	err := d.send(addr, krpcMessage{
+		Transaction: string(transaction),
+		Type:        "q",
+		Method:      method,
+		Args:        args,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := time.NewTimer(QueryTimeout)
+	defer timeout.Stop()
+
+	select {
+	case msg := <-responseChannel:
+		if msg.err != nil {
+			return nil, msg.err
+		}
+		return msg.response, nil
+	case <-timeout.C:
+		return nil, fmt.Errorf("no response from DHT node %s to \"%s\" query", addr, method)
+	case <-d.quit:
+		return nil, fmt.Errorf("the DHT has been closed")
+	}
+}
+
+// Sends a response to a query received from a remote node. The "id" of this
+// node is added to "values".
+func (d *DHT) respond(addr *net.UDPAddr, transaction string, values map[string]interface{}) error {
+	values["id"] = string(d.id[:])
+	return d.send(addr, krpcMessage{
+		Transaction: transaction,
+		Type:        "r",
+		Response:    values,
+	})
+}
+
+// Sends an error to a remote node as a response to one of its queries.
+func (d *DHT) respondError(addr *net.UDPAddr, transaction string, code int, reason string) error {
+	return d.send(addr, krpcMessage{
+		Transaction: transaction,
+		Type:        "e",
+		Err:         []interface{}{code, reason},
+	})
+}
+
+func (d *DHT) send(addr *net.UDPAddr, msg krpcMessage) error {
+	data, err := torrent.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if _, err := d.conn.WriteTo(data, addr); err != nil {
+		return fmt.Errorf("unable to send KRPC message to %s: %w", addr, err)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+// Contains logic related to the node ids and addresses of DHT nodes.
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"net"
+	"time"
+)
+
+// The length of the compact node info: <node id(20B)><IPv4(4B)><port(2B)>.
+const compactNodeLen = sha1.Size + net.IPv4len + 2
+
+// The id of a DHT node. Info hashes are in the same keyspace.
+type NodeId [sha1.Size]byte
+
+func randomNodeId() NodeId {
+	var id NodeId
+	_, _ = rand.Read(id[:])
+	return id
+}
+
+func nodeIdFromString(s string) (NodeId, error) {
+	var id NodeId
+	if len(s) != len(id) {
+		return id, fmt.Errorf("incorrect length of node id, expected: %d, got: %d",
+			len(id), len(s))
+	}
+	copy(id[:], s)
+	return id, nil
+}
+
+// Returns the XOR distance between the two ids.
+func (id NodeId) distance(other NodeId) NodeId {
+	var d NodeId
+	for i := range d {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// Returns true if "id" is closer to "target" than "other" is.
+func (id NodeId) closer(other, target NodeId) bool {
+	a, b := id.distance(target), other.distance(target)
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// Returns the amount of leading bits that the two ids have in common.
+func (id NodeId) commonPrefixLen(other NodeId) int {
+	for i := range id {
+		if x := id[i] ^ other[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(id) * 8
+}
+
+// A remote node in the DHT.
+type node struct {
+	id   NodeId
+	addr *net.UDPAddr
+
+	// The last time that a message was received from the node and the amount
+	// of queries in a row that the node hasn't answered.
+	lastSeen time.Time
+	failures int
+}
+
+// Returns true if the node should be replaced by a new node.
+func (n *node) bad() bool {
+	return n.failures >= MaxFailures
+}
+
+// Returns true if the node hasn't been heard from in a while and should be
+// pinged before it is trusted.
+func (n *node) questionable() bool {
+	return time.Since(n.lastSeen) > QuestionableTime
+}
+
+// Encodes the node into the compact node info format. Returns false if the
+// node doesn't have an IPv4 address.
+func (n *node) compact() ([]byte, bool) {
+	ip := n.addr.IP.To4()
+	if ip == nil {
+		return nil, false
+	}
+
+	data := make([]byte, compactNodeLen)
+	copy(data, n.id[:])
+	copy(data[sha1.Size:], ip)
+	binary.BigEndian.PutUint16(data[sha1.Size+net.IPv4len:], uint16(n.addr.Port))
+	return data, true
+}
+
+// Parses nodes in the compact node info format.
+func parseCompactNodes(data string) ([]*node, error) {
+	if len(data)%compactNodeLen != 0 {
+		return nil, fmt.Errorf("length of compact nodes is not divisible by %d, "+
+			"actual length: %d", compactNodeLen, len(data))
+	}
+
+	nodes := make([]*node, 0, len(data)/compactNodeLen)
+	for i := 0; i+compactNodeLen <= len(data); i += compactNodeLen {
+		var id NodeId
+		copy(id[:], data[i:])
+		ip := net.IP([]byte(data[i+sha1.Size : i+sha1.Size+net.IPv4len]))
+		port := binary.BigEndian.Uint16([]byte(data[i+sha1.Size+net.IPv4len : i+compactNodeLen]))
+		if port == 0 {
+			continue
+		}
+		nodes = append(nodes, &node{id: id, addr: &net.UDPAddr{IP: ip, Port: int(port)}})
+	}
+	return nodes, nil
+}
+
+// Encodes a peer address into the compact format: <IPv4(4B)><port(2B)>.
+func compactPeer(ip net.IP, port int) ([]byte, bool) {
+	ip = ip.To4()
+	if ip == nil || port <= 0 || port > 65535 {
+		return nil, false
+	}
+	return append(append([]byte{}, ip...), byte(port>>8), byte(port)), true
+}
+
+// Parses a peer address in the compact format.
+func parseCompactPeer(data string) (*net.TCPAddr, bool) {
+	if len(data) != net.IPv4len+2 {
+		return nil, false
+	}
+	ip := net.IP([]byte(data[:net.IPv4len]))
+	port := binary.BigEndian.Uint16([]byte(data[net.IPv4len:]))
+	return &net.TCPAddr{IP: ip, Port: int(port)}, true
+}
@@ -0,0 +1,133 @@
+// Contains logic related to the routing table of the DHT.
+package dht
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// The routing table contains one bucket for every possible length of the common
+// prefix between the id of this node and the id of a remote node. Every bucket
+// contains at most K nodes, sorted from least to most recently seen.
+type table struct {
+	mut     sync.Mutex
+	self    NodeId
+	buckets [len(NodeId{}) * 8][]*node
+}
+
+func newTable(self NodeId) *table {
+	return &table{self: self}
+}
+
+func (t *table) bucketIndex(id NodeId) int {
+	return t.self.commonPrefixLen(id)
+}
+
+// Inserts the node into the table or marks it as seen if it already exists.
+// If the bucket is full, a bad node in the bucket is replaced. If there are no
+// bad nodes, the least recently seen node is returned if it is questionable so
+// that the caller can ping it and call "replace" if it doesn't answer.
+func (t *table) insert(n *node) *node {
+	if n.id == t.self {
+		return nil
+	}
+
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	i := t.bucketIndex(n.id)
+	bucket := t.buckets[i]
+	for j, old := range bucket {
+		if old.id == n.id {
+			old.addr = n.addr
+			old.lastSeen = time.Now()
+			old.failures = 0
+			t.buckets[i] = append(append(bucket[:j:j], bucket[j+1:]...), old)
+			return nil
+		}
+	}
+
+	n.lastSeen = time.Now()
+	if len(bucket) < K {
+		t.buckets[i] = append(bucket, n)
+		return nil
+	}
+
+	for j, old := range bucket {
+		if old.bad() {
+			t.buckets[i] = append(append(bucket[:j:j], bucket[j+1:]...), n)
+			return nil
+		}
+	}
+
+	if bucket[0].questionable() {
+		return bucket[0]
+	}
+	return nil
+}
+
+// Replaces the node "old" with "n" if "old" still exists in the table and
+// hasn't been seen since it became questionable.
+func (t *table) replace(old, n *node) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	i := t.bucketIndex(old.id)
+	bucket := t.buckets[i]
+	for j, existing := range bucket {
+		if existing == old && existing.questionable() {
+			t.buckets[i] = append(append(bucket[:j:j], bucket[j+1:]...), n)
+			return
+		}
+	}
+}
+
+// Registers that a query to the node with the given id failed.
+func (t *table) failed(id NodeId) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	for _, n := range t.buckets[t.bucketIndex(id)] {
+		if n.id == id {
+			n.failures++
+			return
+		}
+	}
+}
+
+// Returns the "count" nodes in the table that are closest to "target".
+// Bad nodes are excluded.
+func (t *table) closest(target NodeId, count int) []*node {
+	t.mut.Lock()
+	nodes := make([]*node, 0)
+	for _, bucket := range t.buckets {
+		for _, n := range bucket {
+			if !n.bad() {
+				copied := *n
+				nodes = append(nodes, &copied)
+			}
+		}
+	}
+	t.mut.Unlock()
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].id.closer(nodes[j].id, target)
+	})
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+	return nodes
+}
+
+// Returns the amount of nodes in the table.
+func (t *table) len() int {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	n := 0
+	for _, bucket := range t.buckets {
+		n += len(bucket)
+	}
+	return n
+}
@@ -0,0 +1,126 @@
+// Contains logic related to deciding which remote peers to upload to.
+package handler
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/jmatss/torc/internal/peer"
+)
+
+const (
+	// How often the choker decides which remote peers to unchoke.
+	ChokeInterval = 10 * time.Second
+
+	// How often the optimistic unchoke is moved to another remote peer.
+	OptimisticUnchokeInterval = 30 * time.Second
+
+	// The amount of remote peers that are unchoked because of their transfer
+	// rate. One extra remote peer is unchoked optimistically.
+	UploadSlots = 3
+)
+
+// Choker implements the tit-for-tat choking algorithm. The remote peers that
+// upload the most to this client are unchoked (or the remote peers that this
+// client uploads the most to when seeding). One extra remote peer is unchoked
+// at random so that new peers get a chance to prove that they upload faster.
+//
+// Only used by the torrent Handler, so no locking is done.
+type Choker struct {
+	// The HostAndPort of the optimistically unchoked peer and when it was picked.
+	optimistic     string
+	optimisticTime time.Time
+
+	// The amount of bytes transferred to/from every peer during the previous
+	// rechoke. Used to calculate the transfer rates since then.
+	lastDownloaded map[string]int64
+	lastUploaded   map[string]int64
+}
+
+func NewChoker() *Choker {
+	return &Choker{
+		lastDownloaded: make(map[string]int64),
+		lastUploaded:   make(map[string]int64),
+	}
+}
+
+// Decides which of the connected "peers" should be unchoked. Only remote peers
+// that are interested can be unchoked. If "seeding" is set, the peers are ranked
+// after how much this client uploads to them instead.
+//
+// Returns a set containing the HostAndPort of the peers that should be unchoked,
+// every other peer should be choked.
+func (c *Choker) Rechoke(peers []*peer.Peer, seeding bool) map[string]bool {
+	type candidate struct {
+		hostAndPort string
+		rate        int64
+	}
+
+	downloaded := make(map[string]int64, len(peers))
+	uploaded := make(map[string]int64, len(peers))
+	candidates := make([]candidate, 0, len(peers))
+	for _, p := range peers {
+		p.RLock()
+		downloaded[p.HostAndPort] = p.Downloaded
+		uploaded[p.HostAndPort] = p.Uploaded
+		interested := p.PeerInterested
+		p.RUnlock()
+
+		if !interested {
+			continue
+		}
+
+		var rate int64
+		if seeding {
+			rate = uploaded[p.HostAndPort] - c.lastUploaded[p.HostAndPort]
+		} else {
+			rate = downloaded[p.HostAndPort] - c.lastDownloaded[p.HostAndPort]
+		}
+		candidates = append(candidates, candidate{p.HostAndPort, rate})
+	}
+	c.lastDownloaded = downloaded
+	c.lastUploaded = uploaded
+
+	// Shuffle before sorting so that ties are broken at random.
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].rate > candidates[j].rate
+	})
+
+	unchoke := make(map[string]bool, UploadSlots+1)
+	rest := make([]string, 0)
+	for _, cand := range candidates {
+		if len(unchoke) < UploadSlots {
+			unchoke[cand.hostAndPort] = true
+		} else {
+			rest = append(rest, cand.hostAndPort)
+		}
+	}
+
+	// Keep the current optimistic unchoke until it is time to rotate, unless
+	// it has disconnected, lost interest or earned a regular slot.
+	keep := false
+	if time.Since(c.optimisticTime) < OptimisticUnchokeInterval {
+		for _, hostAndPort := range rest {
+			if hostAndPort == c.optimistic {
+				keep = true
+				break
+			}
+		}
+	}
+	if !keep {
+		c.optimistic = ""
+		if len(rest) > 0 {
+			c.optimistic = rest[rand.Intn(len(rest))]
+			c.optimisticTime = time.Now()
+		}
+	}
+	if c.optimistic != "" {
+		unchoke[c.optimistic] = true
+	}
+
+	return unchoke
+}
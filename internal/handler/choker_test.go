@@ -0,0 +1,171 @@
+package handler
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jmatss/torc/internal/peer"
+)
+
+// Creates "n" remote peers named "peer0", "peer1", ... The rates are the
+// amount of bytes that has been transferred to/from every peer.
+func testPeers(n int, interested bool, downloaded, uploaded func(i int) int64) []*peer.Peer {
+	peers := make([]*peer.Peer, n)
+	for i := range peers {
+		peers[i] = &peer.Peer{
+			HostAndPort:    "peer" + strconv.Itoa(i),
+			PeerInterested: interested,
+			Downloaded:     downloaded(i),
+			Uploaded:       uploaded(i),
+		}
+	}
+	return peers
+}
+
+func transferred(r ...int64) func(i int) int64 {
+	return func(i int) int64 {
+		return r[i]
+	}
+}
+
+func TestRechoke(t *testing.T) {
+	tests := []struct {
+		name       string
+		peers      []*peer.Peer
+		seeding    bool
+		regular    []string // must all be unchoked
+		optimistic []string // exactly one of these must be unchoked
+	}{
+		{
+			"top by download rate",
+			testPeers(6, true, transferred(10, 60, 20, 50, 30, 40), transferred(0, 0, 0, 0, 0, 0)),
+			false,
+			[]string{"peer1", "peer3", "peer5"},
+			[]string{"peer0", "peer2", "peer4"},
+		},
+		{
+			"top by upload rate when seeding",
+			testPeers(6, true, transferred(10, 60, 20, 50, 30, 40), transferred(60, 10, 50, 20, 40, 30)),
+			true,
+			[]string{"peer0", "peer2", "peer4"},
+			[]string{"peer1", "peer3", "peer5"},
+		},
+		{
+			"download rate ignored when seeding",
+			testPeers(4, true, transferred(100, 100, 100, 0), transferred(0, 1, 2, 3)),
+			true,
+			[]string{"peer1", "peer2", "peer3"},
+			[]string{"peer0"},
+		},
+		{
+			"fewer peers than slots",
+			testPeers(2, true, transferred(10, 20), transferred(0, 0)),
+			false,
+			[]string{"peer0", "peer1"},
+			nil,
+		},
+		{
+			"uninterested",
+			testPeers(4, false, transferred(10, 20, 30, 40), transferred(0, 0, 0, 0)),
+			false,
+			nil,
+			nil,
+		},
+		{
+			"uninterested fast peers",
+			append(
+				testPeers(2, false, transferred(1000, 1000), transferred(0, 0)),
+				&peer.Peer{HostAndPort: "slow", PeerInterested: true, Downloaded: 1},
+			),
+			false,
+			[]string{"slow"},
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unchoke := NewChoker().Rechoke(tt.peers, tt.seeding)
+
+			for _, hostAndPort := range tt.regular {
+				if !unchoke[hostAndPort] {
+					t.Fatalf("expected %s to be unchoked, got: %v", hostAndPort, unchoke)
+				}
+			}
+			optimistic := 0
+			for _, hostAndPort := range tt.optimistic {
+				if unchoke[hostAndPort] {
+					optimistic++
+				}
+			}
+			if len(tt.optimistic) > 0 && optimistic != 1 {
+				t.Fatalf("expected 1 optimistic unchoke of %v, got: %v", tt.optimistic, unchoke)
+			}
+			if expected := len(tt.regular) + optimistic; len(unchoke) != expected {
+				t.Fatalf("expected %d unchoked peers, got: %v", expected, unchoke)
+			}
+		})
+	}
+}
+
+func TestRechokeOptimistic(t *testing.T) {
+	// Three fast peers that get the regular slots and three slow peers that
+	// compete for the optimistic unchoke.
+	peers := testPeers(6, true, transferred(0, 0, 0, 0, 0, 0), transferred(0, 0, 0, 0, 0, 0))
+	transfer := func() {
+		for _, p := range peers[:UploadSlots] {
+			p.Downloaded += 1000
+		}
+	}
+	optimistic := func(unchoke map[string]bool) string {
+		for _, p := range peers[UploadSlots:] {
+			if unchoke[p.HostAndPort] {
+				return p.HostAndPort
+			}
+		}
+		return ""
+	}
+
+	c := NewChoker()
+	transfer()
+	first := optimistic(c.Rechoke(peers, false))
+	if first == "" || first != c.optimistic {
+		t.Fatalf("expected an optimistic unchoke, got: %q", first)
+	}
+
+	// The optimistic unchoke is kept until the interval has passed.
+	for i := 0; i < 10; i++ {
+		transfer()
+		if got := optimistic(c.Rechoke(peers, false)); got != first {
+			t.Fatalf("expected the optimistic unchoke %s to be kept, got: %s", first, got)
+		}
+	}
+
+	// After the interval a new optimistic unchoke is picked at random.
+	seen := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		c.optimisticTime = time.Now().Add(-OptimisticUnchokeInterval)
+		transfer()
+		seen[optimistic(c.Rechoke(peers, false))] = true
+
+		if time.Since(c.optimisticTime) > time.Second {
+			t.Fatalf("expected the optimistic unchoke time to be reset")
+		}
+	}
+	if len(seen) < 2 {
+		t.Fatalf("expected the optimistic unchoke to rotate, got: %v", seen)
+	}
+
+	// An optimistic unchoke that loses interest is replaced immediately.
+	transfer()
+	current := c.optimistic
+	for _, p := range peers {
+		if p.HostAndPort == current {
+			p.PeerInterested = false
+		}
+	}
+	if got := optimistic(c.Rechoke(peers, false)); got == current || got == "" {
+		t.Fatalf("expected the uninterested %s to be replaced, got: %q", current, got)
+	}
+}
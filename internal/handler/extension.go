@@ -0,0 +1,130 @@
+// Contains logic related to the extension protocol.
+// See http://www.bittorrent.org/beps/bep_0010.html
+package handler
+
+import (
+	"fmt"
+
+	"github.com/jmatss/torc/internal/peer"
+	"github.com/jmatss/torc/internal/torrent"
+	bt "github.com/jmatss/torc/internal/util/bittorrent"
+)
+
+// The extended message id of the extended handshake.
+const ExtendedHandshakeId byte = 0
+
+// Handles the payload of an extended message received from the remote peer.
+// The payload doesn't include the extended message id.
+type ExtensionHandler func(p *peer.Peer, tor *torrent.Torrent, payload []byte) error
+
+// The bencoded dictionary of an extended handshake. Only the keys used by this
+// client are included.
+type extendedHandshake struct {
+	// The extended message ids of the supported extensions indexed by name.
+	M            map[string]int64 `bencode:"m"`
+	MetadataSize int64            `bencode:"metadata_size,omitempty"`
+	// The TCP port that the peer listens on.
+	Port int64 `bencode:"p,omitempty"`
+}
+
+type extension struct {
+	name    string
+	handler ExtensionHandler
+}
+
+// The extensions supported by this client indexed by the extended message id
+// that remote peers should use when sending them to this client.
+var extensions = make(map[byte]extension)
+
+// Registers the handler of the extension "name". Remote peers are told to use
+// the extended message id "id" when sending messages of this extension to this
+// client. Should only be called from init functions.
+func RegisterExtension(name string, id byte, handler ExtensionHandler) {
+	if id == ExtendedHandshakeId {
+		panic(fmt.Sprintf("extension \"%s\" registered with the id of the extended handshake", name))
+	} else if other, ok := extensions[id]; ok {
+		panic(fmt.Sprintf("extension \"%s\" registered with the same id as \"%s\"", name, other.name))
+	}
+
+	extensions[id] = extension{name: name, handler: handler}
+}
+
+// Sends the extended handshake to the remote peer containing all registered
+// extensions. The size of the metadata is included if this client has it so
+// that the remote peer can request it.
+func sendExtendedHandshake(p *peer.Peer, tor *torrent.Torrent) error {
+	handshake := extendedHandshake{
+		M:    make(map[string]int64, len(extensions)),
+		Port: torrent.Port,
+	}
+	for id, ext := range extensions {
+		handshake.M[ext.name] = int64(id)
+	}
+	if info, err := tor.Info(); err == nil {
+		handshake.MetadataSize = int64(len(info))
+	}
+
+	payload, err := torrent.Marshal(handshake)
+	if err != nil {
+		return fmt.Errorf("unable to encode extended handshake: %w", err)
+	}
+	return p.SendData(bt.Extended, append([]byte{ExtendedHandshakeId}, payload...))
+}
+
+// Parses an extended handshake received from the remote peer. Updates the
+// extensions that the remote peer supports, the size of its metadata and the
+// port that it listens on. An extension with the message id 0 is disabled by
+// the remote peer.
+func recvExtendedHandshake(p *peer.Peer, payload []byte) error {
+	var handshake extendedHandshake
+	if err := torrent.Unmarshal(payload, &handshake); err != nil {
+		return fmt.Errorf("unable to decode extended handshake: %w", err)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if p.Extensions == nil {
+		p.Extensions = make(map[string]byte)
+	}
+	for name, id := range handshake.M {
+		if id < 0 || id > 255 {
+			continue
+		} else if id == 0 {
+			delete(p.Extensions, name)
+		} else {
+			p.Extensions[name] = byte(id)
+		}
+	}
+	if handshake.MetadataSize > 0 {
+		p.MetadataSize = int(handshake.MetadataSize)
+	}
+	if handshake.Port > 0 && handshake.Port <= 65535 {
+		p.ListenPort = uint16(handshake.Port)
+	}
+
+	return nil
+}
+
+// Dispatches an extended message received from the remote peer to the handler
+// of its extension. Messages of unknown extensions are ignored.
+// Format: <extended message id><payload>
+func handleExtended(p *peer.Peer, tor *torrent.Torrent, data []byte) error {
+	if len(data) < 1 {
+		return fmt.Errorf("received empty extended message")
+	}
+
+	extId, payload := data[0], data[1:]
+	if extId == ExtendedHandshakeId {
+		return recvExtendedHandshake(p, payload)
+	}
+
+	ext, ok := extensions[extId]
+	if !ok {
+		return nil
+	}
+	if err := ext.handler(p, tor, payload); err != nil {
+		return fmt.Errorf("unable to handle \"%s\" message: %w", ext.name, err)
+	}
+	return nil
+}
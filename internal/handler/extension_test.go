@@ -0,0 +1,223 @@
+package handler
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/jmatss/torc/internal/peer"
+	"github.com/jmatss/torc/internal/torrent"
+	bt "github.com/jmatss/torc/internal/util/bittorrent"
+)
+
+// Creates a peer connected to one end of a pipe, the other end is returned.
+func newTestPeer() (*peer.Peer, net.Conn) {
+	local, remote := net.Pipe()
+	p := peer.NewPeer("127.0.0.1", 6881)
+	p.Connection = local
+	return p, remote
+}
+
+// Reads a single message from "conn" and returns its id and payload.
+func readMessage(t *testing.T, conn net.Conn) (bt.MessageId, []byte) {
+	var lenPrefix [4]byte
+	if _, err := io.ReadFull(conn, lenPrefix[:]); err != nil {
+		t.Fatalf("unable to read length prefix: %v", err)
+	}
+	data := make([]byte, binary.BigEndian.Uint32(lenPrefix[:]))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatalf("unable to read message: %v", err)
+	}
+	return bt.MessageId(data[0]), data[1:]
+}
+
+func TestRecvExtendedHandshake(t *testing.T) {
+	tests := []struct {
+		name         string
+		payload      string
+		extensions   map[string]byte
+		metadataSize int
+		listenPort   uint16
+		ok           bool
+	}{
+		{
+			"all fields",
+			"d1:md11:ut_metadatai3e6:ut_pexi1ee13:metadata_sizei1234e1:pi6882ee",
+			map[string]byte{"old": 7, "ut_metadata": 3, "ut_pex": 1},
+			1234, 6882, true,
+		},
+		{
+			"unknown keys",
+			"d1:xi1ee",
+			map[string]byte{"old": 7},
+			0, 0, true,
+		},
+		{
+			"disabled extension",
+			"d1:md3:oldi0eee",
+			map[string]byte{},
+			0, 0, true,
+		},
+		{
+			"invalid ids",
+			"d1:md1:ai-1e1:bi256eee",
+			map[string]byte{"old": 7},
+			0, 0, true,
+		},
+		{
+			"invalid port",
+			"d1:pi65536ee",
+			map[string]byte{"old": 7},
+			0, 0, true,
+		},
+		{"id not an integer", "d1:md1:c1:xee", nil, 0, 0, false},
+		{"not a dictionary", "i1e", nil, 0, 0, false},
+		{"malformed", "d1:m", nil, 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The remote peer has earlier announced the extension "old".
+			p := peer.NewPeer("127.0.0.1", 6881)
+			p.Extensions = map[string]byte{"old": 7}
+
+			err := recvExtendedHandshake(p, []byte(tt.payload))
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unable to parse extended handshake: %v", err)
+			}
+
+			if len(p.Extensions) != len(tt.extensions) {
+				t.Fatalf("expected extensions: %v, got: %v", tt.extensions, p.Extensions)
+			}
+			for name, id := range tt.extensions {
+				if p.Extensions[name] != id {
+					t.Fatalf("expected extensions: %v, got: %v", tt.extensions, p.Extensions)
+				}
+			}
+			if p.MetadataSize != tt.metadataSize {
+				t.Errorf("expected metadata size %d, got: %d", tt.metadataSize, p.MetadataSize)
+			}
+			if p.ListenPort != tt.listenPort {
+				t.Errorf("expected listen port %d, got: %d", tt.listenPort, p.ListenPort)
+			}
+		})
+	}
+}
+
+func TestSendExtendedHandshake(t *testing.T) {
+	tests := []struct {
+		name         string
+		tor          *torrent.Torrent
+		metadataSize bool
+	}{
+		{"with metadata", newTestTorrent(t, "test", false), true},
+		{"without metadata", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tor := tt.tor
+			if tor == nil {
+				var err error
+				tor, err = torrent.NewTorrentFromMagnet(
+					"magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567")
+				if err != nil {
+					t.Fatalf("unable to create torrent: %v", err)
+				}
+			}
+
+			p, remote := newTestPeer()
+			defer remote.Close()
+			go sendExtendedHandshake(p, tor)
+
+			id, data := readMessage(t, remote)
+			if id != bt.Extended || len(data) < 1 || data[0] != ExtendedHandshakeId {
+				t.Fatalf("expected an extended handshake, got: %v %v", id, data)
+			}
+
+			// The handshake is parsed the same way as a received one.
+			received := peer.NewPeer("127.0.0.1", 6881)
+			if err := recvExtendedHandshake(received, data[1:]); err != nil {
+				t.Fatalf("unable to parse sent handshake: %v", err)
+			}
+			for id, ext := range extensions {
+				if received.Extensions[ext.name] != id {
+					t.Errorf("%s: expected id %d, got: %d", ext.name, id, received.Extensions[ext.name])
+				}
+			}
+			if received.ListenPort != torrent.Port {
+				t.Errorf("expected port %d, got: %d", torrent.Port, received.ListenPort)
+			}
+
+			if !tt.metadataSize {
+				if received.MetadataSize != 0 {
+					t.Errorf("expected no metadata size, got: %d", received.MetadataSize)
+				}
+				return
+			}
+			info, err := tor.Info()
+			if err != nil {
+				t.Fatalf("unable to get info: %v", err)
+			}
+			if received.MetadataSize != len(info) {
+				t.Errorf("expected metadata size %d, got: %d", len(info), received.MetadataSize)
+			}
+		})
+	}
+}
+
+func TestHandleExtended(t *testing.T) {
+	tor := newTestTorrent(t, "test", false)
+
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"empty", nil, false},
+		{"handshake", append([]byte{ExtendedHandshakeId}, "d1:md3:fooi5eee"...), true},
+		{"malformed handshake", append([]byte{ExtendedHandshakeId}, "d1:m"...), false},
+		{"unknown extension", []byte{200, 1, 2, 3}, true},
+		{"malformed metadata message", []byte{UtMetadataId, 'x'}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := peer.NewPeer("127.0.0.1", 6881)
+
+			err := handleExtended(p, tor, tt.data)
+			if tt.ok && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if !tt.ok && err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+}
+
+func TestRegisterExtension(t *testing.T) {
+	tests := []struct {
+		name string
+		id   byte
+	}{
+		{"handshake id", ExtendedHandshakeId},
+		{"same id", UtMetadataId},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expected a panic")
+				}
+			}()
+			RegisterExtension("test", tt.id, nil)
+		})
+	}
+}
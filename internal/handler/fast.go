@@ -0,0 +1,237 @@
+// Contains logic related to the fast extension which lets remote peers reject
+// requests and download a few pieces while they are choked.
+// See http://www.bittorrent.org/beps/bep_0006.html
+package handler
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/jmatss/torc/internal/peer"
+	"github.com/jmatss/torc/internal/torrent"
+	bt "github.com/jmatss/torc/internal/util/bittorrent"
+	"github.com/jmatss/torc/internal/util/logger"
+)
+
+const (
+	// The amount of pieces in the allowed fast set sent to remote peers.
+	AllowedFastSetSize = 10
+	// The max amount of suggested and allowed fast pieces that are remembered
+	// from a remote peer. Any pieces above this amount are ignored.
+	MaxFastPieces = 32
+)
+
+// Returns the allowed fast set of the remote peer with the IPv4 address "ip"
+// according to the canonical algorithm of BEP 6. The set only depends on the
+// ip, info hash and amount of pieces, so both peers are able to calculate it.
+func allowedFastSet(ip net.IP, infoHash [sha1.Size]byte, amountOfPieces uint32, k int) []uint32 {
+	if uint32(k) > amountOfPieces {
+		k = int(amountOfPieces)
+	}
+
+	// x = (0xFFFFFF00 & ip) + info hash
+	x := make([]byte, 0, net.IPv4len+sha1.Size)
+	x = append(x, ip[0], ip[1], ip[2], 0)
+	x = append(x, infoHash[:]...)
+
+	set := make([]uint32, 0, k)
+	contains := make(map[uint32]bool, k)
+	for len(set) < k {
+		hash := sha1.Sum(x)
+		x = hash[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			pieceIndex := binary.BigEndian.Uint32(x[i*4:]) % amountOfPieces
+			if !contains[pieceIndex] {
+				contains[pieceIndex] = true
+				set = append(set, pieceIndex)
+			}
+		}
+	}
+	return set
+}
+
+// Calculates the allowed fast set of the remote peer and sends it to the remote
+// peer. Requests for pieces in the set are served even if the remote peer is
+// choked, which lets new peers get started before they are un choked.
+//
+// Nothing is sent to remote peers without an IPv4 address since BEP 6 only
+// specifies the set for IPv4.
+func sendAllowedFast(p *peer.Peer, tor *torrent.Torrent) error {
+	ip := p.Ip.To4()
+	if !p.UsingIp || ip == nil || len(tor.Pieces) == 0 {
+		return nil
+	}
+
+	set := allowedFastSet(ip, tor.Tracker.InfoHash, uint32(len(tor.Pieces)), AllowedFastSetSize)
+
+	p.Lock()
+	p.AllowedFast = make(map[uint32]bool, len(set))
+	for _, pieceIndex := range set {
+		p.AllowedFast[pieceIndex] = true
+	}
+	p.Unlock()
+
+	for _, pieceIndex := range set {
+		if err := p.Send(bt.AllowedFast, pieceIndex); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Tells the remote peer that its request won't be answered. Remote peers that
+// doesn't support the fast extension aren't told anything, their requests are
+// silently dropped.
+func rejectRequest(p *peer.Peer, req request) error {
+	if !p.SupportsFast {
+		return nil
+	}
+
+	logger.Log(logger.High, "rejecting request from %s: index: %d, begin: %d",
+		p.HostAndPort, req.Index, req.Begin)
+
+	return p.Send(bt.RejectRequest, req.Index, req.Begin, req.Length)
+}
+
+// Handles the messages of the fast extension received from the remote peer:
+// SuggestPiece, HaveAll, HaveNone, RejectRequest and AllowedFast.
+//
+// Returns an error if the remote peer hasn't negotiated the fast extension or
+// if the message is incorrect, the connection should be closed in that case.
+func handleFast(tor *torrent.Torrent, p *peer.Peer, received remoteDTO) error {
+	if !p.SupportsFast {
+		return fmt.Errorf("received \"%s\" message from remote peer %s that doesn't "+
+			"support the fast extension", received.Id.String(), p.HostAndPort)
+	}
+
+	switch received.Id {
+	case bt.HaveAll, bt.HaveNone:
+		if len(received.Data) != 0 {
+			return fmt.Errorf("incorrect length of %s message, expected: 0, got: %d",
+				received.Id.String(), len(received.Data))
+		}
+		setHaveAll(tor, p, received.Id == bt.HaveAll)
+
+	case bt.SuggestPiece, bt.AllowedFast:
+		if len(received.Data) != 4 {
+			return fmt.Errorf("incorrect length of %s message, expected: 4, got: %d",
+				received.Id.String(), len(received.Data))
+		}
+		pieceIndex := binary.BigEndian.Uint32(received.Data)
+		if int(pieceIndex) >= len(tor.Pieces) {
+			return fmt.Errorf("the remote peer has specified a piece index in a %s message "+
+				"that is to big: %d", received.Id.String(), pieceIndex)
+		}
+
+		p.Lock()
+		defer p.Unlock()
+		if received.Id == bt.SuggestPiece {
+			if p.Suggested == nil {
+				p.Suggested = make(map[uint32]bool)
+			}
+			if len(p.Suggested) < MaxFastPieces {
+				p.Suggested[pieceIndex] = true
+			}
+		} else {
+			if p.RemoteAllowedFast == nil {
+				p.RemoteAllowedFast = make(map[uint32]bool)
+			}
+			if len(p.RemoteAllowedFast) < MaxFastPieces {
+				p.RemoteAllowedFast[pieceIndex] = true
+			}
+		}
+
+	case bt.RejectRequest:
+		if len(received.Data) != 12 {
+			return fmt.Errorf("incorrect length of %s message, expected: 12, got: %d",
+				received.Id.String(), len(received.Data))
+		}
+	}
+
+	return nil
+}
+
+// Replaces the RemoteBitField with a bitfield where every piece is set if "all"
+// is true, or with a bitfield where no piece is set if "all" is false.
+func setHaveAll(tor *torrent.Torrent, p *peer.Peer, all bool) {
+	bitField := make([]byte, tor.BitFieldLength())
+	if all {
+		for i := 0; i < len(tor.Pieces); i++ {
+			bitField[i/8] |= 1 << (7 - uint(i%8))
+		}
+	}
+	setBitField(tor, p, bitField)
+}
+
+// Returns a copy of the RemoteBitField that only contains the pieces that can
+// be requested from the remote peer. Only the pieces in the allowed fast set
+// can be requested while the remote peer is choking this client, and pieces in
+// "rejected" are never requested.
+//
+// Returns false if no pieces can be requested.
+func requestableBitField(p *peer.Peer, rejected map[uint32]bool) ([]byte, bool) {
+	p.RLock()
+	defer p.RUnlock()
+
+	if p.PeerChoking && len(p.RemoteAllowedFast) == 0 {
+		return nil, false
+	}
+
+	bitField := make([]byte, len(p.RemoteBitField))
+	if p.PeerChoking {
+		for pieceIndex := range p.RemoteAllowedFast {
+			if hasPiece(p.RemoteBitField, pieceIndex) {
+				bitField[pieceIndex/8] |= 1 << (7 - pieceIndex%8)
+			}
+		}
+	} else {
+		copy(bitField, p.RemoteBitField)
+	}
+
+	for pieceIndex := range rejected {
+		if int(pieceIndex/8) < len(bitField) {
+			bitField[pieceIndex/8] &^= 1 << (7 - pieceIndex%8)
+		}
+	}
+
+	return bitField, true
+}
+
+// Picks a new piece to download from the remote peer. Pieces that the remote
+// peer has suggested are picked first if possible.
+func pickPiece(
+	t *torrent.Torrent,
+	p *peer.Peer,
+	bitField []byte,
+	active map[uint32]*torrent.Piece,
+) (*torrent.Piece, bool) {
+	p.RLock()
+	var suggested []byte
+	if len(p.Suggested) > 0 {
+		suggested = make([]byte, len(bitField))
+		for pieceIndex := range p.Suggested {
+			if hasPiece(bitField, pieceIndex) {
+				suggested[pieceIndex/8] |= 1 << (7 - pieceIndex%8)
+			}
+		}
+	}
+	p.RUnlock()
+
+	if suggested != nil {
+		if piece, ok := t.Picker.Pick(suggested, active); ok {
+			return piece, true
+		}
+	}
+	return t.Picker.Pick(bitField, active)
+}
+
+// Returns true if the piece with index "pieceIndex" is set in the bitfield.
+func hasPiece(bitField []byte, pieceIndex uint32) bool {
+	byteIndex := pieceIndex / 8
+	if int(byteIndex) >= len(bitField) {
+		return false
+	}
+	return bitField[byteIndex]&(1<<(7-pieceIndex%8)) != 0
+}
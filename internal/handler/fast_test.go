@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/jmatss/torc/internal/peer"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	var infoHash [sha1.Size]byte
+	copy(infoHash[:], bytes.Repeat([]byte{0xaa}, sha1.Size))
+
+	tests := []struct {
+		name           string
+		ip             string
+		amountOfPieces uint32
+		k              int
+		expected       []uint32
+	}{
+		// The test vectors of BEP 6.
+		{"bep 6 k=7", "80.4.4.200", 1313, 7, []uint32{1059, 431, 808, 1217, 287, 376, 1188}},
+		{"bep 6 k=9", "80.4.4.200", 1313, 9, []uint32{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}},
+		// Only the first three bytes of the ip are used.
+		{"same /24", "80.4.4.1", 1313, 7, []uint32{1059, 431, 808, 1217, 287, 376, 1188}},
+		{"no pieces wanted", "80.4.4.200", 1313, 0, []uint32{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := allowedFastSet(net.ParseIP(tt.ip).To4(), infoHash, tt.amountOfPieces, tt.k)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected: %v, got: %v", tt.expected, got)
+			}
+		})
+	}
+
+	// A set larger than the torrent contains every piece once.
+	got := allowedFastSet(net.ParseIP("80.4.4.200").To4(), infoHash, 5, AllowedFastSetSize)
+	seen := make(map[uint32]bool)
+	for _, pieceIndex := range got {
+		if pieceIndex >= 5 || seen[pieceIndex] {
+			t.Fatalf("expected every piece of a small torrent once, got: %v", got)
+		}
+		seen[pieceIndex] = true
+	}
+	if len(seen) != 5 {
+		t.Fatalf("expected every piece of a small torrent once, got: %v", got)
+	}
+}
+
+func TestRequestableBitField(t *testing.T) {
+	tests := []struct {
+		name        string
+		choking     bool
+		allowedFast []uint32
+		rejected    []uint32
+		expected    []byte // nil if nothing can be requested
+	}{
+		{"unchoked", false, nil, nil, []byte{0xf0, 0x80}},
+		{"unchoked with rejected", false, nil, []uint32{0, 8}, []byte{0x70, 0x00}},
+		{"choked", true, nil, nil, nil},
+		{"choked with allowed fast", true, []uint32{1, 5, 8}, nil, []byte{0x40, 0x80}},
+		{"choked with rejected allowed fast", true, []uint32{1, 8}, []uint32{1}, []byte{0x00, 0x80}},
+		{"rejected outside of bitfield", false, nil, []uint32{100}, []byte{0xf0, 0x80}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := peer.NewPeer("127.0.0.1", 6881)
+			// The remote peer has the pieces 0-3 and 8.
+			p.RemoteBitField = []byte{0xf0, 0x80}
+			p.PeerChoking = tt.choking
+			p.RemoteAllowedFast = make(map[uint32]bool)
+			for _, pieceIndex := range tt.allowedFast {
+				p.RemoteAllowedFast[pieceIndex] = true
+			}
+			rejected := make(map[uint32]bool)
+			for _, pieceIndex := range tt.rejected {
+				rejected[pieceIndex] = true
+			}
+
+			bitField, ok := requestableBitField(p, rejected)
+			if tt.expected == nil {
+				if ok {
+					t.Fatalf("expected nothing to be requestable, got: %08b", bitField)
+				}
+				return
+			} else if !ok {
+				t.Fatalf("expected %08b, got nothing", tt.expected)
+			}
+			if !bytes.Equal(bitField, tt.expected) {
+				t.Fatalf("expected: %08b, got: %08b", tt.expected, bitField)
+			}
+			if !bytes.Equal(p.RemoteBitField, []byte{0xf0, 0x80}) {
+				t.Fatalf("the RemoteBitField was modified")
+			}
+		})
+	}
+}
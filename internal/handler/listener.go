@@ -0,0 +1,136 @@
+// Contains logic related to accepting incoming connections from remote peers.
+package handler
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/jmatss/torc/internal/peer"
+	"github.com/jmatss/torc/internal/util/com"
+	"github.com/jmatss/torc/internal/util/logger"
+)
+
+// Listener in charge of accepting connections from remote peers on the
+// specified port.
+//
+// Every accepted connection has its handshake received and is then sent to the
+// parent as a com.Incoming message containing the new Peer and the info hash
+// specified by the remote peer (in "Data"). The parent is responsible for routing
+// the peer to the correct torrent handler, or closing the connection if no
+// such torrent exists.
+func Listener(comParent *com.Channel, childId string, port int) {
+	// Listens on both IPv4 and IPv6 (if the host supports it) since no IP
+	// address is specified.
+	listener, err := net.Listen(peer.Protocol, ":"+strconv.Itoa(port))
+	if err != nil {
+		comParent.SendParent(com.TotalFailure, nil, err, nil, childId)
+		return
+	}
+	defer listener.Close()
+
+	comParent.AddChild(childId)
+	defer comParent.RemoveChild(childId)
+
+	logger.Log(logger.Low, "peer.Listener listening on %s", listener.Addr().String())
+
+	/*
+		Spawn go processes that accepts connections and puts them into the
+		"acceptChannel" (TCP) and "utpAcceptChannel" (uTP, listening on the
+		same port number but on UDP). They exit when the Listener exits or
+		when the listener/socket is closed.
+	*/
+	quit := make(chan struct{})
+	defer close(quit)
+
+	acceptChannel := make(chan net.Conn, com.ChanSize)
+	go accept(listener, acceptChannel, quit)
+
+	var utpAcceptChannel chan net.Conn
+	if peer.UTPSocket != nil {
+		utpAcceptChannel = make(chan net.Conn, com.ChanSize)
+		go accept(peer.UTPSocket, utpAcceptChannel, quit)
+	}
+
+	for {
+		select {
+		case received := <-comParent.GetChildChannel(childId):
+			/*
+				Received message from "controller"/parent.
+			*/
+			switch received.Id {
+			case com.Quit:
+				return
+			}
+
+		case conn, ok := <-acceptChannel:
+			/*
+				Received new connection from a remote peer.
+			*/
+			if !ok {
+				err := fmt.Errorf("stopped accepting connections on %s", listener.Addr().String())
+				comParent.SendParent(com.TotalFailure, nil, err, nil, childId)
+				return
+			}
+
+			// Receive the handshake in a separate go process so that a slow
+			// remote peer can't block other incoming connections.
+			go receiveIncoming(comParent, childId, conn)
+
+		case conn, ok := <-utpAcceptChannel:
+			/*
+				Received new uTP connection from a remote peer.
+			*/
+			if !ok {
+				// Keep accepting TCP connections. A nil channel is never selected.
+				logger.Log(logger.Low, "stopped accepting uTP connections")
+				utpAcceptChannel = nil
+				continue
+			}
+
+			go receiveIncoming(comParent, childId, conn)
+		}
+	}
+}
+
+// Accepts connections from "listener" and puts them into "acceptChannel".
+// Closes the channel and returns when the listener is closed or when "quit"
+// is closed.
+func accept(listener net.Listener, acceptChannel chan<- net.Conn, quit <-chan struct{}) {
+	defer close(acceptChannel)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			logger.Log(logger.High, "accept func exiting, err: %v", err)
+			return
+		}
+
+		select {
+		case acceptChannel <- conn:
+		case <-quit:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// Receives the handshake of the new connection "conn" and sends the peer to
+// the parent as a com.Incoming message.
+func receiveIncoming(comParent *com.Channel, childId string, conn net.Conn) {
+	p, infoHash, err := peer.RecvHandshake(conn)
+	if err != nil {
+		logger.Log(logger.High, "unable to receive handshake from %s: %v",
+			conn.RemoteAddr().String(), err)
+		conn.Close()
+		return
+	}
+
+	msg := com.Message{
+		Id:   com.Incoming,
+		Peer: p,
+		Data: infoHash[:],
+	}
+	if ok := comParent.SendParentCopy(msg, childId); !ok {
+		conn.Close()
+	}
+}
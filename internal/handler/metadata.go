@@ -0,0 +1,330 @@
+// Contains logic related to exchanging the metadata of torrents with remote peers.
+// See http://www.bittorrent.org/beps/bep_0009.html and
+// http://www.bittorrent.org/beps/bep_0010.html
+package handler
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"time"
+
+	"github.com/jmatss/torc/internal/peer"
+	"github.com/jmatss/torc/internal/torrent"
+	bt "github.com/jmatss/torc/internal/util/bittorrent"
+	"github.com/jmatss/torc/internal/util/com"
+	"github.com/jmatss/torc/internal/util/logger"
+)
+
+const (
+	UtMetadata = "ut_metadata"
+	// The extended message id that remote peers should use when sending
+	// ut_metadata messages to this client.
+	UtMetadataId byte = 1
+
+	// The metadata is sent in pieces of this size, the last one might be smaller.
+	MetadataPieceSize = 16 * 1024
+	// Remote peers that claims that the metadata is larger than this are ignored.
+	MaxMetadataSize = 8 * 1024 * 1024
+
+	// How long to wait for the metadata from a remote peer before giving up on it.
+	MetadataTimeout = 1 * time.Minute
+)
+
+// The "msg_type" of ut_metadata messages.
+const (
+	metadataRequest = iota
+	metadataData
+	metadataReject
+)
+
+// The bencoded dictionary at the start of a ut_metadata message.
+type metadataMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// The metadata being downloaded from a remote peer.
+type metadataDownload struct {
+	buffer   []byte
+	received []bool
+	left     int
+}
+
+func init() {
+	RegisterExtension(UtMetadata, UtMetadataId, handleMetadata)
+}
+
+// Handles the ut_metadata messages received after the metadata is known.
+// Requests are answered, the other message types are ignored.
+func handleMetadata(p *peer.Peer, tor *torrent.Torrent, payload []byte) error {
+	msgType, piece, _, err := parseMetadataMessage(payload)
+	if err != nil {
+		return err
+	} else if msgType == metadataRequest {
+		return serveMetadata(p, tor, piece)
+	}
+	return nil
+}
+
+// Parses a ut_metadata message.
+// Format: <bencoded dictionary>[<piece of metadata>]
+// Returns the "msg_type", "piece" and the piece of metadata (if any).
+func parseMetadataMessage(payload []byte) (int, int, []byte, error) {
+	dict, length, err := torrent.ParsePrefix(payload)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("unable to parse ut_metadata message: %w", err)
+	}
+
+	msgType, err := dict.GetInt("msg_type")
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("incorrect ut_metadata message: %w", err)
+	}
+	piece, err := dict.GetInt("piece")
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("incorrect ut_metadata message: %w", err)
+	} else if piece < 0 {
+		return 0, 0, nil, fmt.Errorf("incorrect piece in ut_metadata message: %d", piece)
+	}
+
+	return int(msgType), int(piece), payload[length:], nil
+}
+
+// Sends a ut_metadata message to the remote peer. "totalSize" and "data" are
+// only used by messages with the type metadataData.
+func sendMetadataMessage(p *peer.Peer, msgType, piece, totalSize int, data []byte) error {
+	msg := metadataMessage{MsgType: msgType, Piece: piece}
+	if msgType == metadataData {
+		msg.TotalSize = totalSize
+	}
+	dict, err := torrent.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("unable to encode ut_metadata message: %w", err)
+	}
+
+	payload := make([]byte, 0, len(dict)+len(data))
+	payload = append(payload, dict...)
+	payload = append(payload, data...)
+
+	return p.SendExtended(UtMetadata, payload)
+}
+
+// Answers a ut_metadata request from the remote peer with a piece of the
+// metadata. The request is rejected if this client doesn't have the metadata.
+func serveMetadata(p *peer.Peer, tor *torrent.Torrent, piece int) error {
+	info, err := tor.Info()
+	if err != nil || piece*MetadataPieceSize >= len(info) {
+		return sendMetadataMessage(p, metadataReject, piece, 0, nil)
+	}
+
+	end := (piece + 1) * MetadataPieceSize
+	if end > len(info) {
+		end = len(info)
+	}
+	return sendMetadataMessage(p, metadataData, piece, len(info), info[piece*MetadataPieceSize:end])
+}
+
+// Requests all pieces of the metadata from the remote peer.
+func requestMetadata(p *peer.Peer) (*metadataDownload, error) {
+	p.RLock()
+	size := p.MetadataSize
+	p.RUnlock()
+
+	if !p.SupportsExtension(UtMetadata) {
+		return nil, fmt.Errorf("the remote peer doesn't support %s", UtMetadata)
+	} else if size <= 0 || size > MaxMetadataSize {
+		return nil, fmt.Errorf("incorrect metadata size, expected: 1-%d, got: %d",
+			MaxMetadataSize, size)
+	}
+
+	amountOfPieces := (size + MetadataPieceSize - 1) / MetadataPieceSize
+	download := &metadataDownload{
+		buffer:   make([]byte, size),
+		received: make([]bool, amountOfPieces),
+		left:     amountOfPieces,
+	}
+
+	for piece := 0; piece < amountOfPieces; piece++ {
+		if err := sendMetadataMessage(p, metadataRequest, piece, 0, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return download, nil
+}
+
+// Adds a received piece of the metadata. Returns true if all pieces have been
+// received.
+func (md *metadataDownload) put(piece int, data []byte) (bool, error) {
+	if piece >= len(md.received) {
+		return false, fmt.Errorf("received metadata piece %d outside of the metadata", piece)
+	}
+
+	start := piece * MetadataPieceSize
+	length := MetadataPieceSize
+	if start+length > len(md.buffer) {
+		length = len(md.buffer) - start
+	}
+	if len(data) != length {
+		return false, fmt.Errorf("received metadata piece %d with incorrect length, "+
+			"expected: %d, got: %d", piece, length, len(data))
+	}
+
+	if !md.received[piece] {
+		copy(md.buffer[start:], data)
+		md.received[piece] = true
+		md.left--
+	}
+
+	return md.left == 0, nil
+}
+
+// Downloads the metadata of the torrent from the remote peer. The downloaded
+// metadata is verified against the info hash and sent to the torrent handler.
+// Returns when the torrent handler has set the metadata of the torrent, which
+// might have been downloaded from another remote peer.
+//
+// The Bitfield and Have messages received during this time can't be handled
+// since the amount of pieces isn't known. They are returned so that they can
+// be handled when the metadata is known.
+//
+// Returns false if the peer handler should exit.
+func fetchMetadata(
+	comTorrentHandler *com.Channel,
+	childId string,
+	readChannel chan remoteDTO,
+	tor *torrent.Torrent,
+	p *peer.Peer,
+) ([]remoteDTO, bool) {
+	p.RLock()
+	supportsExtensions := p.SupportsExtensions
+	p.RUnlock()
+	if !supportsExtensions {
+		logger.Log(logger.High, "remote peer %s doesn't support extensions, "+
+			"unable to fetch metadata", p.HostAndPort)
+		return nil, false
+	}
+
+	var download *metadataDownload
+	stash := make([]remoteDTO, 0)
+
+	timeout := time.NewTimer(MetadataTimeout)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case <-tor.MetadataReady():
+			return stash, true
+
+		case received := <-comTorrentHandler.GetChildChannel(childId):
+			/*
+				Received message from "torrentHandler"/parent.
+			*/
+			switch received.Id {
+			case com.Choke, com.UnChoke, com.Interested, com.NotInterested:
+				if err := setState(p, received.Id); err != nil {
+					return nil, false
+				}
+			case com.UploadLimit, com.DownloadLimit:
+				if err := setLimit(p, received.Id, received.Data); err != nil {
+					logger.Log(logger.High, "unable to set limit of remote peer \"%s\": %v",
+						p.HostAndPort, err)
+				}
+			case com.Quit:
+				return nil, false
+			}
+
+		case received := <-readChannel:
+			/*
+				Received message from remote peer.
+			*/
+			if received.Err != nil {
+				return nil, false
+			}
+
+			switch received.Id {
+			case bt.Choke, bt.UnChoke:
+				p.Lock()
+				p.PeerChoking = received.Id == bt.Choke
+				p.Unlock()
+			case bt.Interested, bt.NotInterested:
+				p.Lock()
+				p.PeerInterested = received.Id == bt.Interested
+				p.Unlock()
+			case bt.Bitfield, bt.Have, bt.HaveAll, bt.HaveNone, bt.SuggestPiece, bt.AllowedFast:
+				stash = append(stash, received)
+
+			case bt.Extended:
+				if len(received.Data) < 1 {
+					break
+				}
+
+				extId, payload := received.Data[0], received.Data[1:]
+				switch extId {
+				case ExtendedHandshakeId:
+					if err := recvExtendedHandshake(p, payload); err != nil {
+						logger.Log(logger.High, "remote peer %s: %v", p.HostAndPort, err)
+						return nil, false
+					}
+					if download != nil {
+						break
+					}
+
+					var err error
+					if download, err = requestMetadata(p); err != nil {
+						logger.Log(logger.High, "unable to request metadata from %s: %v",
+							p.HostAndPort, err)
+						return nil, false
+					}
+
+				case UtMetadataId:
+					msgType, piece, data, err := parseMetadataMessage(payload)
+					if err != nil {
+						logger.Log(logger.High, "remote peer %s: %v", p.HostAndPort, err)
+						return nil, false
+					}
+
+					switch msgType {
+					case metadataRequest:
+						if err := serveMetadata(p, tor, piece); err != nil {
+							return nil, false
+						}
+
+					case metadataData:
+						if download == nil {
+							break
+						}
+						done, err := download.put(piece, data)
+						if err != nil {
+							logger.Log(logger.High, "remote peer %s: %v", p.HostAndPort, err)
+							return nil, false
+						} else if !done {
+							break
+						}
+
+						if sha1.Sum(download.buffer) != tor.Tracker.InfoHash {
+							logger.Log(logger.Low, "remote peer \"%s\" sent metadata with "+
+								"incorrect hash", p.HostAndPort)
+							return nil, false
+						}
+						msg := com.Message{Id: com.Metadata, Data: download.buffer}
+						comTorrentHandler.SendParentCopy(msg, childId)
+
+						// Setting the metadata might include a recheck of existing
+						// files, don't give up on the remote peer while waiting.
+						timeout.Stop()
+
+					case metadataReject:
+						logger.Log(logger.High, "remote peer %s rejected metadata request",
+							p.HostAndPort)
+						return nil, false
+					}
+				}
+			}
+
+		case <-timeout.C:
+			logger.Log(logger.High, "no metadata received from %s in time", p.HostAndPort)
+			return nil, false
+		}
+	}
+}
@@ -0,0 +1,686 @@
+package handler
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/jmatss/torc/internal/peer"
+	"github.com/jmatss/torc/internal/torrent"
+	bt "github.com/jmatss/torc/internal/util/bittorrent"
+	"github.com/jmatss/torc/internal/util/com"
+	"github.com/jmatss/torc/internal/util/cons"
+	"github.com/jmatss/torc/internal/util/logger"
+)
+
+type remoteDTO struct {
+	Id   bt.MessageId
+	Data []byte
+	Err  error
+}
+
+// Handler in charge of one specific peer.
+// TODO: dont send torrent argument like this, ugly
+func Peer(comTorrentHandler *com.Channel, p *peer.Peer, tor *torrent.Torrent) {
+	childId := string(p.HostAndPort)
+
+	// Peer handshake. This handler will kill itself if it isn't able to
+	// complete the handshake.
+	// If the peer is incoming, the remote peer has connected to this client and
+	// its handshake has already been received by the Listener.
+	var conn net.Conn
+	var err error
+	if p.Incoming {
+		conn, err = p.AcceptHandshake(tor.Tracker.InfoHash, cons.PeerId)
+		if err != nil {
+			p.Connection.Close()
+		}
+	} else {
+		conn, err = p.Handshake(tor.Tracker.InfoHash, cons.PeerId)
+	}
+	if err != nil {
+		logger.Log(logger.High, "peer handler handshake failure!: %v", err)
+		p.ConnectFailed()
+		// The child id lets the torrent handler know that the connection
+		// attempt to this peer is over.
+		comTorrentHandler.SendParent(com.TotalFailure, nil, err, nil, childId)
+		return
+	}
+	p.ConnectSucceeded()
+	p.Connection = conn
+	p.SetLimits(tor.UploadLimit, tor.DownloadLimit)
+	defer func() {
+		p.Connection.Close()
+		logger.Log(logger.High, "peer handler exiting")
+	}()
+
+	// The torrent handler keeps track of the connected peers through the
+	// Success and Exiting messages.
+	comTorrentHandler.AddChild(childId)
+	defer comTorrentHandler.RemoveChild(childId)
+	comTorrentHandler.SendParentCopy(com.Message{Id: com.Success, Peer: p}, childId)
+
+	// Tell the remote peer which pieces this client has before anything else
+	// is sent.
+	if err := sendHaveState(p, tor); err != nil {
+		comTorrentHandler.SendParentError(com.TotalFailure, err)
+		return
+	}
+
+	// The remote peer starts out choked and not interesting. The choker in the
+	// torrent handler decides when that should change and sends a message to
+	// this handler.
+
+	if p.SupportsExtensions {
+		if err := sendExtendedHandshake(p, tor); err != nil {
+			comTorrentHandler.SendParentError(com.TotalFailure, err)
+			return
+		}
+	}
+
+	/*
+		Spawn a go process that receives data from the remote peer
+		and puts it into the "readChannel".
+	*/
+	// TODO: modify buffer size
+	// TODO: kill this go process when the peer handler exits
+	readChannel := make(chan remoteDTO, com.ChanSize)
+	go func() {
+		for {
+			id, data, err := p.Recv()
+			readChannel <- remoteDTO{id, data, err}
+
+			// Kills itself if it receives a error.
+			// The receiver of the message over the "readChannel" can check and see that
+			// "Err" is set, and figure out that this go process is dead.
+			if err != nil {
+				logger.Log(logger.High, "read func exiting, err: %v", err)
+				return
+			}
+		}
+	}()
+
+	// Torrents added from magnet links needs to get their metadata before
+	// anything can be downloaded.
+	var stash []remoteDTO
+	select {
+	case <-tor.MetadataReady():
+	default:
+		var ok bool
+		if stash, ok = fetchMetadata(comTorrentHandler, childId, readChannel, tor, p); !ok {
+			comTorrentHandler.SendParentError(com.TotalFailure,
+				fmt.Errorf("unable to get metadata from %s", p.HostAndPort))
+			return
+		}
+	}
+
+	// RemoteBitField initialized to all zeros. The pieces of the remote peer
+	// are removed from the availability in the picker when this handler exits.
+	// Bitfields received from now on must have the length of the bitfield.
+	p.Lock()
+	p.RemoteBitField = make([]byte, tor.BitFieldLength())
+	p.BitFieldLength = tor.BitFieldLength()
+	p.Unlock()
+	defer func() {
+		p.RLock()
+		tor.Picker.RemoveBitField(p.RemoteBitField)
+		p.RUnlock()
+	}()
+
+	// Handle the pieces that the remote peer announced before the metadata was known.
+	if len(stash) > 0 {
+		for _, received := range stash {
+			var err error
+			switch received.Id {
+			case bt.Bitfield:
+				setBitField(tor, p, received.Data)
+			case bt.Have:
+				_, err = addHave(tor, p, received.Data)
+			default:
+				err = handleFast(tor, p, received)
+			}
+			if err != nil {
+				comTorrentHandler.SendParentError(com.TotalFailure, err)
+				return
+			}
+		}
+		comTorrentHandler.SendParent(com.Bitfield, nil, nil, nil, childId)
+	}
+
+	// The allowed fast set can only be calculated when the amount of pieces is known.
+	if p.SupportsFast {
+		if err := sendAllowedFast(p, tor); err != nil {
+			comTorrentHandler.SendParentError(com.TotalFailure, err)
+			return
+		}
+	}
+
+	/*
+		Spawn a downloader that requests data from the remote peer.
+		This Handler will receive the data from the remote peer
+		and forward it to the downloader via the downloadChannel.
+	*/
+	downloadChannel := make(chan remoteDTO, com.ChanSize)
+	go downloader(comTorrentHandler, downloadChannel, tor, p)
+
+	/*
+		Spawn an uploader that serves the requests of the remote peer.
+		This Handler forwards the requests to the uploader via the uploadChannel.
+	*/
+	uploadChannel := make(chan remoteDTO, MaxUploadQueue)
+	go uploader(uploadChannel, tor, p)
+	defer close(uploadChannel)
+
+	pex := newPexState()
+
+	for {
+		select {
+		case received := <-comTorrentHandler.GetChildChannel(childId):
+			/*
+				Received message from "torrentHandler"/parent.
+			*/
+			switch received.Id {
+			case com.Have:
+				pieceIndex := binary.BigEndian.Uint32(received.Data)
+				p.Send(bt.Have, pieceIndex)
+
+			case com.Choke, com.UnChoke, com.Interested, com.NotInterested:
+				if err := setState(p, received.Id); err != nil {
+					logger.Log(logger.Low, "unable to send \"%s\" to remote peer \"%s\": %v",
+						received.Id.String(), p.HostAndPort, err)
+					comTorrentHandler.SendParentError(com.TotalFailure, err)
+					return
+				}
+
+				// The queued requests of a choked remote peer are discarded.
+				if received.Id == com.Choke {
+					uploadChannel <- remoteDTO{Id: bt.Choke}
+				}
+
+			case com.UploadLimit, com.DownloadLimit:
+				if err := setLimit(p, received.Id, received.Data); err != nil {
+					logger.Log(logger.High, "unable to set limit of remote peer \"%s\": %v",
+						p.HostAndPort, err)
+				}
+
+			case com.Pex:
+				if err := pex.send(p, decodePexPeers(received.Data)); err != nil {
+					logger.Log(logger.High, "unable to send %s message to remote peer \"%s\": %v",
+						UtPex, p.HostAndPort, err)
+				}
+
+			case com.Quit:
+				// TODO: Kill internal "readChannel" go process & downloader
+				return
+			}
+
+		case received := <-readChannel:
+			/*
+				Received message from remote peer.
+			*/
+			// Kills itself if it receives an error. The connection is lost, so
+			// the peer isn't connected to again until after a backoff.
+			if received.Err != nil {
+				p.ConnectFailed()
+				comTorrentHandler.SendParentError(com.TotalFailure, received.Err)
+
+				// TODO: need to kill downloader, do this in a better way
+				if received.Id == bt.Piece {
+					downloadChannel <- received
+				}
+				return
+			}
+
+			switch received.Id {
+			case bt.KeepAlive:
+				// TODO: do something?
+			case bt.Choke:
+				p.Lock()
+				p.PeerChoking = true
+				p.Unlock()
+				downloadChannel <- received
+			case bt.UnChoke:
+				p.Lock()
+				p.PeerChoking = false
+				p.Unlock()
+				downloadChannel <- received
+			case bt.Interested:
+				p.Lock()
+				p.PeerInterested = true
+				p.Unlock()
+				downloadChannel <- received
+			case bt.NotInterested:
+				p.Lock()
+				p.PeerInterested = false
+				p.Unlock()
+				downloadChannel <- received
+			case bt.Have:
+				amInterested, err := addHave(tor, p, received.Data)
+				if err != nil {
+					comTorrentHandler.SendParentError(com.TotalFailure, err)
+					return
+				}
+				downloadChannel <- received
+
+				// Let the torrent handler decide if this client has become
+				// interested in the remote peer.
+				if !amInterested {
+					comTorrentHandler.SendParent(com.Bitfield, nil, nil, nil, childId)
+				}
+
+			case bt.Bitfield:
+				if setBitField(tor, p, received.Data) {
+					downloadChannel <- received
+					comTorrentHandler.SendParent(com.Bitfield, nil, nil, nil, childId)
+				}
+
+			case bt.SuggestPiece, bt.HaveAll, bt.HaveNone, bt.RejectRequest, bt.AllowedFast:
+				if err := handleFast(tor, p, received); err != nil {
+					comTorrentHandler.SendParentError(com.TotalFailure, err)
+					return
+				}
+				downloadChannel <- received
+
+				if received.Id == bt.HaveAll || received.Id == bt.HaveNone {
+					comTorrentHandler.SendParent(com.Bitfield, nil, nil, nil, childId)
+				}
+
+			case bt.Extended:
+				if err := handleExtended(p, tor, received.Data); err != nil {
+					logger.Log(logger.High, "remote peer %s: %v", p.HostAndPort, err)
+				}
+
+			case bt.Request, bt.Cancel:
+				uploadChannel <- received
+
+			case bt.Piece:
+				if len(received.Data) > 8 {
+					p.Lock()
+					p.Downloaded += int64(len(received.Data) - 8)
+					p.Unlock()
+				}
+				downloadChannel <- received
+
+				// TODO: some sort of logging or feedback of this success.
+			default:
+				comTorrentHandler.SendParentError(
+					com.TotalFailure,
+					fmt.Errorf("unexpected message id \"%d\"", received.Id),
+				)
+				return
+			}
+		}
+	}
+}
+
+// Updates the RemoteBitField after a "have" message where the remote peer
+// indicates that it has just received a piece. Takes the data of the "have"
+// message as input: <piece index>
+//
+// Returns the AmInterested state of the peer.
+func addHave(tor *torrent.Torrent, p *peer.Peer, data []byte) (bool, error) {
+	if len(data) != 4 {
+		return false, fmt.Errorf("incorrect length of have message, "+
+			"expected: 4, got: %d", len(data))
+	}
+
+	// Update the "RemoteBitField" in this peer struct by OR:ing in a 1 at the correct index.
+	pieceIndex := binary.BigEndian.Uint32(data)
+	byteShift := pieceIndex / 8
+	bitShift := 7 - (pieceIndex % 8) // bits are stored in "reverse"
+
+	p.Lock()
+	defer p.Unlock()
+
+	if int(byteShift) >= len(p.RemoteBitField) {
+		return false, fmt.Errorf("the remote peer has specified a piece index that is to big to " +
+			"fit in it's bitfield")
+	}
+
+	if p.RemoteBitField[byteShift]&(1<<bitShift) == 0 {
+		p.RemoteBitField[byteShift] |= 1 << bitShift
+		tor.Picker.AddHave(pieceIndex)
+	}
+
+	return p.AmInterested, nil
+}
+
+// Replaces the RemoteBitField with the bitfield received from the remote peer.
+// If correct length, assume correct bitfield. Returns false if the length is
+// incorrect, in that case nothing is changed.
+func setBitField(tor *torrent.Torrent, p *peer.Peer, bitField []byte) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if len(bitField) != len(p.RemoteBitField) {
+		return false
+	}
+
+	tor.Picker.RemoveBitField(p.RemoteBitField)
+	p.RemoteBitField = bitField
+	tor.Picker.AddBitField(p.RemoteBitField)
+
+	return true
+}
+
+// Changes the choke/interested state of this client towards the remote peer and
+// sends the corresponding message to the remote peer. Nothing is sent if the
+// state already is the requested one.
+func setState(p *peer.Peer, id com.Id) error {
+	p.Lock()
+	var messageId bt.MessageId
+	changed := false
+	switch id {
+	case com.Choke:
+		messageId, changed = bt.Choke, !p.AmChoking
+		p.AmChoking = true
+	case com.UnChoke:
+		messageId, changed = bt.UnChoke, p.AmChoking
+		p.AmChoking = false
+	case com.Interested:
+		messageId, changed = bt.Interested, !p.AmInterested
+		p.AmInterested = true
+	case com.NotInterested:
+		messageId, changed = bt.NotInterested, p.AmInterested
+		p.AmInterested = false
+	}
+	p.Unlock()
+
+	if !changed {
+		return nil
+	}
+	return p.Send(messageId)
+}
+
+// Changes the upload (com.UploadLimit) or download (com.DownloadLimit) rate
+// limit of the remote peer. "data" is a limit encoded with com.EncodeLimit,
+// only limits with the scope com.LimitPeer are used.
+func setLimit(p *peer.Peer, id com.Id, data []byte) error {
+	scope, rate, err := com.DecodeLimit(data)
+	if err != nil {
+		return err
+	} else if scope != com.LimitPeer {
+		return nil
+	}
+
+	if id == com.UploadLimit {
+		p.UploadLimit.SetRate(rate)
+	} else {
+		p.DownloadLimit.SetRate(rate)
+	}
+	return nil
+}
+
+// Download pieces from this remote peer.
+//
+// Multiple requests are kept in flight at the same time (see pipeline) and
+// can span over multiple pieces. The blocks of a piece are buffered in a
+// torrent.Piece and the piece is only written to disk when all blocks have been
+// received and the sha1 hash of the whole piece is correct.
+func downloader(
+	comTorrentHandler *com.Channel,
+	downloadChannel chan remoteDTO,
+	t *torrent.Torrent,
+	p *peer.Peer,
+) {
+	p.RLock()
+	pl := newPipeline(p.MaxRequests)
+	p.RUnlock()
+
+	// The pieces that this downloader currently are downloading.
+	active := make(map[uint32]*torrent.Piece)
+	// The pieces that the remote peer has rejected requests for while it
+	// wasn't choking this client. They aren't requested again.
+	rejected := make(map[uint32]bool)
+
+	// Closing the connection makes the peer handler exit. Release all pieces
+	// that haven't been completed so that they can be downloaded from other peers.
+	defer func() {
+		p.Connection.Close()
+		releaseActive(active, t)
+	}()
+
+	// Wakes up the downloader regularly to check for timed out requests and
+	// pieces that might have been freed by other peers.
+	ticker := time.NewTicker(peer.FreePieceRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := fillPipeline(pl, active, rejected, t, p); err != nil {
+			logger.Log(logger.Low, "unable to send request to remote peer \"%s\": %v",
+				p.HostAndPort, err)
+			return
+		}
+
+		select {
+		case <-t.Picker.Notify():
+			// A block has been received by another downloader during endgame,
+			// or a piece has been completed. Cancel the requests that are
+			// no longer needed.
+			if err := cancelReceived(pl, active, t, p); err != nil {
+				logger.Log(logger.Low, "unable to send cancel to remote peer \"%s\": %v",
+					p.HostAndPort, err)
+				return
+			}
+
+		case received := <-downloadChannel:
+			if received.Err != nil {
+				return
+			}
+
+			switch received.Id {
+			case bt.Choke:
+				// The remote peer discards all requests when it chokes this client.
+				// It might not un choke this client for a long time, so the active
+				// pieces are released so that they can be downloaded from other
+				// peers. Remote peers that supports the fast extension rejects the
+				// requests explicitly instead.
+				if !p.SupportsFast {
+					pl.clear()
+					releaseActive(active, t)
+				}
+
+			case bt.RejectRequest:
+				pieceIndex := binary.BigEndian.Uint32(received.Data[:4])
+				begin := binary.BigEndian.Uint32(received.Data[4:8])
+				pl.cancel(pieceIndex, begin)
+
+				// A rejected request for a piece that can be requested means that
+				// the remote peer won't send the piece, let someone else download it.
+				p.RLock()
+				requestable := !p.PeerChoking || p.RemoteAllowedFast[pieceIndex]
+				p.RUnlock()
+				if !requestable {
+					break
+				}
+				rejected[pieceIndex] = true
+				if piece, ok := active[pieceIndex]; ok {
+					delete(active, pieceIndex)
+					t.Picker.Release(piece)
+				}
+
+			case bt.Piece:
+				if len(received.Data) < 8 {
+					break
+				}
+				pieceIndex := binary.BigEndian.Uint32(received.Data[:4])
+				begin := binary.BigEndian.Uint32(received.Data[4:8])
+
+				// Blocks that haven't been requested are ignored,
+				// they might be answers to old requests.
+				if _, ok := pl.received(pieceIndex, begin, len(received.Data)-8); !ok {
+					logger.Log(logger.High, "ignoring unrequested block from %s: "+
+						"index: %d, begin: %d", p.HostAndPort, pieceIndex, begin)
+					break
+				}
+
+				piece, ok := active[pieceIndex]
+				if !ok {
+					break
+				}
+				completed, err := piece.Put(received.Data)
+				if err != nil {
+					logger.Log(logger.High, "ignoring block from %s: %v", p.HostAndPort, err)
+					break
+				}
+				t.Picker.BlockReceived()
+				if !completed {
+					break
+				}
+
+				// The whole piece has been received, verify it against the sha1 hash
+				// and write it to disk.
+				delete(active, pieceIndex)
+				if ok := completePiece(comTorrentHandler, t, p, piece); !ok {
+					return
+				}
+			}
+
+		case <-ticker.C:
+			if pl.timedOut() {
+				// The remote peer doesn't answer the requests, let other peers
+				// download the active pieces and pick new ones.
+				logger.Log(logger.High, "requests to %s timed out", p.HostAndPort)
+				pl.clear()
+				releaseActive(active, t)
+			}
+		}
+	}
+}
+
+// Releases all pieces in "active" so that they can be downloaded from other
+// peers, and removes them from "active".
+func releaseActive(active map[uint32]*torrent.Piece, t *torrent.Torrent) {
+	for pieceIndex, piece := range active {
+		delete(active, pieceIndex)
+		t.Picker.Release(piece)
+	}
+}
+
+// Sends requests to the remote peer until the pipeline is full. Requests blocks
+// from the active pieces first and picks new pieces when there are no blocks left
+// to request in the active pieces. Only pieces in the allowed fast set are
+// requested while the remote peer is choking this client.
+func fillPipeline(
+	pl *pipeline,
+	active map[uint32]*torrent.Piece,
+	rejected map[uint32]bool,
+	t *torrent.Torrent,
+	p *peer.Peer,
+) error {
+	for pl.free() {
+		bitField, ok := requestableBitField(p, rejected)
+		if !ok {
+			return nil
+		}
+
+		pieceIndex, begin, length, ok := nextBlock(pl, active, bitField)
+		if !ok {
+			piece, ok := pickPiece(t, p, bitField, active)
+			if !ok {
+				// The remote peer doesn't have any piece that needs to be downloaded.
+				return nil
+			}
+
+			active[piece.Index] = piece
+			continue
+		}
+
+		if err := p.Send(bt.Request, pieceIndex, begin, length); err != nil {
+			return err
+		}
+		pl.add(pieceIndex, begin, length)
+	}
+
+	return nil
+}
+
+// Returns the next block in the active pieces that hasn't been received nor
+// requested. Only pieces that are set in "bitField" are considered.
+func nextBlock(
+	pl *pipeline,
+	active map[uint32]*torrent.Piece,
+	bitField []byte,
+) (uint32, uint32, uint32, bool) {
+	for pieceIndex, piece := range active {
+		if piece.Closed() || !hasPiece(bitField, pieceIndex) {
+			continue
+		}
+		for blockIndex := 0; blockIndex < piece.BlockCount(); blockIndex++ {
+			begin, length := piece.Block(blockIndex)
+			if !piece.HasBlock(begin) && !pl.has(pieceIndex, begin) {
+				return pieceIndex, begin, length, true
+			}
+		}
+	}
+	return 0, 0, 0, false
+}
+
+// Sends cancel messages for the outstanding requests of blocks that have been
+// received from other peers (during endgame) and stops downloading pieces that
+// have been completed or discarded by other downloaders.
+func cancelReceived(pl *pipeline, active map[uint32]*torrent.Piece, t *torrent.Torrent, p *peer.Peer) error {
+	for _, req := range pl.requests() {
+		piece, ok := active[req.Index]
+		if ok && !piece.Closed() && !piece.HasBlock(req.Begin) {
+			continue
+		}
+
+		pl.cancel(req.Index, req.Begin)
+		if err := p.Send(bt.Cancel, req.Index, req.Begin, req.Length); err != nil {
+			return err
+		}
+		logger.Log(logger.High, "cancelled request to %s: index: %d, begin: %d",
+			p.HostAndPort, req.Index, req.Begin)
+	}
+
+	for pieceIndex, piece := range active {
+		if piece.Closed() {
+			delete(active, pieceIndex)
+			t.Picker.Release(piece)
+		}
+	}
+
+	return nil
+}
+
+// Verifies and writes a piece where all blocks have been received. The torrent
+// handler is notified if the piece was downloaded successfully.
+//
+// Returns false if the downloader should stop downloading from this remote peer.
+func completePiece(comTorrentHandler *com.Channel, t *torrent.Torrent, p *peer.Peer, piece *torrent.Piece) bool {
+	if err := t.WritePiece(piece); err != nil {
+		if _, ok := err.(*torrent.IncorrectPieceError); ok {
+			t.Picker.Discard(piece)
+
+			// Record that this remote peer sent bad data. Stop downloading
+			// from it if it keeps on sending bad pieces.
+			p.Lock()
+			p.BadPieces++
+			badPieces := p.BadPieces
+			p.Unlock()
+
+			logger.Log(logger.Low, "remote peer \"%s\" sent bad data: %v (%d bad pieces)",
+				p.HostAndPort, err, badPieces)
+
+			return badPieces < peer.MaxBadPieces
+		}
+
+		t.Picker.Discard(piece)
+		logger.Log(logger.Low, "unable to write piece %d: %v", piece.Index, err)
+		return false
+	}
+
+	t.Picker.Complete(piece)
+
+	logger.Log(logger.High, "piece %d downloaded", piece.Index)
+
+	// Send have message to torrentHandler to let it now that a new piece is downloaded
+	// and a Have message can be sent to all peers.
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, piece.Index)
+	comTorrentHandler.SendParent(com.Have, data, nil, nil, "")
+
+	return true
+}
@@ -0,0 +1,258 @@
+// Contains logic related to exchanging peers with remote peers.
+// See http://www.bittorrent.org/beps/bep_0011.html
+package handler
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmatss/torc/internal/peer"
+	"github.com/jmatss/torc/internal/torrent"
+	"github.com/jmatss/torc/internal/util/logger"
+)
+
+const (
+	UtPex = "ut_pex"
+	// The extended message id that remote peers should use when sending
+	// ut_pex messages to this client.
+	UtPexId byte = 2
+
+	// How often the connected peers are sent to the remote peers.
+	PexInterval = 1 * time.Minute
+	// The max amount of added peers in a single ut_pex message. Any added
+	// peers above this amount are ignored.
+	MaxPexPeers = 50
+)
+
+func init() {
+	RegisterExtension(UtPex, UtPexId, handlePex)
+}
+
+// The bencoded dictionary of a ut_pex message. The peers are in the compact
+// format and the flags (see FlagSeed etc.) are given with one byte per peer.
+type pexMessage struct {
+	Added    []byte `bencode:"added"`
+	AddedF   []byte `bencode:"added.f"`
+	Added6   []byte `bencode:"added6"`
+	Added6F  []byte `bencode:"added6.f"`
+	Dropped  []byte `bencode:"dropped"`
+	Dropped6 []byte `bencode:"dropped6"`
+}
+
+// The peers that have been sent to a remote peer in ut_pex messages, indexed
+// by their "host:port". Used to only send the changes since the last message.
+type pexState struct {
+	sent map[string]bool
+}
+
+func newPexState() *pexState {
+	return &pexState{sent: make(map[string]bool)}
+}
+
+// Handles a ut_pex message received from the remote peer. The added peers are
+// merged into the peers of the torrent, the dropped peers are ignored since
+// they might still be reachable from this client.
+func handlePex(p *peer.Peer, tor *torrent.Torrent, payload []byte) error {
+	var msg pexMessage
+	if err := torrent.Unmarshal(payload, &msg); err != nil {
+		return fmt.Errorf("unable to decode ut_pex message: %w", err)
+	}
+
+	peers := make(map[string]*peer.Peer)
+	if err := addPexPeers(peers, msg.Added, msg.AddedF, net.IPv4len); err != nil {
+		return fmt.Errorf("unable to parse \"added\" in ut_pex message: %w", err)
+	}
+	if err := addPexPeers(peers, msg.Added6, msg.Added6F, net.IPv6len); err != nil {
+		return fmt.Errorf("unable to parse \"added6\" in ut_pex message: %w", err)
+	}
+
+	if n := tor.AddPeers(peers); n > 0 {
+		logger.Log(logger.High, "received %d new peers from %s", n, p.HostAndPort)
+	}
+	return nil
+}
+
+// Parses the peers in the compact format with IPs of length "ipLen" and adds
+// them to "peers" together with their flags. The flags are given in the same
+// order as the peers, peers without flags get no flags set. At most MaxPexPeers
+// peers are added in total.
+func addPexPeers(peers map[string]*peer.Peer, compact, flags []byte, ipLen int) error {
+	added, err := peer.ParseCompact(compact, ipLen)
+	if err != nil {
+		return err
+	}
+
+	groupLen := ipLen + 2
+	for i := 0; i*groupLen < len(compact) && len(peers) < MaxPexPeers; i++ {
+		hostAndPort := compactHostAndPort(compact[i*groupLen:(i+1)*groupLen], ipLen)
+		newPeer, ok := added[hostAndPort]
+		if !ok {
+			continue
+		}
+		if i < len(flags) {
+			newPeer.Flags = flags[i]
+		}
+		peers[hostAndPort] = newPeer
+	}
+	return nil
+}
+
+// Sends a ut_pex message to the remote peer containing the changes since the
+// last sent message. "connected" contains the "host:port" of every peer that
+// is connected to this client mapped to its flags, see pexFlags. Nothing is
+// sent if there are no changes or if the remote peer doesn't support ut_pex.
+func (ps *pexState) send(p *peer.Peer, connected map[string]byte) error {
+	if !p.SupportsExtension(UtPex) {
+		return nil
+	}
+
+	self, _ := p.ReachableAt()
+
+	// Peers that doesn't fit in this message are sent in the next one.
+	var added, addedF, added6, added6F, dropped, dropped6 []byte
+	sent := make(map[string]bool, len(connected))
+	current := make(map[string]bool, len(connected))
+	for hostAndPort, flags := range connected {
+		if hostAndPort == self || hostAndPort == p.HostAndPort {
+			continue
+		}
+		current[hostAndPort] = true
+		if ps.sent[hostAndPort] {
+			sent[hostAndPort] = true
+			continue
+		} else if len(added)/(net.IPv4len+2)+len(added6)/(net.IPv6len+2) >= MaxPexPeers {
+			continue
+		}
+
+		compact, ok := compactAddress(hostAndPort)
+		if !ok {
+			continue
+		} else if len(compact) == net.IPv4len+2 {
+			added = append(added, compact...)
+			addedF = append(addedF, flags)
+		} else {
+			added6 = append(added6, compact...)
+			added6F = append(added6F, flags)
+		}
+		sent[hostAndPort] = true
+	}
+
+	for hostAndPort := range ps.sent {
+		if current[hostAndPort] {
+			continue
+		}
+		if compact, ok := compactAddress(hostAndPort); !ok {
+			continue
+		} else if len(compact) == net.IPv4len+2 {
+			dropped = append(dropped, compact...)
+		} else {
+			dropped6 = append(dropped6, compact...)
+		}
+	}
+
+	if len(added)+len(added6)+len(dropped)+len(dropped6) == 0 {
+		return nil
+	}
+
+	payload, err := torrent.Marshal(pexMessage{
+		Added:    added,
+		AddedF:   addedF,
+		Added6:   added6,
+		Added6F:  added6F,
+		Dropped:  dropped,
+		Dropped6: dropped6,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to encode ut_pex message: %w", err)
+	}
+
+	if err := p.SendExtended(UtPex, payload); err != nil {
+		return err
+	}
+	ps.sent = sent
+
+	return nil
+}
+
+// Returns the flags of the connected remote peer "p" that are sent to other
+// remote peers in ut_pex messages.
+func pexFlags(tor *torrent.Torrent, p *peer.Peer) byte {
+	p.RLock()
+	defer p.RUnlock()
+
+	var flags byte
+	if p.Encrypted {
+		flags |= peer.FlagPrefersEncryption
+	}
+	if p.UTP {
+		flags |= peer.FlagUTP
+	}
+
+	seed := tor.HasMetadata()
+	for i := 0; seed && i < len(tor.Pieces); i++ {
+		seed = hasPiece(p.RemoteBitField, uint32(i))
+	}
+	if seed {
+		flags |= peer.FlagSeed
+	}
+
+	return flags
+}
+
+// Encodes the "host:port" and flags of the connected peers into a format that
+// can be sent in the "Data" field of a com.Pex message, one peer per line:
+// "<host:port> <flags>".
+func encodePexPeers(connected map[string]byte) []byte {
+	lines := make([]string, 0, len(connected))
+	for hostAndPort, flags := range connected {
+		lines = append(lines, hostAndPort+" "+strconv.Itoa(int(flags)))
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// Decodes peers encoded with encodePexPeers. Malformed lines are skipped.
+func decodePexPeers(data []byte) map[string]byte {
+	connected := make(map[string]byte)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[1], 10, 8)
+		if err != nil {
+			continue
+		}
+		connected[fields[0]] = byte(flags)
+	}
+	return connected
+}
+
+// Converts a "host:port" into the compact format: <IP(4B or 16B)><port(2B)>.
+// Returns false if the host isn't an IP address.
+func compactAddress(hostAndPort string) ([]byte, bool) {
+	host, portString, err := net.SplitHostPort(hostAndPort)
+	if err != nil {
+		return nil, false
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if ip == nil || err != nil {
+		return nil, false
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return append(ip, byte(port>>8), byte(port)), true
+}
+
+// Returns the "host:port" of a peer in the compact format, the same as the
+// key used by ParseCompact.
+func compactHostAndPort(compact []byte, ipLen int) string {
+	ip := net.IP(compact[:ipLen])
+	port := uint16(compact[ipLen])<<8 | uint16(compact[ipLen+1])
+	return peer.NewPeer(ip.String(), port).HostAndPort
+}
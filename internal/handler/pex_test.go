@@ -0,0 +1,186 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/jmatss/torc/internal/peer"
+	"github.com/jmatss/torc/internal/torrent"
+	bt "github.com/jmatss/torc/internal/util/bittorrent"
+)
+
+// Sends a ut_pex message containing "connected" and returns the payload of the
+// message. Returns nil if no message was sent.
+func sendPex(t *testing.T, ps *pexState, connected map[string]byte) []byte {
+	p, remote := newTestPeer()
+	defer remote.Close()
+	p.Extensions = map[string]byte{UtPex: UtPexId}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- ps.send(p, connected)
+		p.Connection.Close()
+	}()
+
+	// The connection is closed without a message if nothing was sent.
+	var payload []byte
+	var lenPrefix [4]byte
+	if _, err := io.ReadFull(remote, lenPrefix[:]); err == nil {
+		data := make([]byte, binary.BigEndian.Uint32(lenPrefix[:]))
+		if _, err := io.ReadFull(remote, data); err != nil {
+			t.Fatalf("unable to read message: %v", err)
+		}
+		if len(data) < 2 || bt.MessageId(data[0]) != bt.Extended || data[1] != UtPexId {
+			t.Fatalf("expected an extended ut_pex message, got: %v", data)
+		}
+		payload = data[2:]
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("unable to send ut_pex message: %v", err)
+	}
+	return payload
+}
+
+func TestPexRoundTrip(t *testing.T) {
+	connected := map[string]byte{
+		"10.0.0.1:6881":      peer.FlagPrefersEncryption,
+		"10.0.0.2:6882":      peer.FlagSeed | peer.FlagUTP,
+		"[2001:db8::1]:6883": peer.FlagUTP,
+		"127.0.0.1:6881":     peer.FlagSeed, // The receiver of the message.
+	}
+
+	ps := newPexState()
+	payload := sendPex(t, ps, decodePexPeers(encodePexPeers(connected)))
+	if payload == nil {
+		t.Fatalf("expected a ut_pex message to be sent")
+	}
+
+	tor := newTestTorrent(t, "test", false)
+	p, _ := newTestPeer()
+	if err := handlePex(p, tor, payload); err != nil {
+		t.Fatalf("unable to handle ut_pex message: %v", err)
+	}
+
+	if len(tor.Tracker.Peers) != 3 {
+		t.Fatalf("expected: 3 peers, got: %d", len(tor.Tracker.Peers))
+	}
+	for hostAndPort, flags := range connected {
+		if hostAndPort == p.HostAndPort {
+			continue
+		}
+		added, ok := tor.Tracker.Peers[hostAndPort]
+		if !ok {
+			t.Fatalf("expected peer %s, got: %v", hostAndPort, tor.Tracker.Peers)
+		} else if added.Flags != flags {
+			t.Errorf("flags of %s, expected: %08b, got: %08b", hostAndPort, flags, added.Flags)
+		}
+	}
+
+	// Nothing has changed, so nothing should be sent.
+	if payload := sendPex(t, ps, connected); payload != nil {
+		t.Fatalf("expected no ut_pex message, got: %q", payload)
+	}
+
+	// A peer that has disconnected should be dropped.
+	delete(connected, "10.0.0.1:6881")
+	payload = sendPex(t, ps, connected)
+	var msg pexMessage
+	if err := torrent.Unmarshal(payload, &msg); err != nil {
+		t.Fatalf("unable to decode ut_pex message: %v", err)
+	}
+	expected := []byte{10, 0, 0, 1, 0x1a, 0xe1}
+	if !bytes.Equal(msg.Dropped, expected) || len(msg.Added) != 0 {
+		t.Fatalf("expected dropped: %v and nothing added, got: %v, %v", expected, msg.Dropped, msg.Added)
+	}
+}
+
+func TestHandlePex(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		flags   map[string]byte
+		ok      bool
+	}{
+		{
+			"added with flags",
+			"d5:added12:\x0a\x00\x00\x01\x1a\xe1\x0a\x00\x00\x02\x1a\xe27:added.f2:\x01\x04e",
+			map[string]byte{"10.0.0.1:6881": peer.FlagPrefersEncryption, "10.0.0.2:6882": peer.FlagUTP},
+			true,
+		},
+		{
+			"missing flags",
+			"d5:added12:\x0a\x00\x00\x01\x1a\xe1\x0a\x00\x00\x02\x1a\xe27:added.f1:\x02e",
+			map[string]byte{"10.0.0.1:6881": peer.FlagSeed, "10.0.0.2:6882": 0},
+			true,
+		},
+		{"empty", "de", map[string]byte{}, true},
+		{"not a dictionary", "li1ee", nil, false},
+		{"incomplete", "d5:added6:\x0a\x00\x00\x01", nil, false},
+		{"added not a string", "d5:addedi1ee", nil, false},
+		{"flags not a string", "d5:added6:\x0a\x00\x00\x01\x1a\xe17:added.fi1ee", nil, false},
+		{"incorrect length of added", "d5:added5:\x0a\x00\x00\x01\x1ae", nil, false},
+		{"incorrect length of added6", "d6:added66:\x0a\x00\x00\x01\x1a\xe1e", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tor := newTestTorrent(t, "test", false)
+			p, _ := newTestPeer()
+
+			err := handlePex(p, tor, []byte(tt.payload))
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("expected an error, got: nil")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+
+			if len(tor.Tracker.Peers) != len(tt.flags) {
+				t.Fatalf("expected: %d peers, got: %d", len(tt.flags), len(tor.Tracker.Peers))
+			}
+			for hostAndPort, flags := range tt.flags {
+				added, ok := tor.Tracker.Peers[hostAndPort]
+				if !ok {
+					t.Fatalf("expected peer %s, got: %v", hostAndPort, tor.Tracker.Peers)
+				} else if added.Flags != flags {
+					t.Errorf("flags of %s, expected: %08b, got: %08b", hostAndPort, flags, added.Flags)
+				}
+			}
+		})
+	}
+}
+
+func TestPexFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		encrypted bool
+		utp       bool
+		bitField  []byte
+		expected  byte
+	}{
+		{"none", false, false, []byte{0x00}, 0},
+		{"encrypted", true, false, []byte{0x00}, peer.FlagPrefersEncryption},
+		{"utp", false, true, []byte{0x00}, peer.FlagUTP},
+		{"seed", false, false, []byte{0x80}, peer.FlagSeed},
+		{"all", true, true, []byte{0x80}, peer.FlagPrefersEncryption | peer.FlagUTP | peer.FlagSeed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tor := newTestTorrent(t, "test", false)
+			p := peer.NewPeer("10.0.0.1", 6881)
+			p.Encrypted = tt.encrypted
+			p.UTP = tt.utp
+			p.RemoteBitField = tt.bitField
+
+			if got := pexFlags(tor, p); got != tt.expected {
+				t.Fatalf("expected: %08b, got: %08b", tt.expected, got)
+			}
+		})
+	}
+}
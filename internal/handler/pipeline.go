@@ -0,0 +1,193 @@
+// Contains logic related to keeping multiple requests in flight to a remote peer.
+package handler
+
+import (
+	"time"
+
+	"github.com/jmatss/torc/internal/torrent"
+)
+
+const (
+	// Bounds of the amount of requests that can be outstanding to a single
+	// remote peer at the same time. The amount of requests will be adapted
+	// between these values depending on the download rate of the peer.
+	MinRequestQueue     = 2
+	MaxRequestQueue     = 250
+	DefaultRequestQueue = 5
+
+	// The amount of data that should be requested from a remote peer is the
+	// data that it is expected to send during this duration (or during two round
+	// trips if that is longer).
+	RequestQueueTime = 3 * time.Second
+
+	// Requests that haven't been answered after this duration are considered lost.
+	// The timeout is increased for peers with a higher latency.
+	RequestTimeout = 30 * time.Second
+
+	// The download rate is measured over windows of this duration.
+	rateWindow = 1 * time.Second
+)
+
+// A block that has been requested from the remote peer but not received.
+type request struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+	sent   time.Time
+}
+
+type requestKey struct {
+	index uint32
+	begin uint32
+}
+
+// Keeps track of the outstanding requests to a remote peer and adapts the amount
+// of requests that should be outstanding after the measured download rate
+// and latency of the peer.
+//
+// Only accessed by the downloader of the peer, so no locking is done.
+type pipeline struct {
+	// The amount of requests in flight is fixed to this value if it is set.
+	fixedSize int
+
+	outstanding map[requestKey]request
+
+	// Download rate in bytes/second and the latency of the requests,
+	// both are exponentially weighted moving averages.
+	rate    float64
+	latency time.Duration
+
+	windowStart time.Time
+	windowBytes int64
+}
+
+// Creates a new pipeline. If "fixedSize" is > 0, the amount of requests in flight
+// will always be that value instead of being adapted to the remote peer.
+func newPipeline(fixedSize int) *pipeline {
+	return &pipeline{
+		fixedSize:   fixedSize,
+		outstanding: make(map[requestKey]request),
+		windowStart: time.Now(),
+	}
+}
+
+// Returns the amount of requests that should be in flight to the remote peer.
+func (pl *pipeline) size() int {
+	if pl.fixedSize > 0 {
+		return pl.fixedSize
+	} else if pl.rate == 0 {
+		return DefaultRequestQueue
+	}
+
+	queueTime := RequestQueueTime
+	if 2*pl.latency > queueTime {
+		queueTime = 2 * pl.latency
+	}
+
+	size := int(pl.rate * queueTime.Seconds() / float64(torrent.MaxRequestLength))
+	if size < MinRequestQueue {
+		size = MinRequestQueue
+	} else if size > MaxRequestQueue {
+		size = MaxRequestQueue
+	}
+	return size
+}
+
+// Returns true if more requests can be sent to the remote peer.
+func (pl *pipeline) free() bool {
+	return len(pl.outstanding) < pl.size()
+}
+
+func (pl *pipeline) len() int {
+	return len(pl.outstanding)
+}
+
+// Returns true if the block has been requested and not yet received.
+func (pl *pipeline) has(index, begin uint32) bool {
+	_, ok := pl.outstanding[requestKey{index, begin}]
+	return ok
+}
+
+// Adds a request that has been sent to the remote peer.
+func (pl *pipeline) add(index, begin, length uint32) {
+	pl.outstanding[requestKey{index, begin}] = request{
+		Index:  index,
+		Begin:  begin,
+		Length: length,
+		sent:   time.Now(),
+	}
+}
+
+// Removes the request matching a received block. Updates the measured download
+// rate and latency. Returns false if no such block has been requested.
+// The blocks can be received in any order.
+func (pl *pipeline) received(index, begin uint32, length int) (request, bool) {
+	key := requestKey{index, begin}
+	req, ok := pl.outstanding[key]
+	if !ok || int(req.Length) != length {
+		return request{}, false
+	}
+	delete(pl.outstanding, key)
+
+	now := time.Now()
+	latency := now.Sub(req.sent)
+	if pl.latency == 0 {
+		pl.latency = latency
+	} else {
+		pl.latency = (pl.latency*7 + latency) / 8
+	}
+
+	pl.windowBytes += int64(length)
+	if elapsed := now.Sub(pl.windowStart); elapsed >= rateWindow {
+		windowRate := float64(pl.windowBytes) / elapsed.Seconds()
+		if pl.rate == 0 {
+			pl.rate = windowRate
+		} else {
+			pl.rate = pl.rate*0.8 + windowRate*0.2
+		}
+		pl.windowStart = now
+		pl.windowBytes = 0
+	}
+
+	return req, true
+}
+
+// Removes and returns all outstanding requests. Used when the remote peer
+// chokes this client, since it will discard all requests.
+func (pl *pipeline) clear() []request {
+	requests := make([]request, 0, len(pl.outstanding))
+	for key, req := range pl.outstanding {
+		requests = append(requests, req)
+		delete(pl.outstanding, key)
+	}
+	return requests
+}
+
+// Removes the request of a block that has been cancelled or rejected.
+func (pl *pipeline) cancel(index, begin uint32) {
+	delete(pl.outstanding, requestKey{index, begin})
+}
+
+// Returns all outstanding requests.
+func (pl *pipeline) requests() []request {
+	requests := make([]request, 0, len(pl.outstanding))
+	for _, req := range pl.outstanding {
+		requests = append(requests, req)
+	}
+	return requests
+}
+
+// Returns true if the oldest outstanding request haven't been answered in time.
+func (pl *pipeline) timedOut() bool {
+	timeout := RequestTimeout
+	if 4*pl.latency > timeout {
+		timeout = 4 * pl.latency
+	}
+
+	for _, req := range pl.outstanding {
+		if time.Since(req.sent) > timeout {
+			return true
+		}
+	}
+	return false
+}
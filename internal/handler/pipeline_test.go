@@ -0,0 +1,217 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jmatss/torc/internal/torrent"
+)
+
+func TestPipelineSize(t *testing.T) {
+	block := float64(torrent.MaxRequestLength)
+
+	tests := []struct {
+		name      string
+		fixedSize int
+		rate      float64
+		latency   time.Duration
+		expected  int
+	}{
+		{"fixed", 17, 100 * block, 0, 17},
+		{"no rate", 0, 0, 0, DefaultRequestQueue},
+		{"rate", 0, 10 * block, 0, 30},
+		{"high latency", 0, 10 * block, 3 * time.Second, 60},
+		{"min", 0, 1, 0, MinRequestQueue},
+		{"max", 0, 1000 * block, 0, MaxRequestQueue},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pl := newPipeline(tt.fixedSize)
+			pl.rate = tt.rate
+			pl.latency = tt.latency
+
+			if got := pl.size(); got != tt.expected {
+				t.Fatalf("expected: %d, got: %d", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestPipelineAdd(t *testing.T) {
+	pl := newPipeline(2)
+	if !pl.free() {
+		t.Fatalf("expected an empty pipeline to be free")
+	}
+
+	pl.add(0, 0, torrent.MaxRequestLength)
+	pl.add(0, torrent.MaxRequestLength, 100)
+	// Adding the same block twice doesn't add a new request.
+	pl.add(0, torrent.MaxRequestLength, 100)
+
+	if pl.len() != 2 {
+		t.Fatalf("expected 2 requests, got: %d", pl.len())
+	}
+	if pl.free() {
+		t.Fatalf("expected a full pipeline to not be free")
+	}
+	if !pl.has(0, 0) || !pl.has(0, torrent.MaxRequestLength) {
+		t.Fatalf("expected both blocks to be outstanding")
+	}
+	if pl.has(1, 0) {
+		t.Fatalf("expected block of piece 1 to not be outstanding")
+	}
+}
+
+func TestPipelineReceived(t *testing.T) {
+	tests := []struct {
+		name   string
+		index  uint32
+		begin  uint32
+		length int
+		ok     bool
+		left   int // the amount of outstanding requests after the block is received
+	}{
+		{"not requested", 1, 0, int(torrent.MaxRequestLength), false, 2},
+		{"incorrect length", 0, 0, 100, false, 2},
+		{"first", 0, 0, int(torrent.MaxRequestLength), true, 1},
+		{"duplicate", 0, 0, int(torrent.MaxRequestLength), false, 1},
+		// The blocks can be received in any order.
+		{"last", 0, torrent.MaxRequestLength, 100, true, 0},
+	}
+
+	// The cases are run in order against the same pipeline.
+	pl := newPipeline(0)
+	pl.add(0, torrent.MaxRequestLength, 100)
+	pl.add(0, 0, torrent.MaxRequestLength)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, ok := pl.received(tt.index, tt.begin, tt.length)
+			if ok != tt.ok {
+				t.Fatalf("ok: expected %v, got: %v", tt.ok, ok)
+			}
+			if ok && (req.Index != tt.index || req.Begin != tt.begin || int(req.Length) != tt.length) {
+				t.Fatalf("expected request %d/%d/%d, got: %d/%d/%d",
+					tt.index, tt.begin, tt.length, req.Index, req.Begin, req.Length)
+			}
+			if pl.len() != tt.left {
+				t.Fatalf("expected %d outstanding requests, got: %d", tt.left, pl.len())
+			}
+		})
+	}
+
+	if pl.latency == 0 {
+		t.Fatalf("expected the latency to be measured")
+	}
+}
+
+func TestPipelineReceivedRate(t *testing.T) {
+	pl := newPipeline(0)
+	pl.windowStart = time.Now().Add(-2 * rateWindow)
+
+	pl.add(0, 0, torrent.MaxRequestLength)
+	if _, ok := pl.received(0, 0, int(torrent.MaxRequestLength)); !ok {
+		t.Fatalf("expected the block to be received")
+	}
+
+	// One block received over a window of ~2 seconds.
+	expected := float64(torrent.MaxRequestLength) / 2
+	if pl.rate < expected*0.9 || pl.rate > expected*1.1 {
+		t.Fatalf("expected a rate of ~%.0f, got: %.0f", expected, pl.rate)
+	}
+	if pl.windowBytes != 0 {
+		t.Fatalf("expected a new window to be started, got: %d bytes", pl.windowBytes)
+	}
+}
+
+func TestPipelineClear(t *testing.T) {
+	pl := newPipeline(0)
+	pl.add(0, 0, torrent.MaxRequestLength)
+	pl.add(1, 0, torrent.MaxRequestLength)
+
+	if requests := pl.clear(); len(requests) != 2 {
+		t.Fatalf("expected 2 cleared requests, got: %d", len(requests))
+	}
+	if pl.len() != 0 {
+		t.Fatalf("expected an empty pipeline, got: %d requests", pl.len())
+	}
+}
+
+func TestPipelineCancel(t *testing.T) {
+	pl := newPipeline(0)
+	pl.add(0, 0, torrent.MaxRequestLength)
+	pl.add(0, torrent.MaxRequestLength, torrent.MaxRequestLength)
+
+	pl.cancel(0, 0)
+	// Cancelling a block that isn't outstanding does nothing.
+	pl.cancel(1, 0)
+
+	requests := pl.requests()
+	if len(requests) != 1 || requests[0].Begin != torrent.MaxRequestLength {
+		t.Fatalf("expected only the second block to be outstanding, got: %v", requests)
+	}
+	// A cancelled block isn't expected anymore.
+	if _, ok := pl.received(0, 0, int(torrent.MaxRequestLength)); ok {
+		t.Fatalf("expected the cancelled block to be unexpected")
+	}
+}
+
+func TestPipelineTimedOut(t *testing.T) {
+	tests := []struct {
+		name     string
+		age      time.Duration
+		latency  time.Duration
+		expected bool
+	}{
+		{"empty", -1, 0, false},
+		{"in time", RequestTimeout / 2, 0, false},
+		{"timed out", RequestTimeout + time.Second, 0, true},
+		// The timeout is increased to four times the latency of the peer.
+		{"high latency", RequestTimeout + time.Second, RequestTimeout / 2, false},
+		{"high latency timed out", 2*RequestTimeout + time.Second, RequestTimeout / 2, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pl := newPipeline(0)
+			pl.latency = tt.latency
+			if tt.age >= 0 {
+				pl.add(0, 0, torrent.MaxRequestLength)
+				req := pl.outstanding[requestKey{0, 0}]
+				req.sent = time.Now().Add(-tt.age)
+				pl.outstanding[requestKey{0, 0}] = req
+			}
+
+			if got := pl.timedOut(); got != tt.expected {
+				t.Fatalf("expected: %v, got: %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+// Makes sure that released pieces can be picked again, ex. by other peers when
+// this peer chokes this client or stops answering requests.
+func TestReleaseActive(t *testing.T) {
+	tor := newTestTorrent(t, "test", false)
+	tor.Picker = torrent.NewPicker(tor, torrent.RarestFirst{})
+	remoteBitField := []byte{0x80}
+
+	active := make(map[uint32]*torrent.Piece)
+	piece, ok := tor.Picker.Pick(remoteBitField, active)
+	if !ok {
+		t.Fatalf("expected a piece to be picked")
+	}
+	active[piece.Index] = piece
+	if _, ok := tor.Picker.Pick(remoteBitField, active); ok {
+		t.Fatalf("expected no piece to be picked while the piece is active")
+	}
+
+	releaseActive(active, tor)
+	if len(active) != 0 {
+		t.Fatalf("expected: 0 active pieces, got: %d", len(active))
+	}
+	if _, ok := tor.Picker.Pick(remoteBitField, active); !ok {
+		t.Fatalf("expected the released piece to be picked again")
+	}
+}
@@ -0,0 +1,522 @@
+package handler
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/jmatss/torc/internal/dht"
+	"github.com/jmatss/torc/internal/lsd"
+	"github.com/jmatss/torc/internal/peer"
+	"github.com/jmatss/torc/internal/torrent"
+	"github.com/jmatss/torc/internal/util/com"
+	"github.com/jmatss/torc/internal/util/cons"
+	"github.com/jmatss/torc/internal/util/logger"
+)
+
+const (
+	// Max retries before it gives up on the tracker
+	// Will wait tracker.Interval seconds between retries.
+	MaxRetryCount = 5
+	MaxPeers      = 8
+
+	// Max amount of incoming connections from remote peers that will be accepted
+	// on top of the MaxPeers that this client connects to itself.
+	MaxIncomingPeers = 8
+
+	// How often the state of the torrent is stored in the session directory.
+	SessionSaveInterval = 1 * time.Minute
+)
+
+// Handler in charge of one specific torrent.
+// "node" is the DHT used to find peers together with the trackers, it is nil if
+// the DHT isn't used. "local" is used to find peers on the local network, it is
+// nil if Local Service Discovery isn't used.
+func Torrent(comController *com.Channel, tor *torrent.Torrent, node *dht.DHT, local *lsd.LSD) {
+	childId := string(tor.Tracker.InfoHash[:])
+
+	logger.Log(logger.Low, "torrent handler started")
+
+	// Torrents added from magnet links doesn't know their files until the
+	// metadata has been received from a remote peer, they are rechecked then.
+	if tor.HasMetadata() {
+		if err := recheckExisting(comController, childId, tor); err != nil {
+			comController.SendParent(com.Add, nil, err, tor, childId)
+			return
+		}
+	}
+
+	// Peers of private torrents must only be received from the trackers.
+	if tor.Private() {
+		node = nil
+	}
+
+	// Make tracker request. This handler will kill itself if it isn't able to
+	// complete the tracker request, unless peers can be found through the DHT.
+	if err := tor.Request(cons.PeerId); err != nil {
+		if node == nil {
+			comController.SendParent(com.Add, nil, err, tor, childId)
+			return
+		}
+		logger.Log(logger.Low, "tracker request failed, using the DHT: %v", err)
+	}
+	comController.SendParent(com.Add, nil, nil, tor, childId)
+	comController.AddChild(childId)
+	defer comController.RemoveChild(childId)
+
+	// Remote peers connecting with encryption specify the torrent by a hash of
+	// its info hash, which is looked up among the registered info hashes.
+	peer.AddInfoHash(tor.Tracker.InfoHash)
+	defer peer.RemoveInfoHash(tor.Tracker.InfoHash)
+
+	// Store the torrent in the session directory so that it can be restored
+	// if the client restarts. Store the state one last time when exiting unless
+	// the torrent has been removed.
+	removed := false
+	if err := tor.SaveSession(cons.SessionPath); err != nil {
+		comController.SendParentError(com.Failure, err)
+	}
+	defer func() {
+		if removed {
+			return
+		}
+		if err := tor.SaveSession(cons.SessionPath); err != nil {
+			logger.Log(logger.Low, "unable to save session: %v", err)
+		}
+	}()
+
+	logger.Log(logger.High, "torrent handler tracker request done successfully")
+
+	// The picker decides which pieces the peerHandlers download. It is kept
+	// between restarts of the handler so that a selected strategy isn't lost.
+	if tor.Picker == nil && tor.HasMetadata() {
+		tor.Picker = torrent.NewPicker(tor, torrent.RarestFirst{})
+	}
+
+	// Start up peerHandlers. Every peer handler will be in charge of one peer
+	// of this torrent. The peers that are connected to but haven't completed
+	// their handshakes yet are "pending", indexed by HostAndPort.
+	comPeerHandler := com.New()
+	pending := make(map[string]bool)
+	connectPeers(comPeerHandler, tor, pending)
+
+	// The peers that have completed their handshakes, indexed by HostAndPort.
+	// The choker decides which of them that this client uploads to.
+	connected := make(map[string]*peer.Peer)
+	choker := NewChoker()
+
+	// Lookups in the DHT takes a while, so they are done in a separate go process
+	// that sends the found peers over "dhtChannel".
+	var dhtTicker <-chan time.Time
+	dhtChannel := make(chan []*net.TCPAddr, 1)
+	if node != nil {
+		ticker := time.NewTicker(dht.AnnounceInterval)
+		defer ticker.Stop()
+		dhtTicker = ticker.C
+		go announceDHT(node, tor, dhtChannel)
+	}
+
+	// Peers found on the local network are received on "localChannel". The
+	// torrent is announced on every tick of "localTicker" if local discovery
+	// is enabled for it.
+	var localTicker <-chan time.Time
+	var localChannel <-chan *net.TCPAddr
+	if local != nil {
+		ticker := time.NewTicker(lsd.AnnounceInterval)
+		defer ticker.Stop()
+		localTicker = ticker.C
+		localChannel = local.Subscribe(tor.Tracker.InfoHash)
+		defer local.Unsubscribe(tor.Tracker.InfoHash)
+		announceLocal(local, tor)
+	}
+
+	// The result of the recheck of the existing files that is done when the
+	// metadata of a torrent added from a magnet link is received.
+	recheckChannel := make(chan error, 1)
+
+	// Requests to the trackers might take a while, so they are done in a
+	// separate go process that sends the result over "trackerChannel". The
+	// interval timer is restarted when the result is received, so there is
+	// only one request at a time.
+	trackerChannel := make(chan error, 1)
+
+	retryCount := 0
+	intervalTimer := time.NewTimer(tor.TrackerInterval())
+	sessionTicker := time.NewTicker(SessionSaveInterval)
+	defer sessionTicker.Stop()
+	chokeTicker := time.NewTicker(ChokeInterval)
+	defer chokeTicker.Stop()
+	pexTicker := time.NewTicker(PexInterval)
+	defer pexTicker.Stop()
+	for {
+		select {
+		case received := <-comController.GetChildChannel(childId):
+			/*
+				Received message from "controller"/parent.
+			*/
+			switch received.Id {
+			case com.Remove:
+				// TODO: remove files from disk
+				removed = true
+				if err := tor.RemoveSession(cons.SessionPath); err != nil {
+					comController.SendParentError(com.Failure, err)
+				}
+				comController.SendParent(received.Id, nil, nil, nil, childId)
+				return
+
+			case com.Start:
+				count := comPeerHandler.CountChildren()
+				if count > 0 {
+					comController.SendParentError(
+						received.Id,
+						fmt.Errorf("cant start since it isn't stopped, %d go processes "+
+							"still running", count),
+					)
+				} else {
+					connectPeers(comPeerHandler, tor, pending)
+					comController.SendParent(received.Id, nil, nil, nil, childId)
+				}
+
+			case com.Stop:
+				comPeerHandler.SendChildren(com.Quit, nil)
+
+			case com.List:
+				comController.SendParent(com.List, nil, nil, tor, childId)
+
+			case com.Scrape:
+				// The trackers might take a while to answer, don't block the
+				// handler while waiting.
+				go func() {
+					result, err := tor.Scrape()
+					var data []byte
+					if err == nil {
+						data = com.EncodeScrape(result)
+					}
+					comController.SendParent(com.Scrape, data, err, tor, childId)
+				}()
+
+			case com.UploadLimit, com.DownloadLimit:
+				// Limits of the torrent are set here, limits of the remote
+				// peers are passed along to the peer handlers.
+				scope, rate, err := com.DecodeLimit(received.Data)
+				if err != nil {
+					comController.SendParentError(com.Failure, err)
+				} else if scope == com.LimitPeer {
+					comPeerHandler.SendChildren(received.Id, received.Data)
+				} else if received.Id == com.UploadLimit {
+					tor.UploadLimit.SetRate(rate)
+				} else {
+					tor.DownloadLimit.SetRate(rate)
+				}
+
+			case com.LocalDiscovery:
+				enabled := len(received.Data) == 1 && received.Data[0] == 1
+				tor.SetLocalDiscovery(enabled)
+				if local != nil {
+					announceLocal(local, tor)
+				}
+
+			case com.Quit:
+				return
+
+			case com.Incoming:
+				// A remote peer has connected to this client and sent a handshake
+				// containing the info hash of this torrent.
+				if received.Peer == nil {
+					break
+				}
+
+				count := comPeerHandler.CountChildren()
+				if count >= MaxPeers+MaxIncomingPeers || comPeerHandler.Exists(received.Peer.HostAndPort) {
+					logger.Log(logger.High, "rejected incoming peer %s, %d peers connected",
+						received.Peer.HostAndPort, count)
+					received.Peer.Connection.Close()
+					break
+				}
+
+				go Peer(comPeerHandler, received.Peer, tor)
+
+			}
+
+		case received := <-comPeerHandler.Parent:
+			/*
+				Received message from one of the "peerHandlers"/children.
+			*/
+			switch received.Id {
+			case com.Success:
+				// The peerHandler has completed the handshake with its remote peer.
+				// Pass along to the controller so it can see the results.
+				delete(pending, received.Child)
+				if received.Peer != nil {
+					connected[received.Child] = received.Peer
+					updateInterest(comPeerHandler, tor, received.Peer)
+				}
+				comController.SendParentCopy(received, childId)
+
+			case com.Exiting:
+				delete(connected, received.Child)
+
+			case com.Bitfield:
+				// The pieces of the remote peer have changed, this client might
+				// have become interested in it.
+				if p, ok := connected[received.Child]; ok {
+					updateInterest(comPeerHandler, tor, p)
+				}
+
+			case com.Have:
+				comPeerHandler.SendChildren(com.Have, received.Data)
+
+			case com.Metadata:
+				// A peerHandler has downloaded and verified the metadata of a
+				// torrent added from a magnet link. The other peerHandlers waits
+				// for the metadata and can start downloading when it is set.
+				if tor.HasMetadata() {
+					break
+				}
+				if err := tor.SetMetadata(received.Data); err != nil {
+					comController.SendParentError(com.Failure, err)
+					break
+				}
+				logger.Log(logger.Low, "received metadata of torrent \"%s\"", tor.Name)
+
+				// Rechecking the existing files might take a while, don't block
+				// the handler while waiting. The peer handlers are released
+				// when the result is received over "recheckChannel".
+				go func() {
+					recheckChannel <- recheckExisting(comController, childId, tor)
+				}()
+
+			case com.TotalFailure:
+				// The peerHandler just died, try and add a new peer (might be the same peer)
+				// Is selected ~random (depends on the implementation of go's range loop)
+				// The child is set if the handshake failed.
+				delete(pending, received.Child)
+				connectPeers(comPeerHandler, tor, pending)
+			case com.Failure:
+			// TODO: log
+			default:
+				// TODO: log
+			}
+
+		case err := <-recheckChannel:
+			/*
+				The existing files of a torrent that received its metadata
+				have been rechecked, the torrent is ready to be downloaded.
+			*/
+			if err != nil {
+				comController.SendParentError(com.Failure, err)
+			}
+			if tor.Picker == nil {
+				tor.Picker = torrent.NewPicker(tor, torrent.RarestFirst{})
+			}
+			tor.CloseMetadataReady()
+
+			if err := tor.SaveSession(cons.SessionPath); err != nil {
+				comController.SendParentError(com.Failure, err)
+			}
+			comController.SendParent(com.Metadata, nil, nil, tor, childId)
+
+		case <-intervalTimer.C:
+			/*
+				Interval time expired. Send new tracker request to get updated information.
+			*/
+			// TODO: Start connection to peers if it is needed.
+
+			logger.Log(logger.High, "torrent handler interval timeout")
+
+			go announceTracker(tor, trackerChannel)
+
+		case err := <-trackerChannel:
+			/*
+				The tracker request started by the interval timer is done.
+			*/
+			if err != nil {
+				retryCount++
+				if retryCount >= MaxRetryCount && node == nil {
+					comController.SendParentError(com.TotalFailure, err)
+					return
+				} else {
+					comController.SendParentError(com.Failure, err)
+				}
+			} else {
+				retryCount = 0
+			}
+
+			// Reset timer
+			intervalTimer = time.NewTimer(tor.TrackerInterval())
+
+		case <-dhtTicker:
+			/*
+				Look up new peers in the DHT and announce this client to it.
+			*/
+			go announceDHT(node, tor, dhtChannel)
+
+		case addrs := <-dhtChannel:
+			/*
+				Received peers from the DHT.
+			*/
+			peers := make(map[string]*peer.Peer, len(addrs))
+			for _, addr := range addrs {
+				newPeer := peer.NewPeer(addr.IP.String(), uint16(addr.Port))
+				peers[newPeer.HostAndPort] = newPeer
+			}
+			if n := tor.AddPeers(peers); n > 0 {
+				logger.Log(logger.High, "received %d new peers from the DHT", n)
+				connectPeers(comPeerHandler, tor, pending)
+			}
+
+		case <-chokeTicker.C:
+			/*
+				Decide which remote peers to upload to.
+			*/
+			peers := make([]*peer.Peer, 0, len(connected))
+			for _, p := range connected {
+				peers = append(peers, p)
+			}
+
+			unchoke := choker.Rechoke(peers, tor.Seeding())
+			for _, p := range peers {
+				if unchoke[p.HostAndPort] {
+					comPeerHandler.SendChild(com.UnChoke, nil, nil, nil, p.HostAndPort)
+				} else {
+					comPeerHandler.SendChild(com.Choke, nil, nil, nil, p.HostAndPort)
+				}
+				updateInterest(comPeerHandler, tor, p)
+			}
+
+		case <-localTicker:
+			/*
+				Announce the torrent on the local network.
+			*/
+			announceLocal(local, tor)
+
+		case addr := <-localChannel:
+			/*
+				Received a peer on the local network.
+			*/
+			if !tor.LocalDiscovery() {
+				break
+			}
+			newPeer := peer.NewPeer(addr.IP.String(), uint16(addr.Port))
+			if n := tor.AddPeers(map[string]*peer.Peer{newPeer.HostAndPort: newPeer}); n > 0 {
+				logger.Log(logger.High, "found peer %s on the local network", newPeer.HostAndPort)
+				connectPeers(comPeerHandler, tor, pending)
+			}
+
+		case <-pexTicker.C:
+			/*
+				Tell the remote peers about the other connected peers and connect
+				to new peers received from them (or from the tracker).
+			*/
+			addresses := make(map[string]byte, len(connected))
+			for _, p := range connected {
+				if address, ok := p.ReachableAt(); ok {
+					addresses[address] = pexFlags(tor, p)
+				}
+			}
+			if !tor.Private() {
+				comPeerHandler.SendChildren(com.Pex, encodePexPeers(addresses))
+			}
+			connectPeers(comPeerHandler, tor, pending)
+
+		case <-sessionTicker.C:
+			/*
+				Store the current state of the torrent in the session directory.
+			*/
+			if err := tor.SaveSession(cons.SessionPath); err != nil {
+				comController.SendParentError(com.Failure, err)
+			}
+		}
+	}
+}
+
+// Connects to peers of the torrent that aren't connected until there are
+// MaxPeers peer handlers running. The peer handlers that are still doing their
+// handshakes are in "pending" and are counted as well, the new ones are added
+// to it. Peers whose last connection failed are skipped until their backoff
+// has passed.
+//
+// The peers are added concurrently by the trackers and the peer handlers,
+// so the tracker must be locked while they are iterated over.
+func connectPeers(comPeerHandler *com.Channel, tor *torrent.Torrent, pending map[string]bool) {
+	count := comPeerHandler.CountChildren() + len(pending)
+
+	tor.Tracker.Lock()
+	defer tor.Tracker.Unlock()
+
+	for _, val := range tor.Tracker.Peers {
+		if count >= MaxPeers {
+			break
+		} else if !pending[val.HostAndPort] && !comPeerHandler.Exists(val.HostAndPort) &&
+			!val.Banned() && val.CanConnect() {
+			pending[val.HostAndPort] = true
+			go Peer(comPeerHandler, val, tor)
+			count++
+		}
+	}
+}
+
+// Does a tracker request for the torrent, the result is sent over "trackerChannel".
+func announceTracker(tor *torrent.Torrent, trackerChannel chan<- error) {
+	trackerChannel <- tor.Request(cons.PeerId)
+}
+
+// Looks up peers of the torrent in the DHT and announces that this client is
+// a peer of the torrent. The found peers are sent over "dhtChannel".
+func announceDHT(node *dht.DHT, tor *torrent.Torrent, dhtChannel chan<- []*net.TCPAddr) {
+	peers := node.Announce(tor.Tracker.InfoHash, torrent.Port)
+	logger.Log(logger.High, "found %d peers in the DHT", len(peers))
+	dhtChannel <- peers
+}
+
+// Sends announcements of torrents on the local network, implemented by lsd.LSD.
+type localAnnouncer interface {
+	Announce(infoHashes ...[sha1.Size]byte) error
+}
+
+// Announces the torrent on the local network if local discovery is enabled.
+func announceLocal(local localAnnouncer, tor *torrent.Torrent) {
+	if !tor.LocalDiscovery() {
+		return
+	}
+	if err := local.Announce(tor.Tracker.InfoHash); err != nil {
+		logger.Log(logger.High, "%v", err)
+	}
+}
+
+// If the files of a new torrent already exists on disk, verify them against the
+// piece hashes so that the pieces that this client already has aren't
+// downloaded again. Torrents restored from a session already have a bitfield.
+func recheckExisting(comController *com.Channel, childId string, tor *torrent.Torrent) error {
+	if tor.HasAnyPiece() || !tor.FilesExist() {
+		return nil
+	}
+
+	logger.Log(logger.Low, "rechecking existing files of torrent")
+
+	lastPercent := -1
+	return tor.Recheck(func(checked, total int) {
+		// Only notify the parent when the percentage changes.
+		if percent := checked * 100 / total; percent != lastPercent {
+			lastPercent = percent
+			comController.SendParent(com.Recheck, com.EncodeProgress(checked, total),
+				nil, nil, childId)
+		}
+	})
+}
+
+// Tells the peer handler of the remote peer "p" if this client is interested in
+// the remote peer, i.e. if it has any piece that this client doesn't have.
+// The peer handler ignores the message if the state doesn't change.
+func updateInterest(comPeerHandler *com.Channel, tor *torrent.Torrent, p *peer.Peer) {
+	p.RLock()
+	interesting := tor.Interesting(p.RemoteBitField)
+	p.RUnlock()
+
+	if interesting {
+		comPeerHandler.SendChild(com.Interested, nil, nil, nil, p.HostAndPort)
+	} else {
+		comPeerHandler.SendChild(com.NotInterested, nil, nil, nil, p.HostAndPort)
+	}
+}
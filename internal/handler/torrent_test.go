@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmatss/torc/internal/peer"
+	"github.com/jmatss/torc/internal/torrent"
+	"github.com/jmatss/torc/internal/util/com"
+)
+
+// Creates a single file torrent named "name" with one piece.
+func newTestTorrent(t *testing.T, name string, private bool) *torrent.Torrent {
+	privateField := ""
+	if private {
+		privateField = "7:privatei1e"
+	}
+	content := fmt.Sprintf("d4:infod6:lengthi10e4:name%d:%s12:piece lengthi16e6:pieces20:%s%see",
+		len(name), name, strings.Repeat("a", 20), privateField)
+
+	tor, err := torrent.NewTorrentFromContent([]byte(content))
+	if err != nil {
+		t.Fatalf("unable to create torrent: %v", err)
+	}
+	return tor
+}
+
+// Records the info hashes that are announced on the local network.
+type fakeAnnouncer struct {
+	announced [][sha1.Size]byte
+}
+
+func (a *fakeAnnouncer) Announce(infoHashes ...[sha1.Size]byte) error {
+	a.announced = append(a.announced, infoHashes...)
+	return nil
+}
+
+// Makes sure that torrents are only announced on the local network if local
+// discovery is allowed for them.
+func TestAnnounceLocal(t *testing.T) {
+	tests := []struct {
+		name      string
+		private   bool
+		disabled  bool
+		announced bool
+	}{
+		{"public", false, false, true},
+		{"private", true, false, false},
+		{"disabled", false, true, false},
+		{"private and disabled", true, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tor := newTestTorrent(t, tt.name, tt.private)
+			tor.SetLocalDiscovery(!tt.disabled)
+			if got := tor.LocalDiscovery(); got != tt.announced {
+				t.Fatalf("LocalDiscovery: got %v, expected %v", got, tt.announced)
+			}
+
+			local := &fakeAnnouncer{}
+			announceLocal(local, tor)
+
+			if !tt.announced {
+				if len(local.announced) != 0 {
+					t.Fatalf("expected no announcement, got: %x", local.announced)
+				}
+			} else if len(local.announced) != 1 || local.announced[0] != tor.Tracker.InfoHash {
+				t.Fatalf("expected an announcement of %x, got: %x", tor.Tracker.InfoHash, local.announced)
+			}
+		})
+	}
+}
+
+// Returns the address of a local TCP port that refuses connections.
+func refusedAddr(t *testing.T) *net.TCPAddr {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+	return addr
+}
+
+func TestConnectPeers(t *testing.T) {
+	tests := []struct {
+		name    string
+		peers   int
+		pending int // peers that are already being connected to
+		backoff int // peers whose last connection failed
+		banned  int
+		started int
+	}{
+		{"fewer peers than MaxPeers", MaxPeers - 2, 0, 0, 0, MaxPeers - 2},
+		{"more peers than MaxPeers", MaxPeers + 2, 0, 0, 0, MaxPeers},
+		{"pending peers are counted", MaxPeers + 2, 3, 0, 0, MaxPeers - 3},
+		{"all pending", MaxPeers, MaxPeers, 0, 0, 0},
+		{"backoff", 4, 0, 2, 0, 2},
+		{"banned", 4, 0, 0, 1, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tor := newTestTorrent(t, "test", false)
+			addr := refusedAddr(t)
+
+			peers := make(map[string]*peer.Peer, tt.peers)
+			pending := make(map[string]bool)
+			for i := 0; i < tt.peers; i++ {
+				p := peer.NewPeer(fmt.Sprintf("127.0.0.%d", i+1), uint16(addr.Port))
+				switch {
+				case i < tt.pending:
+					pending[p.HostAndPort] = true
+				case i < tt.pending+tt.backoff:
+					p.ConnectFailed()
+				case i < tt.pending+tt.backoff+tt.banned:
+					p.BadPieces = peer.MaxBadPieces
+				}
+				peers[p.HostAndPort] = p
+			}
+			tor.AddPeers(peers)
+
+			comPeerHandler := com.New()
+			connectPeers(comPeerHandler, tor, pending)
+			if len(pending) != tt.pending+tt.started {
+				t.Fatalf("expected %d pending peers, got: %d", tt.pending+tt.started, len(pending))
+			}
+
+			// Every started peer handler fails to connect and reports it with its
+			// child id, the peer isn't connected to again until after a backoff.
+			failed := make(map[string]bool)
+			for i := 0; i < tt.started; i++ {
+				select {
+				case received := <-comPeerHandler.Parent:
+					if received.Id != com.TotalFailure || !pending[received.Child] {
+						t.Fatalf("expected a failure of a pending peer, got: %v %q",
+							received.Id, received.Child)
+					}
+					delete(pending, received.Child)
+					failed[received.Child] = true
+					if peers[received.Child].CanConnect() {
+						t.Fatalf("expected a backoff before connecting to %s again", received.Child)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("expected %d failures, got: %d", tt.started, i)
+				}
+			}
+
+			connectPeers(comPeerHandler, tor, pending)
+			for hostAndPort := range pending {
+				if failed[hostAndPort] {
+					t.Fatalf("expected %s to not be connected to again", hostAndPort)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+// Contains logic related to uploading (seeding) pieces to remote peers.
+package handler
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/jmatss/torc/internal/peer"
+	"github.com/jmatss/torc/internal/torrent"
+	bt "github.com/jmatss/torc/internal/util/bittorrent"
+	"github.com/jmatss/torc/internal/util/logger"
+)
+
+const (
+	// The max amount of requests from a remote peer that are queued waiting
+	// to be served. Requests received when the queue is full are rejected.
+	MaxUploadQueue = 256
+)
+
+// Tells the remote peer which pieces this client has, sent directly after the
+// handshake. Remote peers that supports the fast extension are sent HaveAll or
+// HaveNone if this client has all or none of the pieces. Other remote peers are
+// sent a Bitfield, or nothing if this client doesn't have any pieces.
+func sendHaveState(p *peer.Peer, tor *torrent.Torrent) error {
+	amountOfPieces := 0
+	if tor.HasMetadata() {
+		amountOfPieces = len(tor.Pieces)
+	}
+
+	tor.Tracker.Lock()
+	bitField := append([]byte(nil), tor.Tracker.BitFieldHave...)
+	tor.Tracker.Unlock()
+
+	have := 0
+	for i := 0; i < amountOfPieces; i++ {
+		if hasPiece(bitField, uint32(i)) {
+			have++
+		}
+	}
+
+	if !p.SupportsFast {
+		if have == 0 {
+			return nil
+		}
+		return p.SendData(bt.Bitfield, bitField)
+	}
+
+	if have == 0 {
+		return p.Send(bt.HaveNone)
+	} else if have == amountOfPieces {
+		return p.Send(bt.HaveAll)
+	}
+	return p.SendData(bt.Bitfield, bitField)
+}
+
+// Serves the requests of the remote peer. The requests are queued so that the
+// peer.Handler can keep on receiving messages while the requested data is read
+// from disk and sent to the remote peer.
+//
+// "uploadChannel" receives the Request and Cancel messages of the remote peer,
+// and a Choke message when this client has choked the remote peer. Exits when
+// "uploadChannel" is closed.
+func uploader(uploadChannel chan remoteDTO, tor *torrent.Torrent, p *peer.Peer) {
+	queue := make([]request, 0)
+	failed := false
+
+	for {
+		var received remoteDTO
+		var ok bool
+		if len(queue) == 0 || failed {
+			received, ok = <-uploadChannel
+		} else {
+			// Messages from the remote peer are handled before the next request
+			// is served so that cancelled requests aren't served.
+			select {
+			case received, ok = <-uploadChannel:
+			default:
+				req := queue[0]
+				queue = queue[1:]
+				if err := serveRequest(tor, p, req); err != nil {
+					logger.Log(logger.Low, "unable to send piece to remote peer \"%s\": %v",
+						p.HostAndPort, err)
+					// Closing the connection makes the peer handler exit and close
+					// the "uploadChannel". Everything received until then is ignored.
+					p.Connection.Close()
+					failed = true
+				}
+				continue
+			}
+		}
+
+		if !ok {
+			return
+		} else if failed {
+			continue
+		}
+
+		var err error
+		switch received.Id {
+		case bt.Request:
+			queue, err = enqueueRequest(queue, tor, p, received.Data)
+
+		case bt.Cancel:
+			queue, err = cancelRequest(queue, p, received.Data)
+
+		case bt.Choke:
+			// Requests that aren't allowed now that the remote peer is choked
+			// are discarded.
+			allowed := queue[:0]
+			for _, req := range queue {
+				if allowedRequest(p, tor, req) {
+					allowed = append(allowed, req)
+				} else if err = rejectRequest(p, req); err != nil {
+					break
+				}
+			}
+			queue = allowed
+		}
+
+		if err != nil {
+			logger.Log(logger.Low, "unable to answer request of remote peer \"%s\": %v",
+				p.HostAndPort, err)
+			p.Connection.Close()
+			failed = true
+		}
+	}
+}
+
+// Adds the request in the data of a "request" message to the queue. The request
+// is rejected if it isn't allowed or if the queue is full.
+func enqueueRequest(queue []request, tor *torrent.Torrent, p *peer.Peer, data []byte) ([]request, error) {
+	req, err := parseRequest(data)
+	if err != nil {
+		logger.Log(logger.High, "remote peer %s: %v", p.HostAndPort, err)
+		return queue, nil
+	}
+
+	if len(queue) >= MaxUploadQueue || !allowedRequest(p, tor, req) {
+		return queue, rejectRequest(p, req)
+	}
+	return append(queue, req), nil
+}
+
+// Removes the request in the data of a "cancel" message from the queue. Remote
+// peers that supports the fast extension expects a reject of the cancelled request.
+func cancelRequest(queue []request, p *peer.Peer, data []byte) ([]request, error) {
+	req, err := parseRequest(data)
+	if err != nil {
+		logger.Log(logger.High, "remote peer %s: %v", p.HostAndPort, err)
+		return queue, nil
+	}
+
+	for i, queued := range queue {
+		if queued.Index == req.Index && queued.Begin == req.Begin && queued.Length == req.Length {
+			queue = append(queue[:i], queue[i+1:]...)
+			return queue, rejectRequest(p, req)
+		}
+	}
+
+	// The request has already been served or rejected.
+	return queue, nil
+}
+
+// Reads the requested block from disk and sends it to the remote peer. The
+// request is rejected if it no longer is allowed or if it can't be read.
+func serveRequest(tor *torrent.Torrent, p *peer.Peer, req request) error {
+	if !allowedRequest(p, tor, req) {
+		return rejectRequest(p, req)
+	}
+
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data[:4], req.Index)
+	binary.BigEndian.PutUint32(data[4:8], req.Begin)
+	binary.BigEndian.PutUint32(data[8:], req.Length)
+
+	pieceData, err := tor.ReadData(data)
+	if err != nil {
+		logger.Log(logger.High, "unable to read data requested by %s: %v", p.HostAndPort, err)
+		return rejectRequest(p, req)
+	}
+
+	if err := p.SendData(bt.Piece, pieceData); err != nil {
+		return err
+	}
+
+	uploaded := int64(req.Length)
+	p.Lock()
+	p.Uploaded += uploaded
+	p.Unlock()
+	tor.Tracker.Lock()
+	tor.Tracker.Uploaded += uploaded
+	tor.Tracker.Unlock()
+
+	return nil
+}
+
+// Returns true if the remote peer is allowed to request the block. This client
+// must have the piece and the block must be inside of the piece. The remote peer
+// must not be choked, unless the piece is in the allowed fast set of the remote peer.
+func allowedRequest(p *peer.Peer, tor *torrent.Torrent, req request) bool {
+	if int(req.Index) >= len(tor.Pieces) || req.Length == 0 ||
+		req.Length > torrent.MaxRequestLength ||
+		int64(req.Begin)+int64(req.Length) > tor.PieceSize(req.Index) {
+		return false
+	}
+
+	p.RLock()
+	amChoking := p.AmChoking
+	allowedFast := p.AllowedFast[req.Index]
+	p.RUnlock()
+	if amChoking && !allowedFast {
+		return false
+	}
+
+	tor.Tracker.Lock()
+	defer tor.Tracker.Unlock()
+	return hasPiece(tor.Tracker.BitFieldHave, req.Index)
+}
+
+// Parses the data of a "request" or "cancel" message: <index><begin><length>
+func parseRequest(data []byte) (request, error) {
+	if len(data) != 12 {
+		return request{}, fmt.Errorf("incorrect length of request, "+
+			"expected: 12, got: %d", len(data))
+	}
+	return request{
+		Index:  binary.BigEndian.Uint32(data[:4]),
+		Begin:  binary.BigEndian.Uint32(data[4:8]),
+		Length: binary.BigEndian.Uint32(data[8:]),
+	}, nil
+}
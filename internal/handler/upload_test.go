@@ -0,0 +1,185 @@
+package handler
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jmatss/torc/internal/torrent"
+	bt "github.com/jmatss/torc/internal/util/bittorrent"
+)
+
+// Creates a torrent with a single piece containing the 10 bytes "0123456789"
+// that is stored in a temporary directory. The caller has to remove the
+// download path of the torrent.
+func newUploadTorrent(t *testing.T, have bool) *torrent.Torrent {
+	tor := newTestTorrent(t, "test", false)
+
+	dir, err := ioutil.TempDir("", "torc")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	tor.DownloadPath = dir
+	if err := ioutil.WriteFile(filepath.Join(dir, "test"), []byte("0123456789"), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("unable to write test file: %v", err)
+	}
+
+	if have {
+		tor.Tracker.BitFieldHave[0] = 0x80
+	}
+	return tor
+}
+
+// Returns the payload of a "request", "cancel" or "reject request" message.
+func requestData(req request) []byte {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data[:4], req.Index)
+	binary.BigEndian.PutUint32(data[4:8], req.Begin)
+	binary.BigEndian.PutUint32(data[8:], req.Length)
+	return data
+}
+
+func TestServeRequest(t *testing.T) {
+	tests := []struct {
+		name         string
+		req          request
+		have         bool
+		missingFile  bool
+		amChoking    bool
+		allowedFast  bool
+		supportsFast bool
+		sent         bool // a message is sent to the remote peer
+		id           bt.MessageId
+		data         string
+	}{
+		{"piece", request{Index: 0, Begin: 2, Length: 4}, true, false, false, false, true, true, bt.Piece, "2345"},
+		{"whole piece", request{Index: 0, Begin: 0, Length: 10}, true, false, false, false, false, true, bt.Piece, "0123456789"},
+		{"choked", request{Index: 0, Begin: 0, Length: 4}, true, false, true, false, true, true, bt.RejectRequest, ""},
+		{"choked allowed fast", request{Index: 0, Begin: 0, Length: 4}, true, false, true, true, true, true, bt.Piece, "0123"},
+		{"choked without fast extension", request{Index: 0, Begin: 0, Length: 4}, true, false, true, false, false, false, 0, ""},
+		{"piece not downloaded", request{Index: 0, Begin: 0, Length: 4}, false, false, false, false, true, true, bt.RejectRequest, ""},
+		{"outside of piece", request{Index: 0, Begin: 8, Length: 4}, true, false, false, false, true, true, bt.RejectRequest, ""},
+		{"unknown piece", request{Index: 1, Begin: 0, Length: 4}, true, false, false, false, true, true, bt.RejectRequest, ""},
+		{"zero length", request{Index: 0, Begin: 0, Length: 0}, true, false, false, false, true, true, bt.RejectRequest, ""},
+		{"unable to read", request{Index: 0, Begin: 0, Length: 4}, true, true, false, false, true, true, bt.RejectRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tor := newUploadTorrent(t, tt.have)
+			defer os.RemoveAll(tor.DownloadPath)
+			if tt.missingFile {
+				os.Remove(filepath.Join(tor.DownloadPath, "test"))
+			}
+
+			p, remote := newTestPeer()
+			defer remote.Close()
+			p.AmChoking = tt.amChoking
+			p.SupportsFast = tt.supportsFast
+			p.AllowedFast = map[uint32]bool{0: tt.allowedFast}
+
+			errChannel := make(chan error, 1)
+			go func() { errChannel <- serveRequest(tor, p, tt.req) }()
+
+			if tt.sent {
+				id, data := readMessage(t, remote)
+				if id != tt.id {
+					t.Fatalf("expected message: %v, got: %v", tt.id, id)
+				}
+
+				expected := requestData(tt.req)
+				if tt.id == bt.Piece {
+					expected = append(expected[:8], tt.data...)
+				}
+				if string(data) != string(expected) {
+					t.Fatalf("expected payload: %v, got: %v", expected, data)
+				}
+			}
+
+			// Nothing else is sent, a write to the pipe would block forever.
+			select {
+			case err := <-errChannel:
+				if err != nil {
+					t.Fatalf("unable to serve request: %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("expected the request to be served without sending any more messages")
+			}
+
+			var uploaded int64
+			if tt.id == bt.Piece {
+				uploaded = int64(tt.req.Length)
+			}
+			if p.Uploaded != uploaded || tor.Tracker.Uploaded != uploaded {
+				t.Fatalf("expected uploaded: %d, got: %d (peer), %d (torrent)",
+					uploaded, p.Uploaded, tor.Tracker.Uploaded)
+			}
+		})
+	}
+}
+
+func TestCancelRequest(t *testing.T) {
+	first := request{Index: 0, Begin: 0, Length: 4}
+	second := request{Index: 0, Begin: 4, Length: 4}
+
+	tests := []struct {
+		name         string
+		data         []byte
+		supportsFast bool
+		expected     []request // the queue after the cancel
+		rejected     bool      // the cancelled request is rejected
+	}{
+		{"queued", requestData(second), true, []request{first}, true},
+		{"queued without fast extension", requestData(second), false, []request{first}, false},
+		{"not queued", requestData(request{Index: 0, Begin: 8, Length: 2}), true, []request{first, second}, false},
+		{"other length", requestData(request{Index: 0, Begin: 4, Length: 2}), true, []request{first, second}, false},
+		{"incorrect length", requestData(second)[:8], true, []request{first, second}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, remote := newTestPeer()
+			defer remote.Close()
+			p.SupportsFast = tt.supportsFast
+
+			type result struct {
+				queue []request
+				err   error
+			}
+			resultChannel := make(chan result, 1)
+			go func() {
+				queue, err := cancelRequest([]request{first, second}, p, tt.data)
+				resultChannel <- result{queue, err}
+			}()
+
+			if tt.rejected {
+				id, data := readMessage(t, remote)
+				if id != bt.RejectRequest || string(data) != string(tt.data) {
+					t.Fatalf("expected a reject of %v, got: %v %v", tt.data, id, data)
+				}
+			}
+
+			var res result
+			select {
+			case res = <-resultChannel:
+			case <-time.After(time.Second):
+				t.Fatalf("expected the request to be cancelled without sending any more messages")
+			}
+			if res.err != nil {
+				t.Fatalf("unable to cancel request: %v", res.err)
+			}
+			if len(res.queue) != len(tt.expected) {
+				t.Fatalf("expected queue: %v, got: %v", tt.expected, res.queue)
+			}
+			for i := range res.queue {
+				if res.queue[i] != tt.expected[i] {
+					t.Fatalf("expected queue: %v, got: %v", tt.expected, res.queue)
+				}
+			}
+		})
+	}
+}
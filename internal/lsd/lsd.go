@@ -0,0 +1,265 @@
+// Contains logic related to Local Service Discovery, used to find peers on the
+// local network through multicast announcements.
+// See http://www.bittorrent.org/beps/bep_0014.html
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmatss/torc/internal/util/logger"
+)
+
+const (
+	// Only the IPv4 multicast group is joined, peers on the local network that
+	// only announce over IPv6 aren't found.
+	MulticastAddr4 = "239.192.152.143:6771"
+
+	// How often a torrent handler should announce its torrent.
+	AnnounceInterval = 5 * time.Minute
+	// Announcements of the same info hash are sent at most this often.
+	MinAnnounceInterval = 1 * time.Minute
+
+	// The max amount of info hashes in a single announcement.
+	MaxInfoHashes = 8
+
+	udpMaxPacketSize = 1400
+)
+
+// Announces and listens for torrents on the local network. All exported
+// functions are safe to call from multiple go processes.
+type LSD struct {
+	mut sync.Mutex
+
+	group *net.UDPAddr
+	// Announcements are received on "conn" and sent on "sendConn". The
+	// announcements of other clients on this host are only received if they
+	// are sent on a connection that loops back multicast.
+	conn     *net.UDPConn
+	sendConn *net.UDPConn
+	port     int
+	// Sent in every announcement so that the announcements of this client can
+	// be ignored when they are received.
+	cookie string
+
+	// The channels of the torrents that are interested in peers found on the
+	// local network, indexed by info hash.
+	subscribers  map[[sha1.Size]byte]chan *net.TCPAddr
+	lastAnnounce map[[sha1.Size]byte]time.Time
+
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+// Joins the multicast group "group" (ex. MulticastAddr4). Announcements tell
+// the remote peers that this client listens on "port".
+func New(group string, port int) (*LSD, error) {
+	groupAddr, err := net.ResolveUDPAddr("udp", group)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve multicast address %s: %w", group, err)
+	}
+	conn, err := net.ListenMulticastUDP("udp", nil, groupAddr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to join multicast group %s: %w", group, err)
+	}
+	sendConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to create LSD connection: %w", err)
+	}
+
+	cookie := make([]byte, 8)
+	_, _ = rand.Read(cookie)
+
+	l := &LSD{
+		group:        groupAddr,
+		conn:         conn,
+		sendConn:     sendConn,
+		port:         port,
+		cookie:       hex.EncodeToString(cookie),
+		subscribers:  make(map[[sha1.Size]byte]chan *net.TCPAddr),
+		lastAnnounce: make(map[[sha1.Size]byte]time.Time),
+		quit:         make(chan struct{}),
+	}
+	go l.serve()
+
+	logger.Log(logger.Low, "LSD listening on %s", group)
+
+	return l, nil
+}
+
+func (l *LSD) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.quit)
+		err = l.conn.Close()
+		if sendErr := l.sendConn.Close(); sendErr != nil && err == nil {
+			err = sendErr
+		}
+	})
+	return err
+}
+
+// Returns a channel that receives the peers on the local network that announces
+// the torrent with the given info hash.
+func (l *LSD) Subscribe(infoHash [sha1.Size]byte) <-chan *net.TCPAddr {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	ch, ok := l.subscribers[infoHash]
+	if !ok {
+		ch = make(chan *net.TCPAddr, MaxInfoHashes)
+		l.subscribers[infoHash] = ch
+	}
+	return ch
+}
+
+func (l *LSD) Unsubscribe(infoHash [sha1.Size]byte) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	delete(l.subscribers, infoHash)
+}
+
+// Announces the torrents with the given info hashes on the local network.
+// Info hashes that have been announced during the last MinAnnounceInterval
+// are skipped.
+func (l *LSD) Announce(infoHashes ...[sha1.Size]byte) error {
+	l.mut.Lock()
+	hexHashes := make([]string, 0, len(infoHashes))
+	for _, infoHash := range infoHashes {
+		if time.Since(l.lastAnnounce[infoHash]) < MinAnnounceInterval {
+			continue
+		}
+		l.lastAnnounce[infoHash] = time.Now()
+		hexHashes = append(hexHashes, hex.EncodeToString(infoHash[:]))
+	}
+	l.mut.Unlock()
+
+	for len(hexHashes) > 0 {
+		n := len(hexHashes)
+		if n > MaxInfoHashes {
+			n = MaxInfoHashes
+		}
+		if _, err := l.sendConn.WriteToUDP(l.message(hexHashes[:n]), l.group); err != nil {
+			return fmt.Errorf("unable to send LSD announcement: %w", err)
+		}
+		hexHashes = hexHashes[n:]
+	}
+	return nil
+}
+
+// Creates an announcement of the given hex encoded info hashes.
+// Format: "BT-SEARCH * HTTP/1.1\r\nHost: <multicast address>\r\nPort: <port>\r\n
+// Infohash: <hex info hash>\r\n(one per info hash)cookie: <cookie>\r\n\r\n\r\n"
+func (l *LSD) message(hexHashes []string) []byte {
+	var msg strings.Builder
+	msg.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	msg.WriteString("Host: " + l.group.String() + "\r\n")
+	msg.WriteString("Port: " + strconv.Itoa(l.port) + "\r\n")
+	for _, hexHash := range hexHashes {
+		msg.WriteString("Infohash: " + hexHash + "\r\n")
+	}
+	msg.WriteString("cookie: " + l.cookie + "\r\n")
+	msg.WriteString("\r\n\r\n")
+	return []byte(msg.String())
+}
+
+// Receives announcements until the LSD is closed. The peers are sent to the
+// subscribers of the announced info hashes.
+func (l *LSD) serve() {
+	buffer := make([]byte, udpMaxPacketSize)
+	for {
+		length, addr, err := l.conn.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-l.quit:
+				return
+			default:
+			}
+			logger.Log(logger.High, "unable to read from LSD connection: %v", err)
+			continue
+		}
+
+		port, infoHashes, cookie, err := parseMessage(buffer[:length])
+		if err != nil {
+			logger.Log(logger.High, "received incorrect LSD announcement from %s: %v", addr, err)
+			continue
+		} else if cookie == l.cookie {
+			continue
+		}
+
+		peerAddr := &net.TCPAddr{IP: addr.IP, Port: port}
+		l.mut.Lock()
+		for _, infoHash := range infoHashes {
+			if ch, ok := l.subscribers[infoHash]; ok {
+				// Drop the peer if the subscriber is busy, it will be
+				// announced again.
+				select {
+				case ch <- peerAddr:
+				default:
+				}
+			}
+		}
+		l.mut.Unlock()
+	}
+}
+
+// Parses an announcement. Returns the port, info hashes and cookie (if any).
+func parseMessage(data []byte) (int, [][sha1.Size]byte, string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != "BT-SEARCH * HTTP/1.1" {
+		return 0, nil, "", fmt.Errorf("incorrect request line")
+	}
+
+	port := 0
+	cookie := ""
+	infoHashes := make([][sha1.Size]byte, 0)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			break
+		}
+
+		sep := strings.Index(line, ":")
+		if sep == -1 {
+			continue
+		}
+		key, value := strings.ToLower(line[:sep]), strings.TrimSpace(line[sep+1:])
+
+		switch key {
+		case "port":
+			p, err := strconv.Atoi(value)
+			if err != nil || p <= 0 || p > 65535 {
+				return 0, nil, "", fmt.Errorf("incorrect port \"%s\"", value)
+			}
+			port = p
+		case "infohash":
+			decoded, err := hex.DecodeString(value)
+			if err != nil || len(decoded) != sha1.Size {
+				return 0, nil, "", fmt.Errorf("incorrect info hash \"%s\"", value)
+			}
+			var infoHash [sha1.Size]byte
+			copy(infoHash[:], decoded)
+			infoHashes = append(infoHashes, infoHash)
+		case "cookie":
+			cookie = value
+		}
+	}
+
+	if port == 0 {
+		return 0, nil, "", fmt.Errorf("no port specified")
+	} else if len(infoHashes) == 0 {
+		return 0, nil, "", fmt.Errorf("no info hash specified")
+	}
+	return port, infoHashes, cookie, nil
+}
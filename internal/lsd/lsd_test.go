@@ -0,0 +1,149 @@
+package lsd
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Uses a port other than the one of the LSD multicast group so that the tests
+// don't receive announcements of other clients on the network.
+const testGroup = "239.192.152.143:16771"
+
+func TestParseMessage(t *testing.T) {
+	infoHash := [sha1.Size]byte{0xaa, 0xbb}
+	hexHash := hex.EncodeToString(infoHash[:])
+
+	tests := []struct {
+		name       string
+		message    string
+		port       int
+		infoHashes [][sha1.Size]byte
+		cookie     string
+		wantErr    bool
+	}{
+		{
+			name: "announcement",
+			message: "BT-SEARCH * HTTP/1.1\r\nHost: " + testGroup + "\r\nPort: 6881\r\n" +
+				"Infohash: " + hexHash + "\r\ncookie: abc\r\n\r\n\r\n",
+			port:       6881,
+			infoHashes: [][sha1.Size]byte{infoHash},
+			cookie:     "abc",
+		},
+		{
+			name: "case insensitive keys",
+			message: "BT-SEARCH * HTTP/1.1\r\nPORT: 1\r\nINFOHASH: " + hexHash +
+				"\r\nInfohash: " + hexHash + "\r\n\r\n",
+			port:       1,
+			infoHashes: [][sha1.Size]byte{infoHash, infoHash},
+		},
+		{
+			name:    "incorrect request line",
+			message: "GET / HTTP/1.1\r\nPort: 6881\r\nInfohash: " + hexHash + "\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "no port",
+			message: "BT-SEARCH * HTTP/1.1\r\nInfohash: " + hexHash + "\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "port out of range",
+			message: "BT-SEARCH * HTTP/1.1\r\nPort: 65536\r\nInfohash: " + hexHash + "\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "no info hash",
+			message: "BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "short info hash",
+			message: "BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: aabb\r\n\r\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port, infoHashes, cookie, err := parseMessage([]byte(tt.message))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got port %d", port)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unable to parse message: %v", err)
+			}
+
+			if port != tt.port {
+				t.Errorf("port: got %d, expected %d", port, tt.port)
+			}
+			if !reflect.DeepEqual(infoHashes, tt.infoHashes) {
+				t.Errorf("info hashes: got %x, expected %x", infoHashes, tt.infoHashes)
+			}
+			if cookie != tt.cookie {
+				t.Errorf("cookie: got %q, expected %q", cookie, tt.cookie)
+			}
+		})
+	}
+}
+
+// Starts two LSD instances in the same multicast group on the loopback and
+// makes sure that an announcement from one of them reaches the subscriber of
+// the other one, but not the subscriber of the announcing instance.
+func TestAnnounceSubscribe(t *testing.T) {
+	sender, err := New(testGroup, 6881)
+	if err != nil {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+	defer sender.Close()
+	receiver, err := New(testGroup, 6882)
+	if err != nil {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+	defer receiver.Close()
+
+	infoHash := [sha1.Size]byte{1, 2, 3}
+	otherInfoHash := [sha1.Size]byte{4, 5, 6}
+	peers := receiver.Subscribe(infoHash)
+	otherPeers := receiver.Subscribe(otherInfoHash)
+	ownPeers := sender.Subscribe(infoHash)
+
+	if err := sender.Announce(infoHash); err != nil {
+		t.Skipf("unable to send multicast announcement: %v", err)
+	}
+
+	var addr *net.TCPAddr
+	select {
+	case addr = <-peers:
+	case <-time.After(2 * time.Second):
+		t.Skip("announcement not looped back, multicast is probably unavailable")
+	}
+	if addr.Port != 6881 {
+		t.Errorf("received port %d, expected 6881", addr.Port)
+	}
+
+	select {
+	case addr := <-otherPeers:
+		t.Errorf("received %v for an info hash that wasn't announced", addr)
+	case addr := <-ownPeers:
+		t.Errorf("received own announcement %v", addr)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Announcements of the same info hash are rate limited.
+	receiver.Unsubscribe(infoHash)
+	peers = receiver.Subscribe(infoHash)
+	if err := sender.Announce(infoHash); err != nil {
+		t.Fatalf("unable to announce: %v", err)
+	}
+	select {
+	case addr := <-peers:
+		t.Errorf("received %v from an announcement within MinAnnounceInterval", addr)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,476 @@
+// Contains logic related to Message Stream Encryption (MSE), also known as
+// Protocol Encryption (PE). A Diffie-Hellman key exchange is done before the
+// BitTorrent handshake and the rest of the connection is obfuscated with RC4.
+// See http://wiki.vuze.com/w/Message_Stream_Encryption
+package peer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+
+	bt "github.com/jmatss/torc/internal/util/bittorrent"
+)
+
+// Decides if the connections to remote peers are encrypted.
+type EncryptionPolicy int
+
+const (
+	// Only plaintext connections are used, encrypted incoming connections
+	// are refused.
+	EncryptionDisabled EncryptionPolicy = iota
+	// Outgoing connections are encrypted and falls back to plaintext if the
+	// remote peer doesn't support encryption. Both encrypted and plaintext
+	// incoming connections are accepted.
+	EncryptionPrefer
+	// Only encrypted connections are used, plaintext incoming connections
+	// are refused.
+	EncryptionRequire
+)
+
+func (e EncryptionPolicy) String() string {
+	return []string{
+		"disabled",
+		"prefer",
+		"require",
+	}[e]
+}
+
+// Returns the EncryptionPolicy with the name "name" (case insensitive).
+func ParseEncryptionPolicy(name string) (EncryptionPolicy, error) {
+	for _, policy := range []EncryptionPolicy{EncryptionDisabled, EncryptionPrefer, EncryptionRequire} {
+		if strings.ToLower(name) == policy.String() {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown encryption policy \"%s\"", name)
+}
+
+var (
+	// The encryption policy used for all connections of this client. It can be
+	// changed while connections are made, see Encryption and SetEncryption.
+	currentEncryption    = EncryptionPrefer
+	currentEncryptionMut sync.RWMutex
+	// If set, all data sent after the handshake is RC4 encrypted. Otherwise
+	// only the handshakes are obfuscated if the remote peer allows it.
+	EncryptPayload = true
+)
+
+// Returns the encryption policy used for all connections of this client.
+func Encryption() EncryptionPolicy {
+	currentEncryptionMut.RLock()
+	defer currentEncryptionMut.RUnlock()
+	return currentEncryption
+}
+
+// Changes the encryption policy. Connections that already have been
+// established aren't affected.
+func SetEncryption(policy EncryptionPolicy) {
+	currentEncryptionMut.Lock()
+	defer currentEncryptionMut.Unlock()
+	currentEncryption = policy
+}
+
+const (
+	// The length of the public keys and the shared secret.
+	mseKeyLength = 96
+	// The length of the private keys.
+	msePrivateKeyLength = 20
+	// Max length of the random padding sent during the handshake.
+	mseMaxPadding = 512
+	// The amount of bytes discarded from the start of the RC4 key streams.
+	mseDiscard = 1024
+
+	// The "crypto_provide" and "crypto_select" bits.
+	cryptoPlaintext uint32 = 0x01
+	cryptoRC4       uint32 = 0x02
+)
+
+var (
+	msePrime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	mseGenerator = big.NewInt(2)
+	// The verification constant, 8 zero bytes.
+	mseVC = make([]byte, 8)
+)
+
+// The info hashes of the torrents that this client is in charge of, mapped
+// from HASH('req2', info hash). Used to find the info hash (SKEY) requested by
+// remote peers connecting with encryption.
+var (
+	infoHashes    = make(map[[sha1.Size]byte][sha1.Size]byte)
+	infoHashesMut sync.RWMutex
+)
+
+// Makes it possible for remote peers to connect with encryption to the torrent
+// with the info hash "infoHash".
+func AddInfoHash(infoHash [sha1.Size]byte) {
+	infoHashesMut.Lock()
+	defer infoHashesMut.Unlock()
+	infoHashes[mseHash([]byte("req2"), infoHash[:])] = infoHash
+}
+
+// Removes an info hash added with AddInfoHash.
+func RemoveInfoHash(infoHash [sha1.Size]byte) {
+	infoHashesMut.Lock()
+	defer infoHashesMut.Unlock()
+	delete(infoHashes, mseHash([]byte("req2"), infoHash[:]))
+}
+
+// A connection where the data read and written can be RC4 encrypted. Data
+// received during the handshake that belongs to the stream after the handshake
+// is read before the data on the connection.
+type encryptedConn struct {
+	net.Conn
+	reader io.Reader
+
+	// Makes sure that the data is written in the same order as it is encrypted.
+	writeMut sync.Mutex
+	// Nil if the payload isn't encrypted.
+	encrypt *rc4.Cipher
+}
+
+func newEncryptedConn(conn net.Conn, received []byte, encrypt, decrypt *rc4.Cipher) *encryptedConn {
+	var reader io.Reader = conn
+	if decrypt != nil {
+		reader = &cipherReader{reader: conn, cipher: decrypt}
+	}
+	if len(received) > 0 {
+		reader = io.MultiReader(bytes.NewReader(received), reader)
+	}
+	return &encryptedConn{Conn: conn, reader: reader, encrypt: encrypt}
+}
+
+func (c *encryptedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *encryptedConn) Write(b []byte) (int, error) {
+	if c.encrypt == nil {
+		return c.Conn.Write(b)
+	}
+
+	c.writeMut.Lock()
+	defer c.writeMut.Unlock()
+	encrypted := make([]byte, len(b))
+	c.encrypt.XORKeyStream(encrypted, b)
+	return c.Conn.Write(encrypted)
+}
+
+// Decrypts the data read from "reader".
+type cipherReader struct {
+	reader io.Reader
+	cipher *rc4.Cipher
+}
+
+func (r *cipherReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	r.cipher.XORKeyStream(b[:n], b[:n])
+	return n, err
+}
+
+// Performs the encryption handshake with the remote peer that this client has
+// connected to. Returns the connection that should be used for the BitTorrent
+// handshake and the rest of the communication.
+//
+// https://wiki.vuze.com/w/Message_Stream_Encryption#Handshake
+func initiateEncryption(conn net.Conn, infoHash [sha1.Size]byte) (net.Conn, error) {
+	privateKey, publicKey, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	// 1. A->B: Ya, PadA
+	if _, err := conn.Write(append(publicKey, randomPadding()...)); err != nil {
+		return nil, fmt.Errorf("unable to send public key: %w", err)
+	}
+
+	// 2. B->A: Yb, PadB
+	remoteKey := make([]byte, mseKeyLength)
+	if _, err := io.ReadFull(conn, remoteKey); err != nil {
+		return nil, fmt.Errorf("unable to read public key: %w", err)
+	}
+	secret, err := sharedSecret(privateKey, remoteKey)
+	if err != nil {
+		return nil, err
+	}
+	encrypt := newCipher("keyA", secret, infoHash)
+	decrypt := newCipher("keyB", secret, infoHash)
+
+	// 3. A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	//  ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	// No initial payload (IA) is sent, the BitTorrent handshake is sent
+	// afterwards on the returned connection.
+	req1 := mseHash([]byte("req1"), secret)
+	req2 := mseHash([]byte("req2"), infoHash[:])
+	req3 := mseHash([]byte("req3"), secret)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+	provide := cryptoRC4
+	if !EncryptPayload {
+		provide |= cryptoPlaintext
+	}
+	payload := make([]byte, len(mseVC)+4+2+2)
+	binary.BigEndian.PutUint32(payload[len(mseVC):], provide)
+	encrypt.XORKeyStream(payload, payload)
+
+	data := make([]byte, 0, 2*sha1.Size+len(payload))
+	data = append(data, req1[:]...)
+	data = append(data, req2[:]...)
+	data = append(data, payload...)
+	if _, err := conn.Write(data); err != nil {
+		return nil, fmt.Errorf("unable to send crypto provide: %w", err)
+	}
+
+	// 4. B->A: ENCRYPT(VC, crypto_select, len(padD), padD), ENCRYPT2(Payload Stream)
+	// PadB has a unknown length, so the encrypted VC is used to find where it ends.
+	encryptedVC := make([]byte, len(mseVC))
+	decrypt.XORKeyStream(encryptedVC, mseVC)
+	if err := synchronize(conn, encryptedVC, mseMaxPadding); err != nil {
+		return nil, fmt.Errorf("unable to find verification constant: %w", err)
+	}
+
+	header := make([]byte, 4+2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, fmt.Errorf("unable to read crypto select: %w", err)
+	}
+	decrypt.XORKeyStream(header, header)
+	selected := binary.BigEndian.Uint32(header)
+	padLength := binary.BigEndian.Uint16(header[4:])
+	if padLength > mseMaxPadding {
+		return nil, fmt.Errorf("padding too long, max: %d, got: %d", mseMaxPadding, padLength)
+	}
+	pad := make([]byte, padLength)
+	if _, err := io.ReadFull(conn, pad); err != nil {
+		return nil, fmt.Errorf("unable to read padding: %w", err)
+	}
+	decrypt.XORKeyStream(pad, pad)
+
+	if (selected != cryptoRC4 && selected != cryptoPlaintext) || selected&provide == 0 {
+		return nil, fmt.Errorf("remote peer selected incorrect crypto method %d", selected)
+	} else if selected == cryptoPlaintext {
+		return conn, nil
+	}
+	return newEncryptedConn(conn, nil, encrypt, decrypt), nil
+}
+
+// Performs the encryption handshake with a remote peer that has connected to
+// this client. "received" contains the first bytes that have already been read
+// from the connection. Returns the connection that should be used to receive
+// the BitTorrent handshake and for the rest of the communication.
+//
+// https://wiki.vuze.com/w/Message_Stream_Encryption#Handshake
+func acceptEncryption(conn net.Conn, received []byte) (net.Conn, error) {
+	// 1. A->B: Ya, PadA
+	remoteKey := make([]byte, mseKeyLength)
+	copy(remoteKey, received)
+	if _, err := io.ReadFull(conn, remoteKey[len(received):]); err != nil {
+		return nil, fmt.Errorf("unable to read public key: %w", err)
+	}
+	privateKey, publicKey, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := sharedSecret(privateKey, remoteKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. B->A: Yb, PadB
+	if _, err := conn.Write(append(publicKey, randomPadding()...)); err != nil {
+		return nil, fmt.Errorf("unable to send public key: %w", err)
+	}
+
+	// 3. A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	//  ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	// PadA has a unknown length, so HASH('req1', S) is used to find where it ends.
+	req1 := mseHash([]byte("req1"), secret)
+	if err := synchronize(conn, req1[:], mseMaxPadding); err != nil {
+		return nil, fmt.Errorf("unable to find req1 hash: %w", err)
+	}
+
+	var req2 [sha1.Size]byte
+	if _, err := io.ReadFull(conn, req2[:]); err != nil {
+		return nil, fmt.Errorf("unable to read req2 hash: %w", err)
+	}
+	req3 := mseHash([]byte("req3"), secret)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+	infoHashesMut.RLock()
+	infoHash, ok := infoHashes[req2]
+	infoHashesMut.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("remote peer requested an unknown info hash")
+	}
+	encrypt := newCipher("keyB", secret, infoHash)
+	decrypt := newCipher("keyA", secret, infoHash)
+
+	header := make([]byte, len(mseVC)+4+2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, fmt.Errorf("unable to read crypto provide: %w", err)
+	}
+	decrypt.XORKeyStream(header, header)
+	if !bytes.Equal(header[:len(mseVC)], mseVC) {
+		return nil, fmt.Errorf("incorrect verification constant: %x", header[:len(mseVC)])
+	}
+	provide := binary.BigEndian.Uint32(header[len(mseVC):])
+	padLength := binary.BigEndian.Uint16(header[len(mseVC)+4:])
+	if padLength > mseMaxPadding {
+		return nil, fmt.Errorf("padding too long, max: %d, got: %d", mseMaxPadding, padLength)
+	}
+
+	// Read PadC together with len(IA).
+	pad := make([]byte, padLength+2)
+	if _, err := io.ReadFull(conn, pad); err != nil {
+		return nil, fmt.Errorf("unable to read padding: %w", err)
+	}
+	decrypt.XORKeyStream(pad, pad)
+	initialPayload := make([]byte, binary.BigEndian.Uint16(pad[padLength:]))
+	if _, err := io.ReadFull(conn, initialPayload); err != nil {
+		return nil, fmt.Errorf("unable to read initial payload: %w", err)
+	}
+	decrypt.XORKeyStream(initialPayload, initialPayload)
+
+	var selected uint32
+	if provide&cryptoRC4 != 0 && (EncryptPayload || provide&cryptoPlaintext == 0) {
+		selected = cryptoRC4
+	} else if provide&cryptoPlaintext != 0 {
+		selected = cryptoPlaintext
+	} else {
+		return nil, fmt.Errorf("remote peer provided no supported crypto method: %d", provide)
+	}
+
+	// 4. B->A: ENCRYPT(VC, crypto_select, len(padD), padD), ENCRYPT2(Payload Stream)
+	reply := make([]byte, len(mseVC)+4+2)
+	binary.BigEndian.PutUint32(reply[len(mseVC):], selected)
+	encrypt.XORKeyStream(reply, reply)
+	if _, err := conn.Write(reply); err != nil {
+		return nil, fmt.Errorf("unable to send crypto select: %w", err)
+	}
+
+	if selected == cryptoPlaintext {
+		return newEncryptedConn(conn, initialPayload, nil, nil), nil
+	}
+	return newEncryptedConn(conn, initialPayload, encrypt, decrypt), nil
+}
+
+// Reads the start of a connection from a remote peer that has connected to
+// this client and decides if it is encrypted or not according to the first
+// bytes. The encryption handshake is performed if it is encrypted.
+// Returns the connection that should be used to receive the BitTorrent
+// handshake and if the connection is encrypted.
+func acceptConnection(conn net.Conn) (net.Conn, bool, error) {
+	received := make([]byte, 1+len(bt.PStr))
+	if _, err := io.ReadFull(conn, received); err != nil {
+		return nil, false, fmt.Errorf("unable to read start of connection: %w", err)
+	}
+
+	policy := Encryption()
+	if received[0] == byte(len(bt.PStr)) && bytes.Equal(received[1:], bt.PStr) {
+		if policy == EncryptionRequire {
+			return nil, false, fmt.Errorf("refused plaintext connection, encryption is required")
+		}
+		return newEncryptedConn(conn, received, nil, nil), false, nil
+	}
+
+	if policy == EncryptionDisabled {
+		return nil, false, fmt.Errorf("refused encrypted connection, encryption is disabled")
+	}
+	encrypted, err := acceptEncryption(conn, received)
+	if err != nil {
+		return nil, false, err
+	}
+	return encrypted, true, nil
+}
+
+// Reads from "reader" until "pattern" has been read. Returns an error if more
+// than "maxSkip" bytes are read before the pattern.
+func synchronize(reader io.Reader, pattern []byte, maxSkip int) error {
+	buf := make([]byte, len(pattern))
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return err
+	}
+
+	for skipped := 0; !bytes.Equal(buf, pattern); skipped++ {
+		if skipped >= maxSkip {
+			return fmt.Errorf("pattern not found within %d bytes", maxSkip)
+		}
+		copy(buf, buf[1:])
+		if _, err := io.ReadFull(reader, buf[len(buf)-1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Generates a new private key and returns it together with its public key.
+func newKeyPair() (*big.Int, []byte, error) {
+	private := make([]byte, msePrivateKeyLength)
+	if _, err := rand.Read(private); err != nil {
+		return nil, nil, fmt.Errorf("unable to generate private key: %w", err)
+	}
+	privateKey := new(big.Int).SetBytes(private)
+	publicKey := new(big.Int).Exp(mseGenerator, privateKey, msePrime)
+	return privateKey, padKey(publicKey), nil
+}
+
+// Calculates the shared secret (S) from this clients private key and the
+// public key of the remote peer.
+func sharedSecret(privateKey *big.Int, remoteKey []byte) ([]byte, error) {
+	y := new(big.Int).SetBytes(remoteKey)
+	max := new(big.Int).Sub(msePrime, big.NewInt(1))
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(max) >= 0 {
+		return nil, fmt.Errorf("received incorrect public key")
+	}
+	return padKey(new(big.Int).Exp(y, privateKey, msePrime)), nil
+}
+
+// Returns "key" as a big-endian byte slice of length mseKeyLength.
+func padKey(key *big.Int) []byte {
+	b := key.Bytes()
+	padded := make([]byte, mseKeyLength)
+	copy(padded[mseKeyLength-len(b):], b)
+	return padded
+}
+
+// Returns random bytes with a random length between 0 and mseMaxPadding.
+func randomPadding() []byte {
+	length, err := rand.Int(rand.Reader, big.NewInt(mseMaxPadding+1))
+	if err != nil {
+		return nil
+	}
+	pad := make([]byte, length.Int64())
+	if _, err := rand.Read(pad); err != nil {
+		return nil
+	}
+	return pad
+}
+
+// Creates a RC4 cipher with the key HASH(name, S, SKEY) and discards the
+// first mseDiscard bytes of its key stream.
+func newCipher(name string, secret []byte, infoHash [sha1.Size]byte) *rc4.Cipher {
+	key := mseHash([]byte(name), secret, infoHash[:])
+	cipher, _ := rc4.NewCipher(key[:])
+	discard := make([]byte, mseDiscard)
+	cipher.XORKeyStream(discard, discard)
+	return cipher
+}
+
+func mseHash(parts ...[]byte) [sha1.Size]byte {
+	hash := sha1.New()
+	for _, part := range parts {
+		hash.Write(part)
+	}
+	var sum [sha1.Size]byte
+	copy(sum[:], hash.Sum(nil))
+	return sum
+}
@@ -0,0 +1,221 @@
+package peer
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	bt "github.com/jmatss/torc/internal/util/bittorrent"
+)
+
+// Returns both ends of a TCP connection on localhost.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to connect: %v", err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		client.Close()
+		t.Fatalf("unable to accept: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	client.SetDeadline(deadline)
+	server.SetDeadline(deadline)
+	return client, server
+}
+
+func TestEncryptionHandshake(t *testing.T) {
+	infoHash := sha1.Sum([]byte("torrent"))
+	AddInfoHash(infoHash)
+	defer RemoveInfoHash(infoHash)
+
+	defer SetEncryption(Encryption())
+	defer func(encryptPayload bool) { EncryptPayload = encryptPayload }(EncryptPayload)
+
+	tests := []struct {
+		name           string
+		policy         EncryptionPolicy // the policy of the accepting side
+		plaintext      bool             // the connecting side doesn't use encryption
+		encryptPayload bool
+		infoHash       [sha1.Size]byte
+		encrypted      bool // the handshake is encrypted
+		rc4            bool // the payload is encrypted
+		ok             bool
+	}{
+		{"rc4 payload", EncryptionPrefer, false, true, infoHash, true, true, true},
+		{"rc4 payload required", EncryptionRequire, false, true, infoHash, true, true, true},
+		{"plaintext payload", EncryptionPrefer, false, false, infoHash, true, false, true},
+		{"plaintext connection", EncryptionPrefer, true, true, infoHash, false, false, true},
+		{"plaintext connection encryption disabled", EncryptionDisabled, true, true, infoHash, false, false, true},
+		{"plaintext refused", EncryptionRequire, true, true, infoHash, false, false, false},
+		{"encryption refused", EncryptionDisabled, false, true, infoHash, false, false, false},
+		{"unknown info hash", EncryptionPrefer, false, true, sha1.Sum([]byte("unknown")), false, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetEncryption(tt.policy)
+			EncryptPayload = tt.encryptPayload
+
+			client, server := tcpPair(t)
+			defer client.Close()
+			defer server.Close()
+
+			type result struct {
+				conn net.Conn
+				err  error
+			}
+			initiated := make(chan result, 1)
+			go func() {
+				if tt.plaintext {
+					_, err := client.Write(append([]byte{byte(len(bt.PStr))}, bt.PStr...))
+					initiated <- result{client, err}
+					return
+				}
+				conn, err := initiateEncryption(client, tt.infoHash)
+				initiated <- result{conn, err}
+			}()
+
+			accepted, encrypted, err := acceptConnection(server)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("expected the connection to be refused")
+				}
+				// Makes the connecting side give up.
+				server.Close()
+				<-initiated
+				return
+			} else if err != nil {
+				t.Fatalf("unable to accept connection: %v", err)
+			}
+			init := <-initiated
+			if init.err != nil {
+				t.Fatalf("unable to initiate connection: %v", init.err)
+			}
+
+			if encrypted != tt.encrypted {
+				t.Errorf("encrypted: expected %v, got: %v", tt.encrypted, encrypted)
+			}
+			if c, ok := accepted.(*encryptedConn); !ok || (c.encrypt != nil) != tt.rc4 {
+				t.Errorf("expected the accepted payload to be encrypted: %v", tt.rc4)
+			}
+			if _, ok := init.conn.(*encryptedConn); ok != tt.rc4 {
+				t.Errorf("expected the initiated payload to be encrypted: %v", tt.rc4)
+			}
+
+			// The start of a plaintext handshake is read from the accepted
+			// connection again.
+			if tt.plaintext {
+				start := make([]byte, 1+len(bt.PStr))
+				if _, err := io.ReadFull(accepted, start); err != nil {
+					t.Fatalf("unable to read start of handshake: %v", err)
+				} else if !bytes.Equal(start[1:], bt.PStr) {
+					t.Fatalf("incorrect start of handshake: %q", start)
+				}
+			}
+
+			// Data is received unchanged in both directions.
+			for _, conns := range [][2]net.Conn{{init.conn, accepted}, {accepted, init.conn}} {
+				sent := bytes.Repeat([]byte("payload"), 1000)
+				go conns[0].Write(sent)
+				received := make([]byte, len(sent))
+				if _, err := io.ReadFull(conns[1], received); err != nil {
+					t.Fatalf("unable to read payload: %v", err)
+				} else if !bytes.Equal(received, sent) {
+					t.Fatalf("received payload differs from the sent payload")
+				}
+			}
+		})
+	}
+}
+
+func TestSharedSecret(t *testing.T) {
+	privateA, publicA, err := newKeyPair()
+	if err != nil {
+		t.Fatalf("unable to create key pair: %v", err)
+	}
+	privateB, publicB, err := newKeyPair()
+	if err != nil {
+		t.Fatalf("unable to create key pair: %v", err)
+	}
+
+	secretA, err := sharedSecret(privateA, publicB)
+	if err != nil {
+		t.Fatalf("unable to calculate secret: %v", err)
+	}
+	secretB, err := sharedSecret(privateB, publicA)
+	if err != nil {
+		t.Fatalf("unable to calculate secret: %v", err)
+	}
+	if !bytes.Equal(secretA, secretB) || len(secretA) != mseKeyLength {
+		t.Fatalf("the shared secrets differ")
+	}
+
+	tests := []struct {
+		name string
+		key  *big.Int
+	}{
+		{"zero", big.NewInt(0)},
+		{"one", big.NewInt(1)},
+		{"prime minus one", new(big.Int).Sub(msePrime, big.NewInt(1))},
+		{"prime", msePrime},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := sharedSecret(privateA, padKey(tt.key)); err == nil {
+				t.Fatalf("expected the public key to be refused")
+			}
+		})
+	}
+}
+
+func TestSynchronize(t *testing.T) {
+	pattern := []byte("pattern")
+
+	tests := []struct {
+		name    string
+		data    []byte
+		maxSkip int
+		rest    string // the data left after the pattern
+		ok      bool
+	}{
+		{"at start", []byte("patternrest"), 0, "rest", true},
+		{"after padding", []byte("padpatternrest"), 3, "rest", true},
+		{"partial match in padding", []byte("patpatternrest"), 3, "rest", true},
+		{"padding too long", []byte("padpatternrest"), 2, "", false},
+		{"missing", []byte("padding"), 512, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bytes.NewReader(tt.data)
+			err := synchronize(reader, pattern, tt.maxSkip)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unable to synchronize: %v", err)
+			}
+
+			rest, _ := ioutil.ReadAll(reader)
+			if string(rest) != tt.rest {
+				t.Fatalf("expected %q after the pattern, got: %q", tt.rest, rest)
+			}
+		})
+	}
+}
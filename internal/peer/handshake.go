@@ -5,11 +5,14 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
 	"time"
 
 	bt "github.com/jmatss/torc/internal/util/bittorrent"
 	"github.com/jmatss/torc/internal/util/logger"
+	"github.com/jmatss/torc/internal/utp"
 )
 
 const (
@@ -20,11 +23,11 @@ const (
 // TODO: make sure to do "os.IsTimeout" on the returned error to see if it as timeout
 // https://wiki.theory.org/index.php/BitTorrentSpecification#Handshake
 // Initiates a handshake with the peer.
+// The connection is encrypted according to the policy returned by Encryption.
 func (p *Peer) Handshake(infoHash [sha1.Size]byte, peerId string) (net.Conn, error) {
-	conn, err := net.Dial(Protocol, p.HostAndPort)
+	conn, err := p.dial(infoHash)
 	if err != nil {
-		return nil, fmt.Errorf("unable to establish connection to "+
-			"%s: %w", p.HostAndPort, err)
+		return nil, err
 	}
 
 	p.Connection = conn
@@ -34,11 +37,6 @@ func (p *Peer) Handshake(infoHash [sha1.Size]byte, peerId string) (net.Conn, err
 		}
 	}()
 
-	if err = p.Connection.SetDeadline(time.Now().Add(HandshakeTimeout)); err != nil {
-		return nil, fmt.Errorf("unable to set deadline for connection to "+
-			"%s: %w", p.Connection.RemoteAddr().String(), err)
-	}
-
 	if err = p.sendHandshake(infoHash, peerId); err != nil {
 		return nil, err
 	}
@@ -57,11 +55,122 @@ func (p *Peer) Handshake(infoHash [sha1.Size]byte, peerId string) (net.Conn, err
 	return conn, nil
 }
 
-/*
-TODO: implement so that this client can receive handshake from a remote peer.
- Listen on socket.
-func RecvHandshake(peerId string, infoHash [sha1.Size]byte) (Peer, error) {}
-*/
+// Connects to the remote peer and sets the handshake deadline. Performs the
+// encryption handshake unless encryption is disabled. If encryption is
+// preferred but the encryption handshake fails, a new plaintext connection
+// is made.
+func (p *Peer) dial(infoHash [sha1.Size]byte) (net.Conn, error) {
+	policy := Encryption()
+	conn, err := p.dialWithDeadline()
+	if err != nil || policy == EncryptionDisabled {
+		return conn, err
+	}
+
+	encrypted, err := initiateEncryption(conn, infoHash)
+	if err == nil {
+		p.Encrypted = true
+		return encrypted, nil
+	}
+	conn.Close()
+
+	if policy == EncryptionRequire {
+		return nil, fmt.Errorf("unable to establish encrypted connection to "+
+			"%s: %w", p.HostAndPort, err)
+	}
+	logger.Log(logger.High, "encryption handshake with %s failed, retrying "+
+		"with plaintext: %v", p.HostAndPort, err)
+
+	return p.dialWithDeadline()
+}
+
+func (p *Peer) dialWithDeadline() (net.Conn, error) {
+	conn, err := p.dialTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = conn.SetDeadline(time.Now().Add(HandshakeTimeout)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to set deadline for connection to "+
+			"%s: %w", conn.RemoteAddr().String(), err)
+	}
+
+	return conn, nil
+}
+
+// Receives a handshake from a remote peer that has connected to this client.
+// Creates and returns a new Peer containing the connection together with the
+// info hash that the remote peer specified in its handshake. The caller is
+// responsible for closing the connection if an error is returned.
+//
+// The handshake isn't answered here, the Peer.AcceptHandshake function should
+// be called when it has been decided that the info hash belongs to a torrent
+// that this client is in charge of.
+func RecvHandshake(conn net.Conn) (*Peer, [sha1.Size]byte, error) {
+	var infoHash [sha1.Size]byte
+
+	host, portString, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil, infoHash, fmt.Errorf("unable to parse remote address "+
+			"%s: %w", conn.RemoteAddr().String(), err)
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, infoHash, fmt.Errorf("unable to parse remote port "+
+			"%s: %w", portString, err)
+	}
+
+	p := NewPeer(host, uint16(port))
+	p.Incoming = true
+	_, p.UTP = conn.(*utp.Conn)
+
+	if err = conn.SetDeadline(time.Now().Add(HandshakeTimeout)); err != nil {
+		return nil, infoHash, fmt.Errorf("unable to set deadline for connection to "+
+			"%s: %w", conn.RemoteAddr().String(), err)
+	}
+
+	// The remote peer might have started with an encryption handshake.
+	p.Connection, p.Encrypted, err = acceptConnection(conn)
+	if err != nil {
+		return nil, infoHash, fmt.Errorf("unable to accept connection from "+
+			"%s: %w", conn.RemoteAddr().String(), err)
+	}
+
+	remoteInfoHash, err := p.readHandshake()
+	if err != nil {
+		return nil, infoHash, err
+	}
+	copy(infoHash[:], remoteInfoHash)
+
+	return p, infoHash, nil
+}
+
+// Answers a handshake that has been received with RecvHandshake by sending
+// this clients handshake back to the remote peer.
+func (p *Peer) AcceptHandshake(infoHash [sha1.Size]byte, peerId string) (net.Conn, error) {
+	if !p.Incoming || p.Connection == nil {
+		return nil, fmt.Errorf("unable to accept handshake from %s: "+
+			"no incoming connection established", p.HostAndPort)
+	}
+
+	if err := p.Connection.SetDeadline(time.Now().Add(HandshakeTimeout)); err != nil {
+		return nil, fmt.Errorf("unable to set deadline for connection to "+
+			"%s: %w", p.Connection.RemoteAddr().String(), err)
+	}
+
+	if err := p.sendHandshake(infoHash, peerId); err != nil {
+		return nil, err
+	}
+
+	if err := p.Connection.SetDeadline(time.Now().Add(ConnectionTimeout)); err != nil {
+		return nil, fmt.Errorf("unable to set deadline for connection to "+
+			"%s: %w", p.Connection.RemoteAddr().String(), err)
+	}
+
+	logger.Log(logger.High, "Peer handshake accepted")
+
+	return p.Connection, nil
+}
 
 func (p *Peer) sendHandshake(infoHash [sha1.Size]byte, peerId string) error {
 	// handshake: <pstrlen><pstr><reserved><info_hash><peer_id>
@@ -93,40 +202,54 @@ func (p *Peer) sendHandshake(infoHash [sha1.Size]byte, peerId string) error {
 }
 
 func (p *Peer) recvHandshake(infoHash [sha1.Size]byte) error {
+	remoteInfoHash, err := p.readHandshake()
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(remoteInfoHash, infoHash[:]) {
+		return fmt.Errorf("received incorrect hash id from remote %s, "+
+			"expected: %040x, got: %040x", p.Connection.RemoteAddr().String(), infoHash, remoteInfoHash)
+	}
+
+	return nil
+}
+
+// Reads a handshake message from the remote peer and returns the info hash
+// that the remote peer specified.
+func (p *Peer) readHandshake() ([]byte, error) {
 	// The handshake message is 49+len(pstr) bytes.
 	// len(pstr) is stored in the first byte.
 	lenpstrByte := make([]byte, 1)
 	n, err := p.Connection.Read(lenpstrByte)
 	if err != nil || n != len(lenpstrByte) {
-		return fmt.Errorf("unable to read the first byte of handshake message "+
+		return nil, fmt.Errorf("unable to read the first byte of handshake message "+
 			"sent from remote peer %s: %w", p.Connection.RemoteAddr(), err)
 	}
 	lenpstr := int(lenpstrByte[0])
 
 	// Read rest of handshake response
 	response := make([]byte, 49+lenpstr-1)
-	n, err = p.Connection.Read(response)
+	n, err = io.ReadFull(p.Connection, response)
 	if err != nil {
-		return fmt.Errorf("unable to read handshake message from remote peer "+
+		return nil, fmt.Errorf("unable to read handshake message from remote peer "+
 			"%s: %w", p.Connection.RemoteAddr(), err)
 	} else if n != len(response) {
-		return fmt.Errorf("unexpected amount of bytes read from remote peer %s"+
+		return nil, fmt.Errorf("unexpected amount of bytes read from remote peer %s"+
 			" during handshake. expected: %d, got: %d", p.Connection.RemoteAddr(), len(response), n)
 	}
 
 	// Received handshake format: <pstrlen><pstr><reserved><info_hash><peer_id>
-	// TODO: Ignoring pstr, reserved & peerid, only interested in infoHash,
-	//  implement more functionality later.
+	// TODO: Ignoring pstr & peerid, implement more functionality later.
+	reserved := response[lenpstr : lenpstr+len(bt.Reserved)]
+	p.SupportsExtensions = reserved[bt.ExtensionByte]&bt.ExtensionBit != 0
+	p.SupportsFast = reserved[bt.FastByte]&bt.FastBit != 0
+
 	start := lenpstr + len(bt.Reserved)
-	end := lenpstr + len(bt.Reserved) + len(infoHash)
+	end := lenpstr + len(bt.Reserved) + sha1.Size
 	remoteInfoHash := response[start:end]
 
-	if !bytes.Equal(remoteInfoHash, infoHash[:]) {
-		return fmt.Errorf("received incorrect hash id from remote %s, "+
-			"expected: %040x, got: %040x", p.Connection.RemoteAddr().String(), infoHash, remoteInfoHash)
-	}
-
 	logger.Log(logger.High, "Received peer handshake from %s", p.Connection.RemoteAddr())
 
-	return nil
+	return remoteInfoHash, nil
 }
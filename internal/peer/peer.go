@@ -3,19 +3,89 @@ package peer
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/jmatss/torc/internal/torrent"
 	bt "github.com/jmatss/torc/internal/util/bittorrent"
 	"github.com/jmatss/torc/internal/util/logger"
+	"github.com/jmatss/torc/internal/util/ratelimit"
 )
 
 const (
 	ConnectionTimeout = 2 * time.Minute
+
+	// The amount of pieces with incorrect hashes that a remote peer can send
+	// before this client stops downloading from it.
+	MaxBadPieces = 3
+
+	// How long to wait before connecting to a remote peer again after the
+	// connection failed or was lost. Doubled for every failure in a row, up
+	// to MaxRedialBackoff.
+	RedialBackoff    = 30 * time.Second
+	MaxRedialBackoff = 30 * time.Minute
+
+	// How long a downloader waits before it looks for a free piece again when
+	// the remote peer doesn't have any pieces that needs to be downloaded.
+	FreePieceRetryInterval = 5 * time.Second
+
+	// The max length of the block in a received Piece message, this client
+	// never requests blocks bigger than this. Same as torrent.MaxRequestLength.
+	MaxBlockLength = 1 << 14
+	// The max length of the payload of a received Extended message. Fits a
+	// piece of the metadata (16 KiB) together with its bencoded header.
+	MaxExtendedLength = MaxBlockLength + 1024
+	// The max length of a received Bitfield before the amount of pieces in the
+	// torrent is known, enough for 8388608 pieces.
+	MaxBitFieldLength = 1 << 20
+	// The max length of the payload of all other messages. The longest ones
+	// are Request, Cancel and RejectRequest: <index><begin><length>
+	maxFixedLength = 12
+)
+
+var (
+	// The max upload/download rate of every remote peer in bytes per second,
+	// 0 if unlimited. Changed at runtime with com.UploadLimit/com.DownloadLimit,
+	// see Rates, SetUploadRate and SetDownloadRate.
+	uploadRate   int64
+	downloadRate int64
+	ratesMut     sync.RWMutex
+)
+
+// Returns the max upload and download rate of every remote peer.
+func Rates() (upload, download int64) {
+	ratesMut.RLock()
+	defer ratesMut.RUnlock()
+	return uploadRate, downloadRate
+}
+
+// Sets the max upload rate of remote peers that are connected from now on.
+// The limiters of peers that already are connected are changed separately.
+func SetUploadRate(rate int64) {
+	ratesMut.Lock()
+	defer ratesMut.Unlock()
+	uploadRate = rate
+}
+
+// Sets the max download rate of remote peers that are connected from now on.
+// The limiters of peers that already are connected are changed separately.
+func SetDownloadRate(rate int64) {
+	ratesMut.Lock()
+	defer ratesMut.Unlock()
+	downloadRate = rate
+}
+
+// Flags describing a remote peer, received from other remote peers through
+// peer exchange. See http://www.bittorrent.org/beps/bep_0011.html
+const (
+	FlagPrefersEncryption byte = 1 << iota
+	FlagSeed
+	FlagUTP
+	FlagHolepunch
+	FlagReachable
 )
 
 type Peer struct {
@@ -27,6 +97,30 @@ type Peer struct {
 	Port        uint16
 	HostAndPort string
 
+	// Incoming is set if the remote peer initiated the connection to this client.
+	Incoming bool
+	// Set if the remote peer has set the extension bit in its handshake.
+	SupportsExtensions bool
+	// Set if the remote peer has set the fast extension bit in its handshake.
+	// See http://www.bittorrent.org/beps/bep_0006.html
+	SupportsFast bool
+	// The extensions that the remote peer supports mapped to the message ids
+	// that should be used when sending them to the remote peer. Received in
+	// the extended handshake.
+	Extensions map[string]byte
+	// The size of the metadata (info dictionary) according to the remote peer.
+	MetadataSize int
+	// The port that the remote peer listens on, received in the extended
+	// handshake. Differs from Port if the remote peer connected to this client.
+	ListenPort uint16
+	// Flags of this peer, see FlagPrefersEncryption etc.
+	Flags byte
+	// Set if the connection to the remote peer is encrypted with MSE. The
+	// payload might still be plaintext, see EncryptPayload.
+	Encrypted bool
+	// Set if the connection to the remote peer uses uTP instead of TCP.
+	UTP bool
+
 	Connection     net.Conn
 	RemoteBitField []byte
 
@@ -34,6 +128,45 @@ type Peer struct {
 	AmInterested   bool
 	PeerChoking    bool
 	PeerInterested bool
+
+	// The amount of bytes of piece data received from/sent to this peer.
+	// Used by the choker to rank the peers after their transfer rates.
+	Downloaded int64
+	Uploaded   int64
+
+	// The amount of pieces received from this peer that had an incorrect hash.
+	BadPieces int
+
+	// The amount of connections to this peer in a row that have failed and
+	// when the last one failed, see ConnectFailed.
+	ConnectFailures int
+	lastFailure     time.Time
+
+	// The pieces that the remote peer may request while it is choked by this
+	// client (AllowedFast), and the pieces that this client may request while
+	// it is choked by the remote peer (RemoteAllowedFast). Only used if the
+	// remote peer supports the fast extension.
+	AllowedFast       map[uint32]bool
+	RemoteAllowedFast map[uint32]bool
+	// Pieces that the remote peer has suggested that this client downloads.
+	Suggested map[uint32]bool
+
+	// The length of the bitfield of the torrent, i.e. the length that a
+	// Bitfield received from the remote peer must have. 0 if it isn't known
+	// yet, the torrent is waiting for its metadata in that case.
+	BitFieldLength int
+
+	// The amount of requests that are kept in flight to this peer.
+	// If it is 0, the amount is adapted to the download rate of the peer.
+	MaxRequests int
+
+	// Limits the upload/download rate of this peer. The messages sent with
+	// SendData and received with Recv also has to pass the global limiters
+	// and the limiters of the torrent, see SetLimits.
+	UploadLimit          *ratelimit.Limiter
+	DownloadLimit        *ratelimit.Limiter
+	torrentUploadLimit   *ratelimit.Limiter
+	torrentDownloadLimit *ratelimit.Limiter
 }
 
 // Parameter ipString can be either IPv4, IPv6 or a hostname.
@@ -80,15 +213,16 @@ func NewPeer(ipString string, port uint16) *Peer {
 //
 // This function can send:
 // KeepAlive, Choke, UnChoke, Interested, NotInterested, Have,
-// Request and Cancel messages.
+// Request and Cancel messages. And the messages of the fast extension:
+// SuggestPiece, HaveAll, HaveNone, RejectRequest and AllowedFast.
 //
 // It can not send:
 // Bitfield or Piece messages
 //
 // Format of variadic int "input":
-// - KeepAlive, Choke, UnChoke, Interested, NotInterested: Not used
-// - Have: <piece index>[0]
-// - Request, Cancel: <index>[0], <begin>[1], <length>[2]
+// - KeepAlive, Choke, UnChoke, Interested, NotInterested, HaveAll, HaveNone: Not used
+// - Have, SuggestPiece, AllowedFast: <piece index>[0]
+// - Request, Cancel, RejectRequest: <index>[0], <begin>[1], <length>[2]
 func (p *Peer) Send(messageId bt.MessageId, input ...uint32) error {
 	var data []byte
 	id := byte(messageId)
@@ -97,11 +231,11 @@ func (p *Peer) Send(messageId bt.MessageId, input ...uint32) error {
 	case bt.KeepAlive:
 		// Format: <lenPrefix=0000>
 		data = []byte{0, 0, 0, 0}
-	case bt.Choke, bt.UnChoke, bt.Interested, bt.NotInterested:
+	case bt.Choke, bt.UnChoke, bt.Interested, bt.NotInterested, bt.HaveAll, bt.HaveNone:
 		// Format: <lenPrefix=0001><id=X>
 		data = []byte{0, 0, 0, 1, id}
-	case bt.Have:
-		// Format: <lenPrefix=0005><id=4><piece index>
+	case bt.Have, bt.SuggestPiece, bt.AllowedFast:
+		// Format: <lenPrefix=0005><id=X><piece index>
 		if len(input) != 1 {
 			return fmt.Errorf("unable to send \"%s\" message: "+
 				"incorrect amount of arguments to send function, "+
@@ -113,7 +247,7 @@ func (p *Peer) Send(messageId bt.MessageId, input ...uint32) error {
 
 		copy(data, []byte{0, 0, 0, byte(lenPrefix), id})
 		binary.BigEndian.PutUint32(data[5:], input[0])
-	case bt.Request, bt.Cancel:
+	case bt.Request, bt.Cancel, bt.RejectRequest:
 		// Format: 	<lenPrefix=000(13)><id=X><index(4B)><begin(4B)><length(4B)>
 		if len(input) != 3 {
 			return fmt.Errorf("unable to send \"%s\" message: "+
@@ -150,14 +284,18 @@ func (p *Peer) Send(messageId bt.MessageId, input ...uint32) error {
 // Packet format: <length prefix><message ID><payload>
 //
 // This function can send:
-// Bitfield or Piece messages
+// Bitfield, Piece or Extended messages
+//
+// Blocks until the message is allowed to be sent by the upload rate limiters.
 func (p *Peer) SendData(messageId bt.MessageId, payload []byte) error {
 	lenPrefix := 1 + len(payload)
-	id := byte(messageId)
-	data := make([]byte, 0, 4+lenPrefix)
+	data := make([]byte, 4+lenPrefix)
+
+	binary.BigEndian.PutUint32(data[:4], uint32(lenPrefix))
+	data[4] = byte(messageId)
+	copy(data[5:], payload)
 
-	data = append(data, []byte{0, 0, 0, byte(lenPrefix), id}...)
-	data = append(data, payload...)
+	ratelimit.Wait(len(data), ratelimit.GlobalUpload, p.torrentUploadLimit, p.UploadLimit)
 
 	n, err := p.Connection.Write(data)
 	if err != nil {
@@ -178,6 +316,10 @@ func (p *Peer) SendData(messageId bt.MessageId, payload []byte) error {
 //
 // Packet format: <length prefix><message ID><payload>
 // Where <length prefix> is 4 bytes, <message ID> is 1 byte and <payload> is variable length.
+//
+// Blocks after a message has been received until it is allowed by the download
+// rate limiters. Nothing more is read from the connection while blocked, which
+// makes the remote peer slow down.
 func (p *Peer) Recv() (bt.MessageId, []byte, error) {
 	// Reset deadline
 	if err := p.Connection.SetDeadline(time.Now().Add(ConnectionTimeout)); err != nil {
@@ -185,45 +327,171 @@ func (p *Peer) Recv() (bt.MessageId, []byte, error) {
 			"%s: %w", p.Connection.RemoteAddr().String(), err)
 	}
 
-	// Read the "header" i.e. the first five bytes containing payload length and MessageId
-	header := make([]byte, 5)
-	n, err := p.Connection.Read(header)
-
-	if err != nil {
+	// Read the length prefix. A length of zero means that this is a keep alive message.
+	lenPrefixBytes := make([]byte, 4)
+	if _, err := io.ReadFull(p.Connection, lenPrefixBytes); err != nil {
 		return 0, nil, err
-	} else if n == 4 { // Assume this is a keep alive message
+	}
+	lenPrefix := binary.BigEndian.Uint32(lenPrefixBytes)
+	if lenPrefix == 0 {
 		// TODO: Keep a timer for keep alive messages so that this peer can be killed
 		//  if it stops sending messages for a while. ~2 min seems to be a common time.
-		return -1, nil, nil
-	} else if n < 4 {
-		return 0, nil, fmt.Errorf("peer sent to few bytes, expected: >=4, got: %d", n)
+		return bt.KeepAlive, nil, nil
 	}
-	dataLen := binary.BigEndian.Uint32(header[:4]) - 1 // -1 to "remove" len of messageId
-	messageId := bt.MessageId(int(header[4]))
 
-	if dataLen > torrent.MaxRequestLength*2 { // arbitrary value
-		return 0, nil, fmt.Errorf("peer sent to many bytes, expected: >=%d, got: %d",
-			torrent.MaxRequestLength, dataLen)
+	// Read the MessageId, the max length of the payload depends on it.
+	// -1 to "remove" len of messageId.
+	idBytes := make([]byte, 1)
+	if _, err := io.ReadFull(p.Connection, idBytes); err != nil {
+		return 0, nil, err
+	}
+	messageId := bt.MessageId(int(idBytes[0]))
+	dataLen := lenPrefix - 1
+	if maxLen := p.maxPayloadLength(messageId); dataLen > uint32(maxLen) {
+		return 0, nil, fmt.Errorf("peer sent to many bytes in \"%s\" message, "+
+			"expected: <=%d, got: %d", messageId.String(), maxLen, dataLen)
 	}
 
-	logger.Log(logger.High, "Recv from %s - header: 0x%x, datalen: %d, id: %s",
-		p.Connection.RemoteAddr().String(), header[0:5], dataLen, messageId.String())
-
+	// Read the payload.
 	data := make([]byte, dataLen)
-	off := 0
-	if dataLen > 0 {
-		for off < int(dataLen) {
-			n, err = p.Connection.Read(data[off:])
-			if err != nil {
-				return 0, nil, err
-			}
-			off += n
-		}
+	if _, err := io.ReadFull(p.Connection, data); err != nil {
+		return 0, nil, err
 	}
 
+	ratelimit.Wait(len(lenPrefixBytes)+int(lenPrefix),
+		ratelimit.GlobalDownload, p.torrentDownloadLimit, p.DownloadLimit)
+
+	logger.Log(logger.High, "Recv from %s - datalen: %d, id: %s",
+		p.Connection.RemoteAddr().String(), dataLen, messageId.String())
+
 	return messageId, data, nil
 }
 
+// Returns the max length of the payload of a message with the id "messageId"
+// received from this peer.
+func (p *Peer) maxPayloadLength(messageId bt.MessageId) int {
+	switch messageId {
+	case bt.Bitfield:
+		p.RLock()
+		defer p.RUnlock()
+		if p.BitFieldLength > 0 {
+			return p.BitFieldLength
+		}
+		return MaxBitFieldLength
+	case bt.Piece:
+		// <index(4B)><begin(4B)><block>
+		return 8 + MaxBlockLength
+	case bt.Extended:
+		return MaxExtendedLength
+	default:
+		return maxFixedLength
+	}
+}
+
+// Creates the rate limiters of this peer with the rates returned by Rates,
+// and connects them to the rate limiters of the torrent, "torrentUpload" and
+// "torrentDownload". Must be called before the connection is used by multiple
+// go processes.
+func (p *Peer) SetLimits(torrentUpload, torrentDownload *ratelimit.Limiter) {
+	upload, download := Rates()
+	p.UploadLimit = ratelimit.New(upload)
+	p.DownloadLimit = ratelimit.New(download)
+	p.torrentUploadLimit = torrentUpload
+	p.torrentDownloadLimit = torrentDownload
+}
+
+// Returns true if this peer has sent to many pieces with incorrect hashes
+// and shouldn't be connected to again.
+func (p *Peer) Banned() bool {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.BadPieces >= MaxBadPieces
+}
+
+// Records that the connection to this peer failed or was lost. The peer isn't
+// connected to again until the backoff has passed, see CanConnect.
+func (p *Peer) ConnectFailed() {
+	p.Lock()
+	defer p.Unlock()
+
+	p.ConnectFailures++
+	p.lastFailure = time.Now()
+}
+
+// Records that the handshake with this peer succeeded, which resets the backoff.
+func (p *Peer) ConnectSucceeded() {
+	p.Lock()
+	defer p.Unlock()
+
+	p.ConnectFailures = 0
+}
+
+// Returns true if the backoff after the last failed connection to this peer
+// has passed, or if no connection has failed.
+func (p *Peer) CanConnect() bool {
+	p.RLock()
+	defer p.RUnlock()
+
+	if p.ConnectFailures == 0 {
+		return true
+	}
+	return time.Since(p.lastFailure) >= redialBackoff(p.ConnectFailures)
+}
+
+// Returns how long to wait before connecting to a peer again after "failures"
+// failed connections in a row.
+func redialBackoff(failures int) time.Duration {
+	backoff := RedialBackoff
+	for i := 1; i < failures && backoff < MaxRedialBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > MaxRedialBackoff {
+		backoff = MaxRedialBackoff
+	}
+	return backoff
+}
+
+// Parses peers in the compact format where every peer is "ipLen" + 2 bytes:
+// <IP(ipLen B)><port(2B)>. "ipLen" is net.IPv4len or net.IPv6len.
+// The returned peers are indexed by their "host:port".
+func ParseCompact(data []byte, ipLen int) (map[string]*Peer, error) {
+	groupLen := ipLen + 2
+	if len(data)%groupLen != 0 {
+		return nil, fmt.Errorf("length of compact peers is not divisible by %d, "+
+			"actual length: %d", groupLen, len(data))
+	}
+
+	peers := make(map[string]*Peer)
+	for i := 0; i+groupLen <= len(data); i += groupLen {
+		ip := net.IP(append([]byte{}, data[i:i+ipLen]...))
+		port := binary.BigEndian.Uint16(data[i+ipLen : i+groupLen])
+
+		// Use the peers "host:port" as key in the map.
+		tmpPeer := NewPeer(ip.String(), port)
+		peers[tmpPeer.HostAndPort] = tmpPeer
+	}
+
+	return peers, nil
+}
+
+// Returns the "host:port" that other remote peers can use to connect to this
+// peer. Returns false if it isn't known, i.e. if the peer is specified with a
+// hostname or if it is a incoming peer that hasn't told which port it listens on.
+func (p *Peer) ReachableAt() (string, bool) {
+	p.RLock()
+	defer p.RUnlock()
+
+	if !p.UsingIp {
+		return "", false
+	} else if !p.Incoming {
+		return p.HostAndPort, true
+	} else if p.ListenPort == 0 {
+		return "", false
+	}
+	return net.JoinHostPort(p.Ip.String(), strconv.Itoa(int(p.ListenPort))), true
+}
+
 // Compares the IP/hostname of the peer.
 // Will return false if a host has changed from using a hostname, IPv4 or IPv6 to one of the other,
 // i.e. dns.google and 8.8.8.8 might be the same host, but this function will return false.
@@ -238,3 +506,26 @@ func (p *Peer) Equal(other *Peer) bool {
 		return strings.ToLower(p.Hostname) == strings.ToLower(other.Hostname)
 	}
 }
+
+// Sends a message of the extension "name" to the remote peer. The message id
+// that the remote peer specified in its extended handshake is used.
+func (p *Peer) SendExtended(name string, payload []byte) error {
+	p.RLock()
+	remoteId, ok := p.Extensions[name]
+	p.RUnlock()
+	if !ok {
+		return fmt.Errorf("the remote peer doesn't support %s", name)
+	}
+
+	return p.SendData(bt.Extended, append([]byte{remoteId}, payload...))
+}
+
+// Returns true if the remote peer has specified that it supports the
+// extension "name" in its extended handshake.
+func (p *Peer) SupportsExtension(name string) bool {
+	p.RLock()
+	defer p.RUnlock()
+
+	_, ok := p.Extensions[name]
+	return ok
+}
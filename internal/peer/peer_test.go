@@ -0,0 +1,173 @@
+package peer
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	bt "github.com/jmatss/torc/internal/util/bittorrent"
+)
+
+func TestParseCompact(t *testing.T) {
+	ipv6 := net.ParseIP("2001:db8::1")
+	mapped := net.ParseIP("::ffff:10.0.0.1")
+
+	tests := []struct {
+		name     string
+		data     []byte
+		ipLen    int
+		expected []string // the HostAndPort of the peers
+		ok       bool
+	}{
+		{"empty", nil, net.IPv4len, []string{}, true},
+		{"ipv4", []byte{10, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0x1a, 0xe2}, net.IPv4len,
+			[]string{"10.0.0.1:6881", "10.0.0.2:6882"}, true},
+		{"ipv4 incorrect length", []byte{10, 0, 0, 1, 0x1a}, net.IPv4len, nil, false},
+		{"ipv6", append(append([]byte{}, ipv6...), 0x1a, 0xe1), net.IPv6len,
+			[]string{"[2001:db8::1]:6881"}, true},
+		{"ipv6 multiple", append(append(append(append([]byte{}, ipv6...), 0x1a, 0xe1), ipv6...), 0x1a, 0xe2),
+			net.IPv6len, []string{"[2001:db8::1]:6881", "[2001:db8::1]:6882"}, true},
+		// An IPv4-mapped IPv6 address is the same peer as the IPv4 address.
+		{"ipv4-mapped ipv6", append(append([]byte{}, mapped...), 0x1a, 0xe1), net.IPv6len,
+			[]string{"10.0.0.1:6881"}, true},
+		{"ipv6 incorrect length", append(append([]byte{}, ipv6...), 0x1a, 0xe1, 0), net.IPv6len, nil, false},
+		// 12 bytes is two IPv4 peers, but not a whole IPv6 peer.
+		{"ipv4 data as ipv6", make([]byte, 12), net.IPv6len, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peers, err := ParseCompact(tt.data, tt.ipLen)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("expected an error, got: %v", peers)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unable to parse compact peers: %v", err)
+			}
+
+			got := make([]string, 0, len(peers))
+			for hostAndPort, p := range peers {
+				if p.HostAndPort != hostAndPort {
+					t.Errorf("expected key %s to match the peer, got: %s", hostAndPort, p.HostAndPort)
+				}
+				if !p.UsingIp {
+					t.Errorf("%s: expected the peer to use an IP address", hostAndPort)
+				}
+				got = append(got, hostAndPort)
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tt.expected, ",") {
+				t.Fatalf("expected: %v, got: %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestRecvMaxPayloadLength(t *testing.T) {
+	tests := []struct {
+		name           string
+		id             bt.MessageId
+		payloadLength  int
+		bitFieldLength int
+		ok             bool
+	}{
+		{"have", bt.Have, 4, 0, true},
+		{"have too long", bt.Have, 13, 0, false},
+		{"piece with full block", bt.Piece, 8 + MaxBlockLength, 0, true},
+		{"piece too long", bt.Piece, 9 + MaxBlockLength, 0, false},
+		{"extended metadata piece", bt.Extended, MaxBlockLength + 64, 0, true},
+		{"extended too long", bt.Extended, MaxExtendedLength + 1, 0, false},
+		// 300000 pieces, more than fits in 32 KiB.
+		{"bitfield of large torrent", bt.Bitfield, 37500, 37500, true},
+		{"bitfield longer than torrent", bt.Bitfield, 37501, 37500, false},
+		{"bitfield before metadata", bt.Bitfield, 37500, 0, true},
+		{"bitfield too long before metadata", bt.Bitfield, MaxBitFieldLength + 1, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local, remote := net.Pipe()
+			defer local.Close()
+			defer remote.Close()
+
+			p := NewPeer("127.0.0.1", 6881)
+			p.Connection = local
+			p.BitFieldLength = tt.bitFieldLength
+
+			message := make([]byte, 5+tt.payloadLength)
+			binary.BigEndian.PutUint32(message, uint32(1+tt.payloadLength))
+			message[4] = byte(tt.id)
+			go remote.Write(message)
+
+			id, data, err := p.Recv()
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("expected error, got message with payload length %d", len(data))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if id != tt.id || len(data) != tt.payloadLength {
+				t.Fatalf("expected id %s with payload length %d, got: id %s with payload length %d",
+					tt.id.String(), tt.payloadLength, id.String(), len(data))
+			}
+		})
+	}
+}
+
+func TestRedialBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		expected time.Duration
+	}{
+		{1, RedialBackoff},
+		{2, 2 * RedialBackoff},
+		{3, 4 * RedialBackoff},
+		{6, 32 * RedialBackoff},
+		{7, MaxRedialBackoff},
+		{100, MaxRedialBackoff},
+	}
+
+	for _, tt := range tests {
+		if got := redialBackoff(tt.failures); got != tt.expected {
+			t.Errorf("failures %d: expected: %v, got: %v", tt.failures, tt.expected, got)
+		}
+	}
+}
+
+func TestCanConnect(t *testing.T) {
+	p := NewPeer("127.0.0.1", 6881)
+	if !p.CanConnect() {
+		t.Fatalf("expected to be able to connect to a new peer")
+	}
+
+	p.ConnectFailed()
+	if p.CanConnect() {
+		t.Fatalf("expected a backoff after a failed connection")
+	}
+
+	// The backoff has passed.
+	p.lastFailure = time.Now().Add(-RedialBackoff)
+	if !p.CanConnect() {
+		t.Fatalf("expected to be able to connect after the backoff")
+	}
+
+	// The backoff doubles for every failure in a row.
+	p.ConnectFailed()
+	p.lastFailure = time.Now().Add(-RedialBackoff)
+	if p.CanConnect() {
+		t.Fatalf("expected a longer backoff after a second failed connection")
+	}
+
+	p.ConnectSucceeded()
+	if !p.CanConnect() {
+		t.Fatalf("expected the backoff to be reset after a successful connection")
+	}
+}
@@ -0,0 +1,101 @@
+// Contains logic related to the transport protocols used for connections to
+// remote peers, TCP and uTP. See http://www.bittorrent.org/beps/bep_0029.html
+package peer
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmatss/torc/internal/util/logger"
+	"github.com/jmatss/torc/internal/utp"
+)
+
+// Decides which transport protocol that is used when connecting to remote peers.
+type TransportPolicy int
+
+const (
+	// Only TCP is used to connect to remote peers.
+	TransportTCP TransportPolicy = iota
+	// uTP is tried first and TCP is used if the remote peer doesn't answer.
+	TransportPreferUTP
+	// Only uTP is used to connect to remote peers.
+	TransportUTP
+)
+
+func (t TransportPolicy) String() string {
+	return []string{
+		"tcp",
+		"prefer-utp",
+		"utp",
+	}[t]
+}
+
+// Returns the TransportPolicy with the name "name" (case insensitive).
+func ParseTransportPolicy(name string) (TransportPolicy, error) {
+	for _, policy := range []TransportPolicy{TransportTCP, TransportPreferUTP, TransportUTP} {
+		if strings.ToLower(name) == policy.String() {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown transport policy \"%s\"", name)
+}
+
+// How long to wait for a remote peer to answer a uTP connection attempt
+// before falling back to TCP.
+const UTPDialTimeout = 3 * time.Second
+
+var (
+	// The transport policy used for connections that this client initiates.
+	// Incoming connections are accepted on both TCP and uTP. It can be changed
+	// while connections are made, see Transport and SetTransport.
+	currentTransport    = TransportPreferUTP
+	currentTransportMut sync.RWMutex
+	// The socket used for uTP connections. It listens on the same port as the
+	// Listener. Only TCP is used if it is nil.
+	UTPSocket *utp.Socket
+)
+
+// Returns the transport policy used for connections that this client initiates.
+func Transport() TransportPolicy {
+	currentTransportMut.RLock()
+	defer currentTransportMut.RUnlock()
+	return currentTransport
+}
+
+// Changes the transport policy. Connections that already have been
+// established aren't affected.
+func SetTransport(policy TransportPolicy) {
+	currentTransportMut.Lock()
+	defer currentTransportMut.Unlock()
+	currentTransport = policy
+}
+
+// Connects to the remote peer with uTP and/or TCP according to the policy
+// returned by Transport.
+func (p *Peer) dialTransport() (net.Conn, error) {
+	policy := Transport()
+	if UTPSocket != nil && policy != TransportTCP {
+		conn, err := UTPSocket.Dial(p.HostAndPort, UTPDialTimeout)
+		if err == nil {
+			p.UTP = true
+			return conn, nil
+		} else if policy == TransportUTP {
+			return nil, err
+		}
+		logger.Log(logger.High, "falling back to TCP: %v", err)
+	} else if policy == TransportUTP {
+		return nil, fmt.Errorf("unable to establish uTP connection to %s: "+
+			"no uTP socket", p.HostAndPort)
+	}
+
+	p.UTP = false
+	conn, err := net.Dial(Protocol, p.HostAndPort)
+	if err != nil {
+		return nil, fmt.Errorf("unable to establish connection to "+
+			"%s: %w", p.HostAndPort, err)
+	}
+	return conn, nil
+}
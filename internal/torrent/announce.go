@@ -0,0 +1,146 @@
+// Contains logic related to announcing to multiple trackers.
+// See http://www.bittorrent.org/beps/bep_0012.html
+package torrent
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// The status of a single tracker in the announce list of a torrent.
+type TrackerStatus struct {
+	URL  string
+	Tier int
+
+	// The time of the last successful announce and the result of it.
+	LastAnnounce time.Time
+	Seeders      int64
+	Leechers     int64
+
+	// The error of the last announce, nil if it was successful.
+	Err error
+}
+
+// Parses the tiers of trackers in the torrent file. The "announce-list" is used
+// if it exists, otherwise a single tier containing the "announce" URL is
+// returned (or no tiers if there are no "announce" either). The trackers within
+// every tier are shuffled.
+func getAnnounceList(metainfo *Value) ([][]*TrackerStatus, error) {
+	tiers := make([][]*TrackerStatus, 0)
+
+	announceList, err := metainfo.GetList("announce-list")
+	if _, ok := err.(*NotFoundError); err != nil && !ok {
+		return nil, fmt.Errorf("unable to parse \"announce-list\" from torrent: %w", err)
+	}
+
+	for _, tierValue := range announceList {
+		if tierValue.Kind != ListValue {
+			return nil, fmt.Errorf("expected a tier of the \"announce-list\" "+
+				"to be a list, got: %s", tierValue.Kind)
+		}
+
+		tier := make([]*TrackerStatus, 0, len(tierValue.List))
+		for _, urlValue := range tierValue.List {
+			if urlValue.Kind != StringValue {
+				return nil, fmt.Errorf("expected a tracker URL in the \"announce-list\" "+
+					"to be a string, got: %s", urlValue.Kind)
+			}
+			url := strings.TrimSpace(string(urlValue.Str))
+			if url != "" {
+				tier = append(tier, &TrackerStatus{URL: url, Tier: len(tiers)})
+			}
+		}
+
+		if len(tier) > 0 {
+			rand.Shuffle(len(tier), func(i, j int) {
+				tier[i], tier[j] = tier[j], tier[i]
+			})
+			tiers = append(tiers, tier)
+		}
+	}
+
+	// Clients that support the "announce-list" ignores the "announce" key.
+	if len(tiers) > 0 {
+		return tiers, nil
+	}
+
+	// Torrents without trackers can still be downloaded with peers from other
+	// sources.
+	announce, err := metainfo.GetString("announce")
+	if _, ok := err.(*NotFoundError); ok {
+		return tiers, nil
+	} else if err != nil {
+		return nil, err
+	} else if announce == "" {
+		return nil, fmt.Errorf("unable to parse \"announce\" from torrent: empty string")
+	}
+
+	return [][]*TrackerStatus{{&TrackerStatus{URL: announce}}}, nil
+}
+
+// Announces to the trackers of this torrent. The tiers are tried in order and
+// the trackers within a tier are tried in order until one of them answers.
+// A tracker that answers is moved to the front of its tier so that it is tried
+// first the next time.
+//
+// Returns an error if none of the trackers answered.
+func (t *Torrent) announce(peerId string, event EventId) error {
+	t.announceMut.Lock()
+	defer t.announceMut.Unlock()
+
+	errs := make([]string, 0)
+	for _, tier := range t.AnnounceList {
+		for i, status := range tier {
+			// The lock isn't held during the request since it might take a while.
+			// The torrent handler only does one announce at a time, so the
+			// announce list isn't reordered meanwhile.
+			t.announceMut.Unlock()
+			err := t.trackerRequest(status.URL, peerId, event)
+			t.announceMut.Lock()
+
+			status.Err = err
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", status.URL, err))
+				continue
+			}
+
+			t.Tracker.Lock()
+			status.LastAnnounce = time.Now()
+			status.Seeders = t.Tracker.Seeders
+			status.Leechers = t.Tracker.Leechers
+			t.Tracker.Unlock()
+
+			copy(tier[1:i+1], tier[:i])
+			tier[0] = status
+
+			if event == Started {
+				t.Tracker.Started = true
+			} else if event == Completed {
+				t.Tracker.Completed = true
+			}
+
+			return nil
+		}
+	}
+
+	if len(errs) == 0 {
+		return fmt.Errorf("the torrent doesn't contain any trackers")
+	}
+	return fmt.Errorf("unable to announce to any tracker: %s", strings.Join(errs, "; "))
+}
+
+// Returns a copy of the status of every tracker of this torrent, tier by tier.
+func (t *Torrent) TrackerStatuses() []TrackerStatus {
+	t.announceMut.Lock()
+	defer t.announceMut.Unlock()
+
+	statuses := make([]TrackerStatus, 0)
+	for _, tier := range t.AnnounceList {
+		for _, status := range tier {
+			statuses = append(statuses, *status)
+		}
+	}
+	return statuses
+}
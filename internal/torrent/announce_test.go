@@ -0,0 +1,251 @@
+package torrent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestGetAnnounceList(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected [][]string // the URLs of every tier in any order
+		ok       bool
+	}{
+		{
+			"announce only",
+			"d8:announce5:http1e",
+			[][]string{{"http1"}},
+			true,
+		},
+		{
+			"announce-list",
+			"d8:announce5:http113:announce-listll5:http25:http3el5:http4eee",
+			[][]string{{"http2", "http3"}, {"http4"}},
+			true,
+		},
+		{
+			"empty URLs and tiers",
+			"d8:announce5:http113:announce-listll0:5:http2el1: eee",
+			[][]string{{"http2"}},
+			true,
+		},
+		{"announce-list not a list", "d13:announce-listi1ee", nil, false},
+		{"tier not a list", "d13:announce-listl5:http1ee", nil, false},
+		{"URL not a string", "d13:announce-listlli1eeee", nil, false},
+		{"no trackers", "d4:infodee", [][]string{}, true},
+		{"empty announce", "d8:announce0:e", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metainfo, err := Parse([]byte(tt.content))
+			if err != nil {
+				t.Fatalf("unable to parse metainfo: %v", err)
+			}
+			tiers, err := getAnnounceList(metainfo)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("expected an error, got: %v", tiers)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unable to get announce list: %v", err)
+			}
+
+			if len(tiers) != len(tt.expected) {
+				t.Fatalf("expected %d tiers, got: %d", len(tt.expected), len(tiers))
+			}
+			for i, tier := range tiers {
+				urls := make([]string, 0, len(tier))
+				for _, status := range tier {
+					if status.Tier != i {
+						t.Errorf("%s: expected tier %d, got: %d", status.URL, i, status.Tier)
+					}
+					urls = append(urls, status.URL)
+				}
+				sort.Strings(urls)
+				if strings.Join(urls, ",") != strings.Join(tt.expected[i], ",") {
+					t.Errorf("tier %d: expected: %v, got: %v", i, tt.expected[i], urls)
+				}
+			}
+		})
+	}
+}
+
+func TestGetAnnounceListShuffle(t *testing.T) {
+	metainfo, err := Parse([]byte("d13:announce-listll1:a1:b1:c1:d1:eel1:feee"))
+	if err != nil {
+		t.Fatalf("unable to parse metainfo: %v", err)
+	}
+
+	orders := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		tiers, err := getAnnounceList(metainfo)
+		if err != nil {
+			t.Fatalf("unable to get announce list: %v", err)
+		}
+
+		order := ""
+		for _, status := range tiers[0] {
+			order += status.URL
+		}
+		orders[order] = true
+
+		// The trackers are only shuffled within their tier.
+		if len(tiers) != 2 || len(tiers[1]) != 1 || tiers[1][0].URL != "f" {
+			t.Fatalf("expected the second tier to only contain \"f\"")
+		}
+	}
+
+	if len(orders) < 2 {
+		t.Fatalf("expected the tier to be shuffled, got: %v", orders)
+	}
+}
+
+// Starts HTTP trackers that either answers or fails every announce.
+// Returns the URLs of the trackers and a function returning the URLs of the
+// trackers that has been announced to.
+func startHTTPTrackers(answers ...bool) ([]string, func() []string, func()) {
+	var mut sync.Mutex
+	requested := make([]string, 0)
+
+	urls := make([]string, len(answers))
+	servers := make([]*httptest.Server, len(answers))
+	for i, answer := range answers {
+		answer := answer
+		var server *httptest.Server
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mut.Lock()
+			requested = append(requested, server.URL)
+			mut.Unlock()
+
+			if answer {
+				w.Write([]byte("d8:completei5e10:incompletei3e8:intervali1800e5:peers0:e"))
+			} else {
+				w.Write([]byte("d14:failure reason4:nopee"))
+			}
+		}))
+		servers[i] = server
+		urls[i] = server.URL
+	}
+
+	get := func() []string {
+		mut.Lock()
+		defer mut.Unlock()
+		return append([]string(nil), requested...)
+	}
+	stop := func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	}
+	return urls, get, stop
+}
+
+func TestAnnounce(t *testing.T) {
+	tests := []struct {
+		name      string
+		answers   []bool  // one per tracker
+		tiers     [][]int // the indices of the trackers in every tier
+		requested []int   // the trackers that should be announced to, in order
+		expected  [][]int // the tiers after the announce
+		ok        bool
+	}{
+		{
+			"first answers",
+			[]bool{true, true},
+			[][]int{{0, 1}},
+			[]int{0},
+			[][]int{{0, 1}},
+			true,
+		},
+		{
+			"promote on success",
+			[]bool{false, false, true},
+			[][]int{{0, 1, 2}},
+			[]int{0, 1, 2},
+			[][]int{{2, 0, 1}},
+			true,
+		},
+		{
+			"next tier",
+			[]bool{false, true, true},
+			[][]int{{0}, {1, 2}},
+			[]int{0, 1},
+			[][]int{{0}, {1, 2}},
+			true,
+		},
+		{
+			"promoted within its own tier",
+			[]bool{false, false, true},
+			[][]int{{0}, {1, 2}},
+			[]int{0, 1, 2},
+			[][]int{{0}, {2, 1}},
+			true,
+		},
+		{
+			"none answers",
+			[]bool{false, false},
+			[][]int{{0}, {1}},
+			[]int{0, 1},
+			[][]int{{0}, {1}},
+			false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			urls, requested, stop := startHTTPTrackers(tt.answers...)
+			defer stop()
+
+			tor := newTestTorrent(t, 1<<14, 100)
+			tor.AnnounceList = make([][]*TrackerStatus, len(tt.tiers))
+			for i, tier := range tt.tiers {
+				for _, j := range tier {
+					tor.AnnounceList[i] = append(tor.AnnounceList[i],
+						&TrackerStatus{URL: urls[j], Tier: i})
+				}
+			}
+
+			err := tor.announce("-TR0000-000000000000", Started)
+			if tt.ok && err != nil {
+				t.Fatalf("unable to announce: %v", err)
+			} else if !tt.ok && err == nil {
+				t.Fatalf("expected an error")
+			}
+
+			got := requested()
+			if len(got) != len(tt.requested) {
+				t.Fatalf("expected %d announces, got: %d", len(tt.requested), len(got))
+			}
+			for i, j := range tt.requested {
+				if got[i] != urls[j] {
+					t.Errorf("announce %d: expected tracker %d, got: %s", i, j, got[i])
+				}
+			}
+
+			for i, tier := range tt.expected {
+				for k, j := range tier {
+					status := tor.AnnounceList[i][k]
+					if status.URL != urls[j] {
+						t.Errorf("tier %d position %d: expected tracker %d, got: %s",
+							i, k, j, status.URL)
+					}
+					if answered := status.Err == nil && !status.LastAnnounce.IsZero(); answered &&
+						(status.Seeders != 5 || status.Leechers != 3) {
+						t.Errorf("%s: expected 5 seeders and 3 leechers, got: %d, %d",
+							status.URL, status.Seeders, status.Leechers)
+					}
+				}
+			}
+			if tor.Tracker.Started != tt.ok {
+				t.Errorf("started: expected %v, got: %v", tt.ok, tor.Tracker.Started)
+			}
+		})
+	}
+}
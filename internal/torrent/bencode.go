@@ -2,327 +2,325 @@ package torrent
 
 import (
 	"bytes"
-	"encoding/binary"
 	"fmt"
 	"net"
+	"path/filepath"
+	"sort"
 	"strconv"
-	"unicode"
+	"strings"
 
 	"github.com/jmatss/torc/internal/peer"
 )
 
+const (
+	// The max amount of lists and dictionaries that can be nested inside each
+	// other in a bencoded value.
+	MaxDepth = 64
+)
+
 // Error used to indicate that a specified key doesn't exist in the dictionary.
 type NotFoundError struct{ msg string }
 
 func (e *NotFoundError) Error() string { return e.msg }
 
-// Decode the specified "bencoded structures" recursively to their corresponding "go structures".
-// Everything is casted into interface{} before being returned.
-//
-// Conversion _Bencode_ -> _Go_:
-//  dictionary -> map[string]interface{}
-//  list -> []interface{}
-//  string -> string
-//  integer -> int64
-func Decode(content []byte) (res interface{}, err error) {
-	if len(content) < 2 {
-		return nil, fmt.Errorf("given value is to small, "+
-			"expected: >2, got: %d", len(content))
-	}
-
-	// Might loop until end of "content" and get a index out of bounds if the
-	// list has incorrect format, recover if that is the case.
-	defer func() {
-		if r := recover(); r != nil {
-			res = nil
-			err = fmt.Errorf("unable to parse the list during decoding, "+
-				"the list never ended with an \"e\": %w", r.(error))
-		}
-	}()
-
-	switch content[0] {
-	case 'd':
-		result, err := GetDictInterfaces(content)
-		if err != nil {
-			return nil, err
-		}
+// The type of a parsed bencoded value.
+type ValueKind int
 
-		return result, err
+const (
+	StringValue ValueKind = iota
+	IntValue
+	ListValue
+	DictValue
+)
 
-	case 'l':
-		resultList := make([]interface{}, 0)
-		// Remove starting "l" and ending "e".
-		content := content[1 : len(content)-1]
+func (k ValueKind) String() string {
+	return []string{"string", "integer", "list", "dictionary"}[k]
+}
 
-		for {
-			resultBytes, err := GetNext(content)
-			if err != nil {
-				return nil, err
-			}
+// A parsed bencoded value. Nothing is copied during parsing, the byte slices
+// refer to the parsed data.
+type Value struct {
+	Kind ValueKind
+	// The bencoded bytes of this value, ex. used to calculate the info hash
+	// of an info dictionary.
+	Raw []byte
+
+	Str  []byte  // Set if Kind == StringValue
+	Int  int64   // Set if Kind == IntValue
+	List []Value // Set if Kind == ListValue
+	// Set if Kind == DictValue. The entries are sorted by key.
+	Entries []Entry
+}
 
-			result, err := Decode(resultBytes)
-			if err != nil {
-				return nil, err
-			}
-			resultList = append(resultList, result)
+// A key and value of a bencoded dictionary.
+type Entry struct {
+	Key   []byte
+	Value Value
+}
 
-			content = content[len(resultBytes):]
-			if len(content) <= 0 {
-				break
-			}
-		}
+// Parses the bencoded value in "data" in a single pass. "data" must contain
+// exactly one value.
+//
+// The parsing is strict: integers and string lengths can't have leading zeros
+// (and integers can't be "-0"), the keys of dictionaries must be sorted and
+// unique, strings can't be longer than the remaining data and lists and
+// dictionaries can't be nested deeper than MaxDepth.
+func Parse(data []byte) (*Value, error) {
+	v, n, err := ParsePrefix(data)
+	if err != nil {
+		return nil, err
+	} else if n != len(data) {
+		return nil, fmt.Errorf("trailing data after bencoded value at index %d", n)
+	}
+	return v, nil
+}
 
-		return resultList, nil
+// Parses the bencoded value at the start of "data" the same way as Parse.
+// Returns the value and its length in bytes, any data after it is ignored.
+func ParsePrefix(data []byte) (*Value, int, error) {
+	p := parser{data: data}
+	v := &Value{}
+	if err := p.parse(v, 0); err != nil {
+		return nil, 0, err
+	}
+	return v, p.pos, nil
+}
 
-	case 'i':
-		currentIndex := 0
-		for content[currentIndex] != 'e' {
-			currentIndex++
-		}
+// Decode the specified "bencoded structures" recursively to their corresponding "go structures".
+// Everything is casted into interface{} before being returned.
+//
+// Conversion _Bencode_ -> _Go_:
+//
+//	dictionary -> map[string]interface{}
+//	list -> []interface{}
+//	string -> string
+//	integer -> int64
+func Decode(content []byte) (interface{}, error) {
+	v, err := Parse(content)
+	if err != nil {
+		return nil, err
+	}
+	return v.Interface(), nil
+}
 
-		result, err := strconv.ParseInt(string(content[1:currentIndex]), 10, 64)
-		if err != nil {
-			return nil, err
+// Converts the value into "go structures" the same way as Decode.
+func (v *Value) Interface() interface{} {
+	switch v.Kind {
+	case StringValue:
+		return string(v.Str)
+	case IntValue:
+		return v.Int
+	case ListValue:
+		list := make([]interface{}, len(v.List))
+		for i := range v.List {
+			list[i] = v.List[i].Interface()
 		}
-
-		return result, nil
-
+		return list
 	default:
-		if unicode.IsDigit(rune(content[0])) {
-			start, end, err := getStringIndices(content)
-			if err != nil {
-				return nil, err
-			}
-			result := string(content[start:end])
-
-			return result, nil
-		} else {
-			return nil, fmt.Errorf("incorrect format of torrent file, "+
-				"expecting start of: dict, list, int or string, got: %q", rune(content[0]))
+		dict := make(map[string]interface{}, len(v.Entries))
+		for i := range v.Entries {
+			dict[string(v.Entries[i].Key)] = v.Entries[i].Value.Interface()
 		}
+		return dict
 	}
 }
 
-// Returns the next "structure" contained in the "content" byte slice.
-// A "structure" is either a dictionary, list, string or integer.
-func GetNext(content []byte) (result []byte, err error) {
-	// Might loop until end of "content" and get a index out of bounds if the
-	// torrent file has incorrect format, recover if that is the case.
-	defer func() {
-		if r := recover(); r != nil {
-			result = nil
-			err = fmt.Errorf("unable to parse the next field in the torrent file, "+
-				"the field never ended with an \"e\": %w", r.(error))
-		}
-	}()
-
-	// "openCount" keeps track of how many "structures" (dict or list) that have been started
-	// and not ended. Ex. d3:abcli32e would have count 2 since the dictionary("d") and the
-	// list("l") haven't been ended with an "e" yet. When the counter goes down to 0 again,
-	// the end of the "structure" has been reached and it's time to return.
-	openCount := 0
-
-	// Loop through and find the end of the "structure" (dict, list, string or int).
-	// Return the structure as a byte slice [startIndex:currentIndex].
-	startIndex := 0
-	currentIndex := 0
-	for {
-		switch current := content[currentIndex]; current {
-		case 'd', 'l':
-			openCount++
-			currentIndex++
-		case 'i':
-			for content[currentIndex] != 'e' {
-				currentIndex++
-			}
-			currentIndex++
-		case 'e':
-			openCount--
-			currentIndex++
-			if openCount < 0 {
-				return nil, fmt.Errorf("incorrect format of torrent file, " +
-					"received an ending \"e\" while no structure have been \"opened\"")
-			}
-		default:
-			if unicode.IsDigit(rune(current)) {
-				// will "skip" the string and currentIndex will point to the next "structure"
-				_, currentIndex, err = getStringIndices(content[currentIndex:])
-				if err != nil {
-					return nil, err
-				}
-			} else {
-				return nil, fmt.Errorf("incorrect format of torrent file, "+
-					"expecting start of: dict, list, int or string, got: %q", rune(current))
-			}
-		}
+// Returns the value stored in the dictionary "v" with the key "key".
+// Returns a NotFoundError if the key doesn't exist.
+func (v *Value) Get(key string) (*Value, error) {
+	if v.Kind != DictValue {
+		return nil, fmt.Errorf("unable to get the \"%s\" field from a %s", key, v.Kind)
+	}
 
-		if openCount == 0 {
-			break
-		}
+	// The keys are sorted, see Parse.
+	i := sort.Search(len(v.Entries), func(i int) bool {
+		return string(v.Entries[i].Key) >= key
+	})
+	if i < len(v.Entries) && string(v.Entries[i].Key) == key {
+		return &v.Entries[i].Value, nil
 	}
 
-	return content[startIndex:currentIndex], nil
+	return nil, &NotFoundError{
+		fmt.Sprintf("unable to find the \"%s\" field", key),
+	}
 }
 
-// Returns the value as bytes stored in the bencoded dictionary with the key "key".
+// Gets the dictionary stored in the dictionary "v" with the key "key".
 // Returns a NotFoundError if the key doesn't exist.
-func GetDictValue(content []byte, key string) ([]byte, error) {
-	keyLen := strconv.Itoa(len(key))
-	pattern := []byte(keyLen + ":" + key)
-
-	index := bytes.Index(content, pattern)
-	if index == -1 {
-		return nil, &NotFoundError{
-			fmt.Sprintf("unable to find the \"%s\" field in the torrent file", key),
-		}
-	}
+func (v *Value) GetDict(key string) (*Value, error) {
+	return v.getKind(key, DictValue)
+}
 
-	result, err := GetNext(content[index+len(pattern):])
+// Gets the list stored in the dictionary "v" with the key "key".
+// Returns a NotFoundError if the key doesn't exist.
+func (v *Value) GetList(key string) ([]Value, error) {
+	value, err := v.getKind(key, ListValue)
 	if err != nil {
 		return nil, err
 	}
-
-	return result, nil
+	return value.List, nil
 }
 
-// Gets the decoded value stored in the bencoded dictionary with the key "key".
+// Gets the integer stored in the dictionary "v" with the key "key".
 // Returns a NotFoundError if the key doesn't exist.
-func GetDictInterface(content []byte, key string) (interface{}, error) {
-	keyLen := strconv.Itoa(len(key))
-	pattern := []byte(keyLen + ":" + key)
-
-	index := bytes.Index(content, pattern)
-	if index == -1 {
-		return nil, &NotFoundError{
-			fmt.Sprintf("unable to find the \"%s\" field in the torrent file", key),
-		}
+func (v *Value) GetInt(key string) (int64, error) {
+	value, err := v.getKind(key, IntValue)
+	if err != nil {
+		return 0, err
 	}
+	return value.Int, nil
+}
 
-	valueBytes, err := GetNext(content[index+len(pattern):])
+// Gets the string stored in the dictionary "v" with the key "key".
+// Returns a NotFoundError if the key doesn't exist.
+func (v *Value) GetString(key string) (string, error) {
+	value, err := v.getKind(key, StringValue)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
+	return string(value.Str), nil
+}
 
-	value, err := Decode(valueBytes)
+func (v *Value) getKind(key string, kind ValueKind) (*Value, error) {
+	value, err := v.Get(key)
 	if err != nil {
 		return nil, err
+	} else if value.Kind != kind {
+		return nil, fmt.Errorf("expected the \"%s\" field to contain a %s, got: %s",
+			key, kind, value.Kind)
 	}
-
 	return value, nil
 }
 
-// Fetches all key:value pairs from the bencoded dictionary inside "content"
-// and returns them as a map[string]interface{}.
-func GetDictInterfaces(content []byte) (map[string]interface{}, error) {
-	if len(content) < 3 {
-		return nil, fmt.Errorf("incorrect format of given content")
-	}
+// Parses bencoded values from "data" starting at index "pos".
+type parser struct {
+	data []byte
+	pos  int
+}
 
-	// Remove dictionary starting "d" and ending "e".
-	content = content[1 : len(content)-1]
-	result := make(map[string]interface{}, 0)
+func (p *parser) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("incorrect bencode at index %d: %s", p.pos, fmt.Sprintf(format, a...))
+}
 
-	offset := 0
-	for {
-		start, end, err := getStringIndices(content[offset:])
-		if err != nil {
-			return nil, err
-		}
-		key := string(content[start:end])
+// Parses the value starting at the current position into "v". "depth" is the
+// amount of lists and dictionaries that the value is nested inside.
+func (p *parser) parse(v *Value, depth int) error {
+	if p.pos >= len(p.data) {
+		return p.errorf("unexpected end of data")
+	}
 
-		valueBytes, err := GetNext(content[end:])
+	start := p.pos
+	switch current := p.data[p.pos]; {
+	case current == 'i':
+		p.pos++
+		n, err := p.parseNumber('e', true)
 		if err != nil {
-			return nil, err
+			return err
 		}
+		v.Kind = IntValue
+		v.Int = n
 
-		value, err := Decode(valueBytes)
-		if err != nil {
-			return nil, err
+	case current == 'l':
+		if depth >= MaxDepth {
+			return p.errorf("lists and dictionaries nested deeper than %d", MaxDepth)
 		}
+		p.pos++
 
-		result[key] = value
+		v.Kind = ListValue
+		v.List = make([]Value, 0)
+		for {
+			if p.pos >= len(p.data) {
+				return p.errorf("the list never ended with an \"e\"")
+			} else if p.data[p.pos] == 'e' {
+				p.pos++
+				break
+			}
 
-		offset += len(valueBytes)
-		if offset >= len(content) {
-			break
+			v.List = append(v.List, Value{})
+			if err := p.parse(&v.List[len(v.List)-1], depth+1); err != nil {
+				return err
+			}
 		}
-	}
 
-	return result, nil
-}
+	case current == 'd':
+		if depth >= MaxDepth {
+			return p.errorf("lists and dictionaries nested deeper than %d", MaxDepth)
+		}
+		p.pos++
 
-// Gets the integer stored in the bencoded dictionary with the key "key".
-// Returns a NotFoundError if the key doesn't exist.
-func GetInt(content []byte, key string) (int64, error) {
-	resultBytes, err := GetDictValue(content, key)
-	if err != nil {
-		return 0, err
-	} else if len(resultBytes) < 3 ||
-		resultBytes[0] != 'i' || resultBytes[len(resultBytes)-1] != 'e' {
-		// Min size for integer is three ("i" + number + "e").
-		return 0, fmt.Errorf("unable to parse integer with key \"%s\" "+
-			"from torrent file", key)
-	}
+		v.Kind = DictValue
+		v.Entries = make([]Entry, 0)
+		for {
+			if p.pos >= len(p.data) {
+				return p.errorf("the dictionary never ended with an \"e\"")
+			} else if p.data[p.pos] == 'e' {
+				p.pos++
+				break
+			}
 
-	// Remove staring "i" and ending "e" of bencoded integer before parsing.
-	result, err := strconv.ParseInt(
-		string(resultBytes[1:len(resultBytes)-1]),
-		10,
-		64,
-	)
-	if err != nil {
-		return 0, err
-	}
+			var key Value
+			if err := p.parse(&key, depth+1); err != nil {
+				return err
+			} else if key.Kind != StringValue {
+				return p.errorf("expected the key of a dictionary to be a string, got: %s", key.Kind)
+			} else if n := len(v.Entries); n > 0 && bytes.Compare(v.Entries[n-1].Key, key.Str) >= 0 {
+				return p.errorf("the key \"%s\" is a duplicate or isn't sorted", key.Str)
+			}
 
-	return result, nil
-}
+			v.Entries = append(v.Entries, Entry{Key: key.Str})
+			if err := p.parse(&v.Entries[len(v.Entries)-1].Value, depth+1); err != nil {
+				return err
+			}
+		}
 
-// Gets the string stored in the bencoded dictionary with the key "key".
-// Returns a NotFoundError if the key doesn't exist.
-func GetString(content []byte, key string) (string, error) {
-	resultBytes, err := GetDictValue(content, key)
-	if err != nil {
-		return "", err
-	}
+	case current >= '0' && current <= '9':
+		length, err := p.parseNumber(':', false)
+		if err != nil {
+			return err
+		} else if length > int64(len(p.data)-p.pos) {
+			return p.errorf("string of length %d is longer than the remaining data", length)
+		}
+		v.Kind = StringValue
+		v.Str = p.data[p.pos : p.pos+int(length)]
+		p.pos += int(length)
 
-	start, end, err := getStringIndices(resultBytes)
-	if err != nil {
-		return "", err
+	default:
+		return p.errorf("expecting start of: dict, list, int or string, got: %q", rune(current))
 	}
 
-	return string(resultBytes[start:end]), nil
+	v.Raw = p.data[start:p.pos]
+	return nil
 }
 
-// Returns the index to the first byte of the "byte string" and
-// the index of the byte just after the "given" bencoded string.
-// Example, a call with these arguments:
-//  content = 5:abcdei3e
-//  index 	= 0
-// would return 2, 7 and nil
-func getStringIndices(content []byte) (stringStart int, stringEnd int, err error) {
-	// Recover from index of out range (if the given content doesn't start with a string)
-	defer func() {
-		if r := recover(); r != nil {
-			err = r.(error)
-		}
-	}()
+// Parses a decimal number that ends with the byte "end". Leading zeros aren't
+// allowed. "signed" specifies if the number can be negative.
+func (p *parser) parseNumber(end byte, signed bool) (int64, error) {
+	start := p.pos
+	if signed && p.pos < len(p.data) && p.data[p.pos] == '-' {
+		p.pos++
+	}
 
-	stringStart, stringEnd = 0, 0
-	currentIndex := 0
-	startIndex := 0
-	for content[currentIndex] != ':' {
-		currentIndex++
+	digitsStart := p.pos
+	for p.pos < len(p.data) && p.data[p.pos] >= '0' && p.data[p.pos] <= '9' {
+		p.pos++
+	}
+	digits := p.data[digitsStart:p.pos]
+
+	if p.pos >= len(p.data) || p.data[p.pos] != end {
+		return 0, p.errorf("expected the number to end with %q", rune(end))
+	} else if len(digits) == 0 {
+		return 0, p.errorf("number without digits")
+	} else if digits[0] == '0' && (len(digits) > 1 || digitsStart != start) {
+		return 0, p.errorf("number with leading zero or negative zero")
 	}
 
-	stringLength, err := strconv.Atoi(string(content[startIndex:currentIndex]))
+	n, err := strconv.ParseInt(string(p.data[start:p.pos]), 10, 64)
 	if err != nil {
-		return stringStart, stringEnd, fmt.Errorf("unable to convert benocded "+
-			"string length to integer: %w", err)
+		return 0, p.errorf("unable to parse number: %v", err)
 	}
+	p.pos++
 
-	stringStart = currentIndex + 1
-	stringEnd = stringStart + stringLength
-	return stringStart, stringEnd, nil
+	return n, nil
 }
 
 /*
@@ -357,130 +355,103 @@ func getStringIndices(content []byte) (stringStart int, stringEnd int, err error
 				)
 		)
 */
-// Fetch, convert and return the "files" field from the torrent file.
+// Fetch, convert and return the files from the info dictionary of a torrent file.
 // If it is a single file torrent, convert it to a "multiple files structure"
 // with only one item in the "Files" slices.
-func GetFiles(content []byte) ([]Files, error) {
-	info, err := GetDictValue(content, "info")
-	if err != nil {
-		return nil, err
-	}
-
+func GetFiles(info *Value) ([]Files, error) {
 	// If the "files" field exists: this is a multi file torrent.
 	// Else: it is a single files torrent. (see comment on format over this function)
-	multipleFiles := true
-	filesInterface, err := GetDictInterface(info, "files")
-	if err != nil {
-		if _, ok := err.(*NotFoundError); ok {
-			// The key "files" where not found, this is a single file torrent
-			multipleFiles = false
-		} else {
-			return nil, err
-		}
-	}
-
-	files := make([]Files, 0, 1)
-
-	if multipleFiles {
+	filesList, err := info.GetList("files")
+	if _, ok := err.(*NotFoundError); ok {
 		/*
-			Multiple files torrent
+			Single file torrent
 		*/
-		var totalLength int64 = 0
-
-		filesInterfaceSlice, ok := filesInterface.([]interface{})
-		if !ok {
-			return nil, fmt.Errorf("bencoded torrent file incorrect format: " +
-				"expected \"files\" field to contain a list")
+		name, err := info.GetString("name")
+		if err != nil {
+			return nil, err
 		}
 
-		// Loop through all files and create new "Files" with their length and path
-		// that is appended to the "files" slice.
-		for _, fileInterface := range filesInterfaceSlice {
-			fileMap, ok := fileInterface.(map[string]interface{})
-			if !ok {
-				return nil, fmt.Errorf("bencoded torrent file incorrect format: " +
-					"expected the list in \"files\" to contain maps")
-			}
-
-			lengthInterface, ok := fileMap["length"]
-			if !ok {
-				return nil, fmt.Errorf("bencoded torrent file incorrect format: " +
-					"expected a \"length\" field inside a file inside the \"files\" field")
-			}
-
-			length, ok := lengthInterface.(int64)
-			if !ok {
-				return nil, fmt.Errorf("bencoded torrent file incorrect format: " +
-					"expected \"length\" field inside the \"files\" field to contain an int")
-			}
-
-			pathSlice, ok := fileMap["path"]
-			if !ok {
-				return nil, fmt.Errorf("bencoded torrent file incorrect format: " +
-					"expected a \"path\" field inside a file inside the \"files\" field")
-			}
-
-			pathSliceInterface, ok := pathSlice.([]interface{})
-			if !ok {
-				return nil, fmt.Errorf("bencoded torrent file incorrect format: " +
-					"expected \"path\" field inside the \"files\" field to contain slices of interface")
-			}
+		length, err := info.GetInt("length")
+		if err != nil {
+			return nil, err
+		} else if length < 0 {
+			return nil, fmt.Errorf("incorrect length of file \"%s\": %d", name, length)
+		}
 
-			path := make([]string, 0, 1)
+		if err := checkPathComponent(name); err != nil {
+			return nil, err
+		}
 
-			for _, pathInterface := range pathSliceInterface {
-				pathString, ok := pathInterface.(string)
-				if !ok {
-					return nil, fmt.Errorf("bencoded torrent file incorrect format: " +
-						"expected \"path\" field inside the \"files\" field to contain string slices")
-				}
+		// Reuse the "name" field as "path"
+		return []Files{{Index: 0, Length: length, Path: []string{name}}}, nil
+	} else if err != nil {
+		return nil, err
+	}
 
-				path = append(path, pathString)
-			}
+	/*
+		Multiple files torrent
+	*/
+	var totalLength int64 = 0
+	files := make([]Files, 0, len(filesList))
 
-			files = append(
-				files,
-				Files{
-					Index:  totalLength,
-					Length: length,
-					Path:   path,
-				},
-			)
+	// Loop through all files and create new "Files" with their length and path
+	// that is appended to the "files" slice.
+	for i := range filesList {
+		file := &filesList[i]
 
-			totalLength += length
+		length, err := file.GetInt("length")
+		if err != nil {
+			return nil, fmt.Errorf("incorrect file in the \"files\" field: %w", err)
+		} else if length < 0 {
+			return nil, fmt.Errorf("incorrect length of file in the \"files\" field: %d", length)
 		}
 
-	} else {
-		/*
-			Single file torrent
-		*/
-		// TODO: uglier code while using interfaces and casting over and over again,
-		//  but would be better performance compared to current code using bytes and
-		//  looking through the bytes in linear time.
-		name, err := GetString(info, "name")
+		pathList, err := file.GetList("path")
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("incorrect file in the \"files\" field: %w", err)
 		}
 
-		length, err := GetInt(info, "length")
-		if err != nil {
-			return nil, err
+		path := make([]string, 0, len(pathList))
+		for _, component := range pathList {
+			if component.Kind != StringValue {
+				return nil, fmt.Errorf("expected \"path\" field inside the \"files\" "+
+					"field to contain strings, got: %s", component.Kind)
+			}
+			if err := checkPathComponent(string(component.Str)); err != nil {
+				return nil, err
+			}
+			path = append(path, string(component.Str))
+		}
+		if len(path) == 0 {
+			return nil, fmt.Errorf("empty \"path\" field inside the \"files\" field")
 		}
 
-		// Reuse the "name" field as "path"
 		files = append(
 			files,
 			Files{
-				Index:  0,
+				Index:  totalLength,
 				Length: length,
-				Path:   []string{name},
+				Path:   path,
 			},
 		)
+
+		totalLength += length
 	}
 
 	return files, nil
 }
 
+// Returns an error if "component" of the path of a file could make the file
+// end up outside of the download directory, i.e. if it is empty, "." or ".."
+// or if it contains a path separator or a volume name.
+func checkPathComponent(component string) error {
+	if component == "" || component == "." || component == ".." ||
+		strings.ContainsAny(component, "/\\") || filepath.VolumeName(component) != "" {
+		return fmt.Errorf("incorrect path component of file: \"%s\"", component)
+	}
+	return nil
+}
+
 /*
 	Tracker Error dictionary model:
 		d
@@ -504,120 +475,86 @@ func GetFiles(content []byte) ([]Files, error) {
 			8:complete i<num>e		(seeders)
 			10:incomplete i<num>e	(leechers)
 			5:peers <num>:<string>	// <string> contains a multiple of 6 bytes (IP(4) + PORT(2)) ...
+			6:peers6 <num>:<string>	// <string> contains a multiple of 18 bytes (IP(16) + PORT(2)) ...
 		e
 */
 // Get peers from the tracker response either in the dictionary or the binary model.
-func getPeers(body []byte) (map[string]*peer.Peer, error) {
+// The IPv6 peers in "peers6" are also included.
+func getPeers(body *Value) (map[string]*peer.Peer, error) {
 	// Get the bencoded value with the key "peers".
 	// Is either a list or a string
-	peersValue, err := GetDictValue(body, "peers")
-	if err != nil {
+	peersValue, err := body.Get("peers")
+	if _, ok := err.(*NotFoundError); ok {
+		// The tracker might only return IPv6 peers.
+		return getPeers6(body, make(map[string]*peer.Peer))
+	} else if err != nil {
 		return nil, err
 	}
 
-	startIndex := 0
-	currentIndex := 0
 	peers := make(map[string]*peer.Peer)
 
-	if peersValue[currentIndex] == 'l' {
+	switch peersValue.Kind {
+	case ListValue:
 		/*
 			Dictionary model
 		*/
-		peersList, err := Decode(peersValue)
-		if err != nil {
-			return nil, err
-		}
-
-		peersListInterface, ok := peersList.([]interface{})
-		if !ok {
-			return nil, fmt.Errorf("unable to convert the \"peers\" value " +
-				"into a list using the dictionary model")
-		}
-
-		// TODO: need testing for this. IPv4, IPv6 & hostname
-		for _, peersInterface := range peersListInterface {
-			peersMap, ok := peersInterface.(map[string]interface{})
-			if !ok {
-				return nil, fmt.Errorf("unable to convert the \"peers\" value " +
-					"into a map using the dictionary model")
-			}
-
-			ipInterface, ok := peersMap["ip"]
-			if !ok {
-				return nil, fmt.Errorf("unable to find the \"ip\" field " +
-					"inside the \"peers\" map using the dictionary model")
-			}
-
-			ipString, ok := ipInterface.(string)
-			if !ok {
-				return nil, fmt.Errorf("unable to convert the \"ip\" field " +
-					"into string using the dictionary model")
-			}
+		for i := range peersValue.List {
+			peerDict := &peersValue.List[i]
 
-			portInterface, ok := peersMap["port"]
-			if !ok {
-				return nil, fmt.Errorf("unable to find the \"port\" field " +
-					"inside the \"peers\" map using the dictionary model")
+			ip, err := peerDict.GetString("ip")
+			if err != nil {
+				return nil, fmt.Errorf("incorrect peer in the \"peers\" list "+
+					"using the dictionary model: %w", err)
 			}
 
-			port, ok := portInterface.(int64)
-			if !ok {
-				return nil, fmt.Errorf("unable to convert the \"port\" field " +
-					"from string into int using the dictionary model")
+			port, err := peerDict.GetInt("port")
+			if err != nil {
+				return nil, fmt.Errorf("incorrect peer in the \"peers\" list "+
+					"using the dictionary model: %w", err)
+			} else if port <= 0 || port > 65535 {
+				return nil, fmt.Errorf("incorrect port of peer in the \"peers\" list: %d", port)
 			}
 
 			// Use the peers "host:port" as key in the map.
-			tmpPeer := peer.NewPeer(ipString, uint16(port))
+			tmpPeer := peer.NewPeer(ip, uint16(port))
 			peers[tmpPeer.HostAndPort] = tmpPeer
 		}
 
-	} else {
+	case StringValue:
 		/*
 			Binary model, the peers will be grouped into 6 bytes (4 bytes IP + 2 bytes PORT)
 			concatenated together in a "byte string".
 		*/
-		groupLen := 6
-
-		if unicode.IsDigit(rune(peersValue[currentIndex])) {
-			for peersValue[currentIndex] != ':' {
-				currentIndex++
-			}
-
-			stringLength, err := strconv.Atoi(string(peersValue[startIndex:currentIndex]))
-			if err != nil {
-				return nil, err
-			}
-			if stringLength%groupLen != 0 {
-				return nil, fmt.Errorf("value of the \"peers\" field in the received "+
-					"binary model from the tracker is not divisible by %d, actual length: %d",
-					groupLen, stringLength)
-			}
-
-			// increment current index to point to after the colon and at the start index of the "text" string
-			currentIndex++
-
-			amountOfPeers := stringLength / groupLen
+		peers, err = compactPeers(peersValue.Str)
+		if err != nil {
+			return nil, err
+		}
 
-			for i := 0; i < amountOfPeers; i++ {
-				ip := net.IPv4(
-					peersValue[currentIndex+(i*groupLen+0)],
-					peersValue[currentIndex+(i*groupLen+1)],
-					peersValue[currentIndex+(i*groupLen+2)],
-					peersValue[currentIndex+(i*groupLen+3)],
-				)
+	default:
+		return nil, fmt.Errorf("incorrect format of the field \"peers\" "+
+			"from the tracker, expected: list or string, got: %s", peersValue.Kind)
+	}
 
-				portBytes := peersValue[currentIndex+(i*groupLen+4) : currentIndex+(i*groupLen+6)]
-				port := binary.BigEndian.Uint16(portBytes)
+	return getPeers6(body, peers)
+}
 
-				// Use the peers "host:port" as key in the map.
-				tmpPeer := peer.NewPeer(ip.String(), port)
-				peers[tmpPeer.HostAndPort] = tmpPeer
-			}
+// Adds the IPv6 peers in the "peers6" field of the tracker response to "peers".
+// The peers are grouped into 18 bytes (16 bytes IP + 2 bytes PORT).
+// See http://www.bittorrent.org/beps/bep_0007.html
+func getPeers6(body *Value, peers map[string]*peer.Peer) (map[string]*peer.Peer, error) {
+	peers6Value, err := body.getKind("peers6", StringValue)
+	if _, ok := err.(*NotFoundError); ok {
+		return peers, nil
+	} else if err != nil {
+		return nil, err
+	}
 
-		} else {
-			return nil, fmt.Errorf("incorrect format of the field \"peers\" "+
-				"from a binary model tracker, expected: string, got: %q", rune(peersValue[currentIndex]))
-		}
+	peers6, err := peer.ParseCompact(peers6Value.Str, net.IPv6len)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the \"peers6\" field: %w", err)
+	}
+	for hostAndPort, p := range peers6 {
+		peers[hostAndPort] = p
 	}
 
 	return peers, nil
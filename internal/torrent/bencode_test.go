@@ -0,0 +1,183 @@
+package torrent
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected interface{}
+		ok       bool
+	}{
+		{"string", "4:spam", "spam", true},
+		{"empty string", "0:", "", true},
+		{"binary string", "3:\x00:e", "\x00:e", true},
+		{"int", "i42e", int64(42), true},
+		{"zero", "i0e", int64(0), true},
+		{"negative int", "i-42e", int64(-42), true},
+		{"max int", "i9223372036854775807e", int64(9223372036854775807), true},
+		{"list", "l4:spami42ee", []interface{}{"spam", int64(42)}, true},
+		{"empty list", "le", []interface{}{}, true},
+		{"dict", "d3:bar4:spam3:fooi42ee", map[string]interface{}{"bar": "spam", "foo": int64(42)}, true},
+		{"empty dict", "de", map[string]interface{}{}, true},
+		{
+			"nested", "d1:ald1:bleee1:cdee",
+			map[string]interface{}{
+				"a": []interface{}{map[string]interface{}{"b": []interface{}{}}},
+				"c": map[string]interface{}{},
+			}, true,
+		},
+		{"max depth", strings.Repeat("l", MaxDepth) + strings.Repeat("e", MaxDepth), nil, true},
+
+		{"empty", "", nil, false},
+		{"unknown type", "x", nil, false},
+		{"int leading zero", "i03e", nil, false},
+		{"negative zero", "i-0e", nil, false},
+		{"int without digits", "ie", nil, false},
+		{"int only minus", "i-e", nil, false},
+		{"int unterminated", "i42", nil, false},
+		{"int overflow", "i9223372036854775808e", nil, false},
+		{"int with space", "i 1e", nil, false},
+		{"string leading zero", "04:spam", nil, false},
+		{"negative string length", "-1:a", nil, false},
+		{"string too long", "5:spam", nil, false},
+		{"string length overflow", "99999999999999999999:a", nil, false},
+		{"list unterminated", "l4:spam", nil, false},
+		{"dict unterminated", "d1:ai1e", nil, false},
+		{"dict missing value", "d1:ae", nil, false},
+		{"dict int key", "di1ei2ee", nil, false},
+		{"dict unsorted keys", "d1:bi1e1:ai2ee", nil, false},
+		{"dict duplicate keys", "d1:ai1e1:ai2ee", nil, false},
+		{"too deep", strings.Repeat("l", MaxDepth+1) + strings.Repeat("e", MaxDepth+1), nil, false},
+		{"trailing data", "i1ei2e", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := Parse([]byte(tt.data))
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("expected error, got: %v", v.Interface())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(v.Raw) != tt.data {
+				t.Fatalf("expected raw: %q, got: %q", tt.data, v.Raw)
+			}
+			if tt.expected != nil && !reflect.DeepEqual(v.Interface(), tt.expected) {
+				t.Fatalf("expected: %#v, got: %#v", tt.expected, v.Interface())
+			}
+		})
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	v, n, err := ParsePrefix([]byte("d1:ai1eetrailing"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if n != 8 {
+		t.Fatalf("expected length 8, got: %d", n)
+	} else if string(v.Raw) != "d1:ai1ee" {
+		t.Fatalf("expected raw \"d1:ai1ee\", got: %q", v.Raw)
+	}
+}
+
+func TestValueGet(t *testing.T) {
+	dict, err := Parse([]byte("d4:dictd1:ai1ee3:inti7e4:listli1ee3:str3:abce"))
+	if err != nil {
+		t.Fatalf("unable to parse: %v", err)
+	}
+
+	if sub, err := dict.GetDict("dict"); err != nil || string(sub.Raw) != "d1:ai1ee" {
+		t.Errorf("GetDict: got %v, %v", sub, err)
+	}
+	if n, err := dict.GetInt("int"); err != nil || n != 7 {
+		t.Errorf("GetInt: got %d, %v", n, err)
+	}
+	if list, err := dict.GetList("list"); err != nil || len(list) != 1 || list[0].Int != 1 {
+		t.Errorf("GetList: got %v, %v", list, err)
+	}
+	if s, err := dict.GetString("str"); err != nil || s != "abc" {
+		t.Errorf("GetString: got %q, %v", s, err)
+	}
+
+	if _, err := dict.GetInt("missing"); err == nil {
+		t.Errorf("expected an error for a missing key")
+	} else if _, ok := err.(*NotFoundError); !ok {
+		t.Errorf("expected a NotFoundError for a missing key, got: %v", err)
+	}
+	if _, err := dict.GetString("int"); err == nil {
+		t.Errorf("expected an error for a key of the wrong kind")
+	} else if _, ok := err.(*NotFoundError); ok {
+		t.Errorf("expected an error other than NotFoundError for a key of the wrong kind")
+	}
+
+	list, _ := dict.Get("list")
+	if _, err := list.Get("a"); err == nil {
+		t.Errorf("expected an error when getting a key from a list")
+	}
+}
+
+func TestGetFiles(t *testing.T) {
+	tests := []struct {
+		name  string
+		info  string
+		files []Files
+		ok    bool
+	}{
+		{
+			name:  "single file",
+			info:  "d6:lengthi5e4:name5:a.txte",
+			files: []Files{{Index: 0, Length: 5, Path: []string{"a.txt"}}},
+			ok:    true,
+		},
+		{
+			name: "multiple files",
+			info: "d5:filesld6:lengthi3e4:pathl3:dir1:aeed6:lengthi4e4:pathl1:beee4:name4:roote",
+			files: []Files{
+				{Index: 0, Length: 3, Path: []string{"dir", "a"}},
+				{Index: 3, Length: 4, Path: []string{"b"}},
+			},
+			ok: true,
+		},
+		{name: "single file dot dot", info: "d6:lengthi5e4:name2:..e"},
+		{name: "single file absolute", info: "d6:lengthi5e4:name9:/etc/passe"},
+		{name: "path dot dot", info: "d5:filesld6:lengthi3e4:pathl2:..6:passwdeee4:name4:roote"},
+		{name: "path separator", info: "d5:filesld6:lengthi3e4:pathl9:../passwdeee4:name4:roote"},
+		{name: "path backslash", info: "d5:filesld6:lengthi3e4:pathl9:..\\passwdeee4:name4:roote"},
+		{name: "path absolute", info: "d5:filesld6:lengthi3e4:pathl4:/etceee4:name4:roote"},
+		{name: "path empty component", info: "d5:filesld6:lengthi3e4:pathl0:eee4:name4:roote"},
+		{name: "path empty", info: "d5:filesld6:lengthi3e4:pathleee4:name4:roote"},
+		{name: "negative length", info: "d6:lengthi-1e4:name1:ae"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := Parse([]byte(tt.info))
+			if err != nil {
+				t.Fatalf("unable to parse info: %v", err)
+			}
+
+			files, err := GetFiles(info)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("expected error, got: %v", files)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(files, tt.files) {
+				t.Fatalf("expected: %v, got: %v", tt.files, files)
+			}
+		})
+	}
+}
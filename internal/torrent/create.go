@@ -0,0 +1,241 @@
+// Contains logic related to creating torrent files from local files and
+// directories.
+package torrent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Limits of the piece length that is picked when creating a torrent.
+	MinPieceLength int64 = 1 << 14 // 16 KiB
+	MaxPieceLength int64 = 1 << 24 // 16 MiB
+	// The piece length is picked so that a created torrent contains roughly
+	// this many pieces (but not more).
+	TargetPieces = 1500
+)
+
+// Optional fields of a created torrent.
+type CreateOptions struct {
+	// The tiers of trackers, see BEP 12. The first tracker is also used as
+	// the "announce" of the torrent.
+	AnnounceList [][]string
+	// The URLs of web seeds, see BEP 19.
+	WebSeeds []string
+	Comment  string
+	// Defaults to UserAgent if empty.
+	CreatedBy string
+	// Defaults to the current time if zero.
+	CreationDate time.Time
+	// Private torrents are only shared through their trackers, see BEP 27.
+	Private bool
+	// The piece length in bytes. Has to be a power of two that is at least
+	// MinPieceLength. Picked from the total size of the files if zero.
+	PieceLength int64
+}
+
+// Creates a torrent containing the file or directory at "path". If "path" is a
+// directory, all regular files inside it (recursively) are added to the torrent.
+// The pieces are hashed concurrently by one go process per CPU.
+//
+// Returns the bencoded content of the torrent file.
+func Create(path string, opts CreateOptions) ([]byte, error) {
+	path, err := filepath.Abs(filepath.FromSlash(path))
+	if err != nil {
+		return nil, fmt.Errorf("unable to get absolute path of %s: %w", path, err)
+	}
+
+	fileStat, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get stat of %s: %w", path, err)
+	}
+
+	// Reuse the Torrent struct to read the pieces of the files. The files are
+	// relative to "DownloadPath".
+	var t Torrent
+	multipleFiles := fileStat.IsDir()
+	if multipleFiles {
+		t.DownloadPath = path
+		t.Files, err = walkFiles(path)
+		if err != nil {
+			return nil, err
+		}
+	} else if fileStat.Mode().IsRegular() {
+		t.DownloadPath = filepath.Dir(path)
+		t.Files = []Files{{Index: 0, Length: fileStat.Size(), Path: []string{filepath.Base(path)}}}
+	} else {
+		return nil, fmt.Errorf("%s is not a regular file or a directory", path)
+	}
+
+	t.totalLength = filesLength(t.Files)
+	total := t.TotalLength()
+	if total == 0 {
+		return nil, fmt.Errorf("unable to create torrent: %s contains no data", path)
+	}
+
+	t.PieceLength = opts.PieceLength
+	if t.PieceLength == 0 {
+		t.PieceLength = pickPieceLength(total)
+	} else if t.PieceLength < MinPieceLength || t.PieceLength&(t.PieceLength-1) != 0 {
+		return nil, fmt.Errorf("incorrect piece length, expected a power of two "+
+			">= %d, got: %d", MinPieceLength, t.PieceLength)
+	}
+	t.Pieces = make([]PieceHash, (total+t.PieceLength-1)/t.PieceLength)
+
+	if err := t.hashPieces(); err != nil {
+		return nil, err
+	}
+
+	info := infoDict{
+		Name:        filepath.Base(path),
+		PieceLength: t.PieceLength,
+		Pieces:      make([]byte, 0, len(t.Pieces)*sha1.Size),
+		Private:     opts.Private,
+	}
+	if multipleFiles {
+		for _, file := range t.Files {
+			info.Files = append(info.Files, infoFile{Length: file.Length, Path: file.Path})
+		}
+	} else {
+		info.Length = total
+	}
+	for _, piece := range t.Pieces {
+		info.Pieces = append(info.Pieces, piece[:]...)
+	}
+	infoContent, err := Marshal(info)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode info dictionary: %w", err)
+	}
+
+	metainfo := metainfoFile{
+		Comment:      opts.Comment,
+		CreatedBy:    opts.CreatedBy,
+		CreationDate: opts.CreationDate.Unix(),
+		Info:         infoContent,
+		URLList:      opts.WebSeeds,
+	}
+	if metainfo.CreatedBy == "" {
+		metainfo.CreatedBy = UserAgent
+	}
+	if opts.CreationDate.IsZero() {
+		metainfo.CreationDate = time.Now().Unix()
+	}
+	for _, tier := range opts.AnnounceList {
+		if len(tier) > 0 {
+			metainfo.AnnounceList = append(metainfo.AnnounceList, tier)
+		}
+	}
+	if len(metainfo.AnnounceList) > 0 {
+		metainfo.Announce = metainfo.AnnounceList[0][0]
+	}
+
+	return Marshal(metainfo)
+}
+
+// Creates a torrent containing the file or directory at "path" (see Create) and
+// writes it to the file "output".
+func CreateFile(path, output string, opts CreateOptions) error {
+	content, err := Create(path, opts)
+	if err != nil {
+		return err
+	}
+
+	output = filepath.FromSlash(output)
+	if err := ioutil.WriteFile(output, content, 0644); err != nil {
+		return fmt.Errorf("unable to write torrent file %s: %w", output, err)
+	}
+	return nil
+}
+
+// Returns all regular files inside the directory "dir" (recursively) in
+// lexical order. The paths of the files are relative to "dir".
+func walkFiles(dir string) ([]Files, error) {
+	files := make([]Files, 0)
+	var index int64 = 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if !info.Mode().IsRegular() {
+			// Skip directories, symlinks, devices etc.
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, Files{
+			Index:  index,
+			Length: info.Size(),
+			Path:   strings.Split(filepath.ToSlash(rel), "/"),
+		})
+		index += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to walk directory %s: %w", dir, err)
+	} else if len(files) == 0 {
+		return nil, fmt.Errorf("directory %s contains no files", dir)
+	}
+
+	return files, nil
+}
+
+// Picks the smallest piece length (a power of two) that results in at most
+// TargetPieces pieces, limited to MinPieceLength and MaxPieceLength.
+func pickPieceLength(total int64) int64 {
+	pieceLength := MinPieceLength
+	for pieceLength < MaxPieceLength && total/pieceLength >= TargetPieces {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// Reads every piece from disk and sets its sha1 hash in "Pieces".
+func (t *Torrent) hashPieces() error {
+	amountOfPieces := len(t.Pieces)
+	indexChannel := make(chan int, amountOfPieces)
+	for i := 0; i < amountOfPieces; i++ {
+		indexChannel <- i
+	}
+	close(indexChannel)
+
+	var mut sync.Mutex
+	var firstErr error
+
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			buffer := make([]byte, t.PieceLength)
+			for i := range indexChannel {
+				data := buffer[:t.PieceSize(uint32(i))]
+				if err := t.readAt(data, int64(i)*t.PieceLength); err != nil {
+					mut.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mut.Unlock()
+					return
+				}
+				t.Pieces[i] = sha1.Sum(data)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return fmt.Errorf("unable to hash pieces: %w", firstErr)
+	}
+	return nil
+}
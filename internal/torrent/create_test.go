@@ -0,0 +1,214 @@
+package torrent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPickPieceLength(t *testing.T) {
+	tests := []struct {
+		total    int64
+		expected int64
+	}{
+		{1, MinPieceLength},
+		{TargetPieces*MinPieceLength - 1, MinPieceLength},
+		{TargetPieces * MinPieceLength, 2 * MinPieceLength},
+		{TargetPieces*2*MinPieceLength - 1, 2 * MinPieceLength},
+		{TargetPieces * 2 * MinPieceLength, 4 * MinPieceLength},
+		{1 << 30, 1 << 20},
+		{1 << 40, MaxPieceLength},
+	}
+
+	for _, tt := range tests {
+		got := pickPieceLength(tt.total)
+		if got != tt.expected {
+			t.Errorf("total %d: expected: %d, got: %d", tt.total, tt.expected, got)
+		}
+		if got&(got-1) != 0 {
+			t.Errorf("total %d: expected a power of two, got: %d", tt.total, got)
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	const pieceLength = 1 << 14
+
+	tests := []struct {
+		name    string
+		lengths []int
+		opts    CreateOptions
+	}{
+		{
+			name:    "multiple files",
+			lengths: []int{3*pieceLength + 1000, pieceLength},
+			opts:    CreateOptions{PieceLength: pieceLength},
+		},
+		{
+			name:    "single file",
+			lengths: []int{2*pieceLength + 1},
+			opts:    CreateOptions{PieceLength: pieceLength},
+		},
+		{
+			name:    "picked piece length",
+			lengths: []int{100, 200},
+			opts:    CreateOptions{},
+		},
+		{
+			name:    "all options",
+			lengths: []int{pieceLength},
+			opts: CreateOptions{
+				AnnounceList: [][]string{{"http://a/announce", "http://b/announce"}, {}, {"udp://c:80"}},
+				WebSeeds:     []string{"http://seed/"},
+				Comment:      "comment",
+				CreatedBy:    "test",
+				CreationDate: time.Unix(1600000000, 0),
+				Private:      true,
+				PieceLength:  pieceLength,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pieceLength := tt.opts.PieceLength
+			if pieceLength == 0 {
+				pieceLength = MinPieceLength
+			}
+			expected := newTestTorrent(t, pieceLength, tt.lengths...)
+			writeTestFiles(t, expected)
+			defer os.RemoveAll(expected.DownloadPath)
+
+			path := expected.DownloadPath
+			if len(tt.lengths) == 1 {
+				path = filepath.Join(path, "file0")
+			}
+			content, err := Create(path, tt.opts)
+			if err != nil {
+				t.Fatalf("unable to create torrent: %v", err)
+			}
+			tor, err := NewTorrentFromContent(content)
+			if err != nil {
+				t.Fatalf("unable to parse created torrent: %v", err)
+			}
+
+			metainfo, err := Parse(content)
+			if err != nil {
+				t.Fatalf("unable to parse created torrent: %v", err)
+			}
+			info, err := metainfo.GetDict("info")
+			if err != nil {
+				t.Fatalf("unable to get info: %v", err)
+			}
+			if name, err := info.GetString("name"); err != nil || name != filepath.Base(path) {
+				t.Errorf("expected name %s, got: %s (%v)", filepath.Base(path), name, err)
+			}
+			if tor.PieceLength != pieceLength {
+				t.Errorf("expected piece length %d, got: %d", pieceLength, tor.PieceLength)
+			}
+			if len(tor.Pieces) != len(expected.Pieces) {
+				t.Fatalf("expected %d pieces, got: %d", len(expected.Pieces), len(tor.Pieces))
+			}
+			for i := range tor.Pieces {
+				if tor.Pieces[i] != expected.Pieces[i] {
+					t.Errorf("piece %d: incorrect hash", i)
+				}
+			}
+			if len(tor.Files) != len(tt.lengths) {
+				t.Fatalf("expected %d files, got: %d", len(tt.lengths), len(tor.Files))
+			}
+			for i, file := range tor.Files {
+				if file.Length != int64(tt.lengths[i]) {
+					t.Errorf("file %d: expected length %d, got: %d", i, tt.lengths[i], file.Length)
+				}
+			}
+
+			if tor.Private() != tt.opts.Private {
+				t.Errorf("private: expected %v, got: %v", tt.opts.Private, tor.Private())
+			}
+			for _, field := range []struct {
+				key      string
+				expected string
+			}{
+				{"comment", tt.opts.Comment},
+				{"created by", tt.opts.CreatedBy},
+			} {
+				got, err := metainfo.GetString(field.key)
+				if field.expected == "" {
+					continue
+				} else if err != nil || got != field.expected {
+					t.Errorf("%s: expected %q, got: %q (%v)", field.key, field.expected, got, err)
+				}
+			}
+			if date, err := metainfo.GetInt("creation date"); err != nil {
+				t.Errorf("unable to get creation date: %v", err)
+			} else if !tt.opts.CreationDate.IsZero() && date != tt.opts.CreationDate.Unix() {
+				t.Errorf("expected creation date %d, got: %d", tt.opts.CreationDate.Unix(), date)
+			}
+
+			// Empty tiers are skipped.
+			urls := make([]string, 0)
+			for _, status := range tor.TrackerStatuses() {
+				urls = append(urls, status.URL)
+			}
+			expectedURLs := make([]string, 0)
+			for _, tier := range tt.opts.AnnounceList {
+				expectedURLs = append(expectedURLs, tier...)
+			}
+			if len(urls) != len(expectedURLs) {
+				t.Errorf("expected trackers: %v, got: %v", expectedURLs, urls)
+			}
+			if len(expectedURLs) > 0 {
+				if announce, _ := metainfo.GetString("announce"); announce != expectedURLs[0] {
+					t.Errorf("expected announce %s, got: %s", expectedURLs[0], announce)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torc")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	empty := filepath.Join(dir, "empty")
+	emptyDir := filepath.Join(dir, "emptydir")
+	data := filepath.Join(dir, "data")
+	if err := ioutil.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatalf("unable to create file: %v", err)
+	}
+	if err := os.Mkdir(emptyDir, 0755); err != nil {
+		t.Fatalf("unable to create directory: %v", err)
+	}
+	if err := ioutil.WriteFile(data, []byte("data"), 0644); err != nil {
+		t.Fatalf("unable to create file: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		opts   CreateOptions
+		errMsg string
+	}{
+		{"missing", filepath.Join(dir, "missing"), CreateOptions{}, "stat"},
+		{"empty file", empty, CreateOptions{}, "no data"},
+		{"empty directory", emptyDir, CreateOptions{}, "no files"},
+		{"piece length too small", data, CreateOptions{PieceLength: MinPieceLength / 2}, "piece length"},
+		{"piece length not a power of two", data, CreateOptions{PieceLength: 3 * MinPieceLength}, "piece length"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Create(tt.path, tt.opts)
+			if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Fatalf("expected an error containing %q, got: %v", tt.errMsg, err)
+			}
+		})
+	}
+}
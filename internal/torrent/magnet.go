@@ -0,0 +1,173 @@
+// Contains logic related to torrents added from magnet links.
+// See http://www.bittorrent.org/beps/bep_0009.html
+package torrent
+
+import (
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/jmatss/torc/internal/util/cons"
+	"github.com/jmatss/torc/internal/util/ratelimit"
+)
+
+const (
+	MagnetPrefix = "magnet:?"
+	btihPrefix   = "urn:btih:"
+)
+
+// Create and return a new Torrent struct from a magnet link. The returned torrent
+// doesn't have any metadata (Files, Pieces, PieceLength), it has to be fetched
+// from remote peers and set with SetMetadata before anything can be downloaded.
+//
+// Format: magnet:?xt=urn:btih:<info hash>&dn=<name>&tr=<tracker url>
+// where the info hash is either hex (40 chars) or base32 (32 chars) encoded.
+func NewTorrentFromMagnet(link string) (*Torrent, error) {
+	if !strings.HasPrefix(link, MagnetPrefix) {
+		return nil, fmt.Errorf("incorrect magnet link \"%s\", expected prefix \"%s\"",
+			link, MagnetPrefix)
+	}
+
+	params, err := url.ParseQuery(link[len(MagnetPrefix):])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse magnet link \"%s\": %w", link, err)
+	}
+
+	var infoHash []byte
+	for _, xt := range params["xt"] {
+		if !strings.HasPrefix(xt, btihPrefix) {
+			continue
+		}
+
+		hash := xt[len(btihPrefix):]
+		switch len(hash) {
+		case 2 * sha1.Size:
+			infoHash, err = hex.DecodeString(hash)
+		case 32:
+			infoHash, err = base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+		default:
+			err = fmt.Errorf("incorrect length %d", len(hash))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse info hash \"%s\" in magnet link: %w",
+				hash, err)
+		}
+		break
+	}
+	if len(infoHash) != sha1.Size {
+		return nil, fmt.Errorf("no \"%s\" info hash found in magnet link \"%s\"",
+			btihPrefix, link)
+	}
+
+	// Every tracker is put into a tier of its own so that they are tried in the
+	// order that they were specified.
+	announceList := make([][]*TrackerStatus, 0, len(params["tr"]))
+	for _, tr := range params["tr"] {
+		if tr = strings.TrimSpace(tr); tr != "" {
+			status := &TrackerStatus{URL: tr, Tier: len(announceList)}
+			announceList = append(announceList, []*TrackerStatus{status})
+		}
+	}
+
+	t := &Torrent{
+		AnnounceList:  announceList,
+		DownloadPath:  cons.DownloadPath,
+		Name:          params.Get("dn"),
+		UploadLimit:   ratelimit.New(0),
+		DownloadLimit: ratelimit.New(0),
+		metadataReady: make(chan struct{}),
+	}
+	copy(t.Tracker.InfoHash[:], infoHash)
+
+	return t, nil
+}
+
+// Returns true if the metadata of this torrent is known. Only torrents added
+// from magnet links can be without metadata.
+func (t *Torrent) HasMetadata() bool {
+	t.mut.RLock()
+	defer t.mut.RUnlock()
+
+	return t.Metainfo != nil
+}
+
+// Returns a channel that is closed when the metadata of the torrent is known
+// and pieces can be downloaded.
+func (t *Torrent) MetadataReady() <-chan struct{} {
+	return t.metadataReady
+}
+
+// Closes the channel returned by MetadataReady. Called by the torrent handler
+// once, after the metadata has been set and the torrent is ready to download.
+func (t *Torrent) CloseMetadataReady() {
+	close(t.metadataReady)
+}
+
+// Sets the metadata of a torrent that was created from a magnet link. "info" is
+// the bencoded info dictionary received from remote peers, it is verified
+// against the info hash of the torrent.
+//
+// The Files, Pieces and PieceLength are set and a torrent file (Metainfo) is
+// created so that the torrent can be stored in the session.
+func (t *Torrent) SetMetadata(info []byte) error {
+	if t.HasMetadata() {
+		return fmt.Errorf("the torrent already has metadata")
+	} else if sha1.Sum(info) != t.Tracker.InfoHash {
+		return fmt.Errorf("the sha1 hash of the metadata doesn't match the info hash")
+	}
+
+	// Create a torrent file containing the trackers and the info dictionary.
+	metainfo := metainfoFile{Info: info}
+	for _, status := range t.TrackerStatuses() {
+		if metainfo.Announce == "" {
+			metainfo.Announce = status.URL
+		}
+		metainfo.AnnounceList = append(metainfo.AnnounceList, []string{status.URL})
+	}
+	content, err := Marshal(metainfo)
+	if err != nil {
+		return fmt.Errorf("unable to encode torrent file: %w", err)
+	}
+
+	parsed, err := NewTorrentFromContent(content)
+	if err != nil {
+		return fmt.Errorf("unable to parse the received metadata: %w", err)
+	}
+
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	t.Tracker.Lock()
+	defer t.Tracker.Unlock()
+
+	if parsed.Name != "" {
+		t.Name = parsed.Name
+	}
+	t.Files = parsed.Files
+	t.totalLength = parsed.totalLength
+	t.Pieces = parsed.Pieces
+	t.PieceLength = parsed.PieceLength
+	t.Metainfo = content
+	t.info = parsed.info
+	t.private = parsed.private
+
+	t.Tracker.Left = parsed.Tracker.Left
+	t.Tracker.BitFieldHave = parsed.Tracker.BitFieldHave
+	t.Tracker.BitFieldDownloading = parsed.Tracker.BitFieldDownloading
+
+	return nil
+}
+
+// Returns the info dictionary of this torrent. Used when the metadata is sent
+// to remote peers.
+func (t *Torrent) Info() ([]byte, error) {
+	t.mut.RLock()
+	defer t.mut.RUnlock()
+
+	if t.info == nil {
+		return nil, fmt.Errorf("the torrent doesn't have any metadata")
+	}
+	return t.info, nil
+}
@@ -0,0 +1,362 @@
+// Contains logic related to encoding go values into bencode and decoding
+// bencode into go values (including structs with "bencode" struct tags).
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A raw bencoded value. It is written as is when encoded and is set to the
+// bencoded bytes of the value when unmarshalled. Can be used to keep the exact
+// bytes of an info dictionary so that its info hash doesn't change.
+type RawMessage []byte
+
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
+
+// A field of a struct that is encoded as a key of a bencoded dictionary.
+type structField struct {
+	key       string
+	index     int
+	omitEmpty bool
+}
+
+// Bencodes "v". The keys of dictionaries are sorted.
+//
+// Conversion _Go_ -> _Bencode_:
+//
+//	string, []byte, [n]byte -> string
+//	int, uint (all sizes), bool -> integer (true = 1, false = 0)
+//	slice, array -> list
+//	map with string keys, struct -> dictionary
+//	RawMessage -> written as is
+//
+// Pointers and interfaces are encoded as the value that they point to. See
+// Marshal for how the fields of structs are encoded.
+func Encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodeValue(&buf, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Bencodes "v", usually a struct, the same way as Encode.
+//
+// Every exported field of a struct is encoded as a key in a dictionary. The
+// key is specified with the "bencode" struct tag, ex. `bencode:"piece length"`,
+// otherwise the name of the field is used. Fields tagged with "-" are skipped
+// and fields with the option "omitempty", ex. `bencode:"comment,omitempty"`,
+// are skipped if they are zero, false, nil or empty.
+func Marshal(v interface{}) ([]byte, error) {
+	return Encode(v)
+}
+
+// Decodes the bencoded "data" into the value that "v" points to. Structs are
+// matched with the keys of a dictionary the same way as in Marshal, keys
+// without a matching field are ignored. Values decoded into an interface{} are
+// converted the same way as in Decode.
+func Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("unable to unmarshal into non-pointer %T", v)
+	}
+
+	value, err := Parse(data)
+	if err != nil {
+		return err
+	}
+
+	return decodeValue(value, rv.Elem())
+}
+
+func encodeValue(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		return fmt.Errorf("unable to bencode nil")
+	} else if v.Type() == rawMessageType {
+		if v.Len() == 0 {
+			return fmt.Errorf("unable to bencode empty RawMessage")
+		}
+		buf.Write(v.Bytes())
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return fmt.Errorf("unable to bencode nil %s", v.Type())
+		}
+		return encodeValue(buf, v.Elem())
+
+	case reflect.String:
+		writeString(buf, []byte(v.String()))
+
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteString("i1e")
+		} else {
+			buf.WriteString("i0e")
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf.WriteString("i" + strconv.FormatInt(v.Int(), 10) + "e")
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		buf.WriteString("i" + strconv.FormatUint(v.Uint(), 10) + "e")
+
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			writeString(buf, b)
+			break
+		}
+
+		buf.WriteString("l")
+		for i := 0; i < v.Len(); i++ {
+			if err := encodeValue(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("e")
+
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("unable to bencode map with keys of type %s", v.Type().Key())
+		}
+
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+
+		buf.WriteString("d")
+		for _, key := range keys {
+			writeString(buf, []byte(key.String()))
+			if err := encodeValue(buf, v.MapIndex(key)); err != nil {
+				return fmt.Errorf("unable to bencode \"%s\": %w", key.String(), err)
+			}
+		}
+		buf.WriteString("e")
+
+	case reflect.Struct:
+		buf.WriteString("d")
+		for _, field := range structFields(v.Type()) {
+			fieldValue := v.Field(field.index)
+			if field.omitEmpty && isEmpty(fieldValue) {
+				continue
+			}
+
+			writeString(buf, []byte(field.key))
+			if err := encodeValue(buf, fieldValue); err != nil {
+				return fmt.Errorf("unable to bencode \"%s\": %w", field.key, err)
+			}
+		}
+		buf.WriteString("e")
+
+	default:
+		return fmt.Errorf("unable to bencode value of type %s", v.Type())
+	}
+
+	return nil
+}
+
+func decodeValue(data *Value, v reflect.Value) error {
+	if v.Type() == rawMessageType {
+		v.SetBytes(append([]byte(nil), data.Raw...))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return decodeValue(data, v.Elem())
+
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return fmt.Errorf("unable to unmarshal into non-empty interface %s", v.Type())
+		}
+		v.Set(reflect.ValueOf(data.Interface()))
+
+	case reflect.String:
+		if err := expectKind(data, StringValue, v); err != nil {
+			return err
+		}
+		v.SetString(string(data.Str))
+
+	case reflect.Bool:
+		if err := expectKind(data, IntValue, v); err != nil {
+			return err
+		}
+		v.SetBool(data.Int != 0)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if err := expectKind(data, IntValue, v); err != nil {
+			return err
+		} else if v.OverflowInt(data.Int) {
+			return fmt.Errorf("integer %d overflows %s", data.Int, v.Type())
+		}
+		v.SetInt(data.Int)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if err := expectKind(data, IntValue, v); err != nil {
+			return err
+		} else if data.Int < 0 || v.OverflowUint(uint64(data.Int)) {
+			return fmt.Errorf("integer %d overflows %s", data.Int, v.Type())
+		}
+		v.SetUint(uint64(data.Int))
+
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if err := expectKind(data, StringValue, v); err != nil {
+				return err
+			}
+			v.SetBytes(append([]byte(nil), data.Str...))
+			break
+		}
+
+		if err := expectKind(data, ListValue, v); err != nil {
+			return err
+		}
+		slice := reflect.MakeSlice(v.Type(), len(data.List), len(data.List))
+		for i := range data.List {
+			if err := decodeValue(&data.List[i], slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if err := expectKind(data, StringValue, v); err != nil {
+				return err
+			} else if len(data.Str) != v.Len() {
+				return fmt.Errorf("incorrect length of string, expected: %d, got: %d",
+					v.Len(), len(data.Str))
+			}
+			reflect.Copy(v, reflect.ValueOf(data.Str))
+			break
+		}
+
+		if err := expectKind(data, ListValue, v); err != nil {
+			return err
+		} else if len(data.List) > v.Len() {
+			return fmt.Errorf("list contains more than %d items", v.Len())
+		}
+		for i := range data.List {
+			if err := decodeValue(&data.List[i], v.Index(i)); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("unable to unmarshal into map with keys of type %s", v.Type().Key())
+		} else if err := expectKind(data, DictValue, v); err != nil {
+			return err
+		} else if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+
+		for i := range data.Entries {
+			entry := &data.Entries[i]
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := decodeValue(&entry.Value, elem); err != nil {
+				return fmt.Errorf("unable to unmarshal \"%s\": %w", entry.Key, err)
+			}
+			v.SetMapIndex(reflect.ValueOf(string(entry.Key)).Convert(v.Type().Key()), elem)
+		}
+
+	case reflect.Struct:
+		if err := expectKind(data, DictValue, v); err != nil {
+			return err
+		}
+
+		// Keys without a matching field are ignored.
+		for _, field := range structFields(v.Type()) {
+			value, err := data.Get(field.key)
+			if _, ok := err.(*NotFoundError); ok {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if err := decodeValue(value, v.Field(field.index)); err != nil {
+				return fmt.Errorf("unable to unmarshal \"%s\": %w", field.key, err)
+			}
+		}
+
+	default:
+		return fmt.Errorf("unable to unmarshal into value of type %s", v.Type())
+	}
+
+	return nil
+}
+
+// Returns an error if "data" isn't of the kind "kind". "v" is the value that
+// "data" is unmarshalled into.
+func expectKind(data *Value, kind ValueKind, v reflect.Value) error {
+	if data.Kind != kind {
+		return fmt.Errorf("unable to unmarshal %s into %s", data.Kind, v.Type())
+	}
+	return nil
+}
+
+// Returns the fields of the struct type "t" that are bencoded, sorted by key.
+func structFields(t reflect.Type) []structField {
+	fields := make([]structField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("bencode")
+		if f.PkgPath != "" || tag == "-" {
+			// Unexported or skipped field.
+			continue
+		}
+
+		options := strings.Split(tag, ",")
+		key := options[0]
+		if key == "" {
+			key = f.Name
+		}
+
+		field := structField{key: key, index: i}
+		for _, option := range options[1:] {
+			if option == "omitempty" {
+				field.omitEmpty = true
+			}
+		}
+		fields = append(fields, field)
+	}
+
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].key < fields[j].key
+	})
+	return fields
+}
+
+// Returns true if "v" should be skipped when it is a field with "omitempty".
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+func writeString(buf *bytes.Buffer, b []byte) {
+	buf.WriteString(strconv.Itoa(len(b)) + ":")
+	buf.Write(b)
+}
@@ -0,0 +1,169 @@
+package torrent
+
+import (
+	"reflect"
+	"testing"
+)
+
+type testFile struct {
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+type testMetainfo struct {
+	Announce string     `bencode:"announce"`
+	Comment  string     `bencode:"comment,omitempty"`
+	Private  bool       `bencode:"private,omitempty"`
+	Files    []testFile `bencode:"files"`
+	Hash     [4]byte    `bencode:"hash"`
+	Info     RawMessage `bencode:"info"`
+	Skipped  string     `bencode:"-"`
+	NoTag    uint16
+	unused   int
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    interface{}
+		expected string
+		ok       bool
+	}{
+		{"string", "spam", "4:spam", true},
+		{"empty string", "", "0:", true},
+		{"bytes", []byte{'a', 0, 'b'}, "3:a\x00b", true},
+		{"byte array", [2]byte{'h', 'i'}, "2:hi", true},
+		{"int", 3, "i3e", true},
+		{"negative int", int64(-3), "i-3e", true},
+		{"zero", 0, "i0e", true},
+		{"uint", uint32(42), "i42e", true},
+		{"true", true, "i1e", true},
+		{"false", false, "i0e", true},
+		{"list", []interface{}{"spam", 42}, "l4:spami42ee", true},
+		{"empty list", []int{}, "le", true},
+		{"sorted map", map[string]int{"b": 2, "a": 1}, "d1:ai1e1:bi2ee", true},
+		{"nested", map[string]interface{}{"l": []string{"x"}}, "d1:ll1:xee", true},
+		{"pointer", &[]int{1}, "li1ee", true},
+		{"raw message", RawMessage("d1:ai1ee"), "d1:ai1ee", true},
+		{
+			name: "struct",
+			value: testMetainfo{
+				Announce: "http://a",
+				Files:    []testFile{{Length: 1, Path: []string{"f"}}},
+				Hash:     [4]byte{'a', 'b', 'c', 'd'},
+				Info:     RawMessage("de"),
+				Skipped:  "skipped",
+				unused:   1,
+				NoTag:    7,
+			},
+			expected: "d5:NoTagi7e8:announce8:http://a5:filesld6:lengthi1e4:pathl1:feee" +
+				"4:hash4:abcd4:infodee",
+			ok: true,
+		},
+		{"nil", nil, "", false},
+		{"nil pointer", (*int)(nil), "", false},
+		{"empty raw message", RawMessage{}, "", false},
+		{"map with int keys", map[int]int{1: 1}, "", false},
+		{"float", 1.5, "", false},
+		{"nested error", []interface{}{1.5}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Encode(tt.value)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", got)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unable to encode: %v", err)
+			}
+
+			if string(got) != tt.expected {
+				t.Fatalf("expected: %q, got: %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	metainfo := testMetainfo{
+		Announce: "udp://tracker:80",
+		Comment:  "comment",
+		Private:  true,
+		Files: []testFile{
+			{Length: 10, Path: []string{"dir", "a"}},
+			{Length: 20, Path: []string{"b"}},
+		},
+		Hash:  [4]byte{1, 2, 3, 4},
+		Info:  RawMessage("d4:name1:ae"),
+		NoTag: 65535,
+	}
+
+	data, err := Marshal(metainfo)
+	if err != nil {
+		t.Fatalf("unable to marshal: %v", err)
+	}
+	var got testMetainfo
+	if err := Unmarshal(data, &got); err != nil {
+		t.Fatalf("unable to unmarshal %q: %v", data, err)
+	}
+	if !reflect.DeepEqual(got, metainfo) {
+		t.Fatalf("expected: %+v, got: %+v", metainfo, got)
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		value    interface{}
+		expected interface{}
+		ok       bool
+	}{
+		{"string", "4:spam", new(string), "spam", true},
+		{"bytes", "2:hi", new([]byte), []byte("hi"), true},
+		{"int", "i-5e", new(int), -5, true},
+		{"uint8", "i255e", new(uint8), uint8(255), true},
+		{"bool", "i1e", new(bool), true, true},
+		{"list", "li1ei2ee", new([]int), []int{1, 2}, true},
+		{"map", "d1:ai1e1:bi2ee", new(map[string]int), map[string]int{"a": 1, "b": 2}, true},
+		{
+			"interface", "d1:ali1e1:xee", new(interface{}),
+			map[string]interface{}{"a": []interface{}{int64(1), "x"}}, true,
+		},
+		{"raw message", "d1:ai1ee", new(RawMessage), RawMessage("d1:ai1ee"), true},
+		{"unknown keys ignored", "d6:lengthi3e5:otheri1ee", new(testFile), testFile{Length: 3}, true},
+		{"int overflow", "i256e", new(uint8), nil, false},
+		{"negative uint", "i-1e", new(uint), nil, false},
+		{"wrong kind", "i1e", new(string), nil, false},
+		{"wrong array length", "3:abc", new([4]byte), nil, false},
+		{"too many list items", "li1ei2ei3ee", new([2]int), nil, false},
+		{"incorrect bencode", "i01e", new(int), nil, false},
+		{"float", "i1e", new(float64), nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Unmarshal([]byte(tt.data), tt.value)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", reflect.ValueOf(tt.value).Elem())
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unable to unmarshal: %v", err)
+			}
+
+			if got := reflect.ValueOf(tt.value).Elem().Interface(); !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected: %#v, got: %#v", tt.expected, got)
+			}
+		})
+	}
+
+	var i int
+	if err := Unmarshal([]byte("i1e"), i); err == nil {
+		t.Fatalf("expected an error when unmarshalling into a non-pointer")
+	}
+}
@@ -0,0 +1,338 @@
+// Contains logic related to selecting which pieces to download from remote peers.
+package torrent
+
+import (
+	"math/rand"
+	"sync"
+
+	"github.com/jmatss/torc/internal/util/logger"
+)
+
+const (
+	// The amount of pieces that are picked at random before the rarest first
+	// strategy is used. Getting a few complete pieces fast makes it possible to
+	// start uploading to other peers.
+	RandomFirstPieces = 4
+)
+
+// A PickStrategy decides in which order the pieces of a torrent are downloaded.
+type PickStrategy interface {
+	// Returns the piece to download next out of "candidates". The candidates are
+	// pieces that the remote peer has and that no one is downloading, it always
+	// contains at least one piece. "availability" contains the amount of
+	// connected peers that have every piece and "have" is the amount of pieces
+	// that this client has downloaded.
+	Pick(candidates []uint32, availability []int, have int) uint32
+}
+
+// Picks the piece that the fewest connected peers have so that rare pieces are
+// spread in the swarm. Ties are broken at random so that peers doesn't all
+// download the same pieces. The first RandomFirstPieces pieces are picked at random.
+type RarestFirst struct{}
+
+func (RarestFirst) Pick(candidates []uint32, availability []int, have int) uint32 {
+	if have < RandomFirstPieces {
+		return candidates[rand.Intn(len(candidates))]
+	}
+
+	rarest := make([]uint32, 0, 1)
+	for _, pieceIndex := range candidates {
+		if len(rarest) == 0 || availability[pieceIndex] < availability[rarest[0]] {
+			rarest = append(rarest[:0], pieceIndex)
+		} else if availability[pieceIndex] == availability[rarest[0]] {
+			rarest = append(rarest, pieceIndex)
+		}
+	}
+
+	return rarest[rand.Intn(len(rarest))]
+}
+
+// Picks the pieces in order. Useful when the files should be readable while
+// they are being downloaded, ex. for streaming.
+type Sequential struct{}
+
+func (Sequential) Pick(candidates []uint32, availability []int, have int) uint32 {
+	// The candidates are in ascending order.
+	return candidates[0]
+}
+
+// Picker keeps track of how many of the connected peers that have every piece
+// and hands out pieces to download according to a PickStrategy.
+//
+// The peer handlers report the bitfields and "have" messages of their remote
+// peers to the picker. A picked piece is marked in the Tracker.BitFieldDownloading
+// until it is either completed or released.
+//
+// When every piece that is left is being downloaded, the picker enters endgame.
+// In endgame the pieces that are being downloaded are handed out to every
+// downloader whose remote peer has them, so that a single slow peer can't stall
+// the completion of the torrent.
+type Picker struct {
+	mut sync.Mutex
+
+	t            *Torrent
+	strategy     PickStrategy
+	availability []int
+
+	// The pieces that are being downloaded and the amount of downloaders that
+	// are downloading them (more than one only during endgame).
+	pieces map[uint32]*Piece
+	refs   map[uint32]int
+
+	endgame bool
+	// Closed and replaced every time a block is received during endgame, or a
+	// piece is completed or discarded. Used to notify the other downloaders so
+	// that they can cancel their requests of the same blocks.
+	notify chan struct{}
+}
+
+// Creates a new picker for the torrent. Uses the RarestFirst strategy if
+// "strategy" is nil.
+func NewPicker(t *Torrent, strategy PickStrategy) *Picker {
+	if strategy == nil {
+		strategy = RarestFirst{}
+	}
+
+	return &Picker{
+		t:            t,
+		strategy:     strategy,
+		availability: make([]int, len(t.Pieces)),
+		pieces:       make(map[uint32]*Piece),
+		refs:         make(map[uint32]int),
+		notify:       make(chan struct{}),
+	}
+}
+
+// Changes the strategy used when picking pieces.
+func (pk *Picker) SetStrategy(strategy PickStrategy) {
+	pk.mut.Lock()
+	defer pk.mut.Unlock()
+
+	pk.strategy = strategy
+}
+
+// Adds the pieces in the bitfield of a remote peer to the availability.
+func (pk *Picker) AddBitField(bitField []byte) {
+	pk.updateBitField(bitField, 1)
+}
+
+// Removes the pieces in the bitfield of a remote peer from the availability.
+// Should be called when a remote peer disconnects or sends a new bitfield.
+func (pk *Picker) RemoveBitField(bitField []byte) {
+	pk.updateBitField(bitField, -1)
+}
+
+func (pk *Picker) updateBitField(bitField []byte, delta int) {
+	pk.mut.Lock()
+	defer pk.mut.Unlock()
+
+	for i := range pk.availability {
+		if i/8 >= len(bitField) {
+			break
+		}
+		if bitField[i/8]&(1<<(7-uint(i%8))) != 0 {
+			pk.availability[i] += delta
+		}
+	}
+}
+
+// Adds a single piece that a remote peer has announced with a "have" message.
+func (pk *Picker) AddHave(pieceIndex uint32) {
+	pk.mut.Lock()
+	defer pk.mut.Unlock()
+
+	if int(pieceIndex) < len(pk.availability) {
+		pk.availability[pieceIndex]++
+	}
+}
+
+// Returns the amount of connected peers that have the piece.
+func (pk *Picker) Availability(pieceIndex uint32) int {
+	pk.mut.Lock()
+	defer pk.mut.Unlock()
+
+	if int(pieceIndex) >= len(pk.availability) {
+		return 0
+	}
+	return pk.availability[pieceIndex]
+}
+
+// Picks a piece that the remote peer with the bitfield "remoteBitField" has and
+// that no one is downloading. The piece is marked in BitFieldDownloading.
+//
+// If there are no such pieces and every piece that is left is being downloaded,
+// the picker enters endgame and a piece that is being downloaded by someone else
+// is returned instead. "active" should contain the pieces that the caller
+// already is downloading, they will not be returned again.
+//
+// Returns false if there are no piece to download from the remote peer.
+// Every returned piece must be given back with Complete, Discard or Release.
+func (pk *Picker) Pick(remoteBitField []byte, active map[uint32]*Piece) (*Piece, bool) {
+	pk.mut.Lock()
+	defer pk.mut.Unlock()
+	pk.t.Tracker.Lock()
+	defer pk.t.Tracker.Unlock()
+
+	have := 0
+	free := 0
+	candidates := make([]uint32, 0)
+	for i := range pk.availability {
+		byteIndex := i / 8
+		bit := byte(1 << (7 - uint(i%8)))
+
+		if pk.t.Tracker.BitFieldHave[byteIndex]&bit != 0 {
+			have++
+		}
+
+		localAvailable := pk.t.Tracker.BitFieldDownloading[byteIndex] & bit
+		if localAvailable != 0 {
+			continue
+		}
+		free++
+
+		// If (no one is downloading the piece && the remote peer has this piece):
+		//    it is a candidate
+		if hasBit(remoteBitField, i) {
+			candidates = append(candidates, uint32(i))
+		}
+	}
+
+	if len(candidates) > 0 {
+		pieceIndex := pk.strategy.Pick(candidates, pk.availability, have)
+		pk.t.Tracker.BitFieldDownloading[pieceIndex/8] |= 1 << (7 - (pieceIndex % 8))
+
+		piece := pk.t.NewPiece(pieceIndex)
+		pk.pieces[pieceIndex] = piece
+		pk.refs[pieceIndex] = 1
+		return piece, true
+	} else if free > 0 || len(pk.pieces) == 0 {
+		// There are pieces left that no one is downloading (that the remote peer
+		// doesn't have) or there are nothing left to download, not endgame.
+		return nil, false
+	}
+
+	/*
+		Endgame, every piece that is left is being downloaded. Hand out the piece
+		that the remote peer has and that fewest downloaders are downloading.
+	*/
+	var endgamePiece *Piece
+	for pieceIndex, piece := range pk.pieces {
+		if _, ok := active[pieceIndex]; ok || !hasBit(remoteBitField, int(pieceIndex)) {
+			continue
+		}
+		if endgamePiece == nil || pk.refs[pieceIndex] < pk.refs[endgamePiece.Index] {
+			endgamePiece = piece
+		}
+	}
+
+	if endgamePiece == nil {
+		return nil, false
+	}
+
+	if !pk.endgame {
+		pk.endgame = true
+		logger.Log(logger.Low, "entering endgame, %d pieces left", len(pk.pieces))
+	}
+	pk.refs[endgamePiece.Index]++
+
+	return endgamePiece, true
+}
+
+// Returns true if the picker is in endgame.
+func (pk *Picker) Endgame() bool {
+	pk.mut.Lock()
+	defer pk.mut.Unlock()
+
+	return pk.endgame
+}
+
+// Returns a channel that will be closed the next time a block is received during
+// endgame or a piece is completed or discarded. A downloader should check if
+// any of its outstanding requests should be cancelled when that happens.
+func (pk *Picker) Notify() <-chan struct{} {
+	pk.mut.Lock()
+	defer pk.mut.Unlock()
+
+	return pk.notify
+}
+
+// Should be called every time a new block has been received. Notifies the other
+// downloaders if in endgame.
+func (pk *Picker) BlockReceived() {
+	pk.mut.Lock()
+	defer pk.mut.Unlock()
+
+	if pk.endgame {
+		pk.broadcast()
+	}
+}
+
+// Marks a piece that have been written to disk as downloaded.
+func (pk *Picker) Complete(piece *Piece) {
+	pk.mut.Lock()
+	defer pk.mut.Unlock()
+	pk.t.Tracker.Lock()
+	defer pk.t.Tracker.Unlock()
+
+	pk.t.Tracker.BitFieldHave[piece.Index/8] |= 1 << (7 - (piece.Index % 8))
+	pk.remove(piece)
+}
+
+// Discards a piece that had an incorrect hash so that it is downloaded again.
+func (pk *Picker) Discard(piece *Piece) {
+	pk.mut.Lock()
+	defer pk.mut.Unlock()
+	pk.t.Tracker.Lock()
+	defer pk.t.Tracker.Unlock()
+
+	pk.t.Tracker.BitFieldDownloading[piece.Index/8] &^= 1 << (7 - (piece.Index % 8))
+	pk.remove(piece)
+}
+
+// Releases a piece that was picked but couldn't be downloaded. If no one else is
+// downloading the piece, it is cleared in BitFieldDownloading so that it can be
+// picked again.
+func (pk *Picker) Release(piece *Piece) {
+	pk.mut.Lock()
+	defer pk.mut.Unlock()
+
+	// The piece might already have been completed or discarded by another
+	// downloader, and a new piece with the same index might have been picked.
+	if pk.pieces[piece.Index] != piece {
+		return
+	}
+
+	pk.refs[piece.Index]--
+	if pk.refs[piece.Index] > 0 {
+		return
+	}
+
+	pk.t.Tracker.Lock()
+	defer pk.t.Tracker.Unlock()
+
+	pk.t.Tracker.BitFieldDownloading[piece.Index/8] &^= 1 << (7 - (piece.Index % 8))
+	pk.remove(piece)
+}
+
+// Closes and removes the piece. The caller should hold the lock of the picker.
+func (pk *Picker) remove(piece *Piece) {
+	piece.close()
+	if pk.pieces[piece.Index] == piece {
+		delete(pk.pieces, piece.Index)
+		delete(pk.refs, piece.Index)
+	}
+	pk.broadcast()
+}
+
+// Notifies everyone waiting on the notify channel. The caller should hold the
+// lock of the picker.
+func (pk *Picker) broadcast() {
+	close(pk.notify)
+	pk.notify = make(chan struct{})
+}
+
+// Returns true if the bit for the piece with index "pieceIndex" is set.
+func hasBit(bitField []byte, pieceIndex int) bool {
+	byteIndex := pieceIndex / 8
+	return byteIndex < len(bitField) && bitField[byteIndex]&(1<<(7-uint(pieceIndex%8))) != 0
+}
@@ -0,0 +1,304 @@
+package torrent
+
+import (
+	"testing"
+)
+
+// Creates a bitfield for "amountOfPieces" pieces with the given pieces set.
+func testBitField(amountOfPieces int, pieces ...int) []byte {
+	bitField := make([]byte, (amountOfPieces+7)/8)
+	for _, i := range pieces {
+		bitField[i/8] |= 1 << (7 - uint(i%8))
+	}
+	return bitField
+}
+
+// Creates a picker for a torrent with "amountOfPieces" pieces where this client
+// already has the pieces in "have".
+func newTestPicker(t *testing.T, amountOfPieces int, strategy PickStrategy, have ...int) *Picker {
+	const pieceLength = 1 << 14
+	lengths := make([]int, amountOfPieces)
+	for i := range lengths {
+		lengths[i] = pieceLength
+	}
+	tor := newTestTorrent(t, pieceLength, lengths...)
+	tor.Tracker.BitFieldHave = testBitField(amountOfPieces, have...)
+	tor.Tracker.BitFieldDownloading = testBitField(amountOfPieces, have...)
+	return NewPicker(tor, strategy)
+}
+
+func TestPickStrategy(t *testing.T) {
+	tests := []struct {
+		name         string
+		strategy     PickStrategy
+		candidates   []uint32
+		availability []int
+		have         int
+		expected     []uint32 // any of these are correct
+	}{
+		{"sequential", Sequential{}, []uint32{2, 5, 7}, []int{0, 0, 3, 0, 0, 1, 0, 1}, 10, []uint32{2}},
+		{"rarest", RarestFirst{}, []uint32{0, 1, 2}, []int{3, 1, 2}, RandomFirstPieces, []uint32{1}},
+		{"rarest tie", RarestFirst{}, []uint32{0, 1, 2, 3}, []int{1, 2, 1, 3}, RandomFirstPieces, []uint32{0, 2}},
+		{"rarest non-candidate", RarestFirst{}, []uint32{1, 2}, []int{0, 2, 1}, RandomFirstPieces, []uint32{2}},
+		{"random first", RarestFirst{}, []uint32{0, 1, 2}, []int{3, 1, 2}, RandomFirstPieces - 1, []uint32{0, 1, 2}},
+		{"single candidate", RarestFirst{}, []uint32{4}, []int{0, 0, 0, 0, 9}, RandomFirstPieces, []uint32{4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Ties are broken at random, pick a few times.
+			for i := 0; i < 50; i++ {
+				got := tt.strategy.Pick(tt.candidates, tt.availability, tt.have)
+
+				found := false
+				for _, expected := range tt.expected {
+					found = found || got == expected
+				}
+				if !found {
+					t.Fatalf("expected one of %v, got: %d", tt.expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestPickerAvailability(t *testing.T) {
+	pk := newTestPicker(t, 10, nil)
+	pk.AddBitField(testBitField(10, 0, 1, 9))
+	pk.AddBitField(testBitField(10, 1, 9))
+	pk.AddHave(9)
+	pk.AddHave(100) // outside of the torrent, ignored
+	pk.RemoveBitField(testBitField(10, 0))
+	// A short bitfield only updates the pieces that it contains.
+	pk.AddBitField([]byte{0xff})
+
+	expected := []int{1, 3, 1, 1, 1, 1, 1, 1, 0, 3}
+	for i, availability := range expected {
+		if got := pk.Availability(uint32(i)); got != availability {
+			t.Errorf("piece %d: expected availability %d, got: %d", i, availability, got)
+		}
+	}
+	if got := pk.Availability(100); got != 0 {
+		t.Errorf("expected availability 0 outside of the torrent, got: %d", got)
+	}
+}
+
+func TestPickerPick(t *testing.T) {
+	tests := []struct {
+		name     string
+		have     []int
+		remote   []int
+		expected int // -1 if no piece should be picked
+	}{
+		{"remote has nothing", nil, nil, -1},
+		{"remote has needed piece", nil, []int{3}, 3},
+		{"already have remote pieces", []int{3, 4}, []int{3, 4}, -1},
+		{"first missing piece", []int{0, 1}, []int{0, 1, 2, 3}, 2},
+		{"last piece", nil, []int{7}, 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pk := newTestPicker(t, 8, Sequential{}, tt.have...)
+			remote := testBitField(8, tt.remote...)
+
+			piece, ok := pk.Pick(remote, nil)
+			if tt.expected == -1 {
+				if ok {
+					t.Fatalf("expected no piece, got: %d", piece.Index)
+				}
+				return
+			} else if !ok {
+				t.Fatalf("expected piece %d, got none", tt.expected)
+			} else if piece.Index != uint32(tt.expected) {
+				t.Fatalf("expected piece %d, got: %d", tt.expected, piece.Index)
+			}
+
+			if !hasBit(pk.t.Tracker.BitFieldDownloading, tt.expected) {
+				t.Fatalf("picked piece isn't marked as downloading")
+			}
+			// The same piece can't be picked by another downloader.
+			if other, ok := pk.Pick(remote, nil); ok && other.Index == piece.Index {
+				t.Fatalf("piece %d was picked twice", piece.Index)
+			}
+		})
+	}
+}
+
+func TestPickerGiveBack(t *testing.T) {
+	tests := []struct {
+		name        string
+		giveBack    func(pk *Picker, piece *Piece)
+		have        bool
+		downloading bool
+	}{
+		{"complete", (*Picker).Complete, true, true},
+		{"discard", (*Picker).Discard, false, false},
+		{"release", (*Picker).Release, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pk := newTestPicker(t, 2, Sequential{})
+			remote := testBitField(2, 0, 1)
+
+			piece, ok := pk.Pick(remote, nil)
+			if !ok {
+				t.Fatalf("expected a piece to be picked")
+			}
+			notify := pk.Notify()
+			tt.giveBack(pk, piece)
+
+			if !piece.Closed() {
+				t.Errorf("expected the piece to be closed")
+			}
+			select {
+			case <-notify:
+			default:
+				t.Errorf("expected the downloaders to be notified")
+			}
+			if got := hasBit(pk.t.Tracker.BitFieldHave, 0); got != tt.have {
+				t.Errorf("have: expected %v, got: %v", tt.have, got)
+			}
+			if got := hasBit(pk.t.Tracker.BitFieldDownloading, 0); got != tt.downloading {
+				t.Errorf("downloading: expected %v, got: %v", tt.downloading, got)
+			}
+
+			// A piece that was given back without being completed is picked again.
+			var expected uint32 = 0
+			if tt.have {
+				expected = 1
+			}
+			next, ok := pk.Pick(remote, nil)
+			if !ok {
+				t.Fatalf("expected a piece to be picked")
+			} else if next.Index != expected {
+				t.Fatalf("expected piece %d, got: %d", expected, next.Index)
+			}
+		})
+	}
+}
+
+func TestPickerEndgame(t *testing.T) {
+	tests := []struct {
+		name     string
+		have     []int
+		picked   []int // the pieces already picked by other downloaders
+		remote   []int
+		active   []int // the pieces already picked by this downloader
+		expected int   // -1 if no piece should be picked
+		endgame  bool
+	}{
+		{"free piece left", nil, []int{0, 1}, []int{0, 1, 2}, nil, 2, false},
+		{"free piece remote doesn't have", nil, []int{0, 1}, []int{0, 1}, nil, -1, false},
+		{"all pieces picked", nil, []int{0, 1, 2}, []int{1}, nil, 1, true},
+		{"remaining pieces picked", []int{0, 2}, []int{1}, []int{0, 1, 2}, nil, 1, true},
+		{"remote doesn't have picked pieces", nil, []int{0, 1, 2}, nil, nil, -1, false},
+		{"already active", nil, []int{0, 1, 2}, []int{0, 1, 2}, []int{0, 1, 2}, -1, false},
+		{"skips active", nil, []int{0, 1, 2}, []int{0, 1, 2}, []int{0, 2}, 1, true},
+		{"nothing left", []int{0, 1, 2}, nil, []int{0, 1, 2}, nil, -1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pk := newTestPicker(t, 3, Sequential{}, tt.have...)
+			pieces := make(map[uint32]*Piece)
+			for _, i := range tt.picked {
+				piece, ok := pk.Pick(testBitField(3, i), nil)
+				if !ok || piece.Index != uint32(i) {
+					t.Fatalf("unable to pick piece %d", i)
+				}
+				pieces[piece.Index] = piece
+			}
+			active := make(map[uint32]*Piece)
+			for _, i := range tt.active {
+				active[uint32(i)] = pieces[uint32(i)]
+			}
+
+			piece, ok := pk.Pick(testBitField(3, tt.remote...), active)
+			if tt.expected == -1 {
+				if ok {
+					t.Fatalf("expected no piece, got: %d", piece.Index)
+				}
+			} else if !ok {
+				t.Fatalf("expected piece %d, got none", tt.expected)
+			} else if piece.Index != uint32(tt.expected) {
+				t.Fatalf("expected piece %d, got: %d", tt.expected, piece.Index)
+			} else if tt.endgame && piece != pieces[piece.Index] {
+				t.Fatalf("expected the piece that is already being downloaded")
+			}
+
+			if pk.Endgame() != tt.endgame {
+				t.Fatalf("endgame: expected %v, got: %v", tt.endgame, pk.Endgame())
+			}
+		})
+	}
+}
+
+func TestPickerEndgameShared(t *testing.T) {
+	pk := newTestPicker(t, 2, Sequential{})
+	remote := testBitField(2, 0, 1)
+
+	first, _ := pk.Pick(remote, nil)
+	second, _ := pk.Pick(remote, nil)
+	if pk.Endgame() {
+		t.Fatalf("expected to not be in endgame with free pieces left")
+	}
+
+	// Outside of endgame, received blocks doesn't notify the other downloaders.
+	notify := pk.Notify()
+	pk.BlockReceived()
+	select {
+	case <-notify:
+		t.Fatalf("notified outside of endgame")
+	default:
+	}
+
+	// Both pieces are handed out once more, the piece with the fewest
+	// downloaders first.
+	shared, ok := pk.Pick(remote, map[uint32]*Piece{first.Index: first})
+	if !ok || shared != second {
+		t.Fatalf("expected piece %d to be shared", second.Index)
+	}
+	shared, ok = pk.Pick(remote, map[uint32]*Piece{second.Index: second})
+	if !ok || shared != first {
+		t.Fatalf("expected piece %d to be shared", first.Index)
+	}
+	if !pk.Endgame() {
+		t.Fatalf("expected to be in endgame")
+	}
+
+	notify = pk.Notify()
+	pk.BlockReceived()
+	select {
+	case <-notify:
+	default:
+		t.Fatalf("expected the downloaders to be notified in endgame")
+	}
+
+	// A piece released by one of its downloaders is still being downloaded.
+	pk.Release(first)
+	if !hasBit(pk.t.Tracker.BitFieldDownloading, int(first.Index)) || first.Closed() {
+		t.Fatalf("piece released by one of two downloaders was given back")
+	}
+	pk.Release(first)
+	if hasBit(pk.t.Tracker.BitFieldDownloading, int(first.Index)) || !first.Closed() {
+		t.Fatalf("piece released by all downloaders wasn't given back")
+	}
+
+	// A piece completed by one downloader is closed for the other downloader,
+	// whose blocks and release are ignored.
+	pk.Complete(second)
+	if !second.Closed() {
+		t.Fatalf("expected the completed piece to be closed")
+	}
+	begin, length := second.Block(0)
+	if done, err := second.Put(blockMessage(second.Index, begin, make([]byte, length))); done || err != nil {
+		t.Fatalf("expected blocks of a closed piece to be ignored, got: %v, %v", done, err)
+	}
+	pk.Release(second)
+	if !hasBit(pk.t.Tracker.BitFieldHave, int(second.Index)) ||
+		!hasBit(pk.t.Tracker.BitFieldDownloading, int(second.Index)) {
+		t.Fatalf("release after completion changed the bitfields")
+	}
+}
@@ -0,0 +1,181 @@
+// Contains logic related to assembling pieces from blocks received from remote peers.
+package torrent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// Piece buffers the blocks of a single piece as they are received from remote
+// peers. A piece can only be verified against its sha1 hash when all blocks
+// have been received, so nothing is written to disk before that.
+//
+// A block is the part of a piece that is requested in a single "request"
+// message, it is at most MaxRequestLength bytes.
+//
+// During endgame the same piece is downloaded from multiple remote peers at the
+// same time, so all access to the blocks are synchronized.
+type Piece struct {
+	mut sync.Mutex
+
+	Index  uint32
+	Length int64
+
+	// Format: <index(4B)><begin(4B)><data>
+	// The header of a "piece" message is kept in front of the data so that the
+	// buffer can be given straight to Torrent.WriteData.
+	buffer []byte
+
+	// One entry for every block in the piece, true if the block has been received.
+	received []bool
+	left     int
+
+	// Set by the Picker when the piece has been completed or discarded.
+	// Downloaders should stop requesting blocks of a closed piece.
+	closed bool
+}
+
+// Creates a new empty Piece for the piece with index "pieceIndex".
+func (t *Torrent) NewPiece(pieceIndex uint32) *Piece {
+	length := t.PieceSize(pieceIndex)
+	amountOfBlocks := int((length + int64(MaxRequestLength) - 1) / int64(MaxRequestLength))
+
+	buffer := make([]byte, 8+length)
+	binary.BigEndian.PutUint32(buffer[:4], pieceIndex)
+	binary.BigEndian.PutUint32(buffer[4:8], 0)
+
+	return &Piece{
+		Index:    pieceIndex,
+		Length:   length,
+		buffer:   buffer,
+		received: make([]bool, amountOfBlocks),
+		left:     amountOfBlocks,
+	}
+}
+
+// Returns the amount of blocks in this piece.
+func (p *Piece) BlockCount() int {
+	return len(p.received)
+}
+
+// Returns the begin offset and the length of the block with index "blockIndex".
+// All blocks have the length MaxRequestLength except the last one that might
+// be smaller.
+func (p *Piece) Block(blockIndex int) (uint32, uint32) {
+	begin := uint32(blockIndex) * MaxRequestLength
+	length := MaxRequestLength
+	if int64(begin)+int64(length) > p.Length {
+		length = uint32(p.Length - int64(begin))
+	}
+	return begin, length
+}
+
+// Returns true if the block starting at "begin" has been received.
+func (p *Piece) HasBlock(begin uint32) bool {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	blockIndex := int(begin / MaxRequestLength)
+	return blockIndex < len(p.received) && p.received[blockIndex]
+}
+
+// Adds a block received in a "piece" message to this piece.
+// Takes the data part of an "piece" message as input: <index><begin><block>
+//
+// Returns true if this block completed the piece. Only one call will return true
+// for every piece, even if the same block is received from multiple peers.
+func (p *Piece) Put(pieceData []byte) (bool, error) {
+	if len(pieceData) < 8 {
+		return false, fmt.Errorf("pieceData to small, "+
+			"expected: >=8, got: %d", len(pieceData))
+	}
+	pieceIndex := binary.BigEndian.Uint32(pieceData[:4])
+	begin := binary.BigEndian.Uint32(pieceData[4:8])
+	block := pieceData[8:]
+
+	if pieceIndex != p.Index {
+		return false, fmt.Errorf("received block for incorrect piece, "+
+			"expected: %d, got: %d", p.Index, pieceIndex)
+	}
+	if begin%MaxRequestLength != 0 {
+		return false, fmt.Errorf("received block with unaligned begin %d", begin)
+	}
+
+	blockIndex := int(begin / MaxRequestLength)
+	if blockIndex >= len(p.received) {
+		return false, fmt.Errorf("received block outside of piece %d, begin: %d",
+			p.Index, begin)
+	}
+	if _, length := p.Block(blockIndex); uint32(len(block)) != length {
+		return false, fmt.Errorf("received block with incorrect length, "+
+			"expected: %d, got: %d", length, len(block))
+	}
+
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	if p.received[blockIndex] || p.closed {
+		return false, nil
+	}
+
+	copy(p.buffer[8+int64(begin):], block)
+	p.received[blockIndex] = true
+	p.left--
+
+	return p.left == 0, nil
+}
+
+// Returns true if all blocks of this piece have been received.
+func (p *Piece) Done() bool {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	return p.left == 0
+}
+
+// Returns true if the piece has been completed or discarded by the Picker.
+func (p *Piece) Closed() bool {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	return p.closed
+}
+
+func (p *Piece) close() {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	p.closed = true
+}
+
+// Returns the data of the whole piece (without the "piece" message header).
+func (p *Piece) Data() []byte {
+	return p.buffer[8:]
+}
+
+// Verifies the sha1 hash of the whole piece and writes it to disk if it is
+// correct. Returns an IncorrectPieceError if the hash doesn't match, in that
+// case nothing is written and the piece should be downloaded again.
+func (t *Torrent) WritePiece(p *Piece) error {
+	if !p.Done() {
+		return fmt.Errorf("unable to write piece %d: not all blocks received", p.Index)
+	}
+
+	if !t.IsCorrectPiece(p.Index, p.Data()) {
+		return &IncorrectPieceError{p.Index}
+	}
+
+	if _, err := t.WriteData(p.buffer); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Error used to indicate that the sha1 hash of a received piece is incorrect.
+type IncorrectPieceError struct{ Index uint32 }
+
+func (e *IncorrectPieceError) Error() string {
+	return fmt.Sprintf("the sha1 hash of piece %d is incorrect", e.Index)
+}
@@ -0,0 +1,164 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Creates the data part of a "piece" message: <index><begin><block>
+func blockMessage(pieceIndex, begin uint32, block []byte) []byte {
+	data := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(data[:4], pieceIndex)
+	binary.BigEndian.PutUint32(data[4:8], begin)
+	copy(data[8:], block)
+	return data
+}
+
+func TestPiecePut(t *testing.T) {
+	// 3 blocks where the last block is 100 bytes.
+	tor := newTestTorrent(t, 4*int64(MaxRequestLength), 2*int(MaxRequestLength)+100)
+	full := make([]byte, MaxRequestLength)
+
+	tests := []struct {
+		name  string
+		data  []byte
+		done  bool
+		ok    bool
+		count int // the amount of blocks received after the put
+	}{
+		{"first block", blockMessage(0, 0, full), false, true, 1},
+		{"duplicate block", blockMessage(0, 0, full), false, true, 1},
+		{"too small", []byte{0, 0, 0}, false, false, 1},
+		{"incorrect piece", blockMessage(1, MaxRequestLength, full), false, false, 1},
+		{"unaligned begin", blockMessage(0, 1, full), false, false, 1},
+		{"outside of piece", blockMessage(0, 3*MaxRequestLength, full), false, false, 1},
+		{"incorrect length", blockMessage(0, MaxRequestLength, full[:100]), false, false, 1},
+		{"incorrect last length", blockMessage(0, 2*MaxRequestLength, full), false, false, 1},
+		{"last block", blockMessage(0, 2*MaxRequestLength, full[:100]), false, true, 2},
+		{"completing block", blockMessage(0, MaxRequestLength, full), true, true, 3},
+		{"block after completion", blockMessage(0, MaxRequestLength, full), false, true, 3},
+	}
+
+	// The cases are run in order against the same piece.
+	p := tor.NewPiece(0)
+	if p.BlockCount() != 3 {
+		t.Fatalf("expected 3 blocks, got: %d", p.BlockCount())
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done, err := p.Put(tt.data)
+			if tt.ok && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if !tt.ok && err == nil {
+				t.Fatalf("expected an error")
+			}
+			if done != tt.done {
+				t.Fatalf("done: expected %v, got: %v", tt.done, done)
+			}
+
+			count := 0
+			for i := 0; i < p.BlockCount(); i++ {
+				if begin, _ := p.Block(i); p.HasBlock(begin) {
+					count++
+				}
+			}
+			if count != tt.count {
+				t.Fatalf("expected %d received blocks, got: %d", tt.count, count)
+			}
+		})
+	}
+
+	if !p.Done() {
+		t.Fatalf("expected the piece to be done")
+	}
+}
+
+func TestWritePiece(t *testing.T) {
+	tests := []struct {
+		name       string
+		pieceIndex uint32
+		corrupt    bool
+		incomplete bool
+	}{
+		{"first piece", 0, false, false},
+		{"piece spanning files", 1, false, false},
+		{"smaller last piece", 2, false, false},
+		{"corrupt piece", 1, true, false},
+		{"incomplete piece", 0, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Piece 1 spans over both files and piece 2 is smaller than the
+			// piece length.
+			tor := newTestTorrent(t, 2*int64(MaxRequestLength),
+				3*int(MaxRequestLength), 2*int(MaxRequestLength)+100)
+
+			// The pieces are written to an empty directory.
+			pieceData := testData(int64(tt.pieceIndex)*tor.PieceLength, int(tor.PieceSize(tt.pieceIndex)))
+			if tt.corrupt {
+				pieceData[len(pieceData)-1]++
+			}
+
+			dir, err := ioutil.TempDir("", "torc")
+			if err != nil {
+				t.Fatalf("unable to create temporary directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			tor.DownloadPath = dir
+			tor.Tracker.Left = tor.TotalLength()
+
+			p := tor.NewPiece(tt.pieceIndex)
+			for i := 0; i < p.BlockCount(); i++ {
+				if tt.incomplete && i == p.BlockCount()-1 {
+					break
+				}
+				begin, length := p.Block(i)
+				if _, err := p.Put(blockMessage(tt.pieceIndex, begin, pieceData[begin:begin+length])); err != nil {
+					t.Fatalf("unable to put block %d: %v", i, err)
+				}
+			}
+
+			err = tor.WritePiece(p)
+			switch {
+			case tt.incomplete:
+				if err == nil {
+					t.Fatalf("expected an error when writing an incomplete piece")
+				}
+			case tt.corrupt:
+				if e, ok := err.(*IncorrectPieceError); !ok || e.Index != tt.pieceIndex {
+					t.Fatalf("expected an IncorrectPieceError, got: %v", err)
+				}
+			default:
+				if err != nil {
+					t.Fatalf("unable to write piece: %v", err)
+				}
+			}
+
+			written := err == nil
+			if written != tor.IsCorrectPiece(tt.pieceIndex, p.Data()) {
+				t.Fatalf("IsCorrectPiece doesn't match the result of WritePiece")
+			}
+			left := tor.TotalLength()
+			if written {
+				left -= int64(len(pieceData))
+			}
+			if tor.Tracker.Left != left {
+				t.Fatalf("left: expected %d, got: %d", left, tor.Tracker.Left)
+			}
+
+			// Only a correct piece is found when the written files are rechecked.
+			if err := tor.Recheck(nil); err != nil {
+				t.Fatalf("unable to recheck: %v", err)
+			}
+			for i := range tor.Pieces {
+				have := tor.Tracker.BitFieldHave[i/8]&(1<<(7-uint(i%8))) != 0
+				if expected := written && uint32(i) == tt.pieceIndex; have != expected {
+					t.Errorf("piece %d: expected have %v, got: %v", i, expected, have)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+// Contains logic related to verifying data that already exists on disk.
+package torrent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// Function called during a recheck every time a piece has been checked.
+// "checked" is the amount of pieces that have been checked so far out of "total".
+type RecheckProgress func(checked, total int)
+
+// Returns true if any of the files in this torrent exists on disk.
+func (t *Torrent) FilesExist() bool {
+	for _, file := range t.Files {
+		if _, err := os.Stat(t.filePath(file)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if this client has at least one piece of the torrent.
+func (t *Torrent) HasAnyPiece() bool {
+	t.Tracker.Lock()
+	defer t.Tracker.Unlock()
+
+	for _, b := range t.Tracker.BitFieldHave {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads every piece of the torrent from disk and compares it to the sha1 hash
+// in "Pieces". The BitFieldHave, BitFieldDownloading, Left and Downloaded fields
+// of the Tracker are updated to match the pieces that were found to be correct.
+//
+// The pieces are checked concurrently by one go process per CPU.
+// "progress" is called after every checked piece, it can be nil.
+func (t *Torrent) Recheck(progress RecheckProgress) error {
+	amountOfPieces := len(t.Pieces)
+	if amountOfPieces == 0 {
+		return fmt.Errorf("unable to recheck torrent: it contains no pieces")
+	}
+
+	have := make([]bool, amountOfPieces)
+	indexChannel := make(chan int, amountOfPieces)
+	for i := 0; i < amountOfPieces; i++ {
+		indexChannel <- i
+	}
+	close(indexChannel)
+
+	var mut sync.Mutex
+	checked := 0
+
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			buffer := make([]byte, t.PieceLength)
+			for i := range indexChannel {
+				data := buffer[:t.PieceSize(uint32(i))]
+
+				// A piece that can't be read (ex. a missing file) is treated as
+				// a piece that this client doesn't have.
+				if err := t.readAt(data, int64(i)*t.PieceLength); err == nil {
+					have[i] = sha1.Sum(data) == t.Pieces[i]
+				}
+
+				mut.Lock()
+				checked++
+				if progress != nil {
+					progress(checked, amountOfPieces)
+				}
+				mut.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	t.Tracker.Lock()
+	defer t.Tracker.Unlock()
+
+	total := t.TotalLength()
+
+	var downloaded int64 = 0
+	for i := 0; i < amountOfPieces; i++ {
+		byteIndex := i / 8
+		bitIndex := i % 8
+
+		if have[i] {
+			t.Tracker.BitFieldHave[byteIndex] |= 1 << (7 - uint(bitIndex))
+			t.Tracker.BitFieldDownloading[byteIndex] |= 1 << (7 - uint(bitIndex))
+			downloaded += t.PieceSize(uint32(i))
+		} else {
+			t.Tracker.BitFieldHave[byteIndex] &^= 1 << (7 - uint(bitIndex))
+			t.Tracker.BitFieldDownloading[byteIndex] &^= 1 << (7 - uint(bitIndex))
+		}
+	}
+
+	t.Tracker.Downloaded = downloaded
+	t.Tracker.Left = total - downloaded
+
+	return nil
+}
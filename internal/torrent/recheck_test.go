@@ -0,0 +1,166 @@
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecheck(t *testing.T) {
+	// Two files where piece 3 spans over both of them and piece 4 is smaller
+	// than the piece length.
+	const pieceLength = 1 << 14
+	const firstLength = 3*pieceLength + 1000
+	const secondLength = pieceLength
+
+	tests := []struct {
+		name   string
+		modify func(dir string) error
+		have   []int
+	}{
+		{
+			name:   "all pieces correct",
+			modify: func(dir string) error { return nil },
+			have:   []int{0, 1, 2, 3, 4},
+		},
+		{
+			name:   "corrupt piece",
+			modify: corruptFile("file0", pieceLength+5),
+			have:   []int{0, 2, 3, 4},
+		},
+		{
+			name:   "corrupt piece spanning files",
+			modify: corruptFile("file1", 0),
+			have:   []int{0, 1, 2, 4},
+		},
+		{
+			name:   "corrupt last piece",
+			modify: corruptFile("file1", secondLength-1),
+			have:   []int{0, 1, 2, 3},
+		},
+		{
+			name: "missing file",
+			modify: func(dir string) error {
+				return os.Remove(filepath.Join(dir, "file1"))
+			},
+			have: []int{0, 1, 2},
+		},
+		{
+			name: "truncated file",
+			modify: func(dir string) error {
+				return os.Truncate(filepath.Join(dir, "file0"), pieceLength+1)
+			},
+			have: []int{0, 4},
+		},
+		{
+			name: "no files",
+			modify: func(dir string) error {
+				if err := os.Remove(filepath.Join(dir, "file0")); err != nil {
+					return err
+				}
+				return os.Remove(filepath.Join(dir, "file1"))
+			},
+			have: []int{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tor := newTestTorrent(t, pieceLength, firstLength, secondLength)
+			writeTestFiles(t, tor)
+			defer os.RemoveAll(tor.DownloadPath)
+			if len(tor.Pieces) != 5 {
+				t.Fatalf("expected 5 pieces, got: %d", len(tor.Pieces))
+			}
+
+			if err := tt.modify(tor.DownloadPath); err != nil {
+				t.Fatalf("unable to modify files: %v", err)
+			}
+
+			// Pieces that are found to be incorrect should be removed from
+			// the bitfields.
+			for i := range tor.Pieces {
+				tor.Tracker.BitFieldHave[i/8] |= 1 << (7 - uint(i%8))
+				tor.Tracker.BitFieldDownloading[i/8] |= 1 << (7 - uint(i%8))
+			}
+
+			calls := 0
+			err := tor.Recheck(func(checked, total int) {
+				calls++
+				if checked != calls || total != len(tor.Pieces) {
+					t.Errorf("incorrect progress, checked: %d/%d, call: %d", checked, total, calls)
+				}
+			})
+			if err != nil {
+				t.Fatalf("unable to recheck: %v", err)
+			} else if calls != len(tor.Pieces) {
+				t.Fatalf("expected %d progress calls, got: %d", len(tor.Pieces), calls)
+			}
+
+			expected := make([]byte, len(tor.Tracker.BitFieldHave))
+			var downloaded int64
+			for _, i := range tt.have {
+				expected[i/8] |= 1 << (7 - uint(i%8))
+				downloaded += tor.PieceSize(uint32(i))
+			}
+
+			if string(tor.Tracker.BitFieldHave) != string(expected) {
+				t.Errorf("have: expected %08b, got: %08b", expected, tor.Tracker.BitFieldHave)
+			}
+			if string(tor.Tracker.BitFieldDownloading) != string(expected) {
+				t.Errorf("downloading: expected %08b, got: %08b", expected, tor.Tracker.BitFieldDownloading)
+			}
+			if tor.Tracker.Downloaded != downloaded {
+				t.Errorf("downloaded: expected %d, got: %d", downloaded, tor.Tracker.Downloaded)
+			}
+			if tor.Tracker.Left != firstLength+secondLength-downloaded {
+				t.Errorf("left: expected %d, got: %d", firstLength+secondLength-downloaded, tor.Tracker.Left)
+			}
+			if tor.HasAnyPiece() != (len(tt.have) > 0) {
+				t.Errorf("HasAnyPiece: expected %v", len(tt.have) > 0)
+			}
+		})
+	}
+}
+
+func TestFilesExist(t *testing.T) {
+	tor := newTestTorrent(t, 1<<14, 10, 10)
+	writeTestFiles(t, tor)
+	defer os.RemoveAll(tor.DownloadPath)
+
+	if !tor.FilesExist() {
+		t.Fatalf("expected the files to exist")
+	}
+	if err := os.Remove(filepath.Join(tor.DownloadPath, "file0")); err != nil {
+		t.Fatalf("unable to remove file: %v", err)
+	}
+	if !tor.FilesExist() {
+		t.Fatalf("expected one of the files to exist")
+	}
+	if err := os.Remove(filepath.Join(tor.DownloadPath, "file1")); err != nil {
+		t.Fatalf("unable to remove file: %v", err)
+	}
+	if tor.FilesExist() {
+		t.Fatalf("expected no files to exist")
+	}
+}
+
+// Returns a function that flips the bits of the byte at offset "off" of the
+// file "name".
+func corruptFile(name string, off int64) func(dir string) error {
+	return func(dir string) error {
+		file, err := os.OpenFile(filepath.Join(dir, name), os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		b := make([]byte, 1)
+		if _, err := file.ReadAt(b, off); err != nil {
+			return err
+		}
+		b[0] = ^b[0]
+		_, err = file.WriteAt(b, off)
+		return err
+	}
+}
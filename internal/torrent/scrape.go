@@ -0,0 +1,176 @@
+// Contains logic related to scraping trackers, i.e. getting the amount of
+// seeders, leechers and completed downloads of torrents without announcing.
+// See http://www.bittorrent.org/beps/bep_0048.html
+package torrent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Scrapes the trackers of this torrent. The tiers are tried in order and the
+// result of the first tracker that answers is returned.
+func (t *Torrent) Scrape() (ScrapeResult, error) {
+	errs := make([]string, 0)
+	for _, status := range t.TrackerStatuses() {
+		results, err := ScrapeTracker(status.URL, [][sha1.Size]byte{t.Tracker.InfoHash})
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", status.URL, err))
+			continue
+		}
+
+		result, ok := results[t.Tracker.InfoHash]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("%s: the torrent isn't tracked", status.URL))
+			continue
+		}
+		return result, nil
+	}
+
+	if len(errs) == 0 {
+		return ScrapeResult{}, fmt.Errorf("the torrent doesn't contain any trackers")
+	}
+	return ScrapeResult{}, fmt.Errorf("unable to scrape any tracker: %s", strings.Join(errs, "; "))
+}
+
+// Scrapes the tracker with the announce URL "announce" for the torrents with the
+// given info hashes. Multiple info hashes are batched into as few requests as
+// possible. The returned map only contains the torrents that the tracker knows
+// about.
+func ScrapeTracker(announce string, infoHashes [][sha1.Size]byte) (map[[sha1.Size]byte]ScrapeResult, error) {
+	if len(infoHashes) == 0 {
+		return make(map[[sha1.Size]byte]ScrapeResult), nil
+	}
+
+	if strings.HasPrefix(strings.ToLower(announce), "udp://") {
+		return scrapeUDP(announce, infoHashes)
+	}
+	return scrapeHTTP(announce, infoHashes)
+}
+
+// Derives the scrape URL from the announce URL of a HTTP tracker. The last
+// path component of the announce URL has to start with "announce", it is
+// replaced with "scrape".
+// Example: http://example.com/x/announce.php?a=b -> http://example.com/x/scrape.php?a=b
+func scrapeURL(announce string) (string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse tracker url %s: %w", announce, err)
+	}
+
+	slash := strings.LastIndex(u.Path, "/")
+	if slash == -1 || !strings.HasPrefix(u.Path[slash+1:], "announce") {
+		return "", fmt.Errorf("the tracker %s doesn't support scrape", announce)
+	}
+	u.Path = u.Path[:slash+1] + "scrape" + u.Path[slash+1+len("announce"):]
+
+	return u.String(), nil
+}
+
+func scrapeHTTP(announce string, infoHashes [][sha1.Size]byte) (map[[sha1.Size]byte]ScrapeResult, error) {
+	scrape, err := scrapeURL(announce)
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+	for _, infoHash := range infoHashes {
+		params.Add("info_hash", string(infoHash[:]))
+	}
+
+	var URL string
+	if strings.Contains(scrape, "?") {
+		URL = scrape + "&" + params.Encode()
+	} else {
+		URL = scrape + "?" + params.Encode()
+	}
+
+	client := &http.Client{Timeout: HTTPTrackerTimeout}
+	request, err := http.NewRequest("GET", URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create new http request "+
+			"for url %s: %w", URL, err)
+	}
+	request.Header.Set("User-Agent", UserAgent)
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to %s: %w", URL, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read response from %s: %w", URL, err)
+	}
+
+	// Format: d5:filesd20:<info hash>d8:completei<num>e10:downloadedi<num>e
+	//  10:incompletei<num>ee...ee
+	decoded, err := Decode(body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode scrape response from %s: %w", URL, err)
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("scrape response from %s isn't a dictionary", URL)
+	} else if reason, ok := dict["failure reason"].(string); ok {
+		return nil, fmt.Errorf("received failure reason from tracker: %s", reason)
+	}
+	files, ok := dict["files"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("scrape response from %s without \"files\"", URL)
+	}
+
+	results := make(map[[sha1.Size]byte]ScrapeResult, len(files))
+	for key, value := range files {
+		stats, ok := value.(map[string]interface{})
+		if !ok || len(key) != sha1.Size {
+			continue
+		}
+
+		var infoHash [sha1.Size]byte
+		copy(infoHash[:], key)
+		seeders, _ := stats["complete"].(int64)
+		completed, _ := stats["downloaded"].(int64)
+		leechers, _ := stats["incomplete"].(int64)
+		results[infoHash] = ScrapeResult{
+			Seeders:   seeders,
+			Completed: completed,
+			Leechers:  leechers,
+		}
+	}
+
+	return results, nil
+}
+
+// Scrapes a UDP tracker. The info hashes are split into requests containing at
+// most UDPMaxScrape info hashes each.
+func scrapeUDP(announce string, infoHashes [][sha1.Size]byte) (map[[sha1.Size]byte]ScrapeResult, error) {
+	ut, err := dialUDPTracker(announce)
+	if err != nil {
+		return nil, err
+	}
+	defer ut.Close()
+
+	results := make(map[[sha1.Size]byte]ScrapeResult, len(infoHashes))
+	for start := 0; start < len(infoHashes); start += UDPMaxScrape {
+		end := start + UDPMaxScrape
+		if end > len(infoHashes) {
+			end = len(infoHashes)
+		}
+
+		batch, err := ut.scrape(infoHashes[start:end])
+		if err != nil {
+			return nil, err
+		}
+		for i, result := range batch {
+			results[infoHashes[start+i]] = result
+		}
+	}
+
+	return results, nil
+}
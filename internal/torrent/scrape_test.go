@@ -0,0 +1,137 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestScrapeURL(t *testing.T) {
+	tests := []struct {
+		announce string
+		expected string
+		ok       bool
+	}{
+		{"http://example.com/announce", "http://example.com/scrape", true},
+		{"http://example.com/x/announce", "http://example.com/x/scrape", true},
+		{"http://example.com/announce.php", "http://example.com/scrape.php", true},
+		{"http://example.com/announce?x2%0644", "http://example.com/scrape?x2%0644", true},
+		{"http://example.com/announce?a=b", "http://example.com/scrape?a=b", true},
+		{"https://example.com:8080/x/announce.php?a=b", "https://example.com:8080/x/scrape.php?a=b", true},
+		// Only the last path component is rewritten.
+		{"http://example.com/announce/x/announce", "http://example.com/announce/x/scrape", true},
+		{"http://example.com/a", "", false},
+		{"http://example.com/announce/x", "", false},
+		{"http://example.com/x%064announce", "", false},
+		{"http://example.com", "", false},
+		{"://example.com/announce", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.announce, func(t *testing.T) {
+			got, err := scrapeURL(tt.announce)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("expected an error, got: %s", got)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unable to get scrape url: %v", err)
+			}
+			if got != tt.expected {
+				t.Fatalf("expected: %s, got: %s", tt.expected, got)
+			}
+		})
+	}
+
+	if _, err := scrapeURL("http://example.com/a"); err == nil ||
+		!strings.Contains(err.Error(), "doesn't support scrape") {
+		t.Fatalf("expected a \"doesn't support scrape\" error, got: %v", err)
+	}
+}
+
+func TestScrapeHTTP(t *testing.T) {
+	known := sha1.Sum([]byte("known"))
+	unknown := sha1.Sum([]byte("unknown"))
+
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		expected map[[sha1.Size]byte]ScrapeResult
+		ok       bool
+	}{
+		{
+			name: "files",
+			path: "/announce",
+			body: fmt.Sprintf("d5:filesd20:%sd8:completei5e10:downloadedi50e10:incompletei10eeee",
+				known[:]),
+			expected: map[[sha1.Size]byte]ScrapeResult{
+				known: {Seeders: 5, Completed: 50, Leechers: 10},
+			},
+			ok: true,
+		},
+		{
+			name:     "failure reason",
+			path:     "/announce",
+			body:     "d14:failure reason4:nopee",
+			expected: nil,
+			ok:       false,
+		},
+		{
+			name:     "without files",
+			path:     "/announce",
+			body:     "d8:intervali1ee",
+			expected: nil,
+			ok:       false,
+		},
+		{
+			name:     "doesn't support scrape",
+			path:     "/a",
+			expected: nil,
+			ok:       false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var query map[string][]string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/scrape" {
+					http.NotFound(w, r)
+					return
+				}
+				query = r.URL.Query()
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			results, err := ScrapeTracker(server.URL+tt.path, [][sha1.Size]byte{known, unknown})
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("expected an error, got: %v", results)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unable to scrape: %v", err)
+			}
+
+			// All info hashes are sent in a single request.
+			if infoHashes := query["info_hash"]; len(infoHashes) != 2 ||
+				infoHashes[0] != string(known[:]) || infoHashes[1] != string(unknown[:]) {
+				t.Fatalf("expected both info hashes in the request, got: %q", infoHashes)
+			}
+			if len(results) != len(tt.expected) {
+				t.Fatalf("expected: %v, got: %v", tt.expected, results)
+			}
+			for infoHash, expected := range tt.expected {
+				if results[infoHash] != expected {
+					t.Fatalf("expected: %v, got: %v", expected, results[infoHash])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+// Contains logic related to storing torrents on disk so that they can be
+// restored when the client restarts.
+package torrent
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	SessionTorrentExt = ".torrent"
+	SessionStateExt   = ".state"
+)
+
+// The state of a torrent that is stored in the session directory next to
+// a copy of the torrent file.
+type sessionState struct {
+	DownloadPath string `bencode:"download path"`
+	BitFieldHave []byte `bencode:"have"`
+	Uploaded     int64  `bencode:"uploaded"`
+	Downloaded   int64  `bencode:"downloaded"`
+
+	LocalDiscoveryDisabled bool `bencode:"local discovery disabled,omitempty"`
+}
+
+// Stores the torrent file and the current state of this torrent in the
+// session directory "dir". Files are named after the hex encoded info hash.
+//
+// The files are first written to temporary files and then renamed so that a
+// crash during a save doesn't corrupt an older session. Torrents added from
+// magnet links aren't stored until their metadata is known.
+func (t *Torrent) SaveSession(dir string) error {
+	if !t.HasMetadata() {
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("unable to create session directory %s: %w", dir, err)
+	}
+
+	t.Tracker.Lock()
+	state := sessionState{
+		DownloadPath: t.DownloadPath,
+		BitFieldHave: append([]byte(nil), t.Tracker.BitFieldHave...),
+		Uploaded:     t.Tracker.Uploaded,
+		Downloaded:   t.Tracker.Downloaded,
+	}
+	t.Tracker.Unlock()
+
+	t.mut.RLock()
+	state.LocalDiscoveryDisabled = t.localDiscoveryDisabled
+	t.mut.RUnlock()
+
+	stateData, err := Marshal(state)
+	if err != nil {
+		return fmt.Errorf("unable to encode session state: %w", err)
+	}
+
+	base := filepath.Join(dir, hex.EncodeToString(t.Tracker.InfoHash[:]))
+
+	// The torrent file never changes, only write it the first time.
+	if _, err := os.Stat(base + SessionTorrentExt); os.IsNotExist(err) {
+		if err := writeFileAtomic(base+SessionTorrentExt, t.Metainfo); err != nil {
+			return err
+		}
+	}
+
+	return writeFileAtomic(base+SessionStateExt, stateData)
+}
+
+// Removes the torrent file and state of this torrent from the session
+// directory "dir".
+func (t *Torrent) RemoveSession(dir string) error {
+	base := filepath.Join(dir, hex.EncodeToString(t.Tracker.InfoHash[:]))
+
+	for _, path := range []string{base + SessionTorrentExt, base + SessionStateExt} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove session file %s: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// Restores all torrents that are stored in the session directory "dir".
+// Returns a map with the info hash as key. Torrents that can't be restored
+// are skipped and reported in the returned error (the other torrents are still
+// returned).
+func LoadSession(dir string) (map[string]*Torrent, error) {
+	torrents := make(map[string]*Torrent)
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return torrents, nil
+		}
+		return torrents, fmt.Errorf("unable to read session directory %s: %w", dir, err)
+	}
+
+	failed := make([]string, 0)
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || filepath.Ext(entry.Name()) != SessionTorrentExt {
+			continue
+		}
+
+		base := filepath.Join(dir, strings.TrimSuffix(entry.Name(), SessionTorrentExt))
+		t, err := loadSessionTorrent(base)
+		if err != nil {
+			failed = append(failed, err.Error())
+			continue
+		}
+
+		torrents[string(t.Tracker.InfoHash[:])] = t
+	}
+
+	if len(failed) > 0 {
+		return torrents, fmt.Errorf("unable to restore %d torrent(s) from session: %s",
+			len(failed), strings.Join(failed, "; "))
+	}
+
+	return torrents, nil
+}
+
+func loadSessionTorrent(base string) (*Torrent, error) {
+	t, err := NewTorrent(base + SessionTorrentExt)
+	if err != nil {
+		return nil, err
+	}
+
+	// A missing state file means that the client exited before the state was
+	// saved the first time. Start the torrent from scratch.
+	stateData, err := ioutil.ReadFile(base + SessionStateExt)
+	if os.IsNotExist(err) {
+		return t, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read session state %s: %w",
+			base+SessionStateExt, err)
+	}
+
+	var state sessionState
+	if err := Unmarshal(stateData, &state); err != nil {
+		return nil, fmt.Errorf("unable to decode session state %s: %w",
+			base+SessionStateExt, err)
+	}
+
+	if len(state.BitFieldHave) != len(t.Tracker.BitFieldHave) {
+		return nil, fmt.Errorf("bitfield in session state %s has incorrect length, "+
+			"expected: %d, got: %d", base+SessionStateExt,
+			len(t.Tracker.BitFieldHave), len(state.BitFieldHave))
+	}
+
+	t.DownloadPath = state.DownloadPath
+	t.localDiscoveryDisabled = state.LocalDiscoveryDisabled
+	t.Tracker.Uploaded = state.Uploaded
+	t.Tracker.Downloaded = state.Downloaded
+	copy(t.Tracker.BitFieldHave, state.BitFieldHave)
+	copy(t.Tracker.BitFieldDownloading, state.BitFieldHave)
+
+	// Only the pieces that this client doesn't have are left to download.
+	for i := range t.Pieces {
+		if t.Tracker.BitFieldHave[i/8]&(1<<(7-uint(i%8))) != 0 {
+			t.Tracker.Left -= t.PieceSize(uint32(i))
+		}
+	}
+
+	return t, nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("unable to write session file %s: %w", tmpPath, err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("unable to rename session file %s: %w", tmpPath, err)
+	}
+
+	return nil
+}
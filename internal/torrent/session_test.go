@@ -0,0 +1,141 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSessionRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		have     []int
+		uploaded int64
+	}{
+		{"no pieces", nil, 0},
+		{"first piece", []int{0}, 10},
+		{"last piece", []int{4}, 0},
+		{"all pieces", []int{0, 1, 2, 3, 4}, 1 << 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 5 pieces where the last one is smaller than the piece length.
+			tor := newTestTorrent(t, 1<<14, 4<<14, 100)
+			dir, err := ioutil.TempDir("", "torc")
+			if err != nil {
+				t.Fatalf("unable to create temporary directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			tor.DownloadPath = filepath.Join(dir, "download")
+
+			total := tor.Tracker.Left
+			left := total
+			for _, i := range tt.have {
+				tor.Tracker.BitFieldHave[i/8] |= 1 << (7 - uint(i%8))
+				left -= tor.PieceSize(uint32(i))
+			}
+			tor.Tracker.Uploaded = tt.uploaded
+			tor.Tracker.Downloaded = total - left
+
+			if err := tor.SaveSession(dir); err != nil {
+				t.Fatalf("unable to save session: %v", err)
+			}
+			torrents, err := LoadSession(dir)
+			if err != nil {
+				t.Fatalf("unable to load session: %v", err)
+			} else if len(torrents) != 1 {
+				t.Fatalf("expected 1 torrent, got: %d", len(torrents))
+			}
+
+			restored, ok := torrents[string(tor.Tracker.InfoHash[:])]
+			if !ok {
+				t.Fatalf("restored torrent has the wrong info hash")
+			}
+			if restored.DownloadPath != tor.DownloadPath {
+				t.Errorf("download path: expected %s, got: %s", tor.DownloadPath, restored.DownloadPath)
+			}
+			if !bytes.Equal(restored.Tracker.BitFieldHave, tor.Tracker.BitFieldHave) {
+				t.Errorf("have: expected %08b, got: %08b", tor.Tracker.BitFieldHave, restored.Tracker.BitFieldHave)
+			}
+			if !bytes.Equal(restored.Tracker.BitFieldDownloading, tor.Tracker.BitFieldHave) {
+				t.Errorf("downloading: expected %08b, got: %08b", tor.Tracker.BitFieldHave, restored.Tracker.BitFieldDownloading)
+			}
+			if restored.Tracker.Left != left {
+				t.Errorf("left: expected %d, got: %d", left, restored.Tracker.Left)
+			}
+			if restored.Tracker.Uploaded != tt.uploaded {
+				t.Errorf("uploaded: expected %d, got: %d", tt.uploaded, restored.Tracker.Uploaded)
+			}
+			if restored.Tracker.Downloaded != tor.Tracker.Downloaded {
+				t.Errorf("downloaded: expected %d, got: %d", tor.Tracker.Downloaded, restored.Tracker.Downloaded)
+			}
+			if !bytes.Equal(restored.Metainfo, tor.Metainfo) {
+				t.Errorf("the torrent file changed")
+			}
+
+			if err := tor.RemoveSession(dir); err != nil {
+				t.Fatalf("unable to remove session: %v", err)
+			}
+			if torrents, err := LoadSession(dir); err != nil || len(torrents) != 0 {
+				t.Fatalf("expected an empty session after removal, got: %d torrents, %v", len(torrents), err)
+			}
+		})
+	}
+}
+
+func TestLoadSessionState(t *testing.T) {
+	tests := []struct {
+		name  string
+		state string
+		left  int64 // -1 if the torrent shouldn't be restored
+	}{
+		{"missing state", "", 2 << 14},
+		{"first piece", "d4:have1:\x80e", 1 << 14},
+		{"without bitfield", "d8:uploadedi5ee", -1},
+		{"bitfield too long", "d4:have2:\x80\x00e", -1},
+		{"corrupt state", "d4:have", -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tor := newTestTorrent(t, 1<<14, 2<<14)
+			dir, err := ioutil.TempDir("", "torc")
+			if err != nil {
+				t.Fatalf("unable to create temporary directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			if err := tor.SaveSession(dir); err != nil {
+				t.Fatalf("unable to save session: %v", err)
+			}
+
+			statePath := filepath.Join(dir, hex.EncodeToString(tor.Tracker.InfoHash[:])+SessionStateExt)
+			if tt.state == "" {
+				if err := os.Remove(statePath); err != nil {
+					t.Fatalf("unable to remove state: %v", err)
+				}
+			} else if err := ioutil.WriteFile(statePath, []byte(tt.state), 0644); err != nil {
+				t.Fatalf("unable to write state: %v", err)
+			}
+
+			torrents, err := LoadSession(dir)
+			if tt.left == -1 {
+				if err == nil || len(torrents) != 0 {
+					t.Fatalf("expected the torrent to not be restored, got: %d torrents, %v", len(torrents), err)
+				}
+				return
+			} else if err != nil || len(torrents) != 1 {
+				t.Fatalf("expected 1 restored torrent, got: %d torrents, %v", len(torrents), err)
+			}
+
+			for _, restored := range torrents {
+				if restored.Tracker.Left != tt.left {
+					t.Fatalf("left: expected %d, got: %d", tt.left, restored.Tracker.Left)
+				}
+			}
+		})
+	}
+}
@@ -4,14 +4,17 @@ import (
 	"crypto/sha1"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 
 	"github.com/jmatss/torc/internal/util/cons"
 	"github.com/jmatss/torc/internal/util/logger"
+	"github.com/jmatss/torc/internal/util/ratelimit"
 )
 
 const (
@@ -31,8 +34,21 @@ type PieceHash [sha1.Size]byte
 // Keep single and multiple file mode in a similar struct where the length of
 // "Files" in single file mode is 1.
 type Torrent struct {
-	Announce string
-	Tracker  Tracker
+	// The tiers of trackers, see BEP 12. Trackers that answers are moved to the
+	// front of their tier.
+	AnnounceList [][]*TrackerStatus
+	announceMut  sync.Mutex
+	Tracker      Tracker
+
+	// The raw bencoded content of the torrent file. Kept so that the torrent
+	// can be stored to disk and restored when the client restarts.
+	Metainfo []byte
+	// The bencoded info dictionary inside Metainfo and if it is private.
+	// Protected by "mut".
+	info    []byte
+	private bool
+	// The directory that the files of this torrent are downloaded to.
+	DownloadPath string
 
 	// Lock used when changing filename/moving the file.
 	mut sync.RWMutex
@@ -44,6 +60,26 @@ type Torrent struct {
 	// Contains sha1 hashes corresponding to every piece.
 	Pieces      []PieceHash
 	PieceLength int64
+
+	// The sum of the lengths of all files, set together with "Files" so that
+	// it doesn't have to be recalculated for every piece. See TotalLength.
+	totalLength int64
+
+	// Selects which pieces to download. Created by the torrent Handler.
+	Picker *Picker
+
+	// Limits the total upload/download rate of the peers of this torrent.
+	UploadLimit   *ratelimit.Limiter
+	DownloadLimit *ratelimit.Limiter
+
+	// Closed when the metadata of the torrent is known and the torrent Handler
+	// is ready to download pieces. Torrents added from magnet links starts
+	// without metadata.
+	metadataReady chan struct{}
+
+	// Set if peers shouldn't be searched for on the local network, see BEP 14.
+	// Protected by "mut".
+	localDiscoveryDisabled bool
 }
 
 type Files struct {
@@ -56,6 +92,34 @@ type Files struct {
 	Path   []string
 }
 
+// The bencoded structure of a torrent file.
+type metainfoFile struct {
+	Announce     string     `bencode:"announce,omitempty"`
+	AnnounceList [][]string `bencode:"announce-list,omitempty"`
+	Comment      string     `bencode:"comment,omitempty"`
+	CreatedBy    string     `bencode:"created by,omitempty"`
+	CreationDate int64      `bencode:"creation date,omitempty"`
+	Info         RawMessage `bencode:"info"`
+	// Web seeds, see BEP 19.
+	URLList []string `bencode:"url-list,omitempty"`
+}
+
+// The bencoded structure of the info dictionary of a torrent file. "Files" is
+// set in multiple file mode and "Length" in single file mode.
+type infoDict struct {
+	Files       []infoFile `bencode:"files,omitempty"`
+	Length      int64      `bencode:"length,omitempty"`
+	Name        string     `bencode:"name"`
+	PieceLength int64      `bencode:"piece length"`
+	Pieces      []byte     `bencode:"pieces"`
+	Private     bool       `bencode:"private,omitempty"`
+}
+
+type infoFile struct {
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
 // Create and return a new Torrent struct including a Tracker struct.
 func NewTorrent(filename string) (*Torrent, error) {
 	filename = filepath.FromSlash(filename)
@@ -79,50 +143,77 @@ func NewTorrent(filename string) (*Torrent, error) {
 			file.Name(), err)
 	}
 
-	announce, err := GetString(content, "announce")
+	return NewTorrentFromContent(content)
+}
+
+// Create and return a new Torrent struct from the bencoded content
+// of a torrent file.
+func NewTorrentFromContent(content []byte) (*Torrent, error) {
+	metainfo, err := Parse(content)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse torrent file: %w", err)
+	}
+	info, err := metainfo.GetDict("info")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get field \"info\" from torrent file: %w", err)
+	}
+
+	announceList, err := getAnnounceList(metainfo)
 	if err != nil {
 		return nil, err
-	} else if announce == "" {
-		return nil, fmt.Errorf("unable to parse \"announce\" from torrent: %w", err)
 	}
 
-	piecesString, err := GetString(content, "pieces")
+	piecesValue, err := info.getKind("pieces", StringValue)
 	if err != nil {
 		return nil, err
-	} else if piecesString == "" || len(piecesString)%sha1.Size != 0 {
-		return nil, fmt.Errorf("unable to parse \"pieces\" from torrent: %w", err)
+	} else if len(piecesValue.Str) == 0 || len(piecesValue.Str)%sha1.Size != 0 {
+		return nil, fmt.Errorf("unable to parse \"pieces\" from torrent: "+
+			"incorrect length %d", len(piecesValue.Str))
 	}
 
 	// Turn the received pieces string into slices of PieceHash ([sha1.Size]byte).
 	// Will be faster/easier to access them later on.
-	// TODO: possible to bypass need for copy?
-	amountOfPieces := len(piecesString) / sha1.Size
-	pieces := make([]PieceHash, 0, amountOfPieces)
-	piecesSlice := []byte(piecesString)
+	amountOfPieces := len(piecesValue.Str) / sha1.Size
+	pieces := make([]PieceHash, amountOfPieces)
 	for i := 0; i < amountOfPieces; i++ {
-		copy(pieces[i][:], piecesSlice[i*sha1.Size:i*sha1.Size+sha1.Size])
+		copy(pieces[i][:], piecesValue.Str[i*sha1.Size:i*sha1.Size+sha1.Size])
 	}
 
-	pieceLength, err := GetInt(content, "piece length")
+	pieceLength, err := info.GetInt("piece length")
 	if err != nil {
 		return nil, err
-	} else if pieceLength == 0 {
-		return nil, fmt.Errorf("unable to parse \"piece length\" from torrent: %w", err)
+	} else if pieceLength <= 0 {
+		return nil, fmt.Errorf("unable to parse \"piece length\" from torrent: "+
+			"incorrect length %d", pieceLength)
 	}
 
-	files, err := GetFiles(content)
+	files, err := GetFiles(info)
 	if err != nil {
 		return nil, err
 	}
 
+	// The name is only used for display, a missing name isn't an error.
+	name, _ := info.GetString("name")
+	private, _ := info.GetInt("private")
+
 	t := &Torrent{
-		Announce:    announce,
-		Pieces:      pieces,
-		PieceLength: pieceLength,
-		Files:       files,
+		AnnounceList:  announceList,
+		Metainfo:      content,
+		info:          info.Raw,
+		private:       private == 1,
+		DownloadPath:  cons.DownloadPath,
+		Name:          name,
+		Pieces:        pieces,
+		PieceLength:   pieceLength,
+		Files:         files,
+		totalLength:   filesLength(files),
+		UploadLimit:   ratelimit.New(0),
+		DownloadLimit: ratelimit.New(0),
+		metadataReady: make(chan struct{}),
 	}
+	close(t.metadataReady)
 
-	err = NewTracker(content, t)
+	err = NewTracker(info.Raw, t)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create tracker for torrent: %w", err)
 	}
@@ -131,7 +222,8 @@ func NewTorrent(filename string) (*Torrent, error) {
 }
 
 // Writes the data received in the "PieceHash" message to files.
-// Takes the data part of an "PieceHash" message as input.
+// Takes the data part of an "PieceHash" message as input. The data can be
+// anything from a single block up to a whole piece.
 //
 // Returns the amount of bytes written or an error.
 func (t *Torrent) WriteData(pieceData []byte) (int, error) {
@@ -140,30 +232,38 @@ func (t *Torrent) WriteData(pieceData []byte) (int, error) {
 		return 0, err
 	}
 
+	if int64(begin)+int64(len(data)) > t.PieceSize(pieceIndex) {
+		return 0, fmt.Errorf("data written outside of piece %d: begin: %d, length: %d",
+			pieceIndex, begin, len(data))
+	}
+
 	t.Tracker.Lock()
 	defer t.Tracker.Unlock()
 
 	// The "real" index of the whole "byte stream".
 	requestIndex := int64(pieceIndex)*t.PieceLength + int64(begin)
-	var off int64 = 0
+	if err := t.writeAt(data, requestIndex); err != nil {
+		return 0, err
+	}
 
-	for _, file := range t.Files {
-		// Skip files that have an index less than the requested start index.
-		if requestIndex < file.Index {
-			continue
-		}
+	t.Tracker.Downloaded += int64(len(data))
+	t.Tracker.Left -= int64(len(data))
 
-		path := filepath.FromSlash(cons.DownloadPath + strings.Join(file.Path, "/"))
-		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0444)
-		if err != nil {
-			return 0, fmt.Errorf("unable to open file %s: %w", path, err)
+	return len(data), nil
+}
+
+// Writes "data" starting at offset "off" of the whole "byte stream"
+// of the torrent. The write might span over multiple files.
+// Files and directories are created if they doesn't exist.
+func (t *Torrent) writeAt(data []byte, off int64) error {
+	for _, file := range t.Files[t.fileAt(off):] {
+		if len(data) == 0 {
+			break
 		}
 
-		seekPos := requestIndex - file.Index
-		_, err = f.Seek(seekPos, 0)
-		if err != nil {
-			f.Close()
-			return 0, fmt.Errorf("unable to seek in file %s: %w", path, err)
+		// Skip files that ends before the requested offset.
+		if off >= file.Index+file.Length {
+			continue
 		}
 
 		/*
@@ -175,94 +275,120 @@ func (t *Torrent) WriteData(pieceData []byte) (int, error) {
 			  There are more data to write than there are bytes left in this file.
 			  Will continue writing the rest of the data in the next file.
 		*/
-		amountToWrite := file.Length - seekPos
+		amountToWrite := file.Index + file.Length - off
 		if amountToWrite > int64(len(data)) {
 			amountToWrite = int64(len(data))
 		}
 
-		n, err := f.Write(data[off : off+amountToWrite])
-		if err != nil {
-			f.Close()
-			return 0, fmt.Errorf("unable to write data to file %s: %w", path, err)
+		path := t.filePath(file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("unable to create directory for file %s: %w", path, err)
 		}
 
-		logger.Log(logger.High, "%d bytes written to file %s", n, f.Name())
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("unable to open file %s: %w", path, err)
+		}
 
+		n, err := f.WriteAt(data[:amountToWrite], off-file.Index)
 		f.Close()
-
-		off += int64(n)
-		// All the data have been written to files, break
-		if off >= int64(len(data)) {
-			break
+		if err != nil {
+			return fmt.Errorf("unable to write data to file %s: %w", path, err)
 		}
+
+		logger.Log(logger.High, "%d bytes written to file %s", n, path)
+
+		data = data[amountToWrite:]
+		off += amountToWrite
 	}
 
-	t.Tracker.Downloaded += int64(len(data))
-	t.Tracker.Left -= int64(len(data))
+	if len(data) != 0 {
+		return fmt.Errorf("write outside the end of the torrent")
+	}
 
-	return len(data), nil
+	return nil
 }
 
 // Reads data that has been requested in the "request" message from disk.
-// Takes a "request" message as input.
+// Takes the data part of a "request" message as input: <index><begin><length>
 //
-// Returns the data or an error.
+// Returns the data in the format of the data part of a "piece" message:
+// <index><begin><block>, or an error.
 func (t *Torrent) ReadData(request []byte) ([]byte, error) {
 	pieceIndex, begin, lengthData, err := t.getPieceData(request)
 	if err != nil {
 		return nil, err
+	} else if len(lengthData) != 4 {
+		return nil, fmt.Errorf("incorrect length of request, "+
+			"expected: 12, got: %d", len(request))
 	}
 	length := binary.BigEndian.Uint32(lengthData)
+	if length == 0 || length > MaxRequestLength {
+		return nil, fmt.Errorf("length is incorrect: "+
+			"expected: 0 < length <= %d, got: %d", MaxRequestLength, length)
+	} else if int64(begin)+int64(length) > t.PieceSize(pieceIndex) {
+		return nil, fmt.Errorf("data read outside of piece %d: begin: %d, length: %d",
+			pieceIndex, begin, length)
+	}
 
 	// The "real" index of the whole "byte stream" where the remote peer wants
-	// to start reading data at. The remote peer wants "length" bytes starting
-	// from this index.
+	// to start reading data at.
 	requestIndex := int64(pieceIndex)*t.PieceLength + int64(begin)
-	data := make([]byte, length)
-	dataBuffer := data
+	pieceData := make([]byte, 8+length)
+	copy(pieceData[:8], request[:8])
+	if err := t.readAt(pieceData[8:], requestIndex); err != nil {
+		return nil, err
+	}
 
-	for _, file := range t.Files {
-		// Skip files that have an index less than the requested start index.
-		if requestIndex < file.Index {
-			continue
+	return pieceData, nil
+}
+
+// Reads len(data) bytes starting at offset "off" of the whole "byte stream"
+// of the torrent. The read might span over multiple files.
+func (t *Torrent) readAt(data []byte, off int64) error {
+	for _, file := range t.Files[t.fileAt(off):] {
+		if len(data) == 0 {
+			break
 		}
 
-		path := filepath.FromSlash(cons.DownloadPath + "/" + strings.Join(file.Path, "/"))
-		f, err := os.OpenFile(path, os.O_RDONLY, 0444)
-		if err != nil {
-			return nil, fmt.Errorf("unable to open file %s: %w", path, err)
+		// Skip files that ends before the requested offset.
+		if off >= file.Index+file.Length {
+			continue
 		}
 
-		_, err = f.Seek(requestIndex-file.Index, 0)
-		if err != nil {
-			f.Close()
-			return nil, fmt.Errorf("unable to seek in file %s: %w", path, err)
+		amountToRead := file.Index + file.Length - off
+		if amountToRead > int64(len(data)) {
+			amountToRead = int64(len(data))
 		}
 
-		n, err := f.Read(dataBuffer)
+		path := t.filePath(file)
+		f, err := os.Open(path)
 		if err != nil {
-			f.Close()
-			return nil, fmt.Errorf("unable to read data from file %s: %w", path, err)
+			return fmt.Errorf("unable to open file %s: %w", path, err)
 		}
-		f.Close()
 
-		/*
-			If true:
-			  This file didn't contain all the requested data.
-			  Continue reading data from the next file.
-			  Change "offset"/start for byte slice so that the read data from this current file
-			  doesn't get overwritten.
-			Else:
-			  All data read; break and return data to be sent to remote peer.
-		*/
-		if n < int(length) {
-			dataBuffer = dataBuffer[n:]
-		} else {
-			break
+		_, err = f.ReadAt(data[:amountToRead], off-file.Index)
+		f.Close()
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("unable to read data from file %s: %w", path, err)
+		} else if err == io.EOF {
+			return fmt.Errorf("file %s is to small", path)
 		}
+
+		data = data[amountToRead:]
+		off += amountToRead
+	}
+
+	if len(data) != 0 {
+		return fmt.Errorf("read outside the end of the torrent")
 	}
 
-	return data, nil
+	return nil
+}
+
+// Returns the path on disk of the given file in this torrent.
+func (t *Torrent) filePath(file Files) string {
+	return filepath.Join(t.DownloadPath, filepath.FromSlash(strings.Join(file.Path, "/")))
 }
 
 func (t *Torrent) getPieceData(pieceData []byte) (uint32, uint32, []byte, error) {
@@ -282,25 +408,107 @@ func (t *Torrent) getPieceData(pieceData []byte) (uint32, uint32, []byte, error)
 		return 0, 0, nil, fmt.Errorf("begin is incorrect: "+
 			"expected: %d >= pieceIndex >= 0, got: %d", t.PieceLength, begin)
 	}
-	if len(data) > int(MaxRequestLength) {
-		return 0, 0, nil, fmt.Errorf("length is over MaxRequestLength: "+
-			"expected: <%d, got: %d", MaxRequestLength, len(data))
+	return pieceIndex, begin, data, nil
+}
+
+// Verifies that the data of a whole piece is the data that was requested.
+// Compares the sha1 hash of the data to the sha1 given in the torrent file.
+func (t *Torrent) IsCorrectPiece(pieceIndex uint32, data []byte) bool {
+	if int(pieceIndex) >= len(t.Pieces) {
+		return false
 	}
 
-	return pieceIndex, begin, data, nil
+	return sha1.Sum(data) == t.Pieces[pieceIndex]
 }
 
-// Verifies the data received from the remote peer is the data that was requested.
-// Compares the sha1 hash of the received data to the sha1 given from the tracker.
-func (t *Torrent) IsCorrectPiece(pieceData []byte) bool {
-	pieceIndex := binary.BigEndian.Uint32(pieceData[:4])
+// Returns the total size in bytes of all files in this torrent.
+func (t *Torrent) TotalLength() int64 {
+	return t.totalLength
+}
+
+// Returns the sum of the lengths of "files".
+func filesLength(files []Files) int64 {
+	var total int64 = 0
+	for _, file := range files {
+		total += file.Length
+	}
+	return total
+}
 
-	receivedHash := sha1.Sum(pieceData)
-	realHash := t.Pieces[pieceIndex]
+// Returns the index in "Files" of the first file that ends after the offset
+// "off" of the whole "byte stream". The files are sorted by their Index, so
+// the files before it doesn't have to be looked at when reading or writing.
+func (t *Torrent) fileAt(off int64) int {
+	return sort.Search(len(t.Files), func(i int) bool {
+		return t.Files[i].Index+t.Files[i].Length > off
+	})
+}
+
+// Returns the size in bytes of the piece with index "pieceIndex".
+// All pieces have the size PieceLength except the last one that might be smaller.
+func (t *Torrent) PieceSize(pieceIndex uint32) int64 {
+	start := int64(pieceIndex) * t.PieceLength
+	if total := t.TotalLength(); start+t.PieceLength > total {
+		return total - start
+	}
+	return t.PieceLength
+}
+
+// Returns the length in bytes of a bitfield containing one bit per piece.
+func (t *Torrent) BitFieldLength() int {
+	return (len(t.Pieces) + 7) / 8
+}
+
+// Returns true if peers of this torrent should be searched for on the local
+// network. Private torrents are never announced on the local network.
+func (t *Torrent) LocalDiscovery() bool {
+	t.mut.RLock()
+	disabled := t.localDiscoveryDisabled
+	t.mut.RUnlock()
+
+	return !disabled && !t.Private()
+}
+
+// Enables or disables the search for peers of this torrent on the local network.
+func (t *Torrent) SetLocalDiscovery(enabled bool) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	t.localDiscoveryDisabled = !enabled
+}
+
+// Returns true if the torrent is private, i.e. if peers must only be received
+// from its trackers. See http://www.bittorrent.org/beps/bep_0027.html
+func (t *Torrent) Private() bool {
+	t.mut.RLock()
+	defer t.mut.RUnlock()
 
-	if receivedHash == realHash {
-		return true
-	} else {
+	return t.private
+}
+
+// Returns true if the remote peer with the bitfield "remoteBitField" has any
+// piece that this client doesn't have.
+func (t *Torrent) Interesting(remoteBitField []byte) bool {
+	t.Tracker.Lock()
+	defer t.Tracker.Unlock()
+
+	for i, b := range remoteBitField {
+		if i < len(t.Tracker.BitFieldHave) && b&^t.Tracker.BitFieldHave[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if every piece of this torrent has been downloaded.
+func (t *Torrent) Seeding() bool {
+	// Left is unknown for torrents that are waiting for their metadata.
+	if !t.HasMetadata() {
 		return false
 	}
+
+	t.Tracker.Lock()
+	defer t.Tracker.Unlock()
+
+	return t.Tracker.Left == 0
 }
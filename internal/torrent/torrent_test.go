@@ -0,0 +1,135 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Returns the content of a test file that starts at offset "index" of the
+// torrent. The data differs between every KiB so that no two pieces are equal.
+func testData(index int64, length int) []byte {
+	data := make([]byte, length)
+	for i := range data {
+		data[i] = byte((index + int64(i)) / 1024)
+	}
+	return data
+}
+
+// Creates a torrent with one file per length in "lengths", named "file0",
+// "file1" and so on, and the piece length "pieceLength". The piece hashes are
+// calculated from the data returned by testData. Nothing is stored on disk,
+// see writeTestFiles.
+func newTestTorrent(t testing.TB, pieceLength int64, lengths ...int) *Torrent {
+	var data, files bytes.Buffer
+	for i, length := range lengths {
+		data.Write(testData(int64(data.Len()), length))
+		name := fmt.Sprintf("file%d", i)
+		fmt.Fprintf(&files, "d6:lengthi%de4:pathl%d:%see", length, len(name), name)
+	}
+
+	var pieces bytes.Buffer
+	for off := 0; off < data.Len(); off += int(pieceLength) {
+		end := off + int(pieceLength)
+		if end > data.Len() {
+			end = data.Len()
+		}
+		hash := sha1.Sum(data.Bytes()[off:end])
+		pieces.Write(hash[:])
+	}
+
+	info := fmt.Sprintf("d5:filesl%se4:name4:test12:piece lengthi%de6:pieces%d:%se",
+		files.String(), pieceLength, pieces.Len(), pieces.String())
+	content := "d8:announce30:http://127.0.0.1:6969/announce4:info" + info + "e"
+
+	tor, err := NewTorrentFromContent([]byte(content))
+	if err != nil {
+		t.Fatalf("unable to create test torrent: %v", err)
+	}
+	return tor
+}
+
+// Writes the files of the torrent "tor", created by newTestTorrent, to a new
+// temporary directory that is set as the download path of the torrent. The
+// caller has to remove the directory.
+func writeTestFiles(t testing.TB, tor *Torrent) {
+	dir, err := ioutil.TempDir("", "torc")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+
+	tor.DownloadPath = dir
+	for _, file := range tor.Files {
+		if err := ioutil.WriteFile(tor.filePath(file), testData(file.Index, int(file.Length)), 0644); err != nil {
+			os.RemoveAll(dir)
+			t.Fatalf("unable to write test file: %v", err)
+		}
+	}
+}
+
+func TestPieceSize(t *testing.T) {
+	tests := []struct {
+		name        string
+		lengths     []int
+		pieceLength int64
+		pieceIndex  uint32
+		expected    int64
+	}{
+		{"first piece", []int{100, 100, 100}, 64, 0, 64},
+		{"middle piece", []int{100, 100, 100}, 64, 2, 64},
+		{"last piece smaller", []int{100, 100, 100}, 64, 4, 300 - 4*64},
+		{"last piece full", []int{64, 64}, 64, 1, 64},
+		{"single piece", []int{10}, 64, 0, 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tor := newTestTorrent(t, tt.pieceLength, tt.lengths...)
+			if got := tor.PieceSize(tt.pieceIndex); got != tt.expected {
+				t.Fatalf("expected: %d, got: %d", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestFileAt(t *testing.T) {
+	// A file without any data doesn't contain any offset.
+	tor := newTestTorrent(t, 16, 10, 10, 0, 10, 10)
+
+	tests := []struct {
+		off      int64
+		expected int
+	}{
+		{0, 0},
+		{9, 0},
+		{10, 1},
+		{19, 1},
+		{20, 3},
+		{39, 4},
+		{40, 5},
+	}
+
+	for _, tt := range tests {
+		if got := tor.fileAt(tt.off); got != tt.expected {
+			t.Errorf("offset %d: expected file %d, got: %d", tt.off, tt.expected, got)
+		}
+	}
+}
+
+// Calculates the size of every piece of a torrent with 100000 files.
+func BenchmarkPieceSize(b *testing.B) {
+	lengths := make([]int, 100000)
+	for i := range lengths {
+		lengths[i] = 1024
+	}
+	tor := newTestTorrent(b, 16*1024, lengths...)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for pieceIndex := range tor.Pieces {
+			tor.PieceSize(uint32(pieceIndex))
+		}
+	}
+}
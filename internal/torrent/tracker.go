@@ -1,15 +1,16 @@
 package torrent
 
 import (
-	"bytes"
 	"crypto/sha1"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/jmatss/torc/internal/peer"
 )
@@ -22,6 +23,13 @@ const (
 	Completed
 
 	UserAgent = "torc/1.0"
+
+	// The max time a request to a HTTP tracker, including reading the response,
+	// is allowed to take.
+	HTTPTrackerTimeout = 30 * time.Second
+
+	// The interval used between tracker requests when no tracker has answered.
+	DefaultTrackerInterval = 30 * time.Minute
 )
 
 type EventId int
@@ -63,16 +71,10 @@ type Tracker struct {
 
 // Creates a new tracker struct that will contain anything tracker related
 // including all peers.
-func NewTracker(content []byte, tor *Torrent) error {
-	tracker := Tracker{}
-
-	// Get "info" field from the bencoded torrent
-	// and sha1 hash it into tracker.InfoHash.
-	info, err := GetDictValue(content, "info")
-	if err != nil {
-		return fmt.Errorf("unable to get field \"info\" from "+
-			"torrent file: %w", err)
-	}
+// "info" is the bencoded info dictionary of the torrent, its sha1 hash is the
+// info hash.
+func NewTracker(info []byte, tor *Torrent) error {
+	tracker := &tor.Tracker
 	tracker.InfoHash = sha1.Sum(info)
 
 	var left int64 = 0
@@ -82,13 +84,12 @@ func NewTracker(content []byte, tor *Torrent) error {
 	tracker.Left = left
 
 	// Bitfield initialized to all zeros
-	tracker.BitFieldHave = make([]byte, len(tor.Pieces))
-	tracker.BitFieldDownloading = make([]byte, len(tor.Pieces))
+	tracker.BitFieldHave = make([]byte, tor.BitFieldLength())
+	tracker.BitFieldDownloading = make([]byte, tor.BitFieldLength())
 
 	// Uploaded, Downloaded, Interval, Seeders and Leecehers initialized to 0
 	// Started and Completed initialized to false
 	// Peers initialized to nil
-	tor.Tracker = tracker
 
 	return nil
 }
@@ -99,9 +100,9 @@ func (t *Torrent) Request(peerId string) error {
 	if t.Tracker.Completed {
 		return fmt.Errorf("this torrent has already finished downloading")
 	} else if !t.Tracker.Started {
-		return t.trackerRequest(peerId, Started)
+		return t.announce(peerId, Started)
 	} else {
-		return t.trackerRequest(peerId, Interval)
+		return t.announce(peerId, Interval)
 	}
 }
 
@@ -109,13 +110,19 @@ func (t *Torrent) Request(peerId string) error {
 // will stop requesting data.
 func (t *Torrent) Stop(peerId string, completed bool) error {
 	if completed {
-		return t.trackerRequest(peerId, Completed)
+		return t.announce(peerId, Completed)
 	} else {
-		return t.trackerRequest(peerId, Stopped)
+		return t.announce(peerId, Stopped)
 	}
 }
 
-func (t *Torrent) trackerRequest(peerId string, event EventId) error {
+// Sends a request to the tracker with the URL "announce". Both HTTP(S) and
+// UDP trackers are supported.
+func (t *Torrent) trackerRequest(announce string, peerId string, event EventId) error {
+	if strings.HasPrefix(strings.ToLower(announce), "udp://") {
+		return t.udpTrackerRequest(announce, peerId, event)
+	}
+
 	params := url.Values{}
 	params.Add("info_hash", string(t.Tracker.InfoHash[:]))
 	params.Add("peer_id", peerId)
@@ -126,32 +133,32 @@ func (t *Torrent) trackerRequest(peerId string, event EventId) error {
 	params.Add("compact", "1")
 	params.Add("no_peer_id", "1")
 
+	// Tell the tracker about the IPv6 address of this client so that it can be
+	// given to IPv6 peers even if the request is sent over IPv4. See BEP 7.
+	if ip := localIPv6(); ip != nil {
+		params.Add("ipv6", ip.String())
+	}
+
 	switch event {
 	case Interval:
 		// Should be set during regular "interval" calls to the tracker
 		// , no need to set the "event" flag
 	case Started, Stopped, Completed:
-		if event == Started {
-			t.Tracker.Started = true
-		} else if event == Completed {
-			t.Tracker.Completed = true
-		}
-
 		params.Add("event", strings.ToLower(event.String()))
 	default:
 		return fmt.Errorf("incorrect \"event\" set during tracker request")
 	}
 
 	// See whether this is the first parameter or if there are other parameters
-	// already added into the "Announce" url.
+	// already added into the "announce" url.
 	var URL string
-	if strings.Contains(t.Announce, "?") {
-		URL = t.Announce + "&" + params.Encode()
+	if strings.Contains(announce, "?") {
+		URL = announce + "&" + params.Encode()
 	} else {
-		URL = t.Announce + "?" + params.Encode()
+		URL = announce + "?" + params.Encode()
 	}
 
-	client := &http.Client{}
+	client := &http.Client{Timeout: HTTPTrackerTimeout}
 	request, err := http.NewRequest("GET", URL, nil)
 	if err != nil {
 		return fmt.Errorf("unable to create new htto request "+
@@ -170,57 +177,118 @@ func (t *Torrent) trackerRequest(peerId string, event EventId) error {
 		return fmt.Errorf("unable to read response from %s: %w", URL, err)
 	}
 
-	// If the response body contains the key "failure reason", the tracker request failed.
-	if bytes.Contains(body, []byte("failure reason")) {
-		reason, err := GetString(body, "failure reason")
-		if err != nil {
-			return err
-		} else {
-			return fmt.Errorf("received failure reason from remote peer: %s", reason)
-		}
+	response, err := Parse(body)
+	if err != nil {
+		return fmt.Errorf("unable to parse response from %s: %w", URL, err)
+	}
+
+	// If the response contains the key "failure reason", the tracker request failed.
+	if reason, err := response.GetString("failure reason"); err == nil {
+		return fmt.Errorf("received failure reason from remote peer: %s", reason)
+	} else if _, ok := err.(*NotFoundError); !ok {
+		return err
 	}
 
-	// TODO: uglier code while using interfaces and casting over and over again,
-	//  but would be better performance compared to current code using bytes and
-	//  looking through the bytes in linear time.
 	// Get interval, seeders(complete) and leechers(incomplete) from the tracker response
-	interval, err := GetInt(body, "interval")
+	interval, err := response.GetInt("interval")
 	if err != nil {
 		return err
 	}
-	seeders, err := GetInt(body, "complete")
+	seeders, err := response.GetInt("complete")
 	if err != nil {
 		return err
 	}
-	leechers, err := GetInt(body, "incomplete")
+	leechers, err := response.GetInt("incomplete")
 	if err != nil {
 		return err
 	}
 
-	t.Tracker.Lock()
-	defer t.Tracker.Unlock()
+	peers, err := getPeers(response)
+	if err != nil {
+		return err
+	}
+
+	t.updateTracker(interval, seeders, leechers, peers)
+
+	return nil
+}
 
+// Updates the tracker struct with the result of a successful tracker request.
+// The same result is given by both HTTP and UDP trackers.
+func (t *Torrent) updateTracker(interval, seeders, leechers int64, peers map[string]*peer.Peer) {
+	t.Tracker.Lock()
 	t.Tracker.Interval = interval
 	t.Tracker.Seeders = seeders
 	t.Tracker.Leechers = leechers
+	t.Tracker.Unlock()
 
-	peers, err := getPeers(body)
-	if err != nil {
-		return err
-	}
+	t.AddPeers(peers)
+}
+
+// Adds peers received from a tracker or a remote peer to the peers of this torrent.
+// Peers that already exists are kept, but the flags of the new peer are added
+// to them. Returns the amount of new peers.
+func (t *Torrent) AddPeers(peers map[string]*peer.Peer) int {
+	t.Tracker.Lock()
+	defer t.Tracker.Unlock()
 
 	// If true: first "contact" with the tracker, i.e. all received peers are new,
 	//	        add all of them to the the tracker struct.
 	// Else: add all new peers that isn't already among the "old" peers
 	if t.Tracker.Peers == nil {
 		t.Tracker.Peers = peers
-	} else {
-		for _, newPeer := range peers {
-			if _, ok := t.Tracker.Peers[newPeer.HostAndPort]; !ok {
-				t.Tracker.Peers[newPeer.HostAndPort] = newPeer
-			}
+		return len(peers)
+	}
+
+	added := 0
+	for _, newPeer := range peers {
+		if oldPeer, ok := t.Tracker.Peers[newPeer.HostAndPort]; !ok {
+			t.Tracker.Peers[newPeer.HostAndPort] = newPeer
+			added++
+		} else {
+			oldPeer.Lock()
+			oldPeer.Flags |= newPeer.Flags
+			oldPeer.Unlock()
 		}
 	}
+	return added
+}
+
+// Returns a global unicast IPv6 address of this host or nil if it doesn't have one.
+// Unique local addresses (fc00::/7) aren't reachable from other networks and
+// aren't returned.
+func localIPv6() net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
 
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipNet.IP
+		if ip.To4() == nil && ip.IsGlobalUnicast() && ip[0]&0xfe != 0xfc {
+			return ip
+		}
+	}
 	return nil
 }
+
+// Parses peers in the compact format where every peer is 6 bytes:
+// <IPv4(4B)><port(2B)>. Used by both HTTP and UDP trackers.
+func compactPeers(data []byte) (map[string]*peer.Peer, error) {
+	return peer.ParseCompact(data, net.IPv4len)
+}
+
+// Returns the time to wait until the next tracker request.
+func (t *Torrent) TrackerInterval() time.Duration {
+	t.Tracker.Lock()
+	defer t.Tracker.Unlock()
+
+	if t.Tracker.Interval <= 0 {
+		return DefaultTrackerInterval
+	}
+	return time.Duration(t.Tracker.Interval) * time.Second
+}
@@ -0,0 +1,344 @@
+// Contains logic related to communicating with UDP trackers.
+// See http://www.bittorrent.org/beps/bep_0015.html
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/jmatss/torc/internal/peer"
+)
+
+const (
+	UDPProtocolId uint64 = 0x41727101980
+
+	// The timeout of a request is UDPTimeout * 2^n seconds where n is the
+	// amount of retransmissions so far, up to UDPMaxRetransmissions. A request
+	// that isn't answered at all takes about 2 hours before it gives up.
+	UDPTimeout            = 15 * time.Second
+	UDPMaxRetransmissions = 8
+
+	// Announces gives up on a tracker after UDPAnnounceRetransmissions
+	// retransmissions (15 + 30 + 60 seconds) so that the next tracker in the
+	// announce list is tried.
+	UDPAnnounceRetransmissions = 2
+
+	// A connection ID can be used for one minute after it was received.
+	UDPConnectionIdTimeout = 1 * time.Minute
+
+	// The max amount of info hashes in a single scrape request.
+	UDPMaxScrape = 74
+
+	udpMaxPacketSize = 2048
+)
+
+// The actions of the UDP tracker protocol.
+const (
+	udpConnect uint32 = iota
+	udpAnnounce
+	udpScrape
+	udpError
+)
+
+// The events used in UDP announce requests, they differ from the EventIds.
+const (
+	udpEventNone uint32 = iota
+	udpEventCompleted
+	udpEventStarted
+	udpEventStopped
+)
+
+// Connection IDs received from UDP trackers, indexed by "host:port".
+// Shared between all torrents that uses the same tracker.
+var udpConnections = struct {
+	sync.Mutex
+	ids map[string]udpConnectionId
+}{ids: make(map[string]udpConnectionId)}
+
+type udpConnectionId struct {
+	id       uint64
+	received time.Time
+}
+
+// The result of a scrape of a single torrent.
+type ScrapeResult struct {
+	Seeders   int64
+	Completed int64
+	Leechers  int64
+}
+
+// A UDP tracker at a specific "host:port".
+// A request is retransmitted at most "retransmissions" times, the first
+// attempt waits "timeout" for a response and every retransmission doubles it.
+type udpTracker struct {
+	host string
+	conn net.Conn
+
+	timeout         time.Duration
+	retransmissions int
+}
+
+// Creates a "connection" to the UDP tracker with the announce URL "announce".
+// The caller is responsible for closing the returned tracker.
+func dialUDPTracker(announce string) (*udpTracker, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse UDP tracker url %s: %w", announce, err)
+	} else if u.Scheme != "udp" || u.Host == "" {
+		return nil, fmt.Errorf("incorrect UDP tracker url %s", announce)
+	}
+
+	conn, err := net.Dial("udp", u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to %s: %w", u.Host, err)
+	}
+
+	return &udpTracker{
+		host:            u.Host,
+		conn:            conn,
+		timeout:         UDPTimeout,
+		retransmissions: UDPMaxRetransmissions,
+	}, nil
+}
+
+func (ut *udpTracker) Close() error {
+	return ut.conn.Close()
+}
+
+// Used when doing a request to a UDP tracker. Results in the same updates of
+// the tracker struct as a request to a HTTP tracker.
+func (t *Torrent) udpTrackerRequest(announce string, peerId string, event EventId) error {
+	var udpEvent uint32
+	switch event {
+	case Interval:
+		udpEvent = udpEventNone
+	case Started:
+		udpEvent = udpEventStarted
+	case Stopped:
+		udpEvent = udpEventStopped
+	case Completed:
+		udpEvent = udpEventCompleted
+	default:
+		return fmt.Errorf("incorrect \"event\" set during tracker request")
+	}
+
+	ut, err := dialUDPTracker(announce)
+	if err != nil {
+		return err
+	}
+	defer ut.Close()
+	ut.retransmissions = UDPAnnounceRetransmissions
+
+	// Format: <connection_id(8B)><action(4B)><transaction_id(4B)><info_hash(20B)>
+	//  <peer_id(20B)><downloaded(8B)><left(8B)><uploaded(8B)><event(4B)><IP(4B)>
+	//  <key(4B)><num_want(4B)><port(2B)>
+	// The connection_id and transaction_id are filled in by "roundTrip".
+	request := make([]byte, 98)
+	t.Tracker.Lock()
+	copy(request[16:36], t.Tracker.InfoHash[:])
+	binary.BigEndian.PutUint64(request[56:64], uint64(t.Tracker.Downloaded))
+	binary.BigEndian.PutUint64(request[64:72], uint64(t.Tracker.Left))
+	binary.BigEndian.PutUint64(request[72:80], uint64(t.Tracker.Uploaded))
+	t.Tracker.Unlock()
+	copy(request[36:56], peerId)
+	binary.BigEndian.PutUint32(request[80:84], udpEvent)
+	binary.BigEndian.PutUint32(request[84:88], 0) // IP, 0 = use sender address
+	binary.BigEndian.PutUint32(request[88:92], udpKey(peerId))
+	binary.BigEndian.PutUint32(request[92:96], ^uint32(0)) // num_want, -1 = default
+	binary.BigEndian.PutUint16(request[96:98], Port)
+
+	// Format: <action(4B)><transaction_id(4B)><interval(4B)><leechers(4B)>
+	//  <seeders(4B)><peers(6B * n)>
+	// The peers are 18 bytes (IPv6(16B) + port(2B)) if the tracker is contacted
+	// over IPv6.
+	response, err := ut.roundTrip(udpAnnounce, request)
+	if err != nil {
+		return err
+	} else if len(response) < 20 {
+		return fmt.Errorf("announce response from UDP tracker %s to small, "+
+			"expected: >=20, got: %d", ut.host, len(response))
+	}
+
+	interval := int64(binary.BigEndian.Uint32(response[8:12]))
+	leechers := int64(binary.BigEndian.Uint32(response[12:16]))
+	seeders := int64(binary.BigEndian.Uint32(response[16:20]))
+
+	ipLen := net.IPv4len
+	if udpAddr, ok := ut.conn.RemoteAddr().(*net.UDPAddr); ok && udpAddr.IP.To4() == nil {
+		ipLen = net.IPv6len
+	}
+	peers, err := peer.ParseCompact(response[20:], ipLen)
+	if err != nil {
+		return err
+	}
+
+	t.updateTracker(interval, seeders, leechers, peers)
+
+	return nil
+}
+
+// Scrapes the UDP tracker for the torrents with the given info hashes.
+// The results are returned in the same order as "infoHashes".
+func (ut *udpTracker) scrape(infoHashes [][sha1.Size]byte) ([]ScrapeResult, error) {
+	if len(infoHashes) == 0 || len(infoHashes) > UDPMaxScrape {
+		return nil, fmt.Errorf("incorrect amount of info hashes to scrape, "+
+			"expected: 1-%d, got: %d", UDPMaxScrape, len(infoHashes))
+	}
+
+	// Format: <connection_id(8B)><action(4B)><transaction_id(4B)><info_hash(20B) * n>
+	request := make([]byte, 16, 16+len(infoHashes)*sha1.Size)
+	for _, infoHash := range infoHashes {
+		request = append(request, infoHash[:]...)
+	}
+
+	// Format: <action(4B)><transaction_id(4B)>
+	//  (<seeders(4B)><completed(4B)><leechers(4B)>) * n
+	response, err := ut.roundTrip(udpScrape, request)
+	if err != nil {
+		return nil, err
+	} else if len(response) < 8+12*len(infoHashes) {
+		return nil, fmt.Errorf("scrape response from UDP tracker %s to small, "+
+			"expected: >=%d, got: %d", ut.host, 8+12*len(infoHashes), len(response))
+	}
+
+	results := make([]ScrapeResult, len(infoHashes))
+	for i := range results {
+		data := response[8+12*i:]
+		results[i] = ScrapeResult{
+			Seeders:   int64(binary.BigEndian.Uint32(data[0:4])),
+			Completed: int64(binary.BigEndian.Uint32(data[4:8])),
+			Leechers:  int64(binary.BigEndian.Uint32(data[8:12])),
+		}
+	}
+
+	return results, nil
+}
+
+// Sends a request with the action "action" to the tracker and returns the
+// response. The connection_id, action and transaction_id fields of "request"
+// (the first 16 bytes) are filled in by this function.
+//
+// Requests that aren't answered in time are retransmitted with an increasing
+// timeout, at most "ut.retransmissions" times. A new connection ID is fetched
+// if the current one has expired.
+func (ut *udpTracker) roundTrip(action uint32, request []byte) ([]byte, error) {
+	var err error
+	for n := 0; n <= ut.retransmissions; n++ {
+		var connectionId uint64
+		connectionId, err = ut.connectionId(n)
+		if err != nil {
+			if isTimeout(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		binary.BigEndian.PutUint64(request[0:8], connectionId)
+		binary.BigEndian.PutUint32(request[8:12], action)
+
+		var response []byte
+		response, err = ut.send(request, action, n)
+		if err == nil {
+			return response, nil
+		} else if !isTimeout(err) {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("no response from UDP tracker %s after %d retransmissions: %w",
+		ut.host, ut.retransmissions, err)
+}
+
+// Returns a valid connection ID for this tracker. A new one is requested from
+// the tracker if there are no cached connection ID or if it has expired.
+// "n" is the amount of retransmissions so far.
+func (ut *udpTracker) connectionId(n int) (uint64, error) {
+	udpConnections.Lock()
+	cached, ok := udpConnections.ids[ut.host]
+	udpConnections.Unlock()
+	if ok && time.Since(cached.received) < UDPConnectionIdTimeout {
+		return cached.id, nil
+	}
+
+	// Format: <protocol_id(8B)><action(4B)><transaction_id(4B)>
+	request := make([]byte, 16)
+	binary.BigEndian.PutUint64(request[0:8], UDPProtocolId)
+	binary.BigEndian.PutUint32(request[8:12], udpConnect)
+
+	// Format: <action(4B)><transaction_id(4B)><connection_id(8B)>
+	response, err := ut.send(request, udpConnect, n)
+	if err != nil {
+		return 0, err
+	} else if len(response) < 16 {
+		return 0, fmt.Errorf("connect response from UDP tracker %s to small, "+
+			"expected: >=16, got: %d", ut.host, len(response))
+	}
+
+	id := binary.BigEndian.Uint64(response[8:16])
+	udpConnections.Lock()
+	udpConnections.ids[ut.host] = udpConnectionId{id: id, received: time.Now()}
+	udpConnections.Unlock()
+
+	return id, nil
+}
+
+// Sends a single request to the tracker with a new transaction ID and waits for
+// the response. Responses with other transaction IDs are ignored.
+// "n" is the amount of retransmissions so far and decides the timeout.
+func (ut *udpTracker) send(request []byte, action uint32, n int) ([]byte, error) {
+	transactionId := rand.Uint32()
+	binary.BigEndian.PutUint32(request[12:16], transactionId)
+
+	timeout := ut.timeout * time.Duration(1<<uint(n))
+	if err := ut.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, fmt.Errorf("unable to set deadline for connection to "+
+			"%s: %w", ut.host, err)
+	}
+
+	if _, err := ut.conn.Write(request); err != nil {
+		return nil, fmt.Errorf("unable to send request to UDP tracker %s: %w", ut.host, err)
+	}
+
+	buffer := make([]byte, udpMaxPacketSize)
+	for {
+		length, err := ut.conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		} else if length < 8 || binary.BigEndian.Uint32(buffer[4:8]) != transactionId {
+			continue
+		}
+		response := buffer[:length]
+
+		responseAction := binary.BigEndian.Uint32(response[0:4])
+		if responseAction == udpError {
+			return nil, fmt.Errorf("received failure reason from UDP tracker %s: %s",
+				ut.host, bytes.TrimRight(response[8:], "\x00"))
+		} else if responseAction != action {
+			return nil, fmt.Errorf("incorrect action in response from UDP tracker %s, "+
+				"expected: %d, got: %d", ut.host, action, responseAction)
+		}
+
+		return response, nil
+	}
+}
+
+// Returns the key sent in announce requests. It lets the tracker identify this
+// client if its IP address changes, so it is derived from the peer id.
+func udpKey(peerId string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(peerId))
+	return h.Sum32()
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
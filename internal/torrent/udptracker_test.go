@@ -0,0 +1,381 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConnectionId uint64 = 0x0102030405060708
+
+// Starts a UDP tracker on localhost that answers connect requests itself and
+// calls "handle" with every other request. The responses returned by "handle"
+// are sent in order. Returns the announce URL of the tracker.
+func startUDPTracker(t *testing.T, handle func(request []byte) [][]byte) (string, func()) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to start UDP tracker: %v", err)
+	}
+
+	go func() {
+		buffer := make([]byte, udpMaxPacketSize)
+		for {
+			length, addr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			request := append([]byte(nil), buffer[:length]...)
+
+			var responses [][]byte
+			if length == 16 && binary.BigEndian.Uint64(request[0:8]) == UDPProtocolId {
+				connectionId := make([]byte, 8)
+				binary.BigEndian.PutUint64(connectionId, testConnectionId)
+				responses = [][]byte{udpResponse(udpConnect, request, connectionId)}
+			} else {
+				responses = handle(request)
+			}
+
+			for _, response := range responses {
+				if _, err := conn.WriteToUDP(response, addr); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	return "udp://" + conn.LocalAddr().String() + "/announce", func() { conn.Close() }
+}
+
+// Creates a response with the action "action" to "request". The transaction ID
+// is copied from the request.
+func udpResponse(action uint32, request []byte, body []byte) []byte {
+	response := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(response[0:4], action)
+	copy(response[4:8], request[12:16])
+	return append(response, body...)
+}
+
+func uint32s(values ...uint32) []byte {
+	data := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(data[4*i:], v)
+	}
+	return data
+}
+
+func TestUDPTrackerAnnounce(t *testing.T) {
+	peerId := strings.Repeat("p", 20)
+	compactPeers := []byte{10, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0x1a, 0xe2}
+	announceBody := append(uint32s(1800, 3, 5), compactPeers...)
+
+	tests := []struct {
+		name      string
+		event     EventId
+		udpEvent  uint32
+		responses func(request []byte) [][]byte
+		errMsg    string // empty if the announce should succeed
+	}{
+		{
+			name:     "started",
+			event:    Started,
+			udpEvent: udpEventStarted,
+			responses: func(request []byte) [][]byte {
+				return [][]byte{udpResponse(udpAnnounce, request, announceBody)}
+			},
+		},
+		{
+			name:     "interval",
+			event:    Interval,
+			udpEvent: udpEventNone,
+			responses: func(request []byte) [][]byte {
+				return [][]byte{udpResponse(udpAnnounce, request, announceBody)}
+			},
+		},
+		{
+			name:     "completed ignores other transactions",
+			event:    Completed,
+			udpEvent: udpEventCompleted,
+			responses: func(request []byte) [][]byte {
+				other := append([]byte(nil), request...)
+				other[15]++
+				return [][]byte{
+					udpResponse(udpAnnounce, other, uint32s(1, 1, 1)),
+					{0, 0, 0},
+					udpResponse(udpAnnounce, request, announceBody),
+				}
+			},
+		},
+		{
+			name:     "stopped",
+			event:    Stopped,
+			udpEvent: udpEventStopped,
+			responses: func(request []byte) [][]byte {
+				return [][]byte{udpResponse(udpAnnounce, request, announceBody)}
+			},
+		},
+		{
+			name:     "error",
+			event:    Started,
+			udpEvent: udpEventStarted,
+			responses: func(request []byte) [][]byte {
+				return [][]byte{udpResponse(udpError, request, []byte("denied\x00"))}
+			},
+			errMsg: "denied",
+		},
+		{
+			name:     "incorrect action",
+			event:    Started,
+			udpEvent: udpEventStarted,
+			responses: func(request []byte) [][]byte {
+				return [][]byte{udpResponse(udpScrape, request, announceBody)}
+			},
+			errMsg: "incorrect action",
+		},
+		{
+			name:     "response too small",
+			event:    Started,
+			udpEvent: udpEventStarted,
+			responses: func(request []byte) [][]byte {
+				return [][]byte{udpResponse(udpAnnounce, request, uint32s(1800))}
+			},
+			errMsg: "to small",
+		},
+		{
+			name:     "incorrect peers",
+			event:    Started,
+			udpEvent: udpEventStarted,
+			responses: func(request []byte) [][]byte {
+				return [][]byte{udpResponse(udpAnnounce, request, append(uint32s(1800, 3, 5), 1, 2, 3))}
+			},
+			errMsg: "compact peers",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := make(chan []byte, 1)
+			announce, stop := startUDPTracker(t, func(request []byte) [][]byte {
+				requests <- request
+				return tt.responses(request)
+			})
+			defer stop()
+
+			tor := newTestTorrent(t, 1<<14, 100)
+			tor.Tracker.InfoHash = sha1.Sum([]byte(tt.name))
+			tor.Tracker.Downloaded = 10
+			tor.Tracker.Left = 90
+			tor.Tracker.Uploaded = 20
+
+			err := tor.udpTrackerRequest(announce, peerId, tt.event)
+			if tt.errMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+					t.Fatalf("expected an error containing %q, got: %v", tt.errMsg, err)
+				}
+			} else if err != nil {
+				t.Fatalf("unable to announce: %v", err)
+			}
+
+			request := <-requests
+			if len(request) != 98 {
+				t.Fatalf("expected an announce request of 98 bytes, got: %d", len(request))
+			}
+			expected := []struct {
+				field    string
+				got      interface{}
+				expected interface{}
+			}{
+				{"connection_id", binary.BigEndian.Uint64(request[0:8]), testConnectionId},
+				{"action", binary.BigEndian.Uint32(request[8:12]), udpAnnounce},
+				{"info_hash", string(request[16:36]), string(tor.Tracker.InfoHash[:])},
+				{"peer_id", string(request[36:56]), peerId},
+				{"downloaded", binary.BigEndian.Uint64(request[56:64]), uint64(10)},
+				{"left", binary.BigEndian.Uint64(request[64:72]), uint64(90)},
+				{"uploaded", binary.BigEndian.Uint64(request[72:80]), uint64(20)},
+				{"event", binary.BigEndian.Uint32(request[80:84]), tt.udpEvent},
+				{"ip", binary.BigEndian.Uint32(request[84:88]), uint32(0)},
+				{"key", binary.BigEndian.Uint32(request[88:92]), udpKey(peerId)},
+				{"num_want", binary.BigEndian.Uint32(request[92:96]), ^uint32(0)},
+				{"port", binary.BigEndian.Uint16(request[96:98]), uint16(Port)},
+			}
+			for _, e := range expected {
+				if e.got != e.expected {
+					t.Errorf("%s: expected %v, got: %v", e.field, e.expected, e.got)
+				}
+			}
+
+			if tt.errMsg != "" {
+				return
+			}
+			if tor.Tracker.Interval != 1800 || tor.Tracker.Leechers != 3 || tor.Tracker.Seeders != 5 {
+				t.Errorf("expected interval 1800, 3 leechers and 5 seeders, got: %d, %d, %d",
+					tor.Tracker.Interval, tor.Tracker.Leechers, tor.Tracker.Seeders)
+			}
+			for _, hostAndPort := range []string{"10.0.0.1:6881", "10.0.0.2:6882"} {
+				if _, ok := tor.Tracker.Peers[hostAndPort]; !ok {
+					t.Errorf("expected peer %s, got: %v", hostAndPort, tor.Tracker.Peers)
+				}
+			}
+		})
+	}
+}
+
+func TestUDPTrackerScrape(t *testing.T) {
+	infoHashes := [][sha1.Size]byte{sha1.Sum([]byte("a")), sha1.Sum([]byte("b"))}
+
+	tests := []struct {
+		name       string
+		infoHashes [][sha1.Size]byte
+		body       []byte
+		expected   []ScrapeResult
+		ok         bool
+	}{
+		{
+			name:       "single torrent",
+			infoHashes: infoHashes[:1],
+			body:       uint32s(1, 2, 3),
+			expected:   []ScrapeResult{{Seeders: 1, Completed: 2, Leechers: 3}},
+			ok:         true,
+		},
+		{
+			name:       "multiple torrents",
+			infoHashes: infoHashes,
+			body:       uint32s(1, 2, 3, 4, 5, 6),
+			expected: []ScrapeResult{
+				{Seeders: 1, Completed: 2, Leechers: 3},
+				{Seeders: 4, Completed: 5, Leechers: 6},
+			},
+			ok: true,
+		},
+		{name: "response too small", infoHashes: infoHashes, body: uint32s(1, 2, 3)},
+		{name: "no info hashes", infoHashes: nil},
+		{name: "too many info hashes", infoHashes: make([][sha1.Size]byte, UDPMaxScrape+1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := make(chan []byte, 1)
+			announce, stop := startUDPTracker(t, func(request []byte) [][]byte {
+				requests <- request
+				return [][]byte{udpResponse(udpScrape, request, tt.body)}
+			})
+			defer stop()
+
+			ut, err := dialUDPTracker(announce)
+			if err != nil {
+				t.Fatalf("unable to dial tracker: %v", err)
+			}
+			defer ut.Close()
+
+			results, err := ut.scrape(tt.infoHashes)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("expected an error, got: %v", results)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unable to scrape: %v", err)
+			}
+
+			request := <-requests
+			expectedHashes := make([]byte, 0)
+			for _, infoHash := range tt.infoHashes {
+				expectedHashes = append(expectedHashes, infoHash[:]...)
+			}
+			if binary.BigEndian.Uint32(request[8:12]) != udpScrape || !bytes.Equal(request[16:], expectedHashes) {
+				t.Fatalf("incorrect scrape request: %x", request)
+			}
+
+			if len(results) != len(tt.expected) {
+				t.Fatalf("expected %d results, got: %d", len(tt.expected), len(results))
+			}
+			for i := range results {
+				if results[i] != tt.expected[i] {
+					t.Errorf("result %d: expected %+v, got: %+v", i, tt.expected[i], results[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDialUDPTracker(t *testing.T) {
+	tests := []struct {
+		announce string
+		ok       bool
+	}{
+		{"udp://127.0.0.1:6969/announce", true},
+		{"udp://127.0.0.1:6969", true},
+		{"http://127.0.0.1:6969/announce", false},
+		{"udp:///announce", false},
+		{"udp://%zz", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.announce, func(t *testing.T) {
+			ut, err := dialUDPTracker(tt.announce)
+			if ut != nil {
+				ut.Close()
+			}
+			if (err == nil) != tt.ok {
+				t.Fatalf("expected ok: %v, got error: %v", tt.ok, err)
+			}
+		})
+	}
+}
+
+// Makes sure that a request to a tracker that never answers gives up after the
+// retransmissions of the tracker.
+func TestUDPTrackerRetransmissions(t *testing.T) {
+	const timeout = 20 * time.Millisecond
+
+	// Answers connect requests but never any announce requests.
+	silent, stop := startUDPTracker(t, func(request []byte) [][]byte { return nil })
+	defer stop()
+
+	// Never answers any requests at all.
+	blackHole, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to create UDP socket: %v", err)
+	}
+	defer blackHole.Close()
+
+	tests := []struct {
+		name            string
+		announce        string
+		retransmissions int
+	}{
+		{"connect not answered", "udp://" + blackHole.LocalAddr().String(), 2},
+		{"connect not answered without retransmissions", "udp://" + blackHole.LocalAddr().String(), 0},
+		{"announce not answered", silent, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ut, err := dialUDPTracker(tt.announce)
+			if err != nil {
+				t.Fatalf("unable to dial UDP tracker: %v", err)
+			}
+			defer ut.Close()
+			ut.timeout = timeout
+			ut.retransmissions = tt.retransmissions
+
+			// timeout * (2^0 + 2^1 + ... + 2^retransmissions)
+			expected := timeout * time.Duration(1<<uint(tt.retransmissions+1)-1)
+
+			start := time.Now()
+			response, err := ut.roundTrip(udpAnnounce, make([]byte, 98))
+			elapsed := time.Since(start)
+			if err == nil {
+				t.Fatalf("expected an error, got response: %v", response)
+			} else if !strings.Contains(err.Error(), "no response") {
+				t.Fatalf("expected a \"no response\" error, got: %v", err)
+			}
+			if elapsed < expected || elapsed > expected+time.Second {
+				t.Fatalf("expected to give up after %v, gave up after: %v", expected, elapsed)
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 // Contains information related to the bittorrent protocol.
 package bittorrent
 
+import "strconv"
+
 const (
 	// The KeepAlive message doesn't have an id,
 	//  set to -1 so that it still can be distinguished.
@@ -16,17 +18,58 @@ const (
 	Cancel
 )
 
+const (
+	// Used by the fast extension, see BEP 6.
+	SuggestPiece MessageId = iota + 13
+	HaveAll
+	HaveNone
+	RejectRequest
+	AllowedFast
+)
+
+const (
+	// Used by the extension protocol, see BEP 10.
+	Extended MessageId = 20
+)
+
 // Variables used in the handshake message(s).
 var (
 	PStr     = []byte("BitTorrent protocol")
-	Reserved = []byte{0, 0, 0, 0, 0, 0, 0, 0}
+	Reserved = []byte{0, 0, 0, 0, 0, ExtensionBit, 0, FastBit}
+)
+
+const (
+	// Set in the sixth byte of the reserved bytes by peers that supports the
+	// extension protocol.
+	ExtensionBit  = 0x10
+	ExtensionByte = 5
+
+	// Set in the last byte of the reserved bytes by peers that supports the
+	// fast extension.
+	FastBit  = 0x04
+	FastByte = 7
 )
 
 type MessageId int
 
 func (id MessageId) String() string {
+	switch id {
+	case SuggestPiece:
+		return "SuggestPiece"
+	case HaveAll:
+		return "HaveAll"
+	case HaveNone:
+		return "HaveNone"
+	case RejectRequest:
+		return "RejectRequest"
+	case AllowedFast:
+		return "AllowedFast"
+	case Extended:
+		return "Extended"
+	}
+
 	// enum indexing starts at "-1", need to increment with 1.
-	return []string{
+	names := []string{
 		"KeepAlive",
 		"Choke",
 		"UnChoke",
@@ -37,5 +80,9 @@ func (id MessageId) String() string {
 		"Request",
 		"Piece",
 		"Cancel",
-	}[id+1]
+	}
+	if id < KeepAlive || int(id+1) >= len(names) {
+		return "Unknown(" + strconv.Itoa(int(id)) + ")"
+	}
+	return names[id+1]
 }
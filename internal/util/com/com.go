@@ -4,9 +4,11 @@
 package com
 
 import (
+	"encoding/binary"
 	"fmt"
 	"sync"
 
+	"github.com/jmatss/torc/internal/peer"
 	"github.com/jmatss/torc/internal/torrent"
 )
 
@@ -30,6 +32,37 @@ const (
 	Exiting
 	Complete
 	LogLevel
+	Incoming // A remote peer has connected to this client
+	Recheck  // Progress of a recheck of existing files, see EncodeProgress
+
+	// Sent from the torrent handler to a peer handler to change the state of
+	// the connection to the remote peer.
+	Choke
+	UnChoke
+	Interested
+	NotInterested
+	// Sent from a peer handler when the pieces that the remote peer has changes.
+	Bitfield
+	// Contains the metadata (info dictionary) of a torrent added from a magnet link.
+	Metadata
+	// Sent from the torrent handler to the peer handlers with the "host:port" and
+	// the peer exchange flags of every connected peer, one peer per line.
+	Pex
+	// Contains the result of a scrape of the trackers of a torrent, see EncodeScrape.
+	Scrape
+	// Sets the encryption policy of connections to remote peers.
+	Encryption
+	// Sets the transport policy (TCP/uTP) of connections to remote peers.
+	Transport
+	// Sets the upload/download rate limit of the client, a torrent or the
+	// remote peers. Sent from the view as text: "<scope> [info hash] <rate>".
+	// Passed along to the torrent and peer handlers encoded with EncodeLimit.
+	UploadLimit
+	DownloadLimit
+	// Enables or disables local discovery of a torrent. Sent from the view as
+	// text: "<info hash> <on|off>". Passed along to the torrent handler with a
+	// single byte in the "Data" field, 1 if enabled and 0 if disabled.
+	LocalDiscovery
 )
 
 func (id Id) String() string {
@@ -47,14 +80,113 @@ func (id Id) String() string {
 		"Exiting",
 		"Complete",
 		"LogLevel",
+		"Incoming",
+		"Recheck",
+		"Choke",
+		"UnChoke",
+		"Interested",
+		"NotInterested",
+		"Bitfield",
+		"Metadata",
+		"Pex",
+		"Scrape",
+		"Encryption",
+		"Transport",
+		"UploadLimit",
+		"DownloadLimit",
+		"LocalDiscovery",
 	}[id]
 }
 
+// The levels that a rate limit can be set at, see EncodeLimit.
+type LimitScope byte
+
+const (
+	LimitGlobal LimitScope = iota
+	LimitTorrent
+	LimitPeer
+)
+
+func (s LimitScope) String() string {
+	return []string{
+		"global",
+		"torrent",
+		"peer",
+	}[s]
+}
+
+// Encodes a rate limit of "rate" bytes per second at the level "scope" into a
+// format that can be sent in the "Data" field of a Message.
+// Format: <scope(1B)><rate(8B)>
+func EncodeLimit(scope LimitScope, rate int64) []byte {
+	data := make([]byte, 9)
+	data[0] = byte(scope)
+	binary.BigEndian.PutUint64(data[1:], uint64(rate))
+	return data
+}
+
+// Decodes a rate limit encoded with EncodeLimit.
+func DecodeLimit(data []byte) (LimitScope, int64, error) {
+	if len(data) != 9 {
+		return 0, 0, fmt.Errorf("incorrect length of limit data, "+
+			"expected: 9, got: %d", len(data))
+	} else if LimitScope(data[0]) > LimitPeer {
+		return 0, 0, fmt.Errorf("unknown limit scope %d", data[0])
+	}
+	return LimitScope(data[0]), int64(binary.BigEndian.Uint64(data[1:])), nil
+}
+
+// Encodes a progress of "done" out of "total" into a format that can be sent in
+// the "Data" field of a Message. Format: <done(4B)><total(4B)>
+func EncodeProgress(done, total int) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data[:4], uint32(done))
+	binary.BigEndian.PutUint32(data[4:], uint32(total))
+	return data
+}
+
+// Decodes a progress encoded with EncodeProgress.
+func DecodeProgress(data []byte) (int, int, error) {
+	if len(data) != 8 {
+		return 0, 0, fmt.Errorf("incorrect length of progress data, "+
+			"expected: 8, got: %d", len(data))
+	}
+	done := binary.BigEndian.Uint32(data[:4])
+	total := binary.BigEndian.Uint32(data[4:])
+	return int(done), int(total), nil
+}
+
+// Encodes the result of a scrape into a format that can be sent in the "Data"
+// field of a Message. Format: <seeders(8B)><completed(8B)><leechers(8B)>
+func EncodeScrape(result torrent.ScrapeResult) []byte {
+	data := make([]byte, 24)
+	binary.BigEndian.PutUint64(data[0:8], uint64(result.Seeders))
+	binary.BigEndian.PutUint64(data[8:16], uint64(result.Completed))
+	binary.BigEndian.PutUint64(data[16:24], uint64(result.Leechers))
+	return data
+}
+
+// Decodes a scrape result encoded with EncodeScrape.
+func DecodeScrape(data []byte) (torrent.ScrapeResult, error) {
+	if len(data) != 24 {
+		return torrent.ScrapeResult{}, fmt.Errorf("incorrect length of scrape data, "+
+			"expected: 24, got: %d", len(data))
+	}
+	return torrent.ScrapeResult{
+		Seeders:   int64(binary.BigEndian.Uint64(data[0:8])),
+		Completed: int64(binary.BigEndian.Uint64(data[8:16])),
+		Leechers:  int64(binary.BigEndian.Uint64(data[16:24])),
+	}, nil
+}
+
 type Message struct {
 	Id      Id
 	Torrent *torrent.Torrent
 	Data    []byte
 
+	// Peer is set when a connection from a remote peer is passed along.
+	Peer *peer.Peer
+
 	// Error == nil: everything fine.
 	Error error
 
@@ -72,8 +204,8 @@ type Channel struct {
 	children map[string]chan Message
 }
 
-func New() Channel {
-	return Channel{
+func New() *Channel {
+	return &Channel{
 		Parent:   make(chan Message, ChanSize),
 		children: make(map[string]chan Message),
 	}
@@ -4,4 +4,5 @@ package cons
 var (
 	PeerId       string
 	DownloadPath string
+	SessionPath  string
 )
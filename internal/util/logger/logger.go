@@ -28,6 +28,6 @@ func GetValues() []string {
 
 func Log(level Level, format string, v ...interface{}) {
 	if CurrentLevel >= level {
-		log.Printf(format, v)
+		log.Printf(format, v...)
 	}
 }
@@ -0,0 +1,152 @@
+// Contains token bucket rate limiters used to limit the transfer rates of the
+// connections to remote peers. The limiters are layered: data sent to or
+// received from a remote peer has to pass the global limiter, the limiter of
+// the torrent and the limiter of the peer.
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Limits the total upload/download rate of the client.
+	GlobalUpload   = New(0)
+	GlobalDownload = New(0)
+)
+
+// A token bucket that is filled with "rate" tokens (bytes) per second and can
+// hold at most one second worth of tokens. A nil Limiter or a Limiter with a
+// rate of 0 is unlimited.
+//
+// Taking more tokens than there are in the bucket puts the bucket in debt, the
+// caller has to wait until the debt has been paid off. This makes it possible
+// to pass messages that are bigger than the bucket.
+type Limiter struct {
+	mut    sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+// Creates a Limiter that limits the rate to "rate" bytes per second.
+// The rate is unlimited if "rate" is 0.
+func New(rate int64) *Limiter {
+	l := &Limiter{}
+	l.SetRate(rate)
+	return l
+}
+
+// Returns the rate in bytes per second, 0 if unlimited.
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	return l.rate
+}
+
+// Changes the rate to "rate" bytes per second, 0 makes it unlimited.
+// Callers that already are waiting aren't affected.
+func (l *Limiter) SetRate(rate int64) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if rate < 0 {
+		rate = 0
+	}
+
+	now := time.Now()
+	if l.rate == 0 {
+		// Starts out with a full bucket.
+		l.tokens = float64(rate)
+	} else {
+		l.fill(now)
+		if l.tokens > float64(rate) {
+			l.tokens = float64(rate)
+		}
+	}
+	l.rate = rate
+	l.last = now
+}
+
+// Fills the bucket with the tokens added since the last fill.
+// Must be called with "mut" locked.
+func (l *Limiter) fill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+}
+
+// Takes "n" tokens from the bucket. Returns how long the caller has to wait
+// before the tokens can be used.
+func (l *Limiter) reserve(n int, now time.Time) time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if l.rate == 0 {
+		return 0
+	}
+
+	l.fill(now)
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// Waits until "n" bytes are allowed to pass all of the "limiters".
+// Nil limiters are ignored.
+func Wait(n int, limiters ...*Limiter) {
+	now := time.Now()
+	var delay time.Duration
+	for _, l := range limiters {
+		if d := l.reserve(n, now); d > delay {
+			delay = d
+		}
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// Parses a rate in bytes per second. The rate can have one of the (binary)
+// suffixes "k", "m" or "g", ex. "500k" is 512000 bytes per second. The rates
+// "0", "none" and "unlimited" are parsed as 0 (unlimited).
+func ParseRate(input string) (int64, error) {
+	s := strings.ToLower(strings.TrimSpace(input))
+	if s == "none" || s == "unlimited" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "m"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "g"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		s = s[:len(s)-1]
+	}
+
+	rate, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || rate < 0 {
+		return 0, fmt.Errorf("incorrect rate \"%s\"", input)
+	}
+	return rate * multiplier, nil
+}
@@ -0,0 +1,145 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReserve(t *testing.T) {
+	type step struct {
+		after    time.Duration // since the limiter was created
+		n        int
+		expected time.Duration
+	}
+
+	tests := []struct {
+		name  string
+		rate  int64
+		steps []step
+	}{
+		{"unlimited", 0, []step{{0, 1 << 30, 0}, {0, 1 << 30, 0}}},
+		{"starts full", 1000, []step{{0, 1000, 0}}},
+		{"debt", 1000, []step{{0, 1000, 0}, {0, 500, 500 * time.Millisecond}}},
+		{"larger than bucket", 1000, []step{{0, 3000, 2 * time.Second}}},
+		{"refills", 1000, []step{{0, 1000, 0}, {500 * time.Millisecond, 500, 0}, {500 * time.Millisecond, 1, time.Millisecond}}},
+		{"debt paid off", 1000, []step{{0, 2000, time.Second}, {time.Second, 0, 0}, {time.Second, 1000, time.Second}}},
+		{"capped at one second", 1000, []step{{10 * time.Second, 1500, 500 * time.Millisecond}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(tt.rate)
+			start := l.last
+			for i, s := range tt.steps {
+				if got := l.reserve(s.n, start.Add(s.after)); got != s.expected {
+					t.Fatalf("step %d: expected delay %v, got: %v", i, s.expected, got)
+				}
+			}
+		})
+	}
+
+	var l *Limiter
+	if got := l.reserve(1<<30, time.Now()); got != 0 {
+		t.Fatalf("expected a nil limiter to be unlimited, got delay: %v", got)
+	}
+	if got := l.Rate(); got != 0 {
+		t.Fatalf("expected a nil limiter to have rate 0, got: %d", got)
+	}
+}
+
+func TestSetRate(t *testing.T) {
+	tests := []struct {
+		name     string
+		rate     int64
+		taken    int
+		newRate  int64
+		n        int
+		rate2    int64 // the rate after SetRate
+		expected time.Duration
+	}{
+		// Lowering the rate also lowers the tokens in the bucket.
+		{"lowered", 1000, 0, 100, 200, 100, time.Second},
+		// A raised rate doesn't fill the bucket.
+		{"raised", 100, 100, 1000, 1000, 1000, time.Second},
+		// Going from unlimited to limited starts out with a full bucket.
+		{"from unlimited", 0, 0, 1000, 1000, 1000, 0},
+		{"to unlimited", 1000, 1000, 0, 1 << 30, 0, 0},
+		{"negative", 1000, 1000, -5, 1 << 30, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(tt.rate)
+			l.reserve(tt.taken, l.last)
+			l.SetRate(tt.newRate)
+
+			if got := l.Rate(); got != tt.rate2 {
+				t.Fatalf("expected rate %d, got: %d", tt.rate2, got)
+			}
+			// SetRate fills the bucket up to the current time, which might
+			// add a few tokens.
+			if got := l.reserve(tt.n, l.last); got > tt.expected || got < tt.expected-time.Millisecond {
+				t.Fatalf("expected delay %v, got: %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestWait(t *testing.T) {
+	fast := New(1 << 20)
+	slow := New(1000)
+	slow.reserve(1000, time.Now())
+
+	// The caller waits for the slowest of the limiters, nil limiters are
+	// ignored.
+	start := time.Now()
+	Wait(100, fast, nil, slow)
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("expected to wait ~100ms, waited: %v", elapsed)
+	}
+
+	start = time.Now()
+	Wait(100, fast, nil)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("expected no wait, waited: %v", elapsed)
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+		ok       bool
+	}{
+		{"0", 0, true},
+		{"100", 100, true},
+		{"500k", 500 << 10, true},
+		{"2M", 2 << 20, true},
+		{"1g", 1 << 30, true},
+		{" 10K ", 10 << 10, true},
+		{"none", 0, true},
+		{"Unlimited", 0, true},
+		{"", 0, false},
+		{"k", 0, false},
+		{"-1", 0, false},
+		{"1.5m", 0, false},
+		{"10t", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseRate(tt.input)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("expected an error, got: %d", got)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unable to parse rate: %v", err)
+			}
+			if got != tt.expected {
+				t.Fatalf("expected: %d, got: %d", tt.expected, got)
+			}
+		})
+	}
+}
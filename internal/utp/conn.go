@@ -0,0 +1,631 @@
+// Contains logic related to a single uTP connection: ordering, acks,
+// retransmissions and the LEDBAT congestion control.
+package utp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+type connState int
+
+const (
+	stateSynSent connState = iota
+	stateConnected
+	stateClosed
+)
+
+// A packet that has been sent but not yet acked by the remote peer.
+type outgoingPacket struct {
+	typ           byte
+	seq           uint16
+	payload       []byte
+	sent          time.Time
+	transmissions int
+	// Set when the packet has been acked by a selective ack. It is kept in
+	// "outgoing" until all packets before it have been acked.
+	acked bool
+	// Set when the packet has been resent because packets sent after it have
+	// been acked, so that it isn't resent again for every following ack.
+	fastResent bool
+}
+
+// The minimum delays measured during the last minutes. The smallest of them
+// is the base delay, the delay of the link when no queues are building up.
+type baseDelay struct {
+	samples [baseDelayMinutes]uint32
+	current int
+	started time.Time
+	valid   bool
+}
+
+func (b *baseDelay) add(sample uint32, now time.Time) {
+	if !b.valid {
+		for i := range b.samples {
+			b.samples[i] = sample
+		}
+		b.started = now
+		b.valid = true
+	} else if now.Sub(b.started) >= time.Minute {
+		b.current = (b.current + 1) % len(b.samples)
+		b.samples[b.current] = sample
+		b.started = now
+	} else if int32(sample-b.samples[b.current]) < 0 {
+		b.samples[b.current] = sample
+	}
+}
+
+func (b *baseDelay) min() uint32 {
+	min := b.samples[0]
+	for _, sample := range b.samples[1:] {
+		if int32(sample-min) < 0 {
+			min = sample
+		}
+	}
+	return min
+}
+
+// A uTP connection to a remote peer. Implements net.Conn.
+type Conn struct {
+	socket *Socket
+	addr   *net.UDPAddr
+	recvId uint16
+	sendId uint16
+
+	// Held during the whole Write so that data written by multiple go
+	// processes isn't interleaved, "mut" is released while Write waits.
+	writeMut sync.Mutex
+
+	// Guards all fields below. "cond" is broadcasted when the connection
+	// changes in a way that might unblock Read or Write.
+	mut  sync.Mutex
+	cond *sync.Cond
+
+	state connState
+	// Set when the connection is broken, returned from Read and Write.
+	err error
+	// Set when Close has been called.
+	closed bool
+	// Closed when the connection has been established or has failed.
+	connected chan struct{}
+
+	// The sequence number of the next packet that is sent and the sequence
+	// number of the last packet received in order.
+	seq uint16
+	ack uint16
+
+	outgoing []*outgoingPacket
+	// The amount of payload bytes in "outgoing" that hasn't been acked.
+	inflight int
+	// The congestion window in bytes.
+	maxWindow int
+	// The last time that the congestion window was decreased because of a
+	// lost packet, it is decreased at most once per round trip.
+	lastDecrease time.Time
+	// The receive window advertised by the remote peer.
+	remoteWindow int
+
+	// Data received in order that hasn't been read yet.
+	readBuffer bytes.Buffer
+	// Data received out of order indexed by sequence number, and its size.
+	incoming     map[uint16][]byte
+	incomingSize int
+	finReceived  bool
+	finSeq       uint16
+	eof          bool
+
+	// Difference between the time that the last packet was received and the
+	// timestamp of the packet, sent back to the remote peer in every packet.
+	replyDelay uint32
+	baseDelay  baseDelay
+
+	rtt      time.Duration
+	rttVar   time.Duration
+	timeout  time.Duration
+	lastSent time.Time
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+}
+
+func newConn(socket *Socket, addr *net.UDPAddr, recvId, sendId uint16) *Conn {
+	c := &Conn{
+		socket:       socket,
+		addr:         addr,
+		recvId:       recvId,
+		sendId:       sendId,
+		state:        stateSynSent,
+		connected:    make(chan struct{}),
+		seq:          1,
+		maxWindow:    InitialWindow,
+		remoteWindow: InitialWindow,
+		incoming:     make(map[uint16][]byte),
+		timeout:      InitialTimeout,
+	}
+	c.cond = sync.NewCond(&c.mut)
+	return c
+}
+
+// Reads data received from the remote peer. Returns io.EOF when the remote peer
+// has closed the connection and all data has been read.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	for c.readBuffer.Len() == 0 && !c.eof && c.err == nil && !c.closed && !deadlinePassed(c.readDeadline) {
+		c.cond.Wait()
+	}
+
+	if c.closed {
+		return 0, errClosed
+	} else if c.readBuffer.Len() > 0 {
+		// Tell the remote peer if its window opens up again after being full.
+		wasFull := c.receiveWindow() < MaxPayloadSize
+		n, _ := c.readBuffer.Read(b)
+		if wasFull && c.receiveWindow() >= MaxPayloadSize && c.err == nil {
+			c.sendState()
+		}
+		return n, nil
+	} else if c.eof {
+		return 0, io.EOF
+	} else if c.err != nil {
+		return 0, c.err
+	}
+	return 0, timeoutError{}
+}
+
+// Sends "b" to the remote peer. Blocks until all data has been sent, which
+// might take a while if the congestion window or the window of the remote
+// peer is full. The data might not yet have been acked when Write returns.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.writeMut.Lock()
+	defer c.writeMut.Unlock()
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	written := 0
+	for written < len(b) {
+		for !c.canSend() && c.err == nil && !c.closed && !deadlinePassed(c.writeDeadline) {
+			c.cond.Wait()
+		}
+
+		if c.closed {
+			return written, errClosed
+		} else if c.err != nil {
+			return written, c.err
+		} else if deadlinePassed(c.writeDeadline) {
+			return written, timeoutError{}
+		}
+
+		n := len(b) - written
+		if n > MaxPayloadSize {
+			n = MaxPayloadSize
+		}
+		c.sendNew(stData, append([]byte(nil), b[written:written+n]...))
+		written += n
+	}
+
+	return written, nil
+}
+
+// Closes the connection. A FIN packet is sent to the remote peer and the
+// connection is removed from the socket when it has been acked.
+func (c *Conn) Close() error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if c.closed {
+		return errClosed
+	}
+	c.closed = true
+	if c.state == stateConnected && c.err == nil {
+		c.sendNew(stFin, nil)
+	}
+	c.stopTimers()
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.socket.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.readDeadline = t
+	c.readTimer = c.resetTimer(c.readTimer, t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.writeDeadline = t
+	c.writeTimer = c.resetTimer(c.writeTimer, t)
+	return nil
+}
+
+// Stops "timer" and returns a new timer that wakes up the blocked Read and
+// Write calls at "t". Returns nil if "t" is zero (no deadline).
+func (c *Conn) resetTimer(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	c.cond.Broadcast()
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() {
+		c.mut.Lock()
+		c.cond.Broadcast()
+		c.mut.Unlock()
+	})
+}
+
+func (c *Conn) stopTimers() {
+	if c.readTimer != nil {
+		c.readTimer.Stop()
+	}
+	if c.writeTimer != nil {
+		c.writeTimer.Stop()
+	}
+}
+
+func deadlinePassed(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// Handles a packet received from the remote peer.
+func (c *Conn) receive(h header, payload []byte) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	defer c.cond.Broadcast()
+
+	if c.state == stateClosed {
+		return
+	} else if h.typ == stReset {
+		c.fail(errReset)
+		return
+	}
+
+	c.update(h)
+
+	if c.state == stateSynSent {
+		// The answer to the SYN contains the sequence number of the next
+		// packet that the remote peer sends.
+		if h.typ != stState {
+			return
+		}
+		c.ack = h.seq - 1
+		c.state = stateConnected
+		close(c.connected)
+	}
+
+	c.receiveAck(h)
+
+	if h.typ == stData || h.typ == stFin {
+		c.receiveData(h, payload)
+		// Every data packet is acked, even duplicates since the previous
+		// ack might have been lost.
+		c.sendState()
+	}
+}
+
+// Updates the information about the remote peer that is sent in every packet.
+func (c *Conn) update(h header) {
+	c.replyDelay = timestamp() - h.timestamp
+	c.remoteWindow = int(h.window)
+}
+
+// Removes the packets acked by the remote peer from "outgoing" and updates the
+// round trip time and the congestion window. Packets that are missing while
+// packets sent after them have been selectively acked are resent.
+func (c *Conn) receiveAck(h header) {
+	now := time.Now()
+	ackedBytes := 0
+	acked := false
+	for len(c.outgoing) > 0 && !seqLess(h.ack, c.outgoing[0].seq) {
+		p := c.outgoing[0]
+		c.outgoing[0] = nil
+		c.outgoing = c.outgoing[1:]
+		if !p.acked {
+			ackedBytes += c.ackPacket(p, now)
+			acked = true
+		}
+	}
+
+	// The packet "h.ack+1" is missing if there is a selective ack.
+	for _, p := range c.outgoing {
+		offset := int(p.seq - h.ack - 2)
+		if p.acked || seqLess(p.seq, h.ack+2) || offset >= len(h.selectiveAck)*8 {
+			continue
+		}
+		if h.selectiveAck[offset/8]&(1<<uint(offset%8)) != 0 {
+			p.acked = true
+			ackedBytes += c.ackPacket(p, now)
+			acked = true
+		}
+	}
+
+	if acked && h.timestampDiff != 0 {
+		c.updateWindow(h.timestampDiff, ackedBytes, now)
+	}
+
+	// A packet is considered lost if at least 3 packets sent after it have
+	// been acked.
+	lost := false
+	ackedAfter := 0
+	for i := len(c.outgoing) - 1; i >= 0; i-- {
+		p := c.outgoing[i]
+		if p.acked {
+			ackedAfter++
+		} else if ackedAfter >= 3 && !p.fastResent {
+			p.fastResent = true
+			c.transmit(p)
+			lost = true
+		}
+	}
+	if lost && now.Sub(c.lastDecrease) >= c.rtt {
+		c.lastDecrease = now
+		c.maxWindow /= 2
+		if c.maxWindow < MinWindow {
+			c.maxWindow = MinWindow
+		}
+	}
+}
+
+// Removes the payload of the acked packet "p" from the bytes in flight and
+// returns its size. The round trip time is updated from the packet unless
+// it has been retransmitted, since it isn't known which transmission that
+// was acked then.
+func (c *Conn) ackPacket(p *outgoingPacket, now time.Time) int {
+	c.inflight -= len(p.payload)
+	if p.transmissions == 1 {
+		c.updateRTT(now.Sub(p.sent))
+	}
+	return len(p.payload)
+}
+
+// LEDBAT: the congestion window grows when the delay is below TargetDelay
+// and shrinks when it is above, proportional to how far off the target it is.
+func (c *Conn) updateWindow(delay uint32, ackedBytes int, now time.Time) {
+	c.baseDelay.add(delay, now)
+	ourDelay := float64(delay - c.baseDelay.min())
+	target := float64(TargetDelay / time.Microsecond)
+
+	offTarget := (target - ourDelay) / target
+	windowFactor := float64(ackedBytes) / float64(c.maxWindow)
+	if windowFactor > 1 {
+		windowFactor = 1
+	}
+
+	// Only grow the window if it is used, otherwise it grows without limits
+	// when the application doesn't have anything to send. It is used if there
+	// wasn't room for another packet before the ack.
+	if offTarget > 0 && c.inflight+ackedBytes+MaxPayloadSize <= c.maxWindow {
+		return
+	}
+
+	c.maxWindow += int(MaxWindowIncrease * offTarget * windowFactor)
+	if c.maxWindow < MinWindow {
+		c.maxWindow = MinWindow
+	} else if c.maxWindow > MaxWindow {
+		c.maxWindow = MaxWindow
+	}
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+
+	c.timeout = c.rtt + 4*c.rttVar
+	if c.timeout < MinTimeout {
+		c.timeout = MinTimeout
+	}
+}
+
+// Buffers the data of a received data or FIN packet and moves all data that
+// has been received in order to the read buffer.
+func (c *Conn) receiveData(h header, payload []byte) {
+	if !seqLess(c.ack, h.seq) || (c.finReceived && !seqLess(h.seq, c.finSeq)) {
+		// Already received or after the end of the stream.
+		return
+	}
+
+	if h.typ == stFin {
+		c.finReceived = true
+		c.finSeq = h.seq
+	} else if _, ok := c.incoming[h.seq]; !ok {
+		if c.readBuffer.Len()+c.incomingSize+len(payload) > ReceiveWindow {
+			// Dropped, the remote peer will retransmit it.
+			return
+		}
+		c.incoming[h.seq] = append([]byte(nil), payload...)
+		c.incomingSize += len(payload)
+	}
+
+	for {
+		next := c.ack + 1
+		if c.finReceived && next == c.finSeq {
+			c.ack = next
+			c.eof = true
+			return
+		}
+
+		data, ok := c.incoming[next]
+		if !ok {
+			return
+		}
+		delete(c.incoming, next)
+		c.incomingSize -= len(data)
+		c.readBuffer.Write(data)
+		c.ack = next
+	}
+}
+
+func (c *Conn) receiveWindow() int {
+	window := ReceiveWindow - c.readBuffer.Len() - c.incomingSize
+	if window < 0 {
+		return 0
+	}
+	return window
+}
+
+// Returns true if there is room for another data packet in both the congestion
+// window and the window of the remote peer. One packet is always allowed to
+// be in flight so that the windows can't stall the connection.
+func (c *Conn) canSend() bool {
+	window := c.maxWindow
+	if c.remoteWindow < window {
+		window = c.remoteWindow
+	}
+	return c.inflight == 0 || c.inflight+MaxPayloadSize <= window
+}
+
+// Sends a new packet that uses up a sequence number and keeps it until it has
+// been acked so that it can be retransmitted.
+func (c *Conn) sendNew(typ byte, payload []byte) {
+	p := &outgoingPacket{
+		typ:     typ,
+		seq:     c.seq,
+		payload: payload,
+	}
+	c.seq++
+	c.outgoing = append(c.outgoing, p)
+	c.inflight += len(p.payload)
+	c.transmit(p)
+}
+
+func (c *Conn) transmit(p *outgoingPacket) {
+	p.sent = time.Now()
+	p.transmissions++
+	c.send(p.typ, p.seq, p.payload)
+}
+
+// Sends a state packet, which acks the received packets without using up a
+// sequence number.
+func (c *Conn) sendState() {
+	c.send(stState, c.seq, nil)
+}
+
+func (c *Conn) send(typ byte, seq uint16, payload []byte) {
+	h := header{
+		typ:           typ,
+		connId:        c.sendId,
+		timestamp:     timestamp(),
+		timestampDiff: c.replyDelay,
+		window:        uint32(c.receiveWindow()),
+		seq:           seq,
+		ack:           c.ack,
+		selectiveAck:  c.selectiveAck(),
+	}
+	if typ == stSyn {
+		h.connId = c.recvId
+	}
+	c.lastSent = time.Now()
+	c.socket.send(c.addr, h.marshal(payload))
+}
+
+// Returns the selective ack bitmask of the packets received out of order,
+// or nil if no packets have been received out of order.
+func (c *Conn) selectiveAck() []byte {
+	if len(c.incoming) == 0 {
+		return nil
+	}
+
+	var bitmask [maxSelectiveAckSize]byte
+	size := 0
+	for seq := range c.incoming {
+		offset := int(seq - c.ack - 2)
+		if offset < 0 || offset >= len(bitmask)*8 {
+			continue
+		}
+		bitmask[offset/8] |= 1 << uint(offset%8)
+		// The length is a multiple of 4 bytes.
+		if needed := (offset/32 + 1) * 4; needed > size {
+			size = needed
+		}
+	}
+	if size == 0 {
+		return nil
+	}
+	return bitmask[:size]
+}
+
+// Marks the connection as broken and wakes up all blocked calls.
+func (c *Conn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	if c.state == stateSynSent {
+		close(c.connected)
+	}
+	c.state = stateClosed
+	c.stopTimers()
+	c.cond.Broadcast()
+}
+
+// Retransmits the oldest packet if it has timed out and sends keep alives.
+// Returns true if the connection is done and should be removed from the socket.
+func (c *Conn) tick(now time.Time) bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if c.state == stateClosed {
+		return true
+	} else if c.closed && len(c.outgoing) == 0 {
+		// The FIN has been acked.
+		c.state = stateClosed
+		return true
+	}
+
+	if len(c.outgoing) > 0 {
+		oldest := c.outgoing[0]
+		if now.Sub(oldest.sent) >= c.timeout {
+			if oldest.transmissions >= MaxTransmissions {
+				c.fail(errTimedOut)
+				return true
+			}
+
+			// The packet is considered lost, back off and start over with
+			// the smallest window.
+			c.timeout *= 2
+			if c.timeout > MaxTimeout {
+				c.timeout = MaxTimeout
+			}
+			c.maxWindow = MinWindow
+			c.transmit(oldest)
+			c.cond.Broadcast()
+		}
+	} else if c.state == stateConnected && now.Sub(c.lastSent) >= KeepAliveInterval {
+		c.sendState()
+	}
+
+	return false
+}
@@ -0,0 +1,175 @@
+package utp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUpdateWindow(t *testing.T) {
+	const base uint32 = 1000
+	target := uint32(TargetDelay / time.Microsecond)
+
+	tests := []struct {
+		name       string
+		base       uint32
+		delay      uint32
+		maxWindow  int
+		inflight   int
+		ackedBytes int
+		expected   int
+	}{
+		{"on base delay", base, base, InitialWindow, 3 * MaxPayloadSize, MaxPayloadSize, InitialWindow + 750},
+		{"window not used", base, base, InitialWindow, 0, MaxPayloadSize, InitialWindow},
+		{"half of target", base, base + target/2, InitialWindow, 0, InitialWindow, InitialWindow + 1500},
+		{"on target", base, base + target, InitialWindow, 0, InitialWindow, InitialWindow},
+		{"above target", base, base + 2*target, InitialWindow, 0, MaxPayloadSize, InitialWindow - 750},
+		{"acked more than window", base, base, InitialWindow, InitialWindow, 2 * InitialWindow, InitialWindow + MaxWindowIncrease},
+		{"min window", base, base + 10*target, MinWindow, 0, MinWindow, MinWindow},
+		{"max window", base, base, MaxWindow, MaxWindow, MaxPayloadSize, MaxWindow},
+		{"wrapping timestamps", 0xffffff00, 0x100, InitialWindow, 0, InitialWindow, InitialWindow + 2984},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			c := newConn(nil, nil, 0, 0)
+			c.baseDelay.add(tt.base, now)
+			c.maxWindow = tt.maxWindow
+			c.inflight = tt.inflight
+
+			c.updateWindow(tt.delay, tt.ackedBytes, now)
+			if c.maxWindow != tt.expected {
+				t.Fatalf("expected window %d, got: %d", tt.expected, c.maxWindow)
+			}
+		})
+	}
+}
+
+func TestBaseDelay(t *testing.T) {
+	start := time.Now()
+	steps := []struct {
+		after    time.Duration
+		sample   uint32
+		expected uint32
+	}{
+		{0, 500, 500},
+		{10 * time.Second, 300, 300},
+		{20 * time.Second, 600, 300},
+		// A new minute, the minimum of the previous minute is remembered.
+		{61 * time.Second, 400, 300},
+		// The minimum of the first minute is forgotten.
+		{122 * time.Second, 450, 400},
+		{123 * time.Second, 0xffffffff, 0xffffffff},
+	}
+
+	var b baseDelay
+	for _, step := range steps {
+		b.add(step.sample, start.Add(step.after))
+		if got := b.min(); got != step.expected {
+			t.Fatalf("after %v: expected base delay %d, got: %d", step.after, step.expected, got)
+		}
+	}
+}
+
+func TestUpdateRTT(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []time.Duration
+		rtt     time.Duration
+		timeout time.Duration
+	}{
+		{"min timeout", []time.Duration{100 * time.Millisecond}, 100 * time.Millisecond, MinTimeout},
+		{"first sample", []time.Duration{time.Second}, time.Second, 3 * time.Second},
+		{"stable", []time.Duration{time.Second, time.Second}, time.Second, 2500 * time.Millisecond},
+		{"increase", []time.Duration{time.Second, 1800 * time.Millisecond}, 1100 * time.Millisecond, 3400 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newConn(nil, nil, 0, 0)
+			for _, sample := range tt.samples {
+				c.updateRTT(sample)
+			}
+			if c.rtt != tt.rtt || c.timeout != tt.timeout {
+				t.Fatalf("expected rtt %v and timeout %v, got: %v and %v", tt.rtt, tt.timeout, c.rtt, c.timeout)
+			}
+		})
+	}
+}
+
+func TestReceiveAck(t *testing.T) {
+	socket, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer socket.Close()
+	// Resent packets are sent to "sink" and ignored.
+	sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer sink.Close()
+
+	tests := []struct {
+		name         string
+		maxWindow    int
+		ack          uint16
+		selectiveAck []byte
+		outgoing     int // the amount of packets left in "outgoing"
+		resent       []uint16
+		expected     int
+	}{
+		{"cumulative ack", 6 * MaxPayloadSize, 3, nil, 3, nil, 6 * MaxPayloadSize},
+		{"all acked", 6 * MaxPayloadSize, 6, nil, 0, nil, 6 * MaxPayloadSize},
+		// Packets 4 and 5 acked, packets 1-3 aren't lost yet.
+		{"two acked after", 6 * MaxPayloadSize, 0, []byte{0x0c, 0, 0, 0}, 6, nil, 6 * MaxPayloadSize},
+		// Packets 3-5 acked, packets 1 and 2 are lost.
+		{"three acked after", 6 * MaxPayloadSize, 0, []byte{0x0e, 0, 0, 0}, 6, []uint16{1, 2}, 3 * MaxPayloadSize},
+		// Packets 1 and 3-5 acked, packet 2 is lost.
+		{"lost after cumulative ack", 6 * MaxPayloadSize, 1, []byte{0x07, 0, 0, 0}, 5, []uint16{2}, 3 * MaxPayloadSize},
+		{"halved to min window", MinWindow, 0, []byte{0x0e, 0, 0, 0}, 6, []uint16{1, 2}, MinWindow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newConn(socket, sink.LocalAddr().(*net.UDPAddr), 0, 0)
+			c.maxWindow = tt.maxWindow
+			c.remoteWindow = MaxWindow
+			for i := 0; i < 6; i++ {
+				c.sendNew(stData, make([]byte, MaxPayloadSize))
+			}
+
+			// A zero timestamp difference leaves the window to the loss
+			// detection.
+			c.receiveAck(header{typ: stState, ack: tt.ack, selectiveAck: tt.selectiveAck})
+
+			if len(c.outgoing) != tt.outgoing {
+				t.Fatalf("expected %d outgoing packets, got: %d", tt.outgoing, len(c.outgoing))
+			}
+			acked := 0
+			resent := make([]uint16, 0)
+			for _, p := range c.outgoing {
+				if p.acked {
+					acked++
+				} else if p.transmissions > 1 {
+					resent = append(resent, p.seq)
+				}
+			}
+			if c.inflight != (tt.outgoing-acked)*MaxPayloadSize {
+				t.Errorf("expected %d bytes in flight, got: %d", (tt.outgoing-acked)*MaxPayloadSize, c.inflight)
+			}
+			if len(resent) != len(tt.resent) {
+				t.Fatalf("expected packets %v to be resent, got: %v", tt.resent, resent)
+			}
+			for i := range resent {
+				if resent[i] != tt.resent[i] {
+					t.Fatalf("expected packets %v to be resent, got: %v", tt.resent, resent)
+				}
+			}
+			if c.maxWindow != tt.expected {
+				t.Errorf("expected window %d, got: %d", tt.expected, c.maxWindow)
+			}
+		})
+	}
+}
@@ -0,0 +1,376 @@
+// Contains logic related to the UDP socket that uTP connections are
+// multiplexed on.
+package utp
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jmatss/torc/internal/util/logger"
+)
+
+const (
+	// The max amount of accepted connections that waits for Accept.
+	acceptQueueSize = 32
+	// The max amount of packets that aren't uTP packets that waits for
+	// PacketConn.ReadFrom. Packets are dropped if the queue is full.
+	packetQueueSize  = 256
+	udpMaxPacketSize = 2048
+)
+
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+type packet struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+// A UDP socket that both accepts and dials uTP connections. Packets received
+// on the socket that aren't uTP packets are passed along to the PacketConn
+// of the socket, which makes it possible to share the port with the DHT.
+//
+// Implements net.Listener. All exported functions are safe to call from
+// multiple go processes.
+type Socket struct {
+	mut   sync.Mutex
+	conn  *net.UDPConn
+	conns map[connKey]*Conn
+
+	accept     chan *Conn
+	packetConn *packetConn
+
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+// Creates a socket listening on the UDP address "address" (ex. ":6881").
+func Listen(address string) (*Socket, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve uTP address %s: %w", address, err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on uTP address %s: %w", address, err)
+	}
+
+	s := &Socket{
+		conn:   conn,
+		conns:  make(map[connKey]*Conn),
+		accept: make(chan *Conn, acceptQueueSize),
+		quit:   make(chan struct{}),
+	}
+	s.packetConn = &packetConn{
+		socket:  s,
+		packets: make(chan packet, packetQueueSize),
+		quit:    make(chan struct{}),
+	}
+
+	go s.serve()
+	go s.maintain()
+
+	logger.Log(logger.Low, "uTP socket listening on %s", conn.LocalAddr().String())
+
+	return s, nil
+}
+
+// Returns the address that the socket listens on.
+func (s *Socket) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Waits for and returns the next connection that a remote peer has initiated.
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.quit:
+		return nil, errClosed
+	}
+}
+
+// Closes the socket together with all of its connections.
+func (s *Socket) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.quit)
+		err = s.conn.Close()
+
+		s.mut.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.conns = make(map[connKey]*Conn)
+		s.mut.Unlock()
+
+		for _, c := range conns {
+			c.mut.Lock()
+			c.fail(errClosed)
+			c.mut.Unlock()
+		}
+	})
+	return err
+}
+
+// Connects to the remote peer at "address" ("host:port"). Returns an error if
+// the remote peer hasn't answered within "timeout".
+func (s *Socket) Dial(address string, timeout time.Duration) (*Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve uTP address %s: %w", address, err)
+	}
+
+	// The connection id of received packets is "recvId" and the id of sent
+	// packets is "recvId+1", both have to be unused.
+	s.mut.Lock()
+	var recvId uint16
+	for {
+		recvId = uint16(rand.Intn(1 << 16))
+		_, recvUsed := s.conns[connKey{addr.String(), recvId}]
+		_, sendUsed := s.conns[connKey{addr.String(), recvId + 1}]
+		if !recvUsed && !sendUsed {
+			break
+		}
+	}
+	c := newConn(s, addr, recvId, recvId+1)
+	s.conns[connKey{addr.String(), recvId}] = c
+	s.mut.Unlock()
+
+	c.mut.Lock()
+	c.sendNew(stSyn, nil)
+	c.mut.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-c.connected:
+	case <-timer.C:
+	}
+
+	c.mut.Lock()
+	if c.state != stateConnected && c.err == nil {
+		c.fail(errTimedOut)
+	}
+	err = c.err
+	c.mut.Unlock()
+
+	if err != nil {
+		s.remove(c)
+		return nil, fmt.Errorf("unable to establish uTP connection to %s: %w", address, err)
+	}
+	return c, nil
+}
+
+// Returns a connection that reads the packets received on this socket that
+// aren't uTP packets, and writes packets through this socket.
+func (s *Socket) PacketConn() net.PacketConn {
+	return s.packetConn
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	key := connKey{c.addr.String(), c.recvId}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+// Returns the connection to "addr" that sends packets with the id "sendId".
+// The receive id is either one more or one less depending on which side
+// initiated the connection. Must be called with "mut" locked.
+func (s *Socket) findBySendId(addr *net.UDPAddr, sendId uint16) (*Conn, bool) {
+	for _, recvId := range []uint16{sendId - 1, sendId + 1} {
+		if c, ok := s.conns[connKey{addr.String(), recvId}]; ok && c.sendId == sendId {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+func (s *Socket) send(addr *net.UDPAddr, data []byte) {
+	if _, err := s.conn.WriteToUDP(data, addr); err != nil {
+		logger.Log(logger.High, "unable to send uTP packet to %s: %v", addr, err)
+	}
+}
+
+// Reads packets from the UDP socket and routes them to the correct connection.
+func (s *Socket) serve() {
+	buffer := make([]byte, udpMaxPacketSize)
+	for {
+		length, addr, err := s.conn.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-s.quit:
+				return
+			default:
+			}
+			logger.Log(logger.High, "unable to read from uTP socket: %v", err)
+			continue
+		}
+
+		data := buffer[:length]
+		if !isPacket(data) {
+			s.packetConn.receive(packet{data: append([]byte(nil), data...), addr: addr})
+			continue
+		}
+
+		h, payload, err := parsePacket(data)
+		if err != nil {
+			logger.Log(logger.High, "received incorrect uTP packet from %s: %v", addr, err)
+			continue
+		}
+		s.handle(addr, h, payload)
+	}
+}
+
+func (s *Socket) handle(addr *net.UDPAddr, h header, payload []byte) {
+	if h.typ == stSyn {
+		s.handleSyn(addr, h)
+		return
+	}
+
+	s.mut.Lock()
+	c, ok := s.conns[connKey{addr.String(), h.connId}]
+	if h.typ == stReset {
+		// Resets are sent with the id of the packet that caused it, which is
+		// the id that this side sends packets with.
+		c, ok = s.findBySendId(addr, h.connId)
+	}
+	s.mut.Unlock()
+	if !ok {
+		// Tell the remote peer that the connection doesn't exist.
+		if h.typ != stReset {
+			reset := header{typ: stReset, connId: h.connId, timestamp: timestamp(), ack: h.seq}
+			s.send(addr, reset.marshal(nil))
+		}
+		return
+	}
+
+	c.receive(h, payload)
+}
+
+// A remote peer initiates a connection. The remote peer receives packets with
+// the id "h.connId" and sends packets with the id "h.connId+1".
+func (s *Socket) handleSyn(addr *net.UDPAddr, h header) {
+	key := connKey{addr.String(), h.connId + 1}
+
+	s.mut.Lock()
+	c, ok := s.conns[key]
+	if !ok {
+		c = newConn(s, addr, h.connId+1, h.connId)
+		c.state = stateConnected
+		c.seq = uint16(rand.Intn(1 << 16))
+		c.ack = h.seq
+		close(c.connected)
+		s.conns[key] = c
+	}
+	s.mut.Unlock()
+
+	if !ok {
+		select {
+		case s.accept <- c:
+		default:
+			logger.Log(logger.High, "uTP accept queue full, refused connection from %s", addr)
+			s.remove(c)
+			reset := header{typ: stReset, connId: h.connId, timestamp: timestamp(), ack: h.seq}
+			s.send(addr, reset.marshal(nil))
+			return
+		}
+	}
+
+	// The SYN is answered every time it is received in case the previous
+	// answer was lost.
+	c.mut.Lock()
+	c.update(h)
+	c.sendState()
+	c.mut.Unlock()
+}
+
+// Retransmits timed out packets and removes closed connections.
+func (s *Socket) maintain() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		case now := <-ticker.C:
+			s.mut.Lock()
+			conns := make([]*Conn, 0, len(s.conns))
+			for _, c := range s.conns {
+				conns = append(conns, c)
+			}
+			s.mut.Unlock()
+
+			for _, c := range conns {
+				if done := c.tick(now); done {
+					s.remove(c)
+				}
+			}
+		}
+	}
+}
+
+// The net.PacketConn returned from Socket.PacketConn.
+type packetConn struct {
+	socket    *Socket
+	packets   chan packet
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+func (p *packetConn) receive(pkt packet) {
+	select {
+	case p.packets <- pkt:
+	default:
+		// Nothing is reading the packets, or the reader is too slow.
+	}
+}
+
+func (p *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-p.packets:
+		return copy(b, pkt.data), pkt.addr, nil
+	case <-p.quit:
+		return 0, nil, errClosed
+	case <-p.socket.quit:
+		return 0, nil, errClosed
+	}
+}
+
+func (p *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return p.socket.conn.WriteTo(b, addr)
+}
+
+// Stops the reads of this PacketConn, the socket itself isn't closed.
+func (p *packetConn) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.quit)
+	})
+	return nil
+}
+
+func (p *packetConn) LocalAddr() net.Addr {
+	return p.socket.Addr()
+}
+
+func (p *packetConn) SetDeadline(t time.Time) error {
+	return fmt.Errorf("deadlines aren't supported by the uTP packet connection")
+}
+
+func (p *packetConn) SetReadDeadline(t time.Time) error {
+	return p.SetDeadline(t)
+}
+
+func (p *packetConn) SetWriteDeadline(t time.Time) error {
+	return p.SetDeadline(t)
+}
@@ -0,0 +1,188 @@
+// Contains logic related to the Micro Transport Protocol (uTP), a reliable
+// transport protocol on top of UDP. It uses LEDBAT congestion control which
+// backs off when the delay on the link increases, so that it yields to other
+// traffic instead of saturating the link.
+// See http://www.bittorrent.org/beps/bep_0029.html
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// The max amount of payload in a data packet. Picked so that the packets
+	// fit in the MTU of most links, including IPv6 and tunnels.
+	MaxPayloadSize = 1200
+	// The max amount of received data that is buffered, both data received
+	// out of order and data that hasn't been read yet.
+	ReceiveWindow = 1 << 20
+
+	// LEDBAT tries to keep the one-way queuing delay of the link at this value.
+	TargetDelay = 100 * time.Millisecond
+	// The max amount of bytes that the congestion window grows per round trip.
+	MaxWindowIncrease = 3000
+	// Limits of the congestion window.
+	MinWindow     = MaxPayloadSize
+	MaxWindow     = ReceiveWindow
+	InitialWindow = 4 * MaxPayloadSize
+
+	// Limits of the retransmission timeout, it is calculated from the round
+	// trip time once packets have been acked.
+	InitialTimeout = 1 * time.Second
+	MinTimeout     = 500 * time.Millisecond
+	MaxTimeout     = 30 * time.Second
+	// The amount of times a packet is sent before the connection is
+	// considered broken.
+	MaxTransmissions = 6
+	// An empty state packet is sent if nothing has been sent for this long.
+	KeepAliveInterval = 29 * time.Second
+
+	// How often timeouts of the connections are checked.
+	tickInterval = 50 * time.Millisecond
+	// The amount of minutes that the base delay is remembered.
+	baseDelayMinutes = 2
+
+	version    = 1
+	headerSize = 20
+	// The max length of the selective ack bitmask, covers 256 packets.
+	maxSelectiveAckSize = 32
+)
+
+// Packet types.
+const (
+	stData byte = iota
+	stFin
+	stState
+	stReset
+	stSyn
+)
+
+// Extension types.
+const (
+	extensionNone byte = iota
+	extensionSelectiveAck
+)
+
+var (
+	errClosed   = errors.New("use of closed uTP connection")
+	errReset    = errors.New("uTP connection reset by remote peer")
+	errTimedOut = errors.New("uTP connection timed out")
+)
+
+// Returned from Read and Write when a deadline has passed.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// The header of a uTP packet. The only extension that is used is the selective
+// ack, other extensions are skipped when parsed.
+//
+//	0       4       8               16              24              32
+//	+-------+-------+---------------+---------------+---------------+
+//	| type  | ver   | extension     | connection_id                 |
+//	+-------+-------+---------------+---------------+---------------+
+//	| timestamp_microseconds                                        |
+//	+---------------+---------------+---------------+---------------+
+//	| timestamp_difference_microseconds                             |
+//	+---------------+---------------+---------------+---------------+
+//	| wnd_size                                                      |
+//	+---------------+---------------+---------------+---------------+
+//	| seq_nr                        | ack_nr                        |
+//	+---------------+---------------+---------------+---------------+
+type header struct {
+	typ           byte
+	connId        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	window        uint32
+	seq           uint16
+	ack           uint16
+	// Bitmask of the packets received after "ack+1". The least significant
+	// bit of the first byte is "ack+2". Its length is a multiple of 4.
+	selectiveAck []byte
+}
+
+func (h *header) marshal(payload []byte) []byte {
+	size := headerSize
+	if len(h.selectiveAck) > 0 {
+		size += 2 + len(h.selectiveAck)
+	}
+
+	data := make([]byte, size+len(payload))
+	data[0] = h.typ<<4 | version
+	binary.BigEndian.PutUint16(data[2:], h.connId)
+	binary.BigEndian.PutUint32(data[4:], h.timestamp)
+	binary.BigEndian.PutUint32(data[8:], h.timestampDiff)
+	binary.BigEndian.PutUint32(data[12:], h.window)
+	binary.BigEndian.PutUint16(data[16:], h.seq)
+	binary.BigEndian.PutUint16(data[18:], h.ack)
+	if len(h.selectiveAck) > 0 {
+		// <next extension><length><bitmask>
+		data[1] = extensionSelectiveAck
+		data[headerSize] = extensionNone
+		data[headerSize+1] = byte(len(h.selectiveAck))
+		copy(data[headerSize+2:], h.selectiveAck)
+	}
+	copy(data[size:], payload)
+	return data
+}
+
+// Returns true if "data" looks like a uTP packet. Used to separate uTP packets
+// from other packets received on the same socket (ex. DHT messages, which
+// always start with a "d").
+func isPacket(data []byte) bool {
+	return len(data) >= headerSize && data[0]&0x0f == version && data[0]>>4 <= stSyn
+}
+
+// Parses the uTP packet "data" and returns its header and payload.
+func parsePacket(data []byte) (header, []byte, error) {
+	var h header
+	if !isPacket(data) {
+		return h, nil, fmt.Errorf("not a uTP packet")
+	}
+
+	h.typ = data[0] >> 4
+	h.connId = binary.BigEndian.Uint16(data[2:])
+	h.timestamp = binary.BigEndian.Uint32(data[4:])
+	h.timestampDiff = binary.BigEndian.Uint32(data[8:])
+	h.window = binary.BigEndian.Uint32(data[12:])
+	h.seq = binary.BigEndian.Uint16(data[16:])
+	h.ack = binary.BigEndian.Uint16(data[18:])
+
+	// The extensions are linked: <next extension><length><data>
+	extension := data[1]
+	i := headerSize
+	for extension != extensionNone {
+		if i+2 > len(data) {
+			return h, nil, fmt.Errorf("incorrect uTP extension header")
+		}
+		next, length := data[i], int(data[i+1])
+		i += 2
+		if i+length > len(data) {
+			return h, nil, fmt.Errorf("incorrect uTP extension length")
+		}
+		if extension == extensionSelectiveAck {
+			h.selectiveAck = data[i : i+length]
+		}
+		extension = next
+		i += length
+	}
+
+	return h, data[i:], nil
+}
+
+// Returns the current time in microseconds, truncated to 32 bits.
+func timestamp() uint32 {
+	return uint32(time.Now().UnixNano() / int64(time.Microsecond))
+}
+
+// Returns true if the sequence number "a" comes before "b", taking wrap
+// around into account.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}